@@ -0,0 +1,147 @@
+// Package api defines version 1 of LocalGal's JSON API, served under /api/v1/.
+//
+// The responses are built from these types rather than from the page models behind the HTML pages,
+// so they only change in a backwards compatible way within a version: fields may be added, but not removed or renamed.
+// The OpenAPI document at /api/v1/openapi.json is generated from these types, see OpenAPI.
+package api
+
+// BasePath is the path prefix of every version 1 endpoint
+const BasePath = "/api/v1"
+
+// Version is the version of the API described by this package
+const Version = "1.0.0"
+
+type Gallery struct {
+	Id          int64   `json:"id" doc:"LocalGal's id of the gallery, the album_id of the RipMe database"`
+	Ripper      string  `json:"ripper" doc:"Host of the ripper, such as imgur.com"`
+	Gid         string  `json:"gid" doc:"Gallery id assigned by the ripper"`
+	Title       *string `json:"title" doc:"Local title if set, otherwise the title from RipMe"`
+	RipmeTitle  *string `json:"ripmeTitle" doc:"Title from RipMe"`
+	LocalTitle  *string `json:"localTitle" doc:"Local title, stored by LocalGal"`
+	Description *string `json:"description"`
+	Notes       *string `json:"notes" doc:"Local notes, stored by LocalGal"`
+	Uploader    *string `json:"uploader"`
+	Rating      *int64  `json:"rating" doc:"Local rating, 1-5"`
+	Hidden      bool    `json:"hidden"`
+	Removed     bool    `json:"removed"`
+	FileCount   int     `json:"fileCount" doc:"Fetched files, including ignored files"`
+	Bytes       int64   `json:"bytes"`
+	CreatedTs   *int64  `json:"createdTs" doc:"Unix milliseconds"`
+	ModifiedTs  *int64  `json:"modifiedTs" doc:"Unix milliseconds"`
+	LastFetchTs *int64  `json:"lastFetchTs" doc:"Unix milliseconds"`
+	InsertedTs  int64   `json:"insertedTs" doc:"Unix milliseconds"`
+	CoverFileId *int64  `json:"coverFileId" doc:"Chosen cover; null when the cover rule picks the thumbnail"`
+	ThumbUrl    string  `json:"thumbUrl,omitempty" doc:"Media URL of the thumbnail, only in listings"`
+	PageUrl     string  `json:"pageUrl" doc:"URL of the HTML page"`
+}
+
+type File struct {
+	Id          int64   `json:"id" doc:"LocalGal's id of the file, the remote_file_id of the RipMe database"`
+	Ripper      string  `json:"ripper" doc:"Host of the ripper, such as imgur.com"`
+	Urlid       *string `json:"urlid" doc:"File id assigned by the ripper"`
+	Filename    *string `json:"filename"`
+	MimeType    *string `json:"mimeType"`
+	Title       *string `json:"title" doc:"Local title if set, otherwise the title from RipMe"`
+	RipmeTitle  *string `json:"ripmeTitle" doc:"Title from RipMe"`
+	LocalTitle  *string `json:"localTitle" doc:"Local title, stored by LocalGal"`
+	Description *string `json:"description"`
+	Notes       *string `json:"notes" doc:"Local notes, stored by LocalGal"`
+	Uploader    *string `json:"uploader"`
+	Rating      *int64  `json:"rating" doc:"Local rating, 1-5"`
+	Hidden      bool    `json:"hidden"`
+	Removed     bool    `json:"removed"`
+	Ignored     bool    `json:"ignored" doc:"Ignored files are left out of every listing, so this is only true after a write"`
+	Bytes       *int64  `json:"bytes"`
+	UploadedTs  *int64  `json:"uploadedTs" doc:"Unix milliseconds"`
+	InsertedTs  int64   `json:"insertedTs" doc:"Unix milliseconds"`
+	MediaUrl    string  `json:"mediaUrl,omitempty" doc:"URL of the media file"`
+	PageUrl     string  `json:"pageUrl" doc:"URL of the HTML page"`
+}
+
+type Tag struct {
+	Name  string `json:"name"`
+	Local bool   `json:"local" doc:"Added in LocalGal rather than by RipMe"`
+	Count int    `json:"count,omitempty" doc:"Usage count, only in tag listings"`
+}
+
+// Pagination is part of every paged response
+type Pagination struct {
+	Page     int  `json:"page" doc:"1-based page number"`
+	PageSize int  `json:"pageSize"`
+	Total    int  `json:"total" doc:"Items on all pages"`
+	HasPrev  bool `json:"hasPrev"`
+	HasNext  bool `json:"hasNext"`
+	// Cursors are faster than page numbers on deep pages, and don't skip or repeat items when galleries are added
+	NextCursor string `json:"nextCursor,omitempty" doc:"Cursor of the next page, for the cursor parameter; only where the endpoint takes it"`
+	PrevCursor string `json:"prevCursor,omitempty" doc:"Cursor of the previous page, for the cursor parameter; only where the endpoint takes it"`
+}
+
+type GalleryList struct {
+	Galleries []Gallery `json:"galleries"`
+	Pagination
+}
+
+type FileList struct {
+	Files []File `json:"files"`
+	Pagination
+}
+
+type GalleryDetail struct {
+	Gallery Gallery `json:"gallery"`
+	Tags    []Tag   `json:"tags"`
+	Files   []File  `json:"files" doc:"One page of the gallery's files"`
+	Pagination
+}
+
+type FileDetail struct {
+	File File  `json:"file"`
+	Tags []Tag `json:"tags"`
+}
+
+// GalleryInfo is a gallery without its files, as returned by writes to it
+type GalleryInfo struct {
+	Gallery Gallery `json:"gallery"`
+	Tags    []Tag   `json:"tags"`
+}
+
+// Update is the JSON body of a write to a gallery or file. Fields that are left out are left unchanged.
+type Update struct {
+	Rating     *int64   `json:"rating,omitempty" doc:"Local rating, 1-5, or 0 to unset"`
+	Ignored    *bool    `json:"ignored,omitempty" doc:"Ignore or unignore; for a gallery, every file of it"`
+	AddTags    []string `json:"addTags,omitempty" doc:"Local tags to add"`
+	RemoveTags []string `json:"removeTags,omitempty" doc:"Local tags to remove"`
+	Title      *string  `json:"title,omitempty" doc:"Local title, at most 200 characters; cleared if empty"`
+	Notes      *string  `json:"notes,omitempty" doc:"Notes, at most 10000 characters; cleared if empty"`
+}
+
+type TagList struct {
+	GalleryTags []Tag `json:"galleryTags"`
+	FileTags    []Tag `json:"fileTags"`
+}
+
+// Error codes, the code of an Error. They're stable, unlike the messages.
+const (
+	CodeInvalidRequest = "invalid_request"     // a parameter or form value is missing or invalid
+	CodeUnauthorized   = "unauthorized"        // no session or bearer token, while LocalGal requires a shared secret
+	CodeNotFound       = "not_found"           // the gallery, file, or other resource doesn't exist
+	CodeForbidden      = "forbidden"           // the request isn't allowed
+	CodeReadOnly       = "read_only"           // a write, while LocalGal runs with a read-only database
+	CodeConflict       = "conflict"            // a write that conflicts with the current data, such as a tag implication loop
+	CodePrecondition   = "precondition_failed" // If-Match doesn't match the ETag: the gallery or file changed since it was read
+	CodeUnavailable    = "unavailable"         // a feature that needs the LocalGal database, while it's unavailable
+	CodeBusy           = "busy"                // the database is locked by another writer, such as RipMe; try again later
+	CodeInternal       = "internal_error"      // anything else
+)
+
+// Error is the body of every error response, an RFC 9457 problem details object sent as application/problem+json
+type Error struct {
+	Title   string `json:"title" doc:"HTTP status text"`
+	Status  int    `json:"status" doc:"HTTP status code"`
+	Code    string `json:"code" doc:"Stable machine-readable error code: invalid_request, unauthorized, not_found, forbidden, read_only, conflict, precondition_failed, unavailable, busy, or internal_error"`
+	Detail  string `json:"detail" doc:"Human-readable explanation"`
+	Message string `json:"message" doc:"Same as detail"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
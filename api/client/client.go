@@ -0,0 +1,261 @@
+// Package client is a typed Go client of LocalGal's JSON API, version 1. See package api for the types.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golocalgal/api"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client calls a LocalGal server. The zero value is not usable, use New.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+}
+
+// New returns a client of the server at baseURL, such as http://127.0.0.1:5033. A nil httpClient uses http.DefaultClient.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), httpClient: httpClient}
+}
+
+// SetToken sets the shared secret to send as a bearer token, for servers that require one
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// ListOptions are the paging, sort, and filter query parameters of list endpoints. Zero values use the server's defaults.
+type ListOptions struct {
+	Page     int
+	PageSize int
+	Cursor   string // NextCursor or PrevCursor of a previous response, for Galleries, Gallery, SearchGalleries, and SearchFiles; set Page along with it to keep the page number
+	Sort     string
+	Profile  string
+	Filters  url.Values // gal_rating_min, file_type, and the other filter parameters, see the OpenAPI document
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	for k, vs := range o.Filters {
+		v[k] = vs
+	}
+	if o.Page > 0 {
+		v.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.PageSize > 0 {
+		v.Set("size", strconv.Itoa(o.PageSize))
+	}
+	if o.Cursor != "" {
+		v.Set("cursor", o.Cursor)
+	}
+	if o.Sort != "" {
+		v.Set("sort", o.Sort)
+	}
+	if o.Profile != "" {
+		v.Set("profile", o.Profile)
+	}
+	return v
+}
+
+func (c *Client) Galleries(ctx context.Context, opts ListOptions) (*api.GalleryList, error) {
+	var res api.GalleryList
+	return &res, c.get(ctx, "/galleries", opts.values(), &res)
+}
+
+func (c *Client) Gallery(ctx context.Context, ripperHost string, gid string, opts ListOptions) (*api.GalleryDetail, error) {
+	var res api.GalleryDetail
+	return &res, c.get(ctx, galleryPath(ripperHost, gid), opts.values(), &res)
+}
+
+func (c *Client) File(ctx context.Context, ripperHost string, fileId int64) (*api.FileDetail, error) {
+	var res api.FileDetail
+	return &res, c.get(ctx, filePath(ripperHost, fileId), nil, &res)
+}
+
+func (c *Client) FileGalleries(ctx context.Context, ripperHost string, fileId int64) (*api.GalleryList, error) {
+	var res api.GalleryList
+	return &res, c.get(ctx, filePath(ripperHost, fileId)+"/galleries", nil, &res)
+}
+
+func (c *Client) SearchGalleries(ctx context.Context, query string, opts ListOptions) (*api.GalleryList, error) {
+	v := opts.values()
+	v.Set("q", query)
+	var res api.GalleryList
+	return &res, c.get(ctx, "/search/galleries", v, &res)
+}
+
+func (c *Client) SearchFiles(ctx context.Context, query string, opts ListOptions) (*api.FileList, error) {
+	v := opts.values()
+	v.Set("q", query)
+	var res api.FileList
+	return &res, c.get(ctx, "/search/files", v, &res)
+}
+
+func (c *Client) Tags(ctx context.Context) (*api.TagList, error) {
+	var res api.TagList
+	return &res, c.get(ctx, "/tags", nil, &res)
+}
+
+// RateGallery sets the local rating of a gallery, 1-5, or unsets it with 0
+func (c *Client) RateGallery(ctx context.Context, ripperHost string, gid string, rating int) error {
+	return c.post(ctx, galleryPath(ripperHost, gid), url.Values{"rating": {ratingValue(rating)}})
+}
+
+// RateFile sets the local rating of a file, 1-5, or unsets it with 0
+func (c *Client) RateFile(ctx context.Context, ripperHost string, fileId int64, rating int) error {
+	return c.post(ctx, filePath(ripperHost, fileId), url.Values{"rating": {ratingValue(rating)}})
+}
+
+// IgnoreFile ignores or unignores a file
+func (c *Client) IgnoreFile(ctx context.Context, ripperHost string, fileId int64, ignored bool) error {
+	v := "0"
+	if ignored {
+		v = "1"
+	}
+	return c.post(ctx, filePath(ripperHost, fileId), url.Values{"ignored": {v}})
+}
+
+func (c *Client) EditGalleryTags(ctx context.Context, ripperHost string, gid string, add []string, remove []string) error {
+	return c.post(ctx, galleryPath(ripperHost, gid)+"/tags", url.Values{"add": add, "remove": remove})
+}
+
+func (c *Client) EditFileTags(ctx context.Context, ripperHost string, fileId int64, add []string, remove []string) error {
+	return c.post(ctx, filePath(ripperHost, fileId)+"/tags", url.Values{"add": add, "remove": remove})
+}
+
+// SetGalleryMeta sets the local title and notes of a gallery. A nil value is left unchanged, an empty one is cleared.
+func (c *Client) SetGalleryMeta(ctx context.Context, ripperHost string, gid string, title *string, notes *string) error {
+	return c.post(ctx, galleryPath(ripperHost, gid)+"/meta", metaValues(title, notes))
+}
+
+// SetFileMeta sets the local title and notes of a file. A nil value is left unchanged, an empty one is cleared.
+func (c *Client) SetFileMeta(ctx context.Context, ripperHost string, fileId int64, title *string, notes *string) error {
+	return c.post(ctx, filePath(ripperHost, fileId)+"/meta", metaValues(title, notes))
+}
+
+// UpdateGallery changes the fields of u that are set, and returns the gallery as it is afterwards with its ETag.
+// A non-empty ifMatch is sent as If-Match, so the update fails with a precondition_failed *api.Error if the gallery
+// was changed since that ETag was read.
+func (c *Client) UpdateGallery(ctx context.Context, ripperHost string, gid string, u api.Update, ifMatch string) (*api.GalleryInfo, string, error) {
+	var res api.GalleryInfo
+	etag, err := c.patch(ctx, galleryPath(ripperHost, gid), u, ifMatch, &res)
+	return &res, etag, err
+}
+
+// UpdateFile changes the fields of u that are set, and returns the file as it is afterwards with its ETag.
+// See UpdateGallery for ifMatch.
+func (c *Client) UpdateFile(ctx context.Context, ripperHost string, fileId int64, u api.Update, ifMatch string) (*api.FileDetail, string, error) {
+	var res api.FileDetail
+	etag, err := c.patch(ctx, filePath(ripperHost, fileId), u, ifMatch, &res)
+	return &res, etag, err
+}
+
+func galleryPath(ripperHost string, gid string) string {
+	return "/gallery/" + url.PathEscape(ripperHost) + "/" + url.PathEscape(gid)
+}
+
+func filePath(ripperHost string, fileId int64) string {
+	return "/file/" + url.PathEscape(ripperHost) + "/" + strconv.FormatInt(fileId, 10)
+}
+
+func ratingValue(rating int) string {
+	if rating == 0 {
+		return "unset"
+	}
+	return strconv.Itoa(rating)
+}
+
+func metaValues(title *string, notes *string) url.Values {
+	v := url.Values{}
+	if title != nil {
+		v.Set("title", *title)
+	}
+	if notes != nil {
+		v.Set("notes", *notes)
+	}
+	return v
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, res any) error {
+	u := c.baseURL + api.BasePath + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, res)
+}
+
+func (c *Client) post(ctx context.Context, path string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+api.BasePath+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, nil)
+}
+
+// patch sends body as JSON and returns the ETag of the response
+func (c *Client) patch(ctx context.Context, path string, body any, ifMatch string, res any) (string, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, c.baseURL+api.BasePath+path, bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	header, err := c.doHeader(req, res)
+	return header.Get("ETag"), err
+}
+
+// do sends a request and decodes a JSON body into res. Error responses are returned as *api.Error,
+// whose Code can be compared with the api.Code constants.
+func (c *Client) do(req *http.Request, res any) error {
+	_, err := c.doHeader(req, res)
+	return err
+}
+
+// doHeader is do, and also returns the response headers
+func (c *Client) doHeader(req *http.Request, res any) (http.Header, error) {
+	req.Header.Set("Accept", "application/json, application/problem+json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return http.Header{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		apiErr := &api.Error{Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		return resp.Header, apiErr
+	}
+	if res == nil || resp.StatusCode == http.StatusNoContent {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.Header, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return resp.Header, fmt.Errorf("decode %s %s: %w", req.Method, req.URL.Path, err)
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Param is a path or query parameter, or a field of a form body
+type Param struct {
+	Name     string
+	In       string // "path", "query", or "header"; ignored for form fields
+	Type     string // "string", "integer", or "array" of strings
+	Enum     []string
+	Doc      string
+	Required bool
+}
+
+// Operation is one endpoint of the API. The server registers its routes from Operations, so every documented endpoint is served.
+type Operation struct {
+	Id       string // operationId, and the key of the server's handler
+	Method   string
+	Path     string // relative to BasePath, with path parameters in braces
+	Summary  string
+	Params   []Param
+	Form     []Param // fields of an application/x-www-form-urlencoded body
+	Body     any     // zero value of an application/json body, accepted instead of or as well as Form
+	Response any     // zero value of the response body; nil for 204 No Content
+}
+
+var (
+	ripperParam  = Param{Name: "ripper_host", In: "path", Type: "string", Required: true, Doc: "Host of the ripper, such as imgur.com"}
+	gidParam     = Param{Name: "gid", In: "path", Type: "string", Required: true}
+	fileIdParam  = Param{Name: "file_id", In: "path", Type: "integer", Required: true}
+	pageParams   = []Param{{Name: "page", In: "query", Type: "integer", Doc: "1-based page number"}, {Name: "size", In: "query", Type: "integer", Doc: "Page size"}}
+	profileParam = Param{Name: "profile", In: "query", Type: "string", Doc: "Filter profile to apply"}
+	ifMatchParam = Param{Name: "If-Match", In: "header", Type: "string", Doc: "ETag of the gallery or file as last read; the write fails with 412 if it changed since"}
+	cursorParam  = Param{Name: "cursor", In: "query", Type: "string", Doc: "nextCursor or prevCursor of a response, to page by position instead of by offset. Pass page too, to keep the page number"}
+	unblockParam = Param{Name: "unblock", In: "query", Type: "string", Enum: []string{"1"}, Doc: "Include blocked tags, uploaders, ripper hosts, and galleries"}
+
+	galleryFilterParams = []Param{
+		{Name: "gal_rating_min", In: "query", Type: "integer", Doc: "Minimum local rating, 1-5"},
+		{Name: "gal_rating_max", In: "query", Type: "integer", Doc: "Maximum local rating, 1-5"},
+		{Name: "gal_unrated", In: "query", Type: "string", Enum: []string{"include", "exclude", "only"}},
+	}
+	fileFilterParams = []Param{
+		{Name: "file_rating_min", In: "query", Type: "integer", Doc: "Minimum local rating, 1-5"},
+		{Name: "file_rating_max", In: "query", Type: "integer", Doc: "Maximum local rating, 1-5"},
+		{Name: "file_unrated", In: "query", Type: "string", Enum: []string{"include", "exclude", "only"}},
+		{Name: "file_type", In: "query", Type: "string", Enum: []string{"image", "video"}},
+	}
+
+	ratingForm = []Param{
+		{Name: "rating", Type: "string", Enum: []string{"1", "2", "3", "4", "5", "unset"}, Doc: "Local rating"},
+		{Name: "ignored", Type: "string", Enum: []string{"0", "1"}, Doc: "Ignore (1) or unignore (0)"},
+	}
+	tagsForm = []Param{
+		{Name: "add", Type: "array", Doc: "Local tags to add"},
+		{Name: "remove", Type: "array", Doc: "Local tags to remove"},
+	}
+	metaForm = []Param{
+		{Name: "title", Type: "string", Doc: "Local title, at most 200 characters. Left unchanged if not given, cleared if empty"},
+		{Name: "notes", Type: "string", Doc: "Notes, at most 10000 characters. Left unchanged if not given, cleared if empty"},
+	}
+)
+
+func sortParam(sorts ...string) Param {
+	return Param{Name: "sort", In: "query", Type: "string", Enum: sorts}
+}
+
+func params(groups ...[]Param) []Param {
+	var all []Param
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+var Operations = []Operation{
+	{Id: "listGalleries", Method: "GET", Path: "/galleries", Summary: "Browse galleries",
+		Params:   params(pageParams, []Param{cursorParam, sortParam("fetched", "uploaded", "bytes", "items"), profileParam, unblockParam}, galleryFilterParams),
+		Response: GalleryList{}},
+	{Id: "getGallery", Method: "GET", Path: "/gallery/{ripper_host}/{gid}", Summary: "View a gallery and one page of its files",
+		Params:   params([]Param{ripperParam, gidParam}, pageParams, []Param{cursorParam, sortParam("fetched", "uploaded", "bytes", "score"), profileParam, unblockParam}, fileFilterParams),
+		Response: GalleryDetail{}},
+	{Id: "updateGallery", Method: "PATCH", Path: "/gallery/{ripper_host}/{gid}", Summary: "Change any of the rating, ignored files, local tags, title, and notes of a gallery",
+		Params: []Param{ripperParam, gidParam, ifMatchParam}, Body: Update{},
+		Response: GalleryInfo{}},
+	{Id: "rateGallery", Method: "POST", Path: "/gallery/{ripper_host}/{gid}", Summary: "Rate or ignore a gallery",
+		Params: []Param{ripperParam, gidParam, ifMatchParam}, Form: ratingForm, Body: Update{}},
+	{Id: "editGalleryTags", Method: "POST", Path: "/gallery/{ripper_host}/{gid}/tags", Summary: "Add or remove local tags of a gallery",
+		Params: []Param{ripperParam, gidParam, ifMatchParam}, Form: tagsForm, Body: Update{}},
+	{Id: "setGalleryMeta", Method: "POST", Path: "/gallery/{ripper_host}/{gid}/meta", Summary: "Set the local title and notes of a gallery",
+		Params: []Param{ripperParam, gidParam, ifMatchParam}, Form: metaForm, Body: Update{}},
+	{Id: "getFile", Method: "GET", Path: "/file/{ripper_host}/{file_id}", Summary: "View a file",
+		Params:   []Param{ripperParam, fileIdParam, unblockParam},
+		Response: FileDetail{}},
+	{Id: "listFileGalleries", Method: "GET", Path: "/file/{ripper_host}/{file_id}/galleries", Summary: "List the galleries of a file",
+		Params:   []Param{ripperParam, fileIdParam, unblockParam},
+		Response: GalleryList{}},
+	{Id: "updateFile", Method: "PATCH", Path: "/file/{ripper_host}/{file_id}", Summary: "Change any of the rating, ignored flag, local tags, title, and notes of a file",
+		Params: []Param{ripperParam, fileIdParam, ifMatchParam}, Body: Update{},
+		Response: FileDetail{}},
+	{Id: "rateFile", Method: "POST", Path: "/file/{ripper_host}/{file_id}", Summary: "Rate or ignore a file",
+		Params: []Param{ripperParam, fileIdParam, ifMatchParam}, Form: ratingForm, Body: Update{}},
+	{Id: "editFileTags", Method: "POST", Path: "/file/{ripper_host}/{file_id}/tags", Summary: "Add or remove local tags of a file",
+		Params: []Param{ripperParam, fileIdParam, ifMatchParam}, Form: tagsForm, Body: Update{}},
+	{Id: "setFileMeta", Method: "POST", Path: "/file/{ripper_host}/{file_id}/meta", Summary: "Set the local title and notes of a file",
+		Params: []Param{ripperParam, fileIdParam, ifMatchParam}, Form: metaForm, Body: Update{}},
+	{Id: "searchGalleries", Method: "GET", Path: "/search/galleries", Summary: "Full-text search of galleries",
+		Params:   params([]Param{{Name: "q", In: "query", Type: "string", Required: true, Doc: "SQLite FTS5 query"}}, pageParams, []Param{cursorParam, sortParam("rank", "fetched", "uploaded", "bytes", "items"), profileParam, unblockParam}, galleryFilterParams),
+		Response: GalleryList{}},
+	{Id: "searchFiles", Method: "GET", Path: "/search/files", Summary: "Full-text search of files",
+		Params:   params([]Param{{Name: "q", In: "query", Type: "string", Required: true, Doc: "SQLite FTS5 query"}}, pageParams, []Param{cursorParam, sortParam("rank", "fetched", "uploaded", "bytes", "score"), profileParam, unblockParam}, fileFilterParams),
+		Response: FileList{}},
+	{Id: "listTags", Method: "GET", Path: "/tags", Summary: "List all tags with their usage counts",
+		Params:   []Param{unblockParam},
+		Response: TagList{}},
+	{Id: "getOpenAPI", Method: "GET", Path: "/openapi.json", Summary: "This OpenAPI document",
+		Response: map[string]any{}},
+}
+
+// OpenAPI generates the OpenAPI 3.1 document of Operations. Schemas are derived from the Go types by reflection:
+// the json tags name the properties, fields without omitempty are required, pointers are nullable, and doc tags describe them.
+func OpenAPI() map[string]any {
+	s := schemas{}
+	paths := map[string]any{}
+	for _, op := range Operations {
+		o := map[string]any{
+			"operationId": op.Id,
+			"summary":     op.Summary,
+		}
+		if len(op.Params) > 0 {
+			var ps []any
+			for _, p := range op.Params {
+				ps = append(ps, withDoc(map[string]any{
+					"name":     p.Name,
+					"in":       p.In,
+					"required": p.Required,
+					"schema":   p.schema(),
+				}, p.Doc))
+			}
+			o["parameters"] = ps
+		}
+		content := map[string]any{}
+		if len(op.Form) > 0 {
+			props := map[string]any{}
+			for _, p := range op.Form {
+				props[p.Name] = withDoc(p.schema(), p.Doc)
+			}
+			content["application/x-www-form-urlencoded"] = map[string]any{
+				"schema": map[string]any{"type": "object", "properties": props},
+			}
+		}
+		if op.Body != nil {
+			content["application/json"] = map[string]any{"schema": s.of(reflect.TypeOf(op.Body))}
+		}
+		if len(content) > 0 {
+			o["requestBody"] = map[string]any{"required": true, "content": content}
+		}
+		responses := map[string]any{
+			"default": contentResponse("Error", "application/problem+json", s.of(reflect.TypeOf(Error{}))),
+		}
+		if op.Response == nil {
+			responses["204"] = map[string]any{"description": "Saved"}
+		} else {
+			responses["200"] = jsonResponse("OK", s.of(reflect.TypeOf(op.Response)))
+		}
+		o["responses"] = responses
+		path := BasePath + op.Path
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = o
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "LocalGal API",
+			"version":     Version,
+			"description": "JSON API of LocalGal, a web gallery for RipMe rips. Writes take form bodies and answer 204 No Content.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": map[string]any(s),
+			"securitySchemes": map[string]any{
+				"sharedSecret": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The shared secret, when the server requires one",
+				},
+			},
+		},
+		// The empty requirement makes the secret optional, as it is for servers that don't require one
+		"security": []any{map[string]any{"sharedSecret": []any{}}, map[string]any{}},
+	}
+}
+
+func jsonResponse(description string, schema map[string]any) map[string]any {
+	return contentResponse(description, "application/json", schema)
+}
+
+func contentResponse(description string, contentType string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{contentType: map[string]any{"schema": schema}},
+	}
+}
+
+func withDoc(m map[string]any, doc string) map[string]any {
+	if doc != "" {
+		m["description"] = doc
+	}
+	return m
+}
+
+func (p Param) schema() map[string]any {
+	if p.Type == "array" {
+		return map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+	}
+	m := map[string]any{"type": p.Type}
+	if len(p.Enum) > 0 {
+		m["enum"] = p.Enum
+	}
+	return m
+}
+
+// schemas collects the named struct types as components, keyed by their Go name
+type schemas map[string]any
+
+// of returns the schema of t, a $ref for named structs
+func (s schemas) of(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		m := s.of(t.Elem())
+		if typ, ok := m["type"].(string); ok {
+			m["type"] = []string{typ, "null"}
+			return m
+		}
+		return map[string]any{"oneOf": []any{m, map[string]any{"type": "null"}}}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object"}
+	case reflect.Struct:
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // placeholder, for recursive types
+			props := map[string]any{}
+			var required []string
+			s.addFields(t, props, &required)
+			m := map[string]any{"type": "object", "properties": props}
+			if len(required) > 0 {
+				m["required"] = required
+			}
+			s[t.Name()] = m
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	panic("api: no schema for " + t.String())
+}
+
+// addFields adds the properties of a struct, flattening embedded structs like encoding/json does
+func (s schemas) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && tag == "" {
+			s.addFields(f.Type, props, required)
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = withDoc(s.of(f.Type), f.Tag.Get("doc"))
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
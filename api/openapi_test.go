@@ -0,0 +1,41 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIUpToDate fails when docs/openapi.json no longer matches the spec generated from this package
+func TestOpenAPIUpToDate(t *testing.T) {
+	// Encoded like the openapi command of cmd/golocalgal, which make openapi writes the file with
+	var generated bytes.Buffer
+	enc := json.NewEncoder(&generated)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(OpenAPI()); err != nil {
+		t.Fatalf("encode OpenAPI document: %v", err)
+	}
+	committed, err := os.ReadFile("../docs/openapi.json")
+	if err != nil {
+		t.Fatalf("read docs/openapi.json: %v", err)
+	}
+	if bytes.Equal(generated.Bytes(), committed) {
+		return
+	}
+	want := strings.Split(generated.String(), "\n")
+	got := strings.Split(string(committed), "\n")
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var w, g string
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if w != g {
+			t.Fatalf("docs/openapi.json is out of date, run make openapi\nline %d:\n  docs/openapi.json: %s\n  generated:         %s", i+1, g, w)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"golocalgal/api"
 	"golocalgal/internal/gui"
 	"golocalgal/internal/server"
 	"golocalgal/internal/types"
@@ -12,6 +14,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // - Putting the version vars in a non-main package requires ldflags to fully qualify the package
@@ -61,27 +65,70 @@ func main() {
 		return nil
 	})
 
+	flag.Func("auth-secret", "require this shared secret to log in, see AUTH_SECRET", func(s string) error {
+		vars.AuthSecretFlag.IsSet = true
+		vars.AuthSecretFlag.Value = s
+		return nil
+	})
+
 	flag.Parse()
 	if help {
 		flag.CommandLine.SetOutput(os.Stdout)
-		fmt.Println("Usage: localgal [options]")
+		fmt.Println("Usage: localgal [options] [command]")
 		fmt.Println("Options:")
 		flag.PrintDefaults()
+		fmt.Println("Commands:")
+		fmt.Println("  export-user-data [-format json|csv] [-o file]")
+		fmt.Println("\texport local ratings, local tags, and ignored files, to stdout by default")
+		fmt.Println("  import-user-data [-format json|csv] [-policy keep|overwrite|keep-higher] [-dry-run] file")
+		fmt.Println("\timport user data exported by export-user-data. the import is recorded in history and can be undone")
+		fmt.Println("  openapi [-o file]")
+		fmt.Println("\twrite the OpenAPI document of the /api/v1/ JSON API, to stdout by default")
+		fmt.Println("  clear-auth-secret")
+		fmt.Println("\tremove the stored shared secret, so logging in is no longer required")
 		fmt.Println("Environment Variables:")
 		fmt.Println("  BIND:\tlisten address, default `127.0.0.1:5033` (to listen on all addresses, specify `:5033`)")
-		fmt.Println("  SQLITE_DSN:\tsqlite data source name (connection string), default `file:ripme.sqlite`")
+		fmt.Println("  BASE_URL:\taddress that other programs reach LocalGal at, such as `http://192.168.1.10:5033` or the URL of a reverse proxy, used for the URLs in playlists. default derived from BIND")
+		fmt.Println("  CATALOGUE:\twhere galleries come from: `ripme`, or `folders` to index the folders of MEDIA_ROOT. default `ripme`")
+		fmt.Println("  SQLITE_DSN:\tsqlite data source name (connection string), default `file:ripme.sqlite`, or `file:localgal-folders.sqlite` for the folder catalogue")
+		fmt.Println("  LOCALGAL_DSN:\tsqlite data source name for LocalGal's own data (filter profiles, history, collections, comparisons, gallery covers, local titles and notes), default `localgal.sqlite` next to the ripme database. created if missing")
 		fmt.Println("  SLOW_SQL_MS:\tduration threshold to log slow sql queries, milliseconds, default `100`")
 		fmt.Println("  MEDIA_ROOT:\trip base directory, default: `./rips`")
 		fmt.Println("  DFLOG:\tdownloaded file log, default `./ripme.downloaded.files.log`")
 		fmt.Println("  DFLOG_ROOT:\tbase directory to resolve relative paths in DFLOG from, default directory that DFLOG is in")
+		fmt.Println("  FOLLOW_SYMLINKS:\tif `1`, serve files that symlinks in MEDIA_ROOT or DFLOG_ROOT lead out of them to. default `0`")
 		fmt.Println("  GUI:\tforce GUI mode with `1` or CLI mode with `0`. flag takes precedence")
 		fmt.Println("  RO:\tif `1`, run in read-only mode (no saved ratings). `0` is read-write mode. flag takes precedence")
 		fmt.Println("  CORS_ORIGINS:\tenable CORS, comma-separated list of origins, `*` for all, empty to disable. default empty")
+		fmt.Println("  AUTH_SECRET:\trequire this shared secret to log in, or as a bearer token for /api/. its hash is stored in the LocalGal database and kept when unset. flag takes precedence")
+		fmt.Println("  AUTH_LOOPBACK:\tif `1`, clients on loopback don't need the shared secret. default `0`")
+		fmt.Println("  COVER_RULE:\tthumbnail of galleries without a chosen cover: `latest`, `first`, `first-image`, `rated`, or `largest`. default `latest`")
 		fmt.Println("Notes:")
 		fmt.Println("  If stdin, stdout, and stderr are not a tty, GUI mode gets chosen by default. In containers, use GUI=0 or -cli")
 		fmt.Println("  If environment variables are not specified, localgal looks for the ripme configuration file")
 		fmt.Println("  CORS is only useful if you are using a third-party UI")
+		fmt.Println("  Set AUTH_SECRET before listening on other addresses than loopback. -auth-secret is visible to other local users in the process list")
+		os.Exit(0)
+	}
+
+	switch flag.Arg(0) {
+	case "export-user-data":
+		os.Exit(exportUserData(flag.Args()[1:]))
+	case "import-user-data":
+		os.Exit(importUserData(flag.Args()[1:]))
+	case "openapi":
+		os.Exit(writeOpenAPI(flag.Args()[1:]))
+	case "clear-auth-secret":
+		if err := server.ClearAuthSecret(context.Background(), server.GetServerConfig()); err != nil {
+			log.Printf("Unable to clear the shared secret: %v", err)
+			os.Exit(1)
+		}
+		log.Println("Cleared the shared secret")
 		os.Exit(0)
+	case "":
+	default:
+		log.Printf("Unknown command: %s", flag.Arg(0))
+		os.Exit(2)
 	}
 
 	if gui.ShouldStartGui() {
@@ -114,3 +161,97 @@ func main() {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+func exportUserData(args []string) int {
+	fs := flag.NewFlagSet("export-user-data", flag.ExitOnError)
+	format := fs.String("format", server.UserDataFormatJson, "output format, json or csv")
+	out := fs.String("o", "", "output file, default stdout")
+	_ = fs.Parse(args)
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Printf("Unable to export user data: %v", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := server.ExportUserData(context.Background(), server.GetServerConfig(), w, *format); err != nil {
+		log.Printf("Unable to export user data: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func importUserData(args []string) int {
+	fs := flag.NewFlagSet("import-user-data", flag.ExitOnError)
+	format := fs.String("format", "", "input format, json or csv. default: from the file extension")
+	policy := fs.String("policy", server.ImportPolicyKeep, "conflict policy: keep existing values, overwrite them, or keep-higher ratings")
+	dryRun := fs.Bool("dry-run", false, "show the changes without making them")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Printf("Usage: localgal import-user-data [-format json|csv] [-policy keep|overwrite|keep-higher] [-dry-run] file")
+		return 2
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = server.UserDataFormatJson
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			*format = server.UserDataFormatCsv
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Unable to import user data: %v", err)
+		return 1
+	}
+	defer f.Close()
+	result, err := server.ImportUserData(context.Background(), server.GetServerConfig(), f, *format, *policy, *dryRun)
+	if err != nil {
+		log.Printf("Unable to import user data: %v", err)
+		return 1
+	}
+	for _, c := range result.Changes {
+		fmt.Printf("%s %s/%s %s: %s -> %s\n", c.EntityType, c.RipperHost, c.EntityKey, c.Field, orNone(c.OldValue), orNone(c.NewValue))
+	}
+	verb := "Made"
+	if result.DryRun {
+		verb = "Dry run, would make"
+	}
+	log.Printf("%s %d change(s) from %d gallery and %d file entries (%d not found) with policy %s", verb, len(result.Changes), result.Galleries, result.Files, result.NotFound, result.Policy)
+	return 0
+}
+
+func orNone(v types.SqlJsonString) string {
+	if !v.Valid {
+		return "(none)"
+	}
+	return v.String
+}
+
+func writeOpenAPI(args []string) int {
+	fs := flag.NewFlagSet("openapi", flag.ExitOnError)
+	out := fs.String("o", "", "output file, default stdout")
+	_ = fs.Parse(args)
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Printf("Unable to write OpenAPI document: %v", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(api.OpenAPI()); err != nil {
+		log.Printf("Unable to write OpenAPI document: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -38,12 +38,18 @@ type MainWindow struct {
 	cwd           string
 	bindEd        widget.Editor
 	corsOriginsEd widget.Editor
+	catalogueEd   widget.Editor
 	dsnEd         widget.Editor
+	localDsnEd    widget.Editor
 	roEd          widget.Editor
 	slowSqlEd     widget.Editor
 	mediaRootEd   widget.Editor
 	dflogEd       widget.Editor
 	dflogRootEd   widget.Editor
+	followLinksEd widget.Editor
+	coverRuleEd   widget.Editor
+	authSecretEd  widget.Editor
+	authLoopEd    widget.Editor
 	logEd         widget.Editor
 	logList       widget.List
 	startBtn      widget.Clickable
@@ -65,17 +71,24 @@ func newMainWindow() *MainWindow {
 	}
 	mw.w.Option(
 		app.Title("LocalGal Server"),
-		app.Size(unit.Dp(500), unit.Dp(550)),
-		app.MinSize(unit.Dp(500), unit.Dp(550)),
+		app.Size(unit.Dp(500), unit.Dp(630)),
+		app.MinSize(unit.Dp(500), unit.Dp(630)),
 	)
 
 	mw.bindEd.SingleLine = true
 	mw.dsnEd.SingleLine = true
+	mw.localDsnEd.SingleLine = true
 	mw.roEd.SingleLine = true
 	mw.slowSqlEd.SingleLine = true
 	mw.mediaRootEd.SingleLine = true
 	mw.dflogEd.SingleLine = true
 	mw.dflogRootEd.SingleLine = true
+	mw.followLinksEd.SingleLine = true
+	mw.coverRuleEd.SingleLine = true
+	mw.catalogueEd.SingleLine = true
+	mw.authSecretEd.SingleLine = true
+	mw.authSecretEd.Mask = '•'
+	mw.authLoopEd.SingleLine = true
 	mw.logEd.SingleLine = false
 	mw.logEd.Submit = false
 	mw.logEd.ReadOnly = true
@@ -85,7 +98,9 @@ func newMainWindow() *MainWindow {
 	serverConfig := server.GetServerConfig()
 
 	mw.bindEd.SetText(serverConfig.Bind)
+	mw.catalogueEd.SetText(serverConfig.Catalogue)
 	mw.dsnEd.SetText(serverConfig.Dsn)
+	mw.localDsnEd.SetText(serverConfig.LocalDsn)
 	if vars.RoFlag.IsSet {
 		mw.roEd.SetText(strconv.FormatBool(vars.RoFlag.Value))
 		mw.roEd.ReadOnly = true
@@ -96,6 +111,11 @@ func newMainWindow() *MainWindow {
 	mw.mediaRootEd.SetText(serverConfig.MediaRoot)
 	mw.dflogEd.SetText(serverConfig.DfLog)
 	mw.dflogRootEd.SetText(serverConfig.DfLogRoot)
+	mw.followLinksEd.SetText(strconv.FormatBool(serverConfig.FollowSymlinks))
+	mw.coverRuleEd.SetText(serverConfig.CoverRule)
+	mw.authSecretEd.SetText(serverConfig.AuthSecret)
+	mw.authSecretEd.ReadOnly = vars.AuthSecretFlag.IsSet
+	mw.authLoopEd.SetText(strconv.FormatBool(serverConfig.AuthLoopback))
 
 	var err error
 	mw.cwd, err = os.Getwd()
@@ -132,12 +152,18 @@ func handleEvent(e event.Event, mw *MainWindow) {
 		if mw.startBtn.Clicked(gtx) && !mw.running && !mw.optimizing {
 			vars.EnvBind.SetValue(mw.bindEd.Text())
 			vars.EnvCorsOrigins.SetValue(mw.corsOriginsEd.Text())
+			vars.EnvCatalogue.SetValue(mw.catalogueEd.Text())
 			vars.EnvSqliteDsn.SetValue(mw.dsnEd.Text())
+			vars.EnvLocalDsn.SetValue(mw.localDsnEd.Text())
 			vars.EnvRo.SetValue(mw.roEd.Text())
 			vars.EnvSlowSqlMs.SetValue(mw.slowSqlEd.Text())
 			vars.EnvMediaRoot.SetValue(mw.mediaRootEd.Text())
 			vars.EnvDflog.SetValue(mw.dflogEd.Text())
 			vars.EnvDflogRoot.SetValue(mw.dflogRootEd.Text())
+			vars.EnvFollowSymlinks.SetValue(mw.followLinksEd.Text())
+			vars.EnvCoverRule.SetValue(mw.coverRuleEd.Text())
+			vars.EnvAuthSecret.SetValue(mw.authSecretEd.Text())
+			vars.EnvAuthLoopback.SetValue(mw.authLoopEd.Text())
 
 			cfg := server.GetServerConfig()
 			ctrl, err := server.StartServer(cfg)
@@ -182,6 +208,7 @@ func handleEvent(e event.Event, mw *MainWindow) {
 			cancel()
 		}
 		if mw.optimizeBtn.Clicked(gtx) && !mw.running && !mw.optimizing {
+			vars.EnvCatalogue.SetValue(mw.catalogueEd.Text())
 			vars.EnvSqliteDsn.SetValue(mw.dsnEd.Text())
 
 			mw.optimizing = true
@@ -203,12 +230,18 @@ func handleEvent(e event.Event, mw *MainWindow) {
 		}
 		readOnly := mw.running || mw.optimizing
 		mw.bindEd.ReadOnly = readOnly
+		mw.catalogueEd.ReadOnly = readOnly
 		mw.dsnEd.ReadOnly = readOnly
+		mw.localDsnEd.ReadOnly = readOnly
 		mw.roEd.ReadOnly = readOnly || vars.RoFlag.IsSet
 		mw.slowSqlEd.ReadOnly = readOnly
 		mw.mediaRootEd.ReadOnly = readOnly
 		mw.dflogEd.ReadOnly = readOnly
 		mw.dflogRootEd.ReadOnly = readOnly
+		mw.followLinksEd.ReadOnly = readOnly
+		mw.coverRuleEd.ReadOnly = readOnly
+		mw.authSecretEd.ReadOnly = readOnly || vars.AuthSecretFlag.IsSet
+		mw.authLoopEd.ReadOnly = readOnly
 
 		// Update log view content each frame
 		newLogLines := globalLogBuffer.last(100)
@@ -277,12 +310,18 @@ func handleEvent(e event.Event, mw *MainWindow) {
 					var keys = []string{
 						vars.EnvBind.Key(),
 						vars.EnvCorsOrigins.Key(),
+						vars.EnvCatalogue.Key(),
 						vars.EnvSqliteDsn.Key(),
+						vars.EnvLocalDsn.Key(),
 						vars.EnvRo.Key(),
 						vars.EnvSlowSqlMs.Key(),
 						vars.EnvMediaRoot.Key(),
 						vars.EnvDflog.Key(),
 						vars.EnvDflogRoot.Key(),
+						vars.EnvFollowSymlinks.Key(),
+						vars.EnvCoverRule.Key(),
+						vars.EnvAuthSecret.Key(),
+						vars.EnvAuthLoopback.Key(),
 					}
 					labelWidth := getLabelMaxWidth(gtx, mw, keys)
 
@@ -295,15 +334,26 @@ func handleEvent(e event.Event, mw *MainWindow) {
 						}
 					}
 
+					authSecretHelp := "Shared secret to log in with; kept once set. Empty keeps the saved one"
+					if vars.AuthSecretFlag.IsSet {
+						authSecretHelp += ` (currently forced by "-auth-secret" flag)`
+					}
+
 					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvBind.Key(), &mw.bindEd, "Server listen/bind address, e.g. :5033 or 127.0.0.1:5033")),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvCorsOrigins.Key(), &mw.corsOriginsEd, "Comma-separated list of CORS origins, * for all, or empty to disable CORS")),
+						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvCatalogue.Key(), &mw.catalogueEd, fmt.Sprintf("Where galleries come from: ripme, or folders to index the folders of %s without a RipMe database. With folders, %s is the index", vars.EnvMediaRoot.Key(), vars.EnvSqliteDsn.Key()))),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvSqliteDsn.Key(), &mw.dsnEd, "SQLite data source name")),
+						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvLocalDsn.Key(), &mw.localDsnEd, "SQLite data source name for LocalGal's own data, such as filter profiles")),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvRo.Key(), &mw.roEd, roHelp)),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvSlowSqlMs.Key(), &mw.slowSqlEd, "Duration threshold to log slow sql queries, milliseconds, or -1 to disable")),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvMediaRoot.Key(), &mw.mediaRootEd, "Root directory for media files")),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvDflog.Key(), &mw.dflogEd, "Downloaded file log")),
 						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvDflogRoot.Key(), &mw.dflogRootEd, fmt.Sprintf("Base directory to resolve relative paths in %s from", vars.EnvDflog.Key()))),
+						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvFollowSymlinks.Key(), &mw.followLinksEd, fmt.Sprintf("Follow symlinks that lead out of %s and %s, true or false", vars.EnvMediaRoot.Key(), vars.EnvDflogRoot.Key()))),
+						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvCoverRule.Key(), &mw.coverRuleEd, "Gallery thumbnail when no cover is chosen: latest, first, first-image, rated, or largest")),
+						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvAuthSecret.Key(), &mw.authSecretEd, authSecretHelp)),
+						layout.Rigid(labeledEditor(mw.th, labelWidth, vars.EnvAuthLoopback.Key(), &mw.authLoopEd, "Let clients on this computer in without the shared secret, true or false")),
 					)
 				}),
 				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
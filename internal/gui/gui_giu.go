@@ -9,6 +9,7 @@ import (
 	"golocalgal/internal/vars"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,11 +32,17 @@ type MainWindow struct {
 
 	bind        string
 	corsOrigins string
+	catalogue   string
 	dsn         string
+	localDsn    string
 	slowSql     string
 	mediaRoot   string
 	dflog       string
 	dflogRoot   string
+	followLinks bool
+	coverRule   string
+	authSecret  string
+	authLoop    bool
 	log         string
 
 	status     string
@@ -95,10 +102,18 @@ func loop() {
 		giu.InputText(&mw.corsOrigins),
 		giu.Label("Comma-separated list of CORS origins, * for all, or empty to disable CORS").Wrapped(true),
 
+		giu.Label(vars.EnvCatalogue.Key()),
+		giu.InputText(&mw.catalogue),
+		giu.Label(fmt.Sprintf("Where galleries come from: ripme, or folders to index the folders of %s without a RipMe database. With folders, %s is the index", vars.EnvMediaRoot.Key(), vars.EnvSqliteDsn.Key())).Wrapped(true),
+
 		giu.Label(vars.EnvSqliteDsn.Key()),
 		giu.InputText(&mw.dsn),
 		giu.Label("SQLite data source name").Wrapped(true),
 
+		giu.Label(vars.EnvLocalDsn.Key()),
+		giu.InputText(&mw.localDsn),
+		giu.Label("SQLite data source name for LocalGal's own data, such as filter profiles").Wrapped(true),
+
 		giu.Label(vars.EnvSlowSqlMs.Key()),
 		giu.InputText(&mw.slowSql),
 		giu.Label("Log SQL queries slower than this many milliseconds, or -1 to disable").Wrapped(true),
@@ -115,6 +130,20 @@ func loop() {
 		giu.InputText(&mw.dflogRoot),
 		giu.Label(fmt.Sprintf("Base directory to resolve relative paths in %s from", vars.EnvDflog.Key())).Wrapped(true),
 
+		giu.Checkbox(vars.EnvFollowSymlinks.Key(), &mw.followLinks),
+		giu.Label(fmt.Sprintf("Follow symlinks that lead out of %s and %s", vars.EnvMediaRoot.Key(), vars.EnvDflogRoot.Key())).Wrapped(true),
+
+		giu.Label(vars.EnvCoverRule.Key()),
+		giu.InputText(&mw.coverRule),
+		giu.Label("Gallery thumbnail when no cover is chosen: latest, first, first-image, rated, or largest").Wrapped(true),
+
+		giu.Label(vars.EnvAuthSecret.Key()),
+		giu.InputText(&mw.authSecret).Flags(giu.InputTextFlagsPassword),
+		giu.Label("Shared secret to log in with; kept once set. Empty keeps the saved one").Wrapped(true),
+
+		giu.Checkbox(vars.EnvAuthLoopback.Key(), &mw.authLoop),
+		giu.Label("Let clients on this computer in without the shared secret").Wrapped(true),
+
 		giu.Row(
 			giu.Button("Start").OnClick(onStart).Disabled(mw.running || mw.optimizing),
 			giu.Button("Stop").OnClick(onStop).Disabled(!mw.running || mw.optimizing),
@@ -133,11 +162,17 @@ func loop() {
 func onStart() {
 	vars.EnvBind.SetValue(mw.bind)
 	vars.EnvCorsOrigins.SetValue(mw.corsOrigins)
+	vars.EnvCatalogue.SetValue(mw.catalogue)
 	vars.EnvSqliteDsn.SetValue(mw.dsn)
+	vars.EnvLocalDsn.SetValue(mw.localDsn)
 	vars.EnvSlowSqlMs.SetValue(mw.slowSql)
 	vars.EnvMediaRoot.SetValue(mw.mediaRoot)
 	vars.EnvDflog.SetValue(mw.dflog)
 	vars.EnvDflogRoot.SetValue(mw.dflogRoot)
+	vars.EnvFollowSymlinks.SetValue(strconv.FormatBool(mw.followLinks))
+	vars.EnvCoverRule.SetValue(mw.coverRule)
+	vars.EnvAuthSecret.SetValue(mw.authSecret)
+	vars.EnvAuthLoopback.SetValue(strconv.FormatBool(mw.authLoop))
 
 	cfg := server.GetServerConfig()
 	ctrl, err := server.StartServer(cfg)
@@ -189,6 +224,7 @@ func onStop() {
 }
 
 func onOptimize() {
+	vars.EnvCatalogue.SetValue(mw.catalogue)
 	vars.EnvSqliteDsn.SetValue(mw.dsn)
 
 	mw.optimizing = true
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golocalgal/api"
+	"golocalgal/internal/types"
+	"net/http"
+)
+
+type apiOperationKey struct{}
+
+// apiV1Handlers are the handlers of api.Operations, by operation id. The v1 responses are converted from the page models by apiV1Body.
+func (app *App) apiV1Handlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"listGalleries":     app.handleBrowse,
+		"getGallery":        app.handleGallery,
+		"updateGallery":     app.handleGalleryPatch,
+		"rateGallery":       app.handleGalleryPost,
+		"editGalleryTags":   app.handleGalleryTagsPost,
+		"setGalleryMeta":    app.handleGalleryMetaPost,
+		"getFile":           app.handleFileStandalone,
+		"listFileGalleries": app.handleFileGalleryFragment,
+		"updateFile":        app.handleFilePatch,
+		"rateFile":          app.handleFilePost,
+		"editFileTags":      app.handleFileTagsPost,
+		"setFileMeta":       app.handleFileMetaPost,
+		"searchGalleries":   app.handleSearchGalleries,
+		"searchFiles":       app.handleSearchFiles,
+		"listTags":          app.handleTags,
+		"getOpenAPI":        app.handleOpenAPI,
+	}
+}
+
+// registerApiV1 registers the routes of api.Operations under api.BasePath
+func (app *App) registerApiV1(mux *http.ServeMux) {
+	handlers := app.apiV1Handlers()
+	for _, op := range api.Operations {
+		h, ok := handlers[op.Id]
+		if !ok {
+			panic(fmt.Sprintf("no handler for api operation %s", op.Id))
+		}
+		mux.HandleFunc(op.Method+" "+api.BasePath+op.Path, app.asApiV1(op.Id, h))
+	}
+	mux.HandleFunc(api.BasePath+"/", app.asApiV1("", app.handle404))
+}
+
+// asApiV1 is asApi for the versioned API: the page models are converted to the api types before they are encoded
+func (app *App) asApiV1(operationId string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRenderMode(r, RenderJSON)
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiOperationKey{}, operationId)))
+	}
+}
+
+// getApiOperation returns the id of the api.Operations entry being served, and whether the request is to the versioned API
+func getApiOperation(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(apiOperationKey{}).(string)
+	return id, ok
+}
+
+// handleOpenAPI handles /api/v1/openapi.json
+func (app *App) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	app.render(r.Context(), w, "", api.OpenAPI())
+}
+
+// apiV1Body converts a page model to the response of an api operation, with its status code
+func apiV1Body(operationId string, data any) (any, int) {
+	switch m := data.(type) {
+	case *types.BrowsePage:
+		pagination := apiPagination(m.Page, m.PageSize, m.Total, m.HasPrev, m.HasNext)
+		pagination.NextCursor, pagination.PrevCursor = apiCursors(m.NextCursor, m.PrevCursor, m.HasNext, m.HasPrev)
+		return api.GalleryList{Galleries: apiGalleries(m.Albums), Pagination: pagination}, http.StatusOK
+	case *types.GalleryPage:
+		pagination := apiPagination(m.Page, m.PageSize, m.Total, m.HasPrev, m.HasNext)
+		pagination.NextCursor, pagination.PrevCursor = apiCursors(m.NextCursor, m.PrevCursor, m.HasNext, m.HasPrev)
+		return api.GalleryDetail{
+			Gallery:    apiGallery(m.Album),
+			Tags:       apiTags(m.AlbumTags),
+			Files:      apiFiles(m.Files),
+			Pagination: pagination,
+		}, http.StatusOK
+	case *types.FilePage:
+		if operationId == "listFileGalleries" {
+			return api.GalleryList{Galleries: apiGalleries(m.Albums), Pagination: apiPagination(1, len(m.Albums), len(m.Albums), false, false)}, http.StatusOK
+		}
+		return api.FileDetail{File: apiFile(m.File), Tags: apiTags(m.FileTags)}, http.StatusOK
+	case *types.SearchPage:
+		if operationId == "searchFiles" {
+			pagination := apiPagination(m.Page, m.PageSize, m.FilesTotal, m.HasPrev, m.HasNext)
+			pagination.NextCursor, pagination.PrevCursor = apiCursors(m.NextCursor, m.PrevCursor, m.HasNext, m.HasPrev)
+			return api.FileList{Files: apiFiles(m.Files), Pagination: pagination}, http.StatusOK
+		}
+		pagination := apiPagination(m.Page, m.PageSize, m.AlbumsTotal, m.HasPrev, m.HasNext)
+		pagination.NextCursor, pagination.PrevCursor = apiCursors(m.NextCursor, m.PrevCursor, m.HasNext, m.HasPrev)
+		return api.GalleryList{Galleries: apiGalleries(m.Albums), Pagination: pagination}, http.StatusOK
+	case *types.SearchErrorPage:
+		return api.Error{Status: http.StatusBadRequest, Message: m.Message}, http.StatusBadRequest
+	case *types.TagsPage:
+		return api.TagList{GalleryTags: apiTags(m.AlbumTags), FileTags: apiTags(m.ImageTags)}, http.StatusOK
+	case api.GalleryInfo, api.FileDetail, map[string]any:
+		return m, http.StatusOK
+	}
+	return api.Error{Status: http.StatusInternalServerError, Message: fmt.Sprintf("no api response for %T", data)}, http.StatusInternalServerError
+}
+
+// apiETag is the ETag of a gallery or file response, or "" for other responses. It covers what writes change: the local
+// rating, ignored flag, title, notes, and tags. So a gallery has the same ETag with or without its files, and RipMe
+// adding files to it doesn't fail a write with If-Match. The pages of the unversioned API have the same ETags as the
+// versioned API's responses for them.
+func apiETag(data any) string {
+	var key any
+	switch m := data.(type) {
+	case *types.GalleryPage:
+		return apiETag(api.GalleryInfo{Gallery: apiGallery(m.Album), Tags: apiTags(m.AlbumTags)})
+	case *types.FilePage:
+		return apiETag(api.FileDetail{File: apiFile(m.File), Tags: apiTags(m.FileTags)})
+	case api.GalleryDetail:
+		key = etagKey("gallery", m.Gallery.Id, m.Gallery.Rating, false, m.Gallery.LocalTitle, m.Gallery.Notes, m.Tags)
+	case api.GalleryInfo:
+		key = etagKey("gallery", m.Gallery.Id, m.Gallery.Rating, false, m.Gallery.LocalTitle, m.Gallery.Notes, m.Tags)
+	case api.FileDetail:
+		key = etagKey("file", m.File.Id, m.File.Rating, m.File.Ignored, m.File.LocalTitle, m.File.Notes, m.Tags)
+	default:
+		return ""
+	}
+	b, _ := json.Marshal(key)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func etagKey(kind string, id int64, rating *int64, ignored bool, localTitle *string, notes *string, tags []api.Tag) []any {
+	var localTags []string
+	for _, t := range tags {
+		if t.Local {
+			localTags = append(localTags, t.Name)
+		}
+	}
+	return []any{kind, id, rating, ignored, localTitle, notes, localTags}
+}
+
+func apiPagination(page int, pageSize int, total int, hasPrev bool, hasNext bool) api.Pagination {
+	return api.Pagination{Page: page, PageSize: pageSize, Total: total, HasPrev: hasPrev, HasNext: hasNext}
+}
+
+// apiCursors returns the cursors of the pages there are
+func apiCursors(next string, prev string, hasNext bool, hasPrev bool) (string, string) {
+	if !hasNext {
+		next = ""
+	}
+	if !hasPrev {
+		prev = ""
+	}
+	return next, prev
+}
+
+func apiString(v types.SqlJsonString) *string {
+	if !v.Valid {
+		return nil
+	}
+	return &v.String
+}
+
+func apiInt64(v types.SqlJsonInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
+
+func apiTitle(localTitle types.SqlJsonString, title types.SqlJsonString) *string {
+	if localTitle.Valid {
+		return apiString(localTitle)
+	}
+	return apiString(title)
+}
+
+func apiGallery(a types.Album) api.Gallery {
+	return api.Gallery{
+		Id:          a.AlbumId,
+		Ripper:      a.RipperHost,
+		Gid:         a.Gid,
+		Title:       apiTitle(a.LocalTitle, a.Title),
+		RipmeTitle:  apiString(a.Title),
+		LocalTitle:  apiString(a.LocalTitle),
+		Description: apiString(a.Description),
+		Notes:       apiString(a.Notes),
+		Uploader:    apiString(a.Uploader),
+		Rating:      apiInt64(a.LocalRating),
+		Hidden:      a.Hidden,
+		Removed:     a.Removed,
+		FileCount:   a.FileCount,
+		Bytes:       a.Bytes,
+		CreatedTs:   apiInt64(a.CreatedTs),
+		ModifiedTs:  apiInt64(a.ModifiedTs),
+		LastFetchTs: apiInt64(a.LastFetchTs),
+		InsertedTs:  a.InsertedTs,
+		CoverFileId: apiInt64(a.CoverFileId),
+		ThumbUrl:    a.Thumb.HrefMedia,
+		PageUrl:     fmt.Sprintf("/gallery/%s/%s", a.RipperHost, a.Gid),
+	}
+}
+
+func apiGalleries(albums []types.Album) []api.Gallery {
+	galleries := make([]api.Gallery, len(albums))
+	for i := range albums {
+		galleries[i] = apiGallery(albums[i])
+	}
+	return galleries
+}
+
+func apiFile(f types.File) api.File {
+	return api.File{
+		Id:          f.FileId,
+		Ripper:      f.RipperHost,
+		Urlid:       apiString(f.Urlid),
+		Filename:    apiString(f.Filename),
+		MimeType:    apiString(f.MimeType),
+		Title:       apiTitle(f.LocalTitle, f.Title),
+		RipmeTitle:  apiString(f.Title),
+		LocalTitle:  apiString(f.LocalTitle),
+		Description: apiString(f.Description),
+		Notes:       apiString(f.Notes),
+		Uploader:    apiString(f.Uploader),
+		Rating:      apiInt64(f.LocalRating),
+		Hidden:      f.Hidden,
+		Removed:     f.Removed,
+		Ignored:     f.Ignored,
+		Bytes:       apiInt64(f.Bytes),
+		UploadedTs:  apiInt64(f.UploadedTs),
+		InsertedTs:  f.InsertedTs,
+		MediaUrl:    f.HrefMedia,
+		PageUrl:     fmt.Sprintf("/file/%s/%d", f.RipperHost, f.FileId),
+	}
+}
+
+func apiFiles(files []types.File) []api.File {
+	list := make([]api.File, len(files))
+	for i := range files {
+		list[i] = apiFile(files[i])
+	}
+	return list
+}
+
+func apiTags(tags []types.Tag) []api.Tag {
+	list := make([]api.Tag, len(tags))
+	for i := range tags {
+		list[i] = api.Tag{Name: tags[i].Name, Local: tags[i].IsLocal, Count: tags[i].Count}
+	}
+	return list
+}
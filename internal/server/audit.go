@@ -0,0 +1,620 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	auditFieldRating  = "local_rating"
+	auditFieldIgnored = "ignored"
+	auditFieldTag     = "tag"
+	// The local title, notes, and cover are in LocalDb rather than the RipMe database, see undoLocalTx
+	auditFieldTitle = "title"
+	auditFieldNotes = "notes"
+	auditFieldCover = "cover"
+
+	auditEntityFile    = "file"
+	auditEntityGallery = "gallery"
+)
+
+// auditEntity identifies the file or gallery that a write applies to
+type auditEntity struct {
+	Type       string // auditEntityFile or auditEntityGallery
+	Id         int64  // remote_file_id or album_id
+	RipperHost string
+	Key        string // file id or gid, as used in page URLs
+}
+
+func (e auditEntity) change(field string, oldValue, newValue sql.NullString) types.HistoryEntry {
+	return types.HistoryEntry{
+		EntityType: e.Type,
+		EntityId:   e.Id,
+		RipperHost: e.RipperHost,
+		EntityKey:  e.Key,
+		Field:      field,
+		OldValue:   types.SqlJsonString{NullString: oldValue},
+		NewValue:   types.SqlJsonString{NullString: newValue},
+	}
+}
+
+// table and idColumn are never populated from user input
+func (e auditEntity) table() (table string, idColumn string) {
+	if e.Type == auditEntityGallery {
+		return "album", "album_id"
+	}
+	return "remote_file", "remote_file_id"
+}
+
+// auditChanges collects the changes made by one write, to be recorded in the audit log
+type auditChanges []types.HistoryEntry
+
+func (c *auditChanges) add(entry types.HistoryEntry) {
+	*c = append(*c, entry)
+}
+
+// count returns how many changes were made to a field. For tags, added selects additions or removals.
+func (c auditChanges) count(field string, added bool) int64 {
+	var n int64
+	for _, entry := range c {
+		if entry.Field == field && (field != auditFieldTag || entry.NewValue.Valid == added) {
+			n++
+		}
+	}
+	return n
+}
+
+// writeAudited runs fn in a DbRw transaction and records the changes that fn collects in the audit log.
+// The audit log is in LocalDb, so it's written after the commit; failing to write it is logged but doesn't fail the request.
+func (app *App) writeAudited(ctx context.Context, r *http.Request, fn func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error) (auditChanges, error) {
+	return app.writeAuditedAs(ctx, clientAddr(r), false, fn)
+}
+
+// writeAuditedAs is writeAudited for writes that don't come from a request, such as command line imports.
+// With dryRun, the transaction is rolled back, and the changes are only returned.
+func (app *App) writeAuditedAs(ctx context.Context, client string, dryRun bool, fn func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error) (auditChanges, error) {
+	var changes auditChanges
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		tx, err := app.DbRw.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(ctx, tx, &changes); err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+		return tx.Commit()
+	})
+	if err != nil || dryRun {
+		return changes, err
+	}
+	if err := app.recordAudit(ctx, client, changes); err != nil {
+		log.Printf("unable to record audit log: %v", err)
+	}
+	app.publishRatingEvents(changes)
+	return changes, nil
+}
+
+func (app *App) recordAudit(ctx context.Context, client string, changes auditChanges) error {
+	if app.LocalDb == nil || len(changes) == 0 {
+		return nil
+	}
+	return app.withSQL(ctx, func(ctx context.Context) error {
+		tx, err := app.LocalDb.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := recordAuditTx(ctx, tx, client, changes); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// recordAuditTx records changes in a LocalDb transaction, so writes to LocalDb's own data are recorded along with them
+func recordAuditTx(ctx context.Context, tx *sql.Tx, client string, changes auditChanges) error {
+	// The entries are filled in place, so callers can report them
+	for i := range changes {
+		c := &changes[i]
+		c.ClientAddr = client
+		c.HrefEntity = entityHref(c.EntityType, c.RipperHost, c.EntityKey)
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO audit_log (entity_type, entity_id, ripper_host, entity_key, field, old_value, new_value, client_addr, undo_of)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			RETURNING audit_id, ts
+		`, c.EntityType, c.EntityId, c.RipperHost, c.EntityKey, c.Field, c.OldValue.NullString, c.NewValue.NullString, client, c.UndoOf.NullInt64).Scan(&c.AuditId, &c.Ts); err != nil {
+			return err
+		}
+		if c.UndoOf.Valid {
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE audit_log
+				   SET undone_ts = UNIXEPOCH('subsec') * 1000
+				 WHERE audit_id = ?
+			`, c.UndoOf.Int64); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clientAddr returns the IP address of the client, without the port
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lookupFileEntity finds a file. An empty ripperHost matches any ripper. Returns sql.ErrNoRows if not found.
+func lookupFileEntity(ctx context.Context, tx *sql.Tx, ripperHost string, fileId int64) (auditEntity, error) {
+	e := auditEntity{Type: auditEntityFile, Key: strconv.FormatInt(fileId, 10)}
+	err := tx.QueryRowContext(ctx, `
+		SELECT rf.remote_file_id
+		     , r.host
+		  FROM remote_file rf
+		  JOIN ripper r ON r.ripper_id = rf.ripper_id
+		 WHERE rf.remote_file_id = ?
+		   AND (? = '' OR r.host = ?)
+	`, fileId, ripperHost, ripperHost).Scan(&e.Id, &e.RipperHost)
+	return e, err
+}
+
+// lookupGalleryEntity finds a gallery. Returns sql.ErrNoRows if not found.
+func lookupGalleryEntity(ctx context.Context, tx *sql.Tx, ripperHost string, gid string) (auditEntity, error) {
+	e := auditEntity{Type: auditEntityGallery, RipperHost: ripperHost, Key: gid}
+	err := tx.QueryRowContext(ctx, `
+		SELECT a.album_id
+		  FROM album a
+		  JOIN ripper r ON r.ripper_id = a.ripper_id
+		 WHERE a.gid = ?
+		   AND r.host = ?
+	`, gid, ripperHost).Scan(&e.Id)
+	return e, err
+}
+
+// lookupEntity finds the file or gallery of an audit log entry
+func lookupEntity(ctx context.Context, tx *sql.Tx, entry types.HistoryEntry) (auditEntity, error) {
+	if entry.EntityType == auditEntityGallery {
+		return lookupGalleryEntity(ctx, tx, entry.RipperHost, entry.EntityKey)
+	}
+	return lookupFileEntity(ctx, tx, entry.RipperHost, entry.EntityId)
+}
+
+// parseRating reads the rating form field: 1-5 to set, "unset" to clear, empty to leave alone
+func parseRating(value string) (set bool, rating sql.NullInt64, err error) {
+	if value == "" {
+		return false, rating, nil
+	}
+	if value == "unset" {
+		return true, rating, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > 5 {
+		return false, rating, fmt.Errorf(`invalid rating, must be 1-5 or "unset"`)
+	}
+	return true, sql.NullInt64{Int64: int64(n), Valid: true}, nil
+}
+
+func ratingString(rating sql.NullInt64) sql.NullString {
+	if !rating.Valid {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strconv.FormatInt(rating.Int64, 10), Valid: true}
+}
+
+// setRatingTx sets the local rating of a file or gallery, recording the change if the rating differs
+func setRatingTx(ctx context.Context, tx *sql.Tx, e auditEntity, rating sql.NullInt64, changes *auditChanges) error {
+	table, idColumn := e.table()
+	var old sql.NullInt64
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT local_rating
+		  FROM %s
+		 WHERE %s = ?
+	`, table, idColumn), e.Id).Scan(&old); err != nil {
+		return err
+	}
+	if old == rating {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s
+		   SET local_rating = ?
+		 WHERE %s = ?
+	`, table, idColumn), rating, e.Id); err != nil {
+		return err
+	}
+	changes.add(e.change(auditFieldRating, ratingString(old), ratingString(rating)))
+	return nil
+}
+
+// setFileIgnoredTx sets the ignored flag of a file, recording the change if the flag differs
+func setFileIgnoredTx(ctx context.Context, tx *sql.Tx, e auditEntity, ignored bool, changes *auditChanges) error {
+	var old bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT ignored
+		  FROM remote_file
+		 WHERE remote_file_id = ?
+	`, e.Id).Scan(&old); err != nil {
+		return err
+	}
+	if old == ignored {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE remote_file
+		   SET ignored = ?
+		 WHERE remote_file_id = ?
+	`, ignored, e.Id); err != nil {
+		return err
+	}
+	changes.add(e.change(auditFieldIgnored, boolString(old), boolString(ignored)))
+	return nil
+}
+
+func boolString(b bool) sql.NullString {
+	if b {
+		return sql.NullString{String: "1", Valid: true}
+	}
+	return sql.NullString{String: "0", Valid: true}
+}
+
+// undoTx reverts one audit log entry, provided the value is still what the entry set it to.
+// It returns false if the entry can't be undone.
+func undoTx(ctx context.Context, tx *sql.Tx, entry types.HistoryEntry, changes *auditChanges) (bool, error) {
+	e, err := lookupEntity(ctx, tx, entry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	before := len(*changes)
+	switch entry.Field {
+	case auditFieldRating:
+		table, idColumn := e.table()
+		var current sql.NullInt64
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT local_rating
+			  FROM %s
+			 WHERE %s = ?
+		`, table, idColumn), e.Id).Scan(&current); err != nil {
+			return false, err
+		}
+		if ratingString(current) != entry.NewValue.NullString {
+			return false, nil
+		}
+		_, old, err := parseRating(entry.OldValue.String)
+		if err != nil {
+			return false, err
+		}
+		if err := setRatingTx(ctx, tx, e, old, changes); err != nil {
+			return false, err
+		}
+	case auditFieldIgnored:
+		var current bool
+		if err := tx.QueryRowContext(ctx, `
+			SELECT ignored
+			  FROM remote_file
+			 WHERE remote_file_id = ?
+		`, e.Id).Scan(&current); err != nil {
+			return false, err
+		}
+		if boolString(current) != entry.NewValue.NullString {
+			return false, nil
+		}
+		if err := setFileIgnoredTx(ctx, tx, e, entry.OldValue.String == "1", changes); err != nil {
+			return false, err
+		}
+	case auditFieldTag:
+		if entry.NewValue.Valid {
+			err = editLocalTagsTx(ctx, tx, e, nil, []string{entry.NewValue.String}, changes)
+		} else {
+			err = editLocalTagsTx(ctx, tx, e, []string{entry.OldValue.String}, nil, changes)
+		}
+		if err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unknown audit log field %q", entry.Field)
+	}
+	return markUndo(entry, *changes, before), nil
+}
+
+// isLocalAuditField reports whether an audit log field is stored in LocalDb, and is undone by undoLocalTx rather than undoTx
+func isLocalAuditField(field string) bool {
+	return field == auditFieldTitle || field == auditFieldNotes || field == auditFieldCover
+}
+
+// undoLocalTx is undoTx for the fields stored in LocalDb, in a LocalDb transaction.
+// The entity isn't looked up, as LocalDb keys them by the RipMe id that the entry has.
+func undoLocalTx(ctx context.Context, tx *sql.Tx, entry types.HistoryEntry, changes *auditChanges) (bool, error) {
+	e := auditEntity{Type: entry.EntityType, Id: entry.EntityId, RipperHost: entry.RipperHost, Key: entry.EntityKey}
+
+	before := len(*changes)
+	switch entry.Field {
+	case auditFieldTitle, auditFieldNotes:
+		t := e.metaTable()
+		title, notes, err := getLocalMetaTx(ctx, tx, t, e.Id)
+		if err != nil {
+			return false, err
+		}
+		current, old := title, entry.OldValue.String
+		if entry.Field == auditFieldNotes {
+			current = notes
+		}
+		if metaString(current) != entry.NewValue.NullString {
+			return false, nil
+		}
+		if entry.Field == auditFieldTitle {
+			err = setLocalMetaTx(ctx, tx, t, e, &old, nil, changes)
+		} else {
+			err = setLocalMetaTx(ctx, tx, t, e, nil, &old, changes)
+		}
+		if err != nil {
+			return false, err
+		}
+	case auditFieldCover:
+		current, err := getGalleryCoverTx(ctx, tx, e.Id)
+		if err != nil {
+			return false, err
+		}
+		if coverString(current) != entry.NewValue.NullString {
+			return false, nil
+		}
+		var old sql.NullInt64
+		if entry.OldValue.Valid {
+			if old.Int64, err = strconv.ParseInt(entry.OldValue.String, 10, 64); err != nil {
+				return false, err
+			}
+			old.Valid = true
+		}
+		if err := setGalleryCoverTx(ctx, tx, e, old, changes); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unknown audit log field %q", entry.Field)
+	}
+	return markUndo(entry, *changes, before), nil
+}
+
+// markUndo marks the changes from before on as undoing entry, and reports whether there were any
+func markUndo(entry types.HistoryEntry, changes auditChanges, before int) bool {
+	if len(changes) == before {
+		// Nothing to revert, e.g. the tag was already removed again
+		return false
+	}
+	for i := before; i < len(changes); i++ {
+		changes[i].UndoOf = types.SqlJsonInt64{NullInt64: sql.NullInt64{Int64: entry.AuditId, Valid: true}}
+	}
+	return true
+}
+
+const historyColumns = `
+	audit_id
+	, ts
+	, entity_type
+	, entity_id
+	, ripper_host
+	, entity_key
+	, field
+	, old_value
+	, new_value
+	, client_addr
+	, undo_of
+	, undone_ts
+`
+
+func scanHistoryEntry(rows interface{ Scan(dest ...any) error }) (types.HistoryEntry, error) {
+	var h types.HistoryEntry
+	err := rows.Scan(&h.AuditId, &h.Ts, &h.EntityType, &h.EntityId, &h.RipperHost, &h.EntityKey, &h.Field, &h.OldValue, &h.NewValue, &h.ClientAddr, &h.UndoOf, &h.UndoneTs)
+	h.HrefEntity = entityHref(h.EntityType, h.RipperHost, h.EntityKey)
+	return h, err
+}
+
+func entityHref(entityType string, ripperHost string, key string) string {
+	if entityType == auditEntityGallery {
+		return fmt.Sprintf("/gallery/%s/%s", ripperHost, key)
+	}
+	return fmt.Sprintf("/file/%s/%s", ripperHost, key)
+}
+
+// getHistoryEntries reads audit log entries from LocalDb with a query that selects historyColumns
+func (app *App) getHistoryEntries(ctx context.Context, query string, args ...any) ([]types.HistoryEntry, error) {
+	var entries []types.HistoryEntry
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			h, err := scanHistoryEntry(rows)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, h)
+		}
+		return rows.Err()
+	})
+	return entries, err
+}
+
+// handleHistory handles /history
+func (app *App) handleHistory(w http.ResponseWriter, r *http.Request) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		page, size := getPageParams(w, r, r.URL)
+		offset := (page - 1) * size
+		model := types.HistoryPage{
+			Page:      page,
+			PageSize:  size,
+			Available: app.LocalDb != nil,
+			ReadOnly:  app.DbRw == nil,
+			BasePage:  &types.BasePage{Perf: perf},
+		}
+		if app.LocalDb != nil {
+			if err := app.withSQL(ctx, func(ctx context.Context) error {
+				return app.LocalDb.QueryRowContext(ctx, `
+					SELECT COUNT(*)
+					  FROM audit_log
+				`).Scan(&model.Total)
+			}); err != nil {
+				return err
+			}
+			entries, err := app.getHistoryEntries(ctx, `
+				SELECT `+historyColumns+`
+				  FROM audit_log
+				 ORDER BY audit_id DESC
+				 LIMIT ? OFFSET ?
+			`, size, offset)
+			if err != nil {
+				return err
+			}
+			model.Entries = entries
+		}
+		model.HasPrev = page > 1
+		model.HasNext = offset+len(model.Entries) < model.Total
+		app.render(ctx, w, "history.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleHistoryUndo handles POST /history/{audit_id}/undo
+func (app *App) handleHistoryUndo(w http.ResponseWriter, r *http.Request) {
+	auditId, err := strconv.ParseInt(r.PathValue("audit_id"), 10, 64)
+	if err != nil || auditId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid history entry id"))
+		return
+	}
+	app.undoHistory(w, r, `
+		SELECT `+historyColumns+`
+		  FROM audit_log
+		 WHERE audit_id = ?
+	`, auditId)
+}
+
+const maxUndoLast = 1000
+
+// handleHistoryUndoLast handles POST /history/undo, which undoes the last n changes that aren't undone yet
+func (app *App) handleHistoryUndoLast(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n < 1 || n > maxUndoLast {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid n, must be 1-%d", maxUndoLast))
+		return
+	}
+	// Undo entries are skipped, so undoing the last n twice goes further back instead of redoing
+	app.undoHistory(w, r, `
+		SELECT `+historyColumns+`
+		  FROM audit_log
+		 WHERE undone_ts IS NULL
+		   AND undo_of IS NULL
+		 ORDER BY audit_id DESC
+		 LIMIT ?
+	`, n)
+}
+
+// undoHistory undoes the audit log entries selected by query, newest first, in one transaction
+func (app *App) undoHistory(w http.ResponseWriter, r *http.Request, query string, args ...any) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("localgal database is unavailable, history can't be used"))
+		return
+	}
+	if app.DbRw == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusForbidden, errReadOnly{fmt.Errorf("database is read-only, cannot undo")})
+		return
+	}
+	model := types.UndoResultPage{}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		entries, err := app.getHistoryEntries(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return sql.ErrNoRows
+		}
+		app.bustCache(w)
+		// The fields in LocalDb are undone in a second transaction, once the RipMe one is committed
+		var local []types.HistoryEntry
+		changes, err := app.writeAudited(ctx, r, func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error {
+			for _, entry := range entries {
+				if entry.UndoneTs.Valid {
+					model.Skipped++
+					continue
+				}
+				if isLocalAuditField(entry.Field) {
+					local = append(local, entry)
+					continue
+				}
+				ok, err := undoTx(ctx, tx, entry, changes)
+				if err != nil {
+					return err
+				}
+				if ok {
+					model.Undone++
+				} else {
+					model.Skipped++
+				}
+			}
+			return nil
+		})
+		model.Changes = changes
+		if err != nil || len(local) == 0 {
+			return err
+		}
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			tx, err := app.LocalDb.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			var changes auditChanges
+			for _, entry := range local {
+				ok, err := undoLocalTx(ctx, tx, entry, &changes)
+				if err != nil {
+					return err
+				}
+				if ok {
+					model.Undone++
+				} else {
+					model.Skipped++
+				}
+			}
+			if err := recordAuditTx(ctx, tx, clientAddr(r), changes); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			model.Changes = append(model.Changes, changes...)
+			return nil
+		})
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+
+	if getRenderMode(r.Context()) == RenderJSON {
+		model.BasePage = &types.BasePage{Perf: &p}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, withChanged(postRedirectTarget(r, "/history"), int64(len(model.Changes))), http.StatusSeeOther)
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single shared secret guards LocalGal when it's reachable from other machines. There are no user accounts.
+// Browsers log in once and get a signed session cookie; API clients send the secret as a bearer token.
+// The LocalGal database stores a hash of the secret, never the secret itself.
+
+const (
+	settingAuthSecretHash = "auth_secret_hash"
+	settingAuthSessionKey = "auth_session_key"
+	sessionCookieName     = "session"
+	sessionMaxAge         = 30 * 24 * time.Hour
+	mediaTokenMaxAge      = 7 * 24 * time.Hour // of the tokens in playlist entries
+	authHashIterations    = 600_000
+
+	authFreeFailures   = 5               // failed attempts from an address before it has to wait between attempts
+	authMaxBackoff     = 5 * time.Minute // the longest wait, doubling from a second after each failure
+	authHashSlots      = 2               // slow hashes run at once, however many clients try
+	authMaxRejected    = 1024            // wrong secrets remembered, so trying one again skips the slow hash
+	authMaxFailedAddrs = 4096            // addresses with failed attempts remembered
+)
+
+type auth struct {
+	secretHash string // see hashAuthSecret
+	sessionKey []byte // signs session cookies; replaced along with the secret, which logs everyone out
+	loopback   bool   // let loopback clients in without the secret
+	mu         sync.Mutex
+	verified   [sha256.Size]byte // digest of the last secret that matched secretHash, so bearer tokens skip the slow hash
+	rejected   map[[sha256.Size]byte]struct{}
+	failures   map[string]*authFailures // by client address
+	hashSlots  chan struct{}
+}
+
+// authFailures are the recent failed attempts of a client address
+type authFailures struct {
+	count int
+	last  time.Time
+	until time.Time // attempts before this aren't checked
+}
+
+// loadAuth returns the authentication of the server, or nil when no shared secret is set.
+// A non-empty secret replaces the stored one. An empty secret keeps the stored one, if any.
+func loadAuth(ctx context.Context, db *sql.DB, secret string, loopback bool) (*auth, error) {
+	a := &auth{loopback: loopback, rejected: make(map[[sha256.Size]byte]struct{}), failures: make(map[string]*authFailures), hashSlots: make(chan struct{}, authHashSlots)}
+	if db != nil {
+		var key string
+		if err := db.QueryRowContext(ctx, "SELECT value FROM setting WHERE name = ?", settingAuthSecretHash).Scan(&a.secretHash); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("unable to load the shared secret: %w", err)
+		}
+		if err := db.QueryRowContext(ctx, "SELECT value FROM setting WHERE name = ?", settingAuthSessionKey).Scan(&key); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("unable to load the session key: %w", err)
+		}
+		a.sessionKey, _ = base64.RawStdEncoding.DecodeString(key)
+	}
+
+	if secret != "" && (a.secretHash == "" || !a.check(secret)) {
+		hash, err := hashAuthSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		a.secretHash = hash
+		a.verified = sha256.Sum256([]byte(secret))
+		a.sessionKey = nil
+		if db == nil {
+			log.Printf("The shared secret won't be remembered without the LocalGal database")
+		} else {
+			a.sessionKey = randomSessionKey()
+			if err := saveAuthSettings(ctx, db, a); err != nil {
+				return nil, err
+			}
+			log.Printf("Saved the new shared secret; existing sessions are logged out")
+		}
+	}
+	if a.secretHash == "" {
+		return nil, nil
+	}
+	if len(a.sessionKey) == 0 {
+		// Sessions last until restart
+		a.sessionKey = randomSessionKey()
+	}
+	return a, nil
+}
+
+func saveAuthSettings(ctx context.Context, db *sql.DB, a *auth) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	const upsert = `INSERT INTO setting (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value, updated_ts = UNIXEPOCH('subsec') * 1000`
+	if _, err := tx.ExecContext(ctx, upsert, settingAuthSecretHash, a.secretHash); err != nil {
+		return fmt.Errorf("unable to save the shared secret: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, upsert, settingAuthSessionKey, base64.RawStdEncoding.EncodeToString(a.sessionKey)); err != nil {
+		return fmt.Errorf("unable to save the session key: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ClearAuthSecret removes the stored shared secret, so the server no longer requires one unless it's set again
+func ClearAuthSecret(ctx context.Context, cfg Config) error {
+	localDsn := DsnWithDefaultTimeout(cfg.LocalDsn)
+	localDsn = DsnWithForeignKeys(localDsn)
+	db, err := GetLocalDb(ctx, localDsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM setting WHERE name IN (?, ?)", settingAuthSecretHash, settingAuthSessionKey)
+	return err
+}
+
+func randomSessionKey() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key) // never returns an error
+	return key
+}
+
+// hashAuthSecret returns "pbkdf2-sha256$<iterations>$<salt>$<key>", with base64 salt and key
+func hashAuthSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	_, _ = rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, secret, salt, authHashIterations, sha256.Size)
+	if err != nil {
+		return "", fmt.Errorf("unable to hash the shared secret: %w", err)
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", authHashIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func checkAuthSecretHash(secret string, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, secret, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// check reports whether secret is the shared secret
+func (a *auth) check(secret string) bool {
+	if secret == "" {
+		return false
+	}
+	digest := sha256.Sum256([]byte(secret))
+	a.mu.Lock()
+	verified := a.verified
+	a.mu.Unlock()
+	if verified != [sha256.Size]byte{} && subtle.ConstantTimeCompare(digest[:], verified[:]) == 1 {
+		return true
+	}
+	a.mu.Lock()
+	_, rejected := a.rejected[digest]
+	a.mu.Unlock()
+	if rejected {
+		return false
+	}
+	a.hashSlots <- struct{}{}
+	ok := checkAuthSecretHash(secret, a.secretHash)
+	<-a.hashSlots
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !ok {
+		if len(a.rejected) >= authMaxRejected {
+			clear(a.rejected)
+		}
+		a.rejected[digest] = struct{}{}
+		return false
+	}
+	a.verified = digest
+	return true
+}
+
+// checkFrom is check for a client address. After authFreeFailures failed attempts, the address has to wait before
+// each further attempt, twice as long each time; until then its attempts fail without a check, returning the wait.
+func (a *auth) checkFrom(addr string, secret string, now time.Time) (bool, time.Duration) {
+	a.mu.Lock()
+	if f := a.failures[addr]; f != nil && now.Before(f.until) {
+		a.mu.Unlock()
+		return false, f.until.Sub(now)
+	}
+	a.mu.Unlock()
+	ok := a.check(secret)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ok {
+		delete(a.failures, addr)
+		return true, 0
+	}
+	f := a.failures[addr]
+	if f == nil || now.Sub(f.last) > 2*authMaxBackoff {
+		if len(a.failures) >= authMaxFailedAddrs {
+			for k, old := range a.failures {
+				if now.Sub(old.last) > 2*authMaxBackoff {
+					delete(a.failures, k)
+				}
+			}
+		}
+		f = &authFailures{}
+		a.failures[addr] = f
+	}
+	f.count++
+	f.last = now
+	if n := f.count - authFreeFailures; n > 0 {
+		f.until = now.Add(min(time.Second<<min(n-1, 16), authMaxBackoff))
+	}
+	return false, 0
+}
+
+// newSession returns the value of a session cookie, "<expiry>.<signature>", expiry in Unix seconds
+func (a *auth) newSession(now time.Time) string {
+	expiry := strconv.FormatInt(now.Add(sessionMaxAge).Unix(), 10)
+	return expiry + "." + a.sign("session", expiry)
+}
+
+func (a *auth) validSession(value string, now time.Time) bool {
+	return a.validSigned("session", value, "", now)
+}
+
+// newMediaToken returns a token that lets a request for the media path p in without a session, for players that
+// can't log in. It's "<expiry>.<signature>" like a session, and only good for p.
+func (a *auth) newMediaToken(p string, now time.Time) string {
+	expiry := strconv.FormatInt(now.Add(mediaTokenMaxAge).Unix(), 10)
+	return expiry + "." + a.sign("media", expiry+":"+p)
+}
+
+func (a *auth) validMediaToken(p string, token string, now time.Time) bool {
+	return a.validSigned("media", token, ":"+p, now)
+}
+
+// validSigned reports whether value is an unexpired "<expiry>.<signature>", signed for purpose over the expiry
+// followed by suffix
+func (a *auth) validSigned(purpose string, value string, suffix string, now time.Time) bool {
+	expiry, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	n, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() >= n {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(a.sign(purpose, expiry+suffix)))
+}
+
+func (a *auth) sign(purpose string, value string) string {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write([]byte(purpose + ":" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isAuthenticated reports whether r may be served: a loopback client, if they're let in, a valid session cookie,
+// for media, a media token of its path, or, for the API, the shared secret as a bearer token. wait is how long a client with too many wrong tokens has to wait.
+func (app *App) isAuthenticated(r *http.Request) (ok bool, wait time.Duration) {
+	a := app.auth
+	if a.loopback && isLoopbackAddr(r.RemoteAddr) {
+		return true, 0
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil && a.validSession(c.Value, time.Now()) {
+		return true, 0
+	}
+	if strings.HasPrefix(r.URL.Path, "/media/") && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if token := r.URL.Query().Get("token"); token != "" && a.validMediaToken(r.URL.Path, token, time.Now()) {
+			return true, 0
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			return a.checkFrom(clientAddr(r), strings.TrimSpace(token), time.Now())
+		}
+	}
+	return false, 0
+}
+
+// isAuthExempt reports whether r is served without authentication: the login page, static files, health checks,
+// and CORS preflights, which never carry credentials
+func isAuthExempt(r *http.Request) bool {
+	return r.Method == http.MethodOptions ||
+		r.URL.Path == "/login" ||
+		r.URL.Path == "/healthz" ||
+		strings.HasPrefix(r.URL.Path, "/static/")
+}
+
+// withAuth requires the shared secret, when one is set. Pages redirect to the login page; the API answers 401.
+func (app *App) withAuth(next http.Handler) http.Handler {
+	if app.auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAuthExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := app.isAuthenticated(r)
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="LocalGal"`)
+			r = withRenderMode(r, RenderJSON)
+			if wait > 0 {
+				w.Header().Set("Retry-After", retryAfter(wait))
+				app.renderError(r.Context(), w, &types.Perf{}, http.StatusUnauthorized, errUnauthorized{fmt.Errorf("too many wrong secrets, try again in %s seconds", retryAfter(wait))})
+				return
+			}
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusUnauthorized, errUnauthorized{errors.New("log in, or send the shared secret as a bearer token")})
+			return
+		}
+		target := "/login"
+		// A write can't be repeated after logging in, so only come back to pages
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			target += "?next=" + url.QueryEscape(r.URL.RequestURI())
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+	})
+}
+
+func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if app.auth == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	app.renderLogin(w, r, http.StatusOK, types.LoginPage{Next: loginNext(r.URL.Query().Get("next"))})
+}
+
+func (app *App) handleLoginPost(w http.ResponseWriter, r *http.Request) {
+	if app.auth == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	next := loginNext(r.PostForm.Get("next"))
+	ok, wait := app.auth.checkFrom(clientAddr(r), r.PostForm.Get("secret"), time.Now())
+	if wait > 0 {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		app.renderLogin(w, r, http.StatusTooManyRequests, types.LoginPage{Next: next, Message: fmt.Sprintf("Too many wrong secrets, try again in %s seconds", retryAfter(wait))})
+		return
+	}
+	if !ok {
+		log.Printf("Failed login from %s", r.RemoteAddr)
+		app.renderLogin(w, r, http.StatusUnauthorized, types.LoginPage{Next: next, Message: "Wrong secret"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    app.auth.newSession(time.Now()),
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	newCSRFToken(w, r)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// retryAfter is a wait in whole seconds, rounded up, for the Retry-After header
+func retryAfter(wait time.Duration) string {
+	return strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10)
+}
+
+// handleLogout logs out, and goes to the login page, which comes back to the page of the form after logging in again
+func (app *App) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	target := "/login"
+	if next := postRedirectTarget(r, ""); next != "" {
+		target += "?next=" + url.QueryEscape(next)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func (app *App) renderLogin(w http.ResponseWriter, r *http.Request, status int, page types.LoginPage) {
+	page.BasePage = &types.BasePage{Perf: &types.Perf{}, CSRFToken: csrfToken(w, r), CSPNonce: cspNonce(r.Context())}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = app.Tpl.ExecuteTemplate(w, "login.gohtml", page)
+}
+
+// loginNext returns the local page to go to after logging in, or / when next isn't one
+func loginNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") || strings.HasPrefix(next, "/login") {
+		return "/"
+	}
+	return next
+}
+
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLoopbackBind reports whether a listen address only accepts loopback clients
+func isLoopbackBind(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	return err == nil && host != "" && isLoopbackAddr(host)
+}
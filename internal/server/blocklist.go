@@ -0,0 +1,559 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The blocklist hides tags, uploaders, ripper hosts, and galleries from every listing, search, count, and random pick,
+// unless a request asks for ?unblock=1. It is stored in LocalDb, so the RipMe database isn't changed.
+// Queries exclude blocked entities with the clauses of gallerySQL, fileSQL, and tagSQL, which are empty when nothing
+// is blocked, so the blocklist costs nothing until it's used.
+
+type blocklistKey struct{}
+
+// blocklist is the blocklist of a request. A nil blocklist blocks nothing.
+type blocklist struct {
+	tags      []string    // blocked tag names, with the aliases and implying tags of each
+	uploaders [][2]string // ripper host, uploader
+	hosts     []string
+	galleries []int64 // album ids
+}
+
+// getBlocklist returns the blocklist of the request, or nil if there is none or the request has ?unblock=1
+func getBlocklist(ctx context.Context) *blocklist {
+	b, _ := ctx.Value(blocklistKey{}).(*blocklist)
+	return b
+}
+
+// withBlocklist loads the blocklist for the request, see getBlocklist
+func (app *App) withBlocklist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.LocalDb == nil || r.URL.Query().Get("unblock") == "1" ||
+			strings.HasPrefix(r.URL.Path, "/media/") || strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		b, err := app.loadBlocklist(r.Context())
+		if err != nil {
+			log.Printf("unable to load blocklist: %v", err)
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusInternalServerError, err)
+			return
+		}
+		if b != nil {
+			r = r.WithContext(context.WithValue(r.Context(), blocklistKey{}, b))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadBlocklist reads the blocklist from LocalDb, or returns nil if it's empty
+func (app *App) loadBlocklist(ctx context.Context) (*blocklist, error) {
+	var tags, uploaders, hosts, galleries string
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, `
+			SELECT (SELECT COALESCE(json_group_array(name), '[]') FROM blocked_tag)
+			     , (SELECT COALESCE(json_group_array(json_array(ripper_host, uploader)), '[]') FROM blocked_uploader)
+			     , (SELECT COALESCE(json_group_array(ripper_host), '[]') FROM blocked_host)
+			     , (SELECT COALESCE(json_group_array(album_id), '[]') FROM blocked_gallery)
+		`).Scan(&tags, &uploaders, &hosts, &galleries)
+	}); err != nil {
+		return nil, err
+	}
+	var b blocklist
+	for _, v := range []struct {
+		json string
+		dst  any
+	}{{tags, &b.tags}, {uploaders, &b.uploaders}, {hosts, &b.hosts}, {galleries, &b.galleries}} {
+		if err := json.Unmarshal([]byte(v.json), v.dst); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.tags) == 0 && len(b.uploaders) == 0 && len(b.hosts) == 0 && len(b.galleries) == 0 {
+		return nil, nil
+	}
+	if len(b.tags) > 0 {
+		// Everything that counts as a blocked tag is blocked too
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range b.tags {
+			for _, m := range rel.members(name) {
+				if !slices.Contains(names, m) {
+					names = append(names, m)
+				}
+			}
+		}
+		b.tags = names
+	}
+	return &b, nil
+}
+
+// key identifies the blocklist in cache keys, so that changing it doesn't leave stale counts
+func (b *blocklist) key() string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprint(*b)
+}
+
+// galleryBlocked returns the condition that the gallery of album alias a is blocked, or "" if galleries aren't blocked.
+// Never pass user input into a. The conditions are never NULL, so that NOT excludes exactly the blocked rows.
+func (b *blocklist) galleryBlocked(a string, hosts bool) (string, []any) {
+	if b == nil {
+		return "", nil
+	}
+	var conds []string
+	var args []any
+	if hosts && len(b.hosts) > 0 {
+		conds = append(conds, a+`.ripper_id IN (SELECT bl_r.ripper_id FROM ripper bl_r WHERE bl_r.host IN (SELECT value FROM json_each(?)))`)
+		args = append(args, jsonArray(b.hosts))
+	}
+	if len(b.galleries) > 0 {
+		conds = append(conds, a+`.album_id IN (SELECT value FROM json_each(?))`)
+		args = append(args, jsonArray(b.galleries))
+	}
+	if len(b.uploaders) > 0 {
+		conds = append(conds, `(`+a+`.ripper_id, IFNULL(`+a+`.uploader, '')) IN (
+			SELECT bl_r.ripper_id, json_extract(bl_j.value, '$[1]')
+			  FROM json_each(?) bl_j
+			  JOIN ripper bl_r ON bl_r.host = json_extract(bl_j.value, '$[0]'))`)
+		args = append(args, jsonArray(b.uploaders))
+	}
+	if len(b.tags) > 0 {
+		conds = append(conds, a+`.album_id IN (
+			SELECT bl_mat.album_id
+			  FROM map_album_tag bl_mat
+			  JOIN tag bl_t ON bl_t.tag_id = bl_mat.tag_id
+			 WHERE bl_t.name IN (SELECT value FROM json_each(?)))`)
+		args = append(args, jsonArray(b.tags))
+	}
+	return strings.Join(conds, " OR "), args
+}
+
+// gallerySQL returns a clause excluding blocked galleries for album alias a, e.g. "a". Never pass user input into a.
+// Returns ("", nil) when nothing is blocked.
+func (b *blocklist) gallerySQL(a string) (string, []any) {
+	cond, args := b.galleryBlocked(a, true)
+	if cond == "" {
+		return "", nil
+	}
+	return "AND NOT (" + cond + ")", args
+}
+
+// fileSQL returns a clause excluding blocked files for remote_file alias rf, e.g. "rf". Never pass user input into rf.
+// A file is blocked by its own ripper host, uploader, and tags, and by every gallery it's in.
+// Returns ("", nil) when nothing is blocked.
+func (b *blocklist) fileSQL(rf string) (string, []any) {
+	if b == nil {
+		return "", nil
+	}
+	var conds []string
+	var args []any
+	if len(b.hosts) > 0 {
+		conds = append(conds, rf+`.ripper_id IN (SELECT bl_r.ripper_id FROM ripper bl_r WHERE bl_r.host IN (SELECT value FROM json_each(?)))`)
+		args = append(args, jsonArray(b.hosts))
+	}
+	if len(b.uploaders) > 0 {
+		conds = append(conds, `(`+rf+`.ripper_id, IFNULL(`+rf+`.uploader, '')) IN (
+			SELECT bl_r.ripper_id, json_extract(bl_j.value, '$[1]')
+			  FROM json_each(?) bl_j
+			  JOIN ripper bl_r ON bl_r.host = json_extract(bl_j.value, '$[0]'))`)
+		args = append(args, jsonArray(b.uploaders))
+	}
+	if len(b.tags) > 0 {
+		conds = append(conds, rf+`.remote_file_id IN (
+			SELECT bl_mrft.remote_file_id
+			  FROM map_remote_file_tag bl_mrft
+			  JOIN tag bl_t ON bl_t.tag_id = bl_mrft.tag_id
+			 WHERE bl_t.name IN (SELECT value FROM json_each(?)))`)
+		args = append(args, jsonArray(b.tags))
+	}
+	// The gallery's ripper host is the file's, so hosts were checked above
+	if galleryCond, galleryArgs := b.galleryBlocked("bl_a", false); galleryCond != "" {
+		conds = append(conds, rf+`.remote_file_id IN (
+			SELECT bl_marf.remote_file_id
+			  FROM map_album_remote_file bl_marf
+			  JOIN album bl_a ON bl_a.album_id = bl_marf.album_id
+			 WHERE `+galleryCond+`)`)
+		args = append(args, galleryArgs...)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "AND NOT (" + strings.Join(conds, " OR ") + ")", args
+}
+
+// tagSQL returns a clause excluding blocked tags for tag name column name, e.g. "t.name". Never pass user input into name.
+// Returns ("", nil) when no tags are blocked.
+func (b *blocklist) tagSQL(name string) (string, []any) {
+	if b == nil || len(b.tags) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("AND %s NOT IN (SELECT value FROM json_each(?))", name), []any{jsonArray(b.tags)}
+}
+
+// blocksTag reports whether name is blocked
+func (b *blocklist) blocksTag(name string) bool {
+	return b != nil && slices.Contains(b.tags, name)
+}
+
+// blocksUploader reports whether the uploader of ripperHost, or ripperHost itself, is blocked
+func (b *blocklist) blocksUploader(ripperHost string, uploader string) bool {
+	return b != nil && (slices.Contains(b.hosts, ripperHost) || slices.Contains(b.uploaders, [2]string{ripperHost, uploader}))
+}
+
+// errBlocked is returned for the page of a blocked gallery, file, tag, or uploader
+func errBlocked(what string) error {
+	return errNotFound{fmt.Errorf("%s is blocked; add ?unblock=1 to the address to see it", what)}
+}
+
+// checkGalleryBlocked returns errBlocked if the gallery is blocked
+func (app *App) checkGalleryBlocked(ctx context.Context, albumId int64) error {
+	clause, args := getBlocklist(ctx).gallerySQL("a")
+	if clause == "" {
+		return nil
+	}
+	var blocked bool
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT NOT EXISTS(SELECT 1 FROM album a WHERE a.album_id = ? `+clause+`)
+		`, append([]any{albumId}, args...)...).Scan(&blocked)
+	}); err != nil {
+		return err
+	}
+	if blocked {
+		return errBlocked("gallery")
+	}
+	return nil
+}
+
+// checkFileBlocked returns errBlocked if the file is blocked
+func (app *App) checkFileBlocked(ctx context.Context, fileId int64) error {
+	clause, args := getBlocklist(ctx).fileSQL("rf")
+	if clause == "" {
+		return nil
+	}
+	var blocked bool
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT NOT EXISTS(SELECT 1 FROM remote_file rf WHERE rf.remote_file_id = ? `+clause+`)
+		`, append([]any{fileId}, args...)...).Scan(&blocked)
+	}); err != nil {
+		return err
+	}
+	if blocked {
+		return errBlocked("file")
+	}
+	return nil
+}
+
+// withoutBlockedGalleries removes the blocked galleries from a galleries event. Only the listed galleries are
+// checked, so the count of the rest may still include blocked ones.
+func (app *App) withoutBlockedGalleries(ctx context.Context, e types.GalleriesEvent) (types.GalleriesEvent, error) {
+	clause, args := getBlocklist(ctx).gallerySQL("a")
+	if clause == "" || len(e.Galleries) == 0 {
+		return e, nil
+	}
+	var ids []int64
+	for _, a := range e.Galleries {
+		ids = append(ids, a.AlbumId)
+	}
+	visible := map[int64]bool{}
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT a.album_id
+			  FROM album a
+			 WHERE a.album_id IN (SELECT value FROM json_each(?))
+			   `+clause+`
+		`, append([]any{jsonArray(ids)}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			visible[id] = true
+		}
+		return rows.Err()
+	}); err != nil {
+		return e, err
+	}
+	out := types.GalleriesEvent{Count: e.Count, Galleries: []types.Album{}}
+	for _, a := range e.Galleries {
+		if visible[a.AlbumId] {
+			out.Galleries = append(out.Galleries, a)
+		} else {
+			out.Count--
+		}
+	}
+	return out, nil
+}
+
+// blocklistEntry is one entry of the blocklist, as posted by the blocklist forms
+type blocklistEntry struct {
+	kind       string // tag, uploader, host, or gallery
+	tag        string
+	ripperHost string
+	uploader   string
+	gid        string
+	albumId    int64 // instead of ripper_host and gid, to unblock a gallery that is no longer in the RipMe database
+}
+
+// parseBlocklistEntry reads the kind field and the fields of that kind: tag; ripper_host and uploader; ripper_host;
+// or ripper_host and gid, or album_id
+func parseBlocklistEntry(r *http.Request) (blocklistEntry, error) {
+	e := blocklistEntry{
+		kind:       r.FormValue("kind"),
+		tag:        strings.TrimSpace(r.FormValue("tag")),
+		ripperHost: strings.TrimSpace(r.FormValue("ripper_host")),
+		uploader:   strings.TrimSpace(r.FormValue("uploader")),
+		gid:        strings.TrimSpace(r.FormValue("gid")),
+	}
+	switch e.kind {
+	case "tag":
+		if e.tag == "" {
+			return e, fmt.Errorf("expected a tag name in tag")
+		}
+		return e, checkTagName(e.tag)
+	case "uploader":
+		if e.ripperHost == "" || e.uploader == "" {
+			return e, fmt.Errorf("expected ripper_host and uploader")
+		}
+	case "host":
+		if e.ripperHost == "" {
+			return e, fmt.Errorf("expected ripper_host")
+		}
+	case "gallery":
+		if v := r.FormValue("album_id"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id <= 0 {
+				return e, fmt.Errorf("invalid album_id %q", v)
+			}
+			e.albumId = id
+		} else if e.ripperHost == "" || e.gid == "" {
+			return e, fmt.Errorf("expected ripper_host and gid, or album_id")
+		}
+	default:
+		return e, fmt.Errorf("invalid kind %q, expected tag, uploader, host, or gallery", e.kind)
+	}
+	return e, nil
+}
+
+// blocklistAlbumId returns the album id of a gallery entry
+func (app *App) blocklistAlbumId(ctx context.Context, e blocklistEntry) (int64, error) {
+	if e.albumId != 0 {
+		return e.albumId, nil
+	}
+	album, err := app.getAlbum(ctx, e.ripperHost, e.gid)
+	return album.AlbumId, err
+}
+
+// getBlocklistPage lists the blocklist, with the galleries looked up in the RipMe database
+func (app *App) getBlocklistPage(ctx context.Context, model *types.BlocklistPage) error {
+	model.Tags, model.Uploaders, model.Hosts, model.Galleries = []string{}, []types.BlockedUploader{}, []string{}, []types.BlockedGallery{}
+	var albumIds []int64
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT 'tag', name, '' FROM blocked_tag
+			 UNION ALL
+			SELECT 'uploader', ripper_host, uploader FROM blocked_uploader
+			 UNION ALL
+			SELECT 'host', ripper_host, '' FROM blocked_host
+			 UNION ALL
+			SELECT 'gallery', album_id, '' FROM blocked_gallery
+			 ORDER BY 1, 2, 3
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var kind, a, b string
+			if err := rows.Scan(&kind, &a, &b); err != nil {
+				return err
+			}
+			switch kind {
+			case "tag":
+				model.Tags = append(model.Tags, a)
+			case "uploader":
+				model.Uploaders = append(model.Uploaders, types.BlockedUploader{RipperHost: a, Uploader: b})
+			case "host":
+				model.Hosts = append(model.Hosts, a)
+			case "gallery":
+				if id, err := strconv.ParseInt(a, 10, 64); err == nil {
+					albumIds = append(albumIds, id)
+				}
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil || len(albumIds) == 0 {
+		return err
+	}
+	found := map[int64]types.BlockedGallery{}
+	err = app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT a.album_id
+			     , r.host
+			     , a.gid
+			     , a.title
+			  FROM album a
+			  JOIN ripper r ON r.ripper_id = a.ripper_id
+			 WHERE a.album_id IN (SELECT value FROM json_each(?))
+		`, jsonArray(albumIds))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var g types.BlockedGallery
+			if err := rows.Scan(&g.AlbumId, &g.RipperHost, &g.Gid, &g.Title); err != nil {
+				return err
+			}
+			found[g.AlbumId] = g
+		}
+		return rows.Err()
+	})
+	for _, id := range albumIds {
+		g, ok := found[id]
+		if !ok {
+			g = types.BlockedGallery{AlbumId: id}
+		}
+		model.Galleries = append(model.Galleries, g)
+	}
+	return err
+}
+
+// handleBlocklist handles /blocklist and /api/blocklist
+func (app *App) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		model := types.BlocklistPage{
+			Available: app.LocalDb != nil,
+			BasePage:  &types.BasePage{Perf: perf},
+		}
+		if app.LocalDb != nil {
+			if err := app.getBlocklistPage(ctx, &model); err != nil {
+				return err
+			}
+		}
+		app.render(ctx, w, "blocklist.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleBlocklistPost handles POST /blocklist and POST /api/blocklist
+func (app *App) handleBlocklistPost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save blocklist"))
+		return
+	}
+	e, err := parseBlocklistEntry(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		var query string
+		var args []any
+		switch e.kind {
+		case "tag":
+			query, args = `INSERT OR IGNORE INTO blocked_tag (name) VALUES (?)`, []any{e.tag}
+		case "uploader":
+			query, args = `INSERT OR IGNORE INTO blocked_uploader (ripper_host, uploader) VALUES (?, ?)`, []any{e.ripperHost, e.uploader}
+		case "host":
+			query, args = `INSERT OR IGNORE INTO blocked_host (ripper_host) VALUES (?)`, []any{e.ripperHost}
+		case "gallery":
+			albumId, err := app.blocklistAlbumId(ctx, e)
+			if err != nil {
+				return err
+			}
+			query, args = `INSERT OR IGNORE INTO blocked_gallery (album_id) VALUES (?)`, []any{albumId}
+		}
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			_, err := app.LocalDb.ExecContext(ctx, query, args...)
+			return err
+		})
+	})
+	app.finishBlocklistWrite(w, r, &p, err)
+}
+
+// handleBlocklistDelete handles POST /blocklist/delete and DELETE /api/blocklist, with the fields of POST /blocklist
+func (app *App) handleBlocklistDelete(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot delete from blocklist"))
+		return
+	}
+	e, err := parseBlocklistEntry(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		var query string
+		var args []any
+		switch e.kind {
+		case "tag":
+			query, args = `DELETE FROM blocked_tag WHERE name = ?`, []any{e.tag}
+		case "uploader":
+			query, args = `DELETE FROM blocked_uploader WHERE ripper_host = ? AND uploader = ?`, []any{e.ripperHost, e.uploader}
+		case "host":
+			query, args = `DELETE FROM blocked_host WHERE ripper_host = ?`, []any{e.ripperHost}
+		case "gallery":
+			albumId, err := app.blocklistAlbumId(ctx, e)
+			if err != nil {
+				return err
+			}
+			query, args = `DELETE FROM blocked_gallery WHERE album_id = ?`, []any{albumId}
+		}
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			res, err := app.LocalDb.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return sql.ErrNoRows
+			}
+			return nil
+		})
+	})
+	app.finishBlocklistWrite(w, r, &p, err)
+}
+
+// finishBlocklistWrite responds to a blocklist write: the updated blocklist in JSON mode, otherwise a redirect
+func (app *App) finishBlocklistWrite(w http.ResponseWriter, r *http.Request, p *types.Perf, err error) {
+	if err != nil {
+		app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderJSON {
+		model := types.BlocklistPage{Available: true, BasePage: &types.BasePage{Perf: p}}
+		if err := app.getBlocklistPage(r.Context(), &model); err != nil {
+			app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+			return
+		}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	target := postRedirectTarget(r, "/blocklist")
+	app.httpRedirect(r.Context(), w, r, p, target, http.StatusSeeOther)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// maxBulkFiles bounds the size of a single bulk transaction, since DbRw has only one connection
+const maxBulkFiles = 10000
+
+// parseBulkFileIds reads the repeated file_id form field
+func parseBulkFileIds(values []string) ([]int64, error) {
+	var ids []int64
+	for _, v := range values {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid file id: %q", v)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no files selected")
+	}
+	if len(ids) > maxBulkFiles {
+		return nil, fmt.Errorf("too many files selected, maximum %d", maxBulkFiles)
+	}
+	return ids, nil
+}
+
+// handleFilesBulkPost handles POST /files/bulk
+func (app *App) handleFilesBulkPost(w http.ResponseWriter, r *http.Request) {
+	if app.DbRw == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusForbidden, errReadOnly{fmt.Errorf("database is read-only, cannot save changes")})
+		return
+	}
+	_ = r.ParseForm()
+	fileIds, err := parseBulkFileIds(r.PostForm["file_id"])
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+
+	setRating, rating, err := parseRating(r.PostForm.Get("rating"))
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	ignoredString := r.PostForm.Get("ignored")
+	if err := parseIgnored(ignoredString); err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+
+	add, err := parseTagNames(r.PostForm["add"])
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	remove, err := parseTagNames(r.PostForm["remove"])
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	if !setRating && ignoredString == "" && len(add) == 0 && len(remove) == 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("no action given, expected rating, ignored, add, or remove"))
+		return
+	}
+
+	model := types.BulkResultPage{Selected: len(fileIds)}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		changes, err := app.writeAudited(ctx, r, func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error {
+			for _, fileId := range fileIds {
+				e, err := lookupFileEntity(ctx, tx, "", fileId)
+				if errors.Is(err, sql.ErrNoRows) {
+					model.NotFound++
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if setRating {
+					if err := setRatingTx(ctx, tx, e, rating, changes); err != nil {
+						return err
+					}
+				}
+				if ignoredString != "" {
+					if err := setFileIgnoredTx(ctx, tx, e, ignoredString == "1", changes); err != nil {
+						return err
+					}
+				}
+				if err := editLocalTagsTx(ctx, tx, e, add, remove, changes); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		model.Rated = changes.count(auditFieldRating, false)
+		model.Ignored = changes.count(auditFieldIgnored, false)
+		model.TagsAdded = changes.count(auditFieldTag, true)
+		model.TagsRemoved = changes.count(auditFieldTag, false)
+		model.Changed = int64(len(changes))
+		return err
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+
+	if getRenderMode(r.Context()) == RenderJSON {
+		model.BasePage = &types.BasePage{Perf: &p}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, withChanged(postRedirectTarget(r, "/"), model.Changed), http.StatusSeeOther)
+}
+
+// getSelectMode reports whether file tiles should show selection checkboxes.
+// ?select=1 or ?select=0 toggles selection mode for the browser session, so it survives pagination.
+func getSelectMode(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Query().Get("select") {
+	case "1":
+		http.SetCookie(w, &http.Cookie{Name: "selectMode", Value: "1", Path: "/", SameSite: http.SameSiteStrictMode})
+		return true
+	case "0":
+		http.SetCookie(w, &http.Cookie{Name: "selectMode", Value: "", Path: "/", MaxAge: -1})
+		return false
+	}
+	cookie, err := r.Cookie("selectMode")
+	if err != nil {
+		return false
+	}
+	return cookie.Value == "1"
+}
+
+// selectToggleHref returns the current page with selection mode switched on or off
+func selectToggleHref(current *url.URL, selectMode bool) string {
+	u := *current
+	q := u.Query()
+	q.Del("changed")
+	if selectMode {
+		q.Set("select", "0")
+	} else {
+		q.Set("select", "1")
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// herePath is the page of r for its forms to come back to, without the one-off changed parameter.
+// It's empty for a page rendered by a post, which can't be gone back to.
+func herePath(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	u := *r.URL
+	q := u.Query()
+	q.Del("changed")
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// withChanged adds the changed query parameter to a redirect target, so the page can report the result
+func withChanged(target string, changed int64) string {
+	u, err := url.Parse(target)
+	if err != nil || target == "" {
+		return target
+	}
+	q := u.Query()
+	q.Set("changed", strconv.FormatInt(changed, 10))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A catalogue is where galleries, files, and tags come from: the RipMe database, or an index of the folders of
+// MEDIA_ROOT for media saved by other downloaders. Either way, the handlers query a SQLite database with the tables
+// and columns of the RipMe schema that they use, so every page works the same against each catalogue.
+
+const (
+	CatalogueRipMe   = "ripme"
+	CatalogueFolders = "folders"
+)
+
+var Catalogues = []string{CatalogueRipMe, CatalogueFolders}
+
+const settingCatalogue = "catalogue"
+
+type catalogue interface {
+	// name is the catalogue's name in Catalogues
+	name() string
+	// open opens the database for reads, and for writes unless cfg.ReadOnly. rw is nil when it can't be written.
+	open(ctx context.Context, cfg Config) (ro *sql.DB, rw *sql.DB, err error)
+	// load brings the catalogue up to date before the server listens
+	load(ctx context.Context, cfg Config) error
+	// schemaVersion describes the version of the database schema
+	schemaVersion(ctx context.Context) (string, error)
+	// mediaFile finds the file of a media path, the part of a /media/ URL after /media/, if the catalogue knows where
+	// it is. Otherwise handleMedia looks for it where RipMe saves files.
+	mediaFile(ctx context.Context, path string) (knownFile, bool)
+}
+
+func newCatalogue(app *App, name string) catalogue {
+	if name == CatalogueFolders {
+		return &folderCatalogue{app: app}
+	}
+	return &ripmeCatalogue{app: app}
+}
+
+// checkLocalDbCatalogue records which catalogue the LocalGal database belongs to, and refuses another catalogue,
+// since gallery and file ids in one mean something else in the other
+func checkLocalDbCatalogue(ctx context.Context, db *sql.DB, name string) error {
+	if db == nil {
+		return nil
+	}
+	var recorded string
+	err := db.QueryRowContext(ctx, "SELECT value FROM setting WHERE name = ?", settingCatalogue).Scan(&recorded)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = db.ExecContext(ctx, "INSERT INTO setting (name, value) VALUES (?, ?)", settingCatalogue, name)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if recorded != name {
+		return fmt.Errorf("the LocalGal database belongs to the %s catalogue, not %s. Set LOCALGAL_DSN to use another one", recorded, name)
+	}
+	return nil
+}
+
+// ripmeCatalogue is the database that RipMe saves its rips in
+type ripmeCatalogue struct {
+	app *App
+}
+
+func (c *ripmeCatalogue) name() string {
+	return CatalogueRipMe
+}
+
+func (c *ripmeCatalogue) open(ctx context.Context, cfg Config) (*sql.DB, *sql.DB, error) {
+	dsn := DsnWithReadOnly(cfg.Dsn)
+	dsn = DsnWithDefaultTimeout(dsn)
+	dsn = DsnWithForeignKeys(dsn)
+
+	ro, err := GetDb(dsn, "read-only")
+	if err != nil {
+		return nil, nil, err
+	}
+	ro.SetMaxOpenConns(0) // 0 is unlimited; fine for read-only
+
+	var rw *sql.DB
+	if !cfg.ReadOnly {
+		dsnRw := DsnWithReadWrite(dsn)
+		rw, err = GetDb(dsnRw, "read-write")
+		if err == nil {
+			rw.SetMaxOpenConns(1) // sqlite doesn't handle simultaneous writes well
+		} else {
+			log.Printf("open rw db: %v (ratings/tags won't be savable)", err)
+		}
+	}
+
+	if err := initDB(ctx, ro, getFileFromDsn(dsn)); err != nil {
+		log.Printf("init db: %v", err)
+		return nil, nil, err
+	}
+
+	if err := checkMinimumDbSchemaVersion(ctx, ro); err != nil {
+		return nil, nil, err
+	}
+	return ro, rw, nil
+}
+
+func (c *ripmeCatalogue) load(ctx context.Context, cfg Config) error {
+	return c.app.loadKnownFiles(ctx, cfg.DfLog)
+}
+
+func (c *ripmeCatalogue) schemaVersion(ctx context.Context) (string, error) {
+	var version string
+	err := c.app.Db.QueryRowContext(ctx, `
+		SELECT COALESCE((
+		                    SELECT version
+		                      FROM flyway_schema_history
+		                     WHERE success = 1
+		                     ORDER BY installed_rank DESC
+		                     LIMIT 1
+		                ), 'unknown')
+	`).Scan(&version)
+	return version, err
+}
+
+func (c *ripmeCatalogue) mediaFile(ctx context.Context, path string) (knownFile, bool) {
+	return knownFile{}, false
+}
@@ -0,0 +1,653 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const FolderIndexFile = "localgal-folders.sqlite"
+
+// folderRipperHost is the ripper host of every gallery and file in the folder catalogue
+const folderRipperHost = "folder"
+
+// folderMimeTypes are the media files that the folder catalogue indexes, by lowercase extension
+var folderMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".jxl":  "image/jxl",
+	".bmp":  "image/bmp",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+}
+
+// folderIndexMigrations holds the schema of the folder index, the tables and columns of the RipMe schema that the
+// handlers use. Each folder of MEDIA_ROOT with media in it is a gallery, whose url is its path relative to MEDIA_ROOT.
+// The urlid, url_path, and filename of a file are all its path relative to MEDIA_ROOT, so that a /media/ URL finds it
+// without a gallery. Applied like localDbMigrations; only ever append to this list.
+var folderIndexMigrations = []string{
+	// 1: galleries, files, and tags
+	`
+	CREATE TABLE ripper
+	(
+	    ripper_id INTEGER PRIMARY KEY,
+	    name      TEXT NOT NULL,
+	    host      TEXT NOT NULL UNIQUE
+	);
+	INSERT INTO ripper (name, host) VALUES ('Folder', 'folder');
+	CREATE TABLE mime_type
+	(
+	    mime_type_id INTEGER PRIMARY KEY,
+	    name         TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE tag
+	(
+	    tag_id INTEGER PRIMARY KEY,
+	    name   TEXT    NOT NULL,
+	    local  INTEGER NOT NULL DEFAULT 0,
+	    UNIQUE (name, local)
+	);
+	CREATE TABLE album
+	(
+	    album_id      INTEGER PRIMARY KEY,
+	    ripper_id     INTEGER NOT NULL REFERENCES ripper,
+	    gid           TEXT    NOT NULL,
+	    url           TEXT    NOT NULL UNIQUE,
+	    uploader      TEXT,
+	    title         TEXT,
+	    description   TEXT,
+	    created_ts    INTEGER,
+	    modified_ts   INTEGER,
+	    fetch_count   INTEGER NOT NULL DEFAULT 0,
+	    hidden        INTEGER NOT NULL DEFAULT 0,
+	    removed       INTEGER NOT NULL DEFAULT 0,
+	    local_rating  INTEGER,
+	    sum_rf_bytes  INTEGER NOT NULL DEFAULT 0,
+	    cnt_rf        INTEGER NOT NULL DEFAULT 0,
+	    last_fetch_ts INTEGER,
+	    inserted_ts   INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    UNIQUE (ripper_id, gid)
+	);
+	CREATE TABLE remote_file
+	(
+	    remote_file_id INTEGER PRIMARY KEY,
+	    ripper_id      INTEGER NOT NULL REFERENCES ripper,
+	    urlid          TEXT,
+	    url_base       TEXT,
+	    url_path       TEXT    NOT NULL UNIQUE,
+	    filename       TEXT,
+	    mime_type_id   INTEGER REFERENCES mime_type,
+	    bytes          INTEGER,
+	    width_px       INTEGER,
+	    height_px      INTEGER,
+	    duration_ms    INTEGER,
+	    title          TEXT,
+	    description    TEXT,
+	    uploaded_ts    INTEGER,
+	    uploader       TEXT,
+	    aux            TEXT,
+	    hidden         INTEGER NOT NULL DEFAULT 0,
+	    removed        INTEGER NOT NULL DEFAULT 0,
+	    fetched        INTEGER NOT NULL DEFAULT 0,
+	    ignored        INTEGER NOT NULL DEFAULT 0,
+	    local_rating   INTEGER,
+	    scanned_ts     INTEGER,
+	    inserted_ts    INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE TABLE map_album_remote_file
+	(
+	    album_id       INTEGER NOT NULL REFERENCES album,
+	    remote_file_id INTEGER NOT NULL REFERENCES remote_file,
+	    PRIMARY KEY (album_id, remote_file_id)
+	);
+	CREATE INDEX map_album_remote_file_remote_file_id ON map_album_remote_file (remote_file_id);
+	CREATE TABLE map_album_tag
+	(
+	    album_id INTEGER NOT NULL REFERENCES album,
+	    tag_id   INTEGER NOT NULL REFERENCES tag,
+	    PRIMARY KEY (album_id, tag_id)
+	);
+	CREATE INDEX map_album_tag_tag_id ON map_album_tag (tag_id);
+	CREATE TABLE map_remote_file_tag
+	(
+	    remote_file_id INTEGER NOT NULL REFERENCES remote_file,
+	    tag_id         INTEGER NOT NULL REFERENCES tag,
+	    PRIMARY KEY (remote_file_id, tag_id)
+	);
+	CREATE INDEX map_remote_file_tag_tag_id ON map_remote_file_tag (tag_id);
+	CREATE VIRTUAL TABLE album_fts5 USING fts5(title, description, content='album', content_rowid='album_id');
+	CREATE VIRTUAL TABLE remote_file_fts5 USING fts5(title, description, content='remote_file', content_rowid='remote_file_id');
+	CREATE VIRTUAL TABLE tag_fts5 USING fts5(name, content='tag', content_rowid='tag_id');
+	CREATE TRIGGER album_ai AFTER INSERT ON album BEGIN
+	    INSERT INTO album_fts5 (rowid, title, description) VALUES (new.album_id, new.title, new.description);
+	END;
+	CREATE TRIGGER album_ad AFTER DELETE ON album BEGIN
+	    INSERT INTO album_fts5 (album_fts5, rowid, title, description) VALUES ('delete', old.album_id, old.title, old.description);
+	END;
+	CREATE TRIGGER album_au AFTER UPDATE OF title, description ON album BEGIN
+	    INSERT INTO album_fts5 (album_fts5, rowid, title, description) VALUES ('delete', old.album_id, old.title, old.description);
+	    INSERT INTO album_fts5 (rowid, title, description) VALUES (new.album_id, new.title, new.description);
+	END;
+	CREATE TRIGGER remote_file_ai AFTER INSERT ON remote_file BEGIN
+	    INSERT INTO remote_file_fts5 (rowid, title, description) VALUES (new.remote_file_id, new.title, new.description);
+	END;
+	CREATE TRIGGER remote_file_ad AFTER DELETE ON remote_file BEGIN
+	    INSERT INTO remote_file_fts5 (remote_file_fts5, rowid, title, description) VALUES ('delete', old.remote_file_id, old.title, old.description);
+	END;
+	CREATE TRIGGER remote_file_au AFTER UPDATE OF title, description ON remote_file BEGIN
+	    INSERT INTO remote_file_fts5 (remote_file_fts5, rowid, title, description) VALUES ('delete', old.remote_file_id, old.title, old.description);
+	    INSERT INTO remote_file_fts5 (rowid, title, description) VALUES (new.remote_file_id, new.title, new.description);
+	END;
+	CREATE TRIGGER tag_ai AFTER INSERT ON tag BEGIN
+	    INSERT INTO tag_fts5 (rowid, name) VALUES (new.tag_id, new.name);
+	END;
+	CREATE TRIGGER tag_ad AFTER DELETE ON tag BEGIN
+	    INSERT INTO tag_fts5 (tag_fts5, rowid, name) VALUES ('delete', old.tag_id, old.name);
+	END;
+	CREATE TRIGGER tag_au AFTER UPDATE OF name ON tag BEGIN
+	    INSERT INTO tag_fts5 (tag_fts5, rowid, name) VALUES ('delete', old.tag_id, old.name);
+	    INSERT INTO tag_fts5 (rowid, name) VALUES (new.tag_id, new.name);
+	END;
+	`,
+	// 2: metadata from JSON sidecars, see sidecars.go. The source URL of a file with a sidecar is its url_base.
+	// Titles from sidecars replace file and folder names, so paths are searchable too.
+	`
+	ALTER TABLE album ADD COLUMN sidecar_ts INTEGER;
+	ALTER TABLE remote_file ADD COLUMN sidecar_ts INTEGER;
+	DROP TRIGGER album_ai;
+	DROP TRIGGER album_ad;
+	DROP TRIGGER album_au;
+	DROP TRIGGER remote_file_ai;
+	DROP TRIGGER remote_file_ad;
+	DROP TRIGGER remote_file_au;
+	DROP TABLE album_fts5;
+	DROP TABLE remote_file_fts5;
+	CREATE VIRTUAL TABLE album_fts5 USING fts5(title, description, url, content='album', content_rowid='album_id');
+	CREATE VIRTUAL TABLE remote_file_fts5 USING fts5(title, description, url_path, content='remote_file', content_rowid='remote_file_id');
+	INSERT INTO album_fts5 (album_fts5) VALUES ('rebuild');
+	INSERT INTO remote_file_fts5 (remote_file_fts5) VALUES ('rebuild');
+	CREATE TRIGGER album_ai AFTER INSERT ON album BEGIN
+	    INSERT INTO album_fts5 (rowid, title, description, url) VALUES (new.album_id, new.title, new.description, new.url);
+	END;
+	CREATE TRIGGER album_ad AFTER DELETE ON album BEGIN
+	    INSERT INTO album_fts5 (album_fts5, rowid, title, description, url) VALUES ('delete', old.album_id, old.title, old.description, old.url);
+	END;
+	CREATE TRIGGER album_au AFTER UPDATE OF title, description, url ON album BEGIN
+	    INSERT INTO album_fts5 (album_fts5, rowid, title, description, url) VALUES ('delete', old.album_id, old.title, old.description, old.url);
+	    INSERT INTO album_fts5 (rowid, title, description, url) VALUES (new.album_id, new.title, new.description, new.url);
+	END;
+	CREATE TRIGGER remote_file_ai AFTER INSERT ON remote_file BEGIN
+	    INSERT INTO remote_file_fts5 (rowid, title, description, url_path) VALUES (new.remote_file_id, new.title, new.description, new.url_path);
+	END;
+	CREATE TRIGGER remote_file_ad AFTER DELETE ON remote_file BEGIN
+	    INSERT INTO remote_file_fts5 (remote_file_fts5, rowid, title, description, url_path) VALUES ('delete', old.remote_file_id, old.title, old.description, old.url_path);
+	END;
+	CREATE TRIGGER remote_file_au AFTER UPDATE OF title, description, url_path ON remote_file BEGIN
+	    INSERT INTO remote_file_fts5 (remote_file_fts5, rowid, title, description, url_path) VALUES ('delete', old.remote_file_id, old.title, old.description, old.url_path);
+	    INSERT INTO remote_file_fts5 (rowid, title, description, url_path) VALUES (new.remote_file_id, new.title, new.description, new.url_path);
+	END;
+	`,
+	// 3: local tags were indexed both by the tag triggers and by getOrCreateLocalTag, which corrupted tag_fts5
+	`
+	INSERT INTO tag_fts5 (tag_fts5) VALUES ('rebuild');
+	`,
+}
+
+// folderCatalogue indexes the folders of MEDIA_ROOT, for media saved by downloaders other than RipMe
+type folderCatalogue struct {
+	app *App
+	db  *sql.DB // read-write, for scans, even when ratings and tags can't be changed
+}
+
+func (c *folderCatalogue) name() string {
+	return CatalogueFolders
+}
+
+func (c *folderCatalogue) open(ctx context.Context, cfg Config) (*sql.DB, *sql.DB, error) {
+	dsn := DsnWithReadWrite(cfg.Dsn)
+	dsn = DsnWithDefaultTimeout(dsn)
+	dsn = DsnWithForeignKeys(dsn)
+
+	// The index is owned by LocalGal, so it is created if it doesn't exist
+	log.Printf("Using SQLite DSN for %s: %s", "folder index", dsn)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		log.Printf("open folder index: %v", err)
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1) // sqlite doesn't handle simultaneous writes well
+	if err := migrateDb(ctx, db, "folder index", folderIndexMigrations); err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	c.db = db
+
+	dsnRo := DsnWithReadOnly(dsn)
+	ro, err := GetDb(dsnRo, "read-only")
+	if err != nil {
+		return nil, nil, err
+	}
+	ro.SetMaxOpenConns(0) // 0 is unlimited; fine for read-only
+	if err := initDB(ctx, ro, getFileFromDsn(dsnRo)); err != nil {
+		log.Printf("init db: %v", err)
+		return nil, nil, err
+	}
+
+	if cfg.ReadOnly {
+		return ro, nil, nil
+	}
+	return ro, db, nil
+}
+
+// load scans MEDIA_ROOT into the index. Galleries and files keep their ids, ratings, and tags from scan to scan.
+// Files that are gone are kept like files that RipMe hasn't fetched, in case their drive is only unmounted.
+func (c *folderCatalogue) load(ctx context.Context, cfg Config) error {
+	start := time.Now()
+	mediaRoot := c.app.MediaRoot
+	log.Printf("Scanning %s %s", mediaRoot.label, mediaRoot.dir)
+	root, err := mediaRoot.getRoot()
+	if err != nil {
+		log.Printf("scan: %v", err)
+		return err
+	}
+	scanTs := start.UnixMilli()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ripperId int64
+	if err := tx.QueryRowContext(ctx, "SELECT ripper_id FROM ripper WHERE host = ?", folderRipperHost).Scan(&ripperId); err != nil {
+		return err
+	}
+	albumIds := map[string]int64{}    // by folder
+	mimeTypeIds := map[string]int64{} // by name
+	tagIds := map[string]int64{}      // of tags from sidecars, by name
+	fileCount := 0
+	fsys := root.FS()
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == "." {
+				return err
+			}
+			log.Printf("scan: %v", err)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		mimeType, ok := folderMimeTypes[strings.ToLower(path.Ext(p))]
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("scan: %v", err)
+			return nil
+		}
+
+		dir := path.Dir(p)
+		albumId, ok := albumIds[dir]
+		if !ok {
+			if albumId, err = upsertFolderAlbum(ctx, tx, ripperId, dir, mediaRoot.dir, scanTs); err != nil {
+				return err
+			}
+			albumIds[dir] = albumId
+		}
+		mimeTypeId, ok := mimeTypeIds[mimeType]
+		if !ok {
+			if err := tx.QueryRowContext(ctx, `
+				INSERT INTO mime_type (name)
+				VALUES (?)
+				ON CONFLICT (name) DO UPDATE SET name = excluded.name
+				RETURNING mime_type_id
+			`, mimeType).Scan(&mimeTypeId); err != nil {
+				return err
+			}
+			mimeTypeIds[mimeType] = mimeTypeId
+		}
+
+		var fileId int64
+		var sidecarTs sql.NullInt64
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO remote_file (ripper_id, urlid, url_path, filename, mime_type_id, bytes, title, description, uploaded_ts, fetched, scanned_ts)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?)
+			ON CONFLICT (url_path) DO UPDATE SET mime_type_id = excluded.mime_type_id
+			                                   , bytes        = excluded.bytes
+			                                   , uploaded_ts  = IIF(sidecar_ts IS NULL, excluded.uploaded_ts, uploaded_ts)
+			                                   , fetched      = 1
+			                                   , scanned_ts   = excluded.scanned_ts
+			RETURNING remote_file_id, sidecar_ts
+		`, ripperId, p, p, p, mimeTypeId, info.Size(), path.Base(p), folderDescription(dir), info.ModTime().UnixMilli(), scanTs).Scan(&fileId, &sidecarTs); err != nil {
+			return err
+		}
+		if err := applyFileSidecar(ctx, tx, fsys, tagIds, fileId, p, info.ModTime().UnixMilli(), sidecarTs); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO map_album_remote_file (album_id, remote_file_id)
+			VALUES (?, ?)
+		`, albumId, fileId); err != nil {
+			return err
+		}
+		fileCount++
+		return nil
+	})
+	if err != nil {
+		log.Printf("scan: %v", err)
+		return err
+	}
+
+	for dir, albumId := range albumIds {
+		if err := applyFolderSidecar(ctx, tx, fsys, tagIds, albumId, dir, mediaRoot.dir); err != nil {
+			return err
+		}
+	}
+
+	// Hide files that are gone, and count what's left of each gallery. A gallery without a sidecar is dated by its
+	// files, and is uploaded by the uploader of its files if they have just one.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE remote_file
+		   SET fetched = (scanned_ts = ?)
+		 WHERE fetched != (scanned_ts = ?)
+	`, scanTs, scanTs); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE album
+		   SET (cnt_rf, sum_rf_bytes, modified_ts, created_ts, uploader) = (
+		           SELECT COUNT(*)
+		                , COALESCE(SUM(rf.bytes), 0)
+		                , MAX(rf.uploaded_ts)
+		                , IIF(album.sidecar_ts IS NULL, MIN(rf.uploaded_ts), album.created_ts)
+		                , IIF(album.sidecar_ts IS NULL, IIF(COUNT(DISTINCT rf.uploader) = 1, MAX(rf.uploader), NULL), album.uploader)
+		             FROM map_album_remote_file marf
+		             JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
+		            WHERE marf.album_id = album.album_id
+		              AND rf.fetched = 1
+		       )
+		     , fetch_count = (last_fetch_ts = ?)
+	`, scanTs); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE
+		  FROM tag
+		 WHERE local = 0
+		   AND NOT EXISTS(SELECT 1 FROM map_remote_file_tag mrft WHERE mrft.tag_id = tag.tag_id)
+		   AND NOT EXISTS(SELECT 1 FROM map_album_tag mat WHERE mat.tag_id = tag.tag_id)
+	`); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Scanned %d files in %d folders in %v", fileCount, len(albumIds), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// upsertFolderAlbum returns the gallery of dir, a folder relative to MEDIA_ROOT, adding it if it's new
+func upsertFolderAlbum(ctx context.Context, tx *sql.Tx, ripperId int64, dir string, mediaRootDir string, scanTs int64) (int64, error) {
+	var albumId int64
+	err := tx.QueryRowContext(ctx, `
+		UPDATE album
+		   SET last_fetch_ts = ?
+		 WHERE url = ?
+		RETURNING album_id
+	`, scanTs, dir).Scan(&albumId)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return albumId, err
+	}
+
+	title := folderTitle(dir, mediaRootDir)
+	// Another folder may have the same gid, such as "a~b" and "a/b"
+	base := folderGid(dir)
+	gid := base
+	for n := 2; ; n++ {
+		var taken bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM album WHERE ripper_id = ? AND gid = ?)", ripperId, gid).Scan(&taken); err != nil {
+			return 0, err
+		}
+		if !taken {
+			break
+		}
+		gid = fmt.Sprintf("%s~%d", base, n)
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO album (ripper_id, gid, url, title, description, last_fetch_ts)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING album_id
+	`, ripperId, gid, dir, title, folderDescription(dir), scanTs).Scan(&albumId)
+	return albumId, err
+}
+
+// applyFileSidecar reads the sidecar of the file p if it changed since the last scan. A file without one is named
+// and dated by the file itself again.
+func applyFileSidecar(ctx context.Context, tx *sql.Tx, fsys fs.FS, tagIds map[string]int64, fileId int64, p string, modTs int64, lastSidecarTs sql.NullInt64) error {
+	name, sidecarTs, ok := findSidecar(fsys, fileSidecarNames(p))
+	if !ok {
+		if !lastSidecarTs.Valid {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE remote_file
+			   SET title       = ?
+			     , description = ?
+			     , uploader    = NULL
+			     , url_base    = NULL
+			     , uploaded_ts = ?
+			     , sidecar_ts  = NULL
+			 WHERE remote_file_id = ?
+		`, path.Base(p), folderDescription(path.Dir(p)), modTs, fileId); err != nil {
+			return err
+		}
+		return setSidecarTags(ctx, tx, tagIds, "map_remote_file_tag", "remote_file_id", fileId, nil)
+	}
+	if lastSidecarTs.Valid && lastSidecarTs.Int64 == sidecarTs {
+		return nil
+	}
+	s, err := readSidecar(fsys, name)
+	if err != nil {
+		// Not read again until it changes
+		log.Printf("scan: %v", err)
+	}
+	title := s.title
+	if title == "" {
+		title = path.Base(p)
+	}
+	description := s.description
+	if description == "" {
+		description = folderDescription(path.Dir(p))
+	}
+	uploadedTs := s.uploadedTs
+	if uploadedTs == 0 {
+		uploadedTs = modTs
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE remote_file
+		   SET title       = ?
+		     , description = ?
+		     , uploader    = NULLIF(?, '')
+		     , url_base    = NULLIF(?, '')
+		     , uploaded_ts = ?
+		     , sidecar_ts  = ?
+		 WHERE remote_file_id = ?
+	`, title, description, s.uploader, s.sourceUrl, uploadedTs, sidecarTs, fileId); err != nil {
+		return err
+	}
+	return setSidecarTags(ctx, tx, tagIds, "map_remote_file_tag", "remote_file_id", fileId, s.tags)
+}
+
+// applyFolderSidecar reads the sidecar of the folder dir if it changed since the last scan. A gallery without one is
+// named by its folder again.
+func applyFolderSidecar(ctx context.Context, tx *sql.Tx, fsys fs.FS, tagIds map[string]int64, albumId int64, dir string, mediaRootDir string) error {
+	var lastSidecarTs sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT sidecar_ts FROM album WHERE album_id = ?", albumId).Scan(&lastSidecarTs); err != nil {
+		return err
+	}
+	name, sidecarTs, ok := findSidecar(fsys, []string{path.Join(dir, folderSidecarName)})
+	if !ok {
+		if !lastSidecarTs.Valid {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE album
+			   SET title       = ?
+			     , description = ?
+			     , uploader    = NULL
+			     , sidecar_ts  = NULL
+			 WHERE album_id = ?
+		`, folderTitle(dir, mediaRootDir), folderDescription(dir), albumId); err != nil {
+			return err
+		}
+		return setSidecarTags(ctx, tx, tagIds, "map_album_tag", "album_id", albumId, nil)
+	}
+	if lastSidecarTs.Valid && lastSidecarTs.Int64 == sidecarTs {
+		return nil
+	}
+	s, err := readSidecar(fsys, name)
+	if err != nil {
+		// Not read again until it changes
+		log.Printf("scan: %v", err)
+	}
+	title := s.title
+	if title == "" {
+		title = folderTitle(dir, mediaRootDir)
+	}
+	description := s.description
+	if description == "" {
+		description = folderDescription(dir)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE album
+		   SET title       = ?
+		     , description = ?
+		     , uploader    = NULLIF(?, '')
+		     , created_ts  = COALESCE(NULLIF(?, 0), created_ts)
+		     , sidecar_ts  = ?
+		 WHERE album_id = ?
+	`, title, description, s.uploader, s.uploadedTs, sidecarTs, albumId); err != nil {
+		return err
+	}
+	return setSidecarTags(ctx, tx, tagIds, "map_album_tag", "album_id", albumId, s.tags)
+}
+
+// setSidecarTags replaces the tags from sidecars, which aren't local, of a file or gallery.
+// mapTable and idColumn are never populated from user input.
+func setSidecarTags(ctx context.Context, tx *sql.Tx, tagIds map[string]int64, mapTable string, idColumn string, id int64, tags []string) error {
+	if _, err := tx.ExecContext(ctx, `
+		DELETE
+		  FROM `+mapTable+`
+		 WHERE `+idColumn+` = ?
+		   AND tag_id IN (SELECT tag_id FROM tag WHERE local = 0)
+	`, id); err != nil {
+		return err
+	}
+	for _, name := range tags {
+		tagId, ok := tagIds[name]
+		if !ok {
+			if err := tx.QueryRowContext(ctx, `
+				INSERT INTO tag (name, local)
+				VALUES (?, 0)
+				ON CONFLICT (name, local) DO UPDATE SET local = excluded.local
+				RETURNING tag_id
+			`, name).Scan(&tagId); err != nil {
+				return err
+			}
+			tagIds[name] = tagId
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO `+mapTable+` (`+idColumn+`, tag_id)
+			VALUES (?, ?)
+		`, id, tagId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// folderTitle is the title of the gallery of dir without a sidecar: the name of the folder
+func folderTitle(dir string, mediaRootDir string) string {
+	if dir == "." {
+		return filepath.Base(mediaRootDir)
+	}
+	return path.Base(dir)
+}
+
+// folderGid is the gallery id of dir, a folder relative to MEDIA_ROOT: its path with "~" between folders, and
+// without the characters that mean something in a URL
+func folderGid(dir string) string {
+	if dir == "." {
+		return "~"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/':
+			return '~'
+		case '?', '#', '%', '\\':
+			return '_'
+		}
+		return r
+	}, dir)
+}
+
+// folderDescription is the searchable description of the galleries and files of dir: the names of its folders
+func folderDescription(dir string) string {
+	if dir == "." {
+		return ""
+	}
+	return strings.ReplaceAll(dir, "/", " / ")
+}
+
+func (c *folderCatalogue) schemaVersion(ctx context.Context) (string, error) {
+	var version int
+	err := c.app.Db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return fmt.Sprintf("folder index %d", version), err
+}
+
+// mediaFile finds /media/folder/{path}, and /media/folder/{gid}/{path} of a file in a gallery
+func (c *folderCatalogue) mediaFile(ctx context.Context, mediaPath string) (knownFile, bool) {
+	host, rest, ok := strings.Cut(mediaPath, "/")
+	if !ok || host != folderRipperHost {
+		return knownFile{}, false
+	}
+	names := []string{rest}
+	if _, afterGid, ok := strings.Cut(rest, "/"); ok {
+		names = append(names, afterGid)
+	}
+	for _, name := range names {
+		var exists bool
+		err := c.app.withSQL(ctx, func(ctx context.Context) error {
+			return c.app.Db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM remote_file WHERE url_path = ?)", name).Scan(&exists)
+		})
+		if err == nil && exists {
+			return knownFile{c.app.MediaRoot, filepath.FromSlash(name)}, true
+		}
+	}
+	return knownFile{}, false
+}
@@ -0,0 +1,904 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// collectionFavorites is the builtin value of the favorites collection, which is created by the LocalGal database migration
+	collectionFavorites = "favorites"
+
+	maxCollectionNameLength = 200
+	// maxCollectionFiles bounds the file ids in one request to change a collection
+	maxCollectionFiles = 10000
+)
+
+var matchCollectionFile = regexp.MustCompile(`^/collection/(\d+)/(\d+)/?$`)
+var matchCollection = regexp.MustCompile(`^/collection/(\d+)/?$`)
+
+// collectionColumns takes one bind arg: the file id to check collection membership of, or 0
+const collectionColumns = `
+	       c.collection_id
+	     , c.name
+	     , COALESCE(c.builtin, '') AS builtin
+	     , c.cover_file_id
+	     , (SELECT COUNT(*) FROM collection_file cf WHERE cf.collection_id = c.collection_id) AS file_count
+	     , c.created_ts
+	     , c.updated_ts
+	     , EXISTS (
+	    SELECT 1
+	      FROM collection_file cf
+	     WHERE cf.collection_id = c.collection_id
+	       AND cf.remote_file_id = ?
+	       ) AS contains
+`
+
+func scanCollection(row interface{ Scan(...any) error }) (types.Collection, error) {
+	var c types.Collection
+	err := row.Scan(
+		&c.CollectionId,
+		&c.Name,
+		&c.Builtin,
+		&c.CoverFileId,
+		&c.FileCount,
+		&c.CreatedTs,
+		&c.UpdatedTs,
+		&c.Contains,
+	)
+	c.HrefPage = fmt.Sprintf("/collection/%d", c.CollectionId)
+	return c, err
+}
+
+func (app *App) getCollection(ctx context.Context, collectionId int64) (types.Collection, error) {
+	var c types.Collection
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		var err error
+		c, err = scanCollection(app.LocalDb.QueryRowContext(ctx, `
+			SELECT `+collectionColumns+`
+			  FROM collection c
+			 WHERE c.collection_id = ?
+		`, 0, collectionId))
+		return err
+	})
+	return c, err
+}
+
+// getCollections lists every collection, favorites first. Contains is set for the collections that hold fileId.
+func (app *App) getCollections(ctx context.Context, fileId int64) ([]types.Collection, error) {
+	var list []types.Collection
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT `+collectionColumns+`
+			  FROM collection c
+			 ORDER BY c.builtin IS NULL, c.name COLLATE NOCASE, c.collection_id
+		`, fileId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			c, err := scanCollection(rows)
+			if err != nil {
+				return err
+			}
+			list = append(list, c)
+		}
+		return rows.Err()
+	})
+	return list, err
+}
+
+// getFileCollections lists collections for the "add to collection" controls of a file page; errors only get logged
+func (app *App) getFileCollections(ctx context.Context, fileId int64) []types.Collection {
+	if app.LocalDb == nil {
+		return nil
+	}
+	list, err := app.getCollections(ctx, fileId)
+	if err != nil {
+		log.Printf("list collections: %v", err)
+	}
+	return list
+}
+
+// getCollectionFileIds returns the files of a collection in order, including files that aren't visible
+func (app *App) getCollectionFileIds(ctx context.Context, collectionId int64) ([]int64, error) {
+	var ids []int64
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT remote_file_id
+			  FROM collection_file
+			 WHERE collection_id = ?
+			 ORDER BY position, added_ts
+		`, collectionId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
+
+// getCollectionFiles loads the visible files among fileIds, keeping their order.
+// Collections live in the LocalGal database, so the ids are passed to the RipMe database as a JSON array.
+// A negative limit loads every file.
+func (app *App) getCollectionFiles(ctx context.Context, fileIds []int64, frf types.RatingFilter, ftf types.FileTypeFilter, limit int) ([]types.File, error) {
+	if len(fileIds) == 0 {
+		return nil, nil
+	}
+	var files []types.File
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
+		ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
+		blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+		replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
+		args := []any{jsonArray(fileIds)}
+		args = append(args, rfArgs...)
+		args = append(args, ftArgs...)
+		args = append(args, blArgs...)
+		args = append(args, limit)
+		//language=sqlite
+		rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
+			SELECT rf.remote_file_id
+			     , r.name AS ripper_name
+			     , r.host AS ripper_host
+			     , rf.urlid
+			     , rf.filename
+			     , mt.name AS mime_type
+			     , rf.title
+			     , rf.uploaded_ts
+			     , rf.hidden
+			     , rf.removed
+			     , rf.bytes
+			     , rf.local_rating
+			     , rf.inserted_ts
+			  FROM json_each(?) j
+			  JOIN remote_file rf ON rf.remote_file_id = j.value
+			  JOIN ripper r ON r.ripper_id = rf.ripper_id
+			  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+			 WHERE rf.fetched = 1
+			   AND rf.ignored = 0
+			   /*RATING_FILTER*/
+			   /*FILE_TYPE_FILTER*/
+			   /*BLOCKLIST*/
+			 ORDER BY j.key
+			 LIMIT ?
+		`), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var f types.File
+			if err := rows.Scan(
+				&f.FileId,
+				&f.RipperName,
+				&f.RipperHost,
+				&f.Urlid,
+				&f.Filename,
+				&f.MimeType,
+				&f.Title,
+				&f.UploadedTs,
+				&f.Hidden,
+				&f.Removed,
+				&f.Bytes,
+				&f.LocalRating,
+				&f.InsertedTs,
+			); err != nil {
+				return err
+			}
+			if f.Filename.Valid {
+				f.HrefMedia = fmt.Sprintf("/media/%s/%s", f.RipperHost, f.Filename.String)
+			}
+			files = append(files, f)
+		}
+		return rows.Err()
+	})
+	app.populateFilesLocalMeta(ctx, files)
+	return files, err
+}
+
+// populateCollectionThumbs uses the cover as the thumbnail, or the first visible file if the cover isn't visible
+func (app *App) populateCollectionThumbs(ctx context.Context, collections []types.Collection) error {
+	for i := range collections {
+		ids, err := app.getCollectionFileIds(ctx, collections[i].CollectionId)
+		if err != nil {
+			return err
+		}
+		if collections[i].CoverFileId.Valid {
+			ids = append([]int64{collections[i].CoverFileId.Int64}, ids...)
+		}
+		thumbs, err := app.getCollectionFiles(ctx, ids, types.RatingFilter{}, types.FileTypeFilter{}, 1)
+		if err != nil {
+			return err
+		}
+		if len(thumbs) > 0 {
+			collections[i].Thumb = thumbs[0]
+			collections[i].Thumb.HrefPage = fmt.Sprintf("%s/%d", collections[i].HrefPage, thumbs[0].FileId)
+		}
+	}
+	return nil
+}
+
+// fileFilterQuery carries the file filters of a page over to the links of its files
+func fileFilterQuery(frf types.RatingFilter, ftf types.FileTypeFilter) string {
+	q := url.Values{}
+	if frf.Active() {
+		q.Set("file_rating_min", strconv.Itoa(frf.Min))
+		q.Set("file_rating_max", strconv.Itoa(frf.Max))
+	}
+	if frf.Unrated != "" {
+		q.Set("file_unrated", frf.Unrated)
+	}
+	if ftf.Active() {
+		q.Set("file_type", ftf.Type)
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+func parseCollectionId(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("collection_id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid collection id, must be a positive integer")
+	}
+	return id, nil
+}
+
+func parseCollectionName(s string) (string, error) {
+	name := strings.TrimSpace(s)
+	if name == "" {
+		return "", fmt.Errorf("collection name is required")
+	}
+	if len(name) > maxCollectionNameLength {
+		return "", fmt.Errorf("collection name is too long, maximum %d bytes", maxCollectionNameLength)
+	}
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return "", fmt.Errorf("collection name must not contain control characters")
+	}
+	return name, nil
+}
+
+// parseCollectionFileIds reads a repeated file id form field; unlike parseBulkFileIds, no ids is fine
+func parseCollectionFileIds(values []string) ([]int64, error) {
+	var ids []int64
+	for _, v := range values {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid file id: %q", v)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxCollectionFiles {
+		return nil, fmt.Errorf("too many files, maximum %d", maxCollectionFiles)
+	}
+	return ids, nil
+}
+
+// checkFilesExist makes sure that files to add to a collection are known to the RipMe database
+func (app *App) checkFilesExist(ctx context.Context, fileIds []int64) error {
+	if len(fileIds) == 0 {
+		return nil
+	}
+	var found int
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT COUNT(*)
+			  FROM remote_file rf
+			 WHERE rf.remote_file_id IN (SELECT value FROM json_each(?))
+		`, jsonArray(fileIds)).Scan(&found)
+	}); err != nil {
+		return err
+	}
+	if found != len(fileIds) {
+		return errInvalid{fmt.Errorf("unknown file id, %d of %d files not found", len(fileIds)-found, len(fileIds))}
+	}
+	return nil
+}
+
+// addCollectionFilesTx appends files to the end of a collection. Files already in the collection keep their position.
+func addCollectionFilesTx(ctx context.Context, tx *sql.Tx, collectionId int64, fileIds []int64) error {
+	for _, fileId := range fileIds {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE
+			  INTO collection_file (collection_id, remote_file_id, position)
+			SELECT ?, ?, COALESCE(MAX(position), 0) + 1
+			  FROM collection_file
+			 WHERE collection_id = ?
+		`, collectionId, fileId, collectionId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveCollectionFileTx moves a file to a 1-based position and renumbers the collection.
+// Positions past the end move the file to the end.
+func moveCollectionFileTx(ctx context.Context, tx *sql.Tx, collectionId int64, fileId int64, position int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT remote_file_id
+		  FROM collection_file
+		 WHERE collection_id = ?
+		 ORDER BY position, added_ts
+	`, collectionId)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	i := slices.Index(ids, fileId)
+	if i < 0 {
+		return errNotFound{fmt.Errorf("file %d is not in the collection", fileId)}
+	}
+	ids = slices.Delete(ids, i, i+1)
+	ids = slices.Insert(ids, min(max(position, 1), len(ids)+1)-1, fileId)
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE collection_file
+			   SET position = ?
+			 WHERE collection_id = ?
+			   AND remote_file_id = ?
+		`, i+1, collectionId, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCollection runs fn in a LocalDb transaction and marks the collection as updated.
+// Returns sql.ErrNoRows if the collection doesn't exist.
+func (app *App) writeCollection(ctx context.Context, collectionId int64, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return app.withSQL(ctx, func(ctx context.Context) error {
+		tx, err := app.LocalDb.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.ExecContext(ctx, `
+			UPDATE collection
+			   SET updated_ts = UNIXEPOCH('subsec') * 1000
+			 WHERE collection_id = ?
+		`, collectionId)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return sql.ErrNoRows
+		}
+		if err := fn(ctx, tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// handleCollections handles /collections and /api/collections
+func (app *App) handleCollections(w http.ResponseWriter, r *http.Request) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		var collections []types.Collection
+		if app.LocalDb != nil {
+			var err error
+			collections, err = app.getCollections(ctx, 0)
+			if err != nil {
+				return err
+			}
+			if err := app.populateCollectionThumbs(ctx, collections); err != nil {
+				return err
+			}
+		}
+		model := types.CollectionsPage{
+			Collections: collections,
+			Available:   app.LocalDb != nil,
+			BasePage:    &types.BasePage{Perf: perf},
+		}
+		app.render(ctx, w, "collections.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleCollectionCreate handles POST /collections and POST /api/collections.
+// Files in the add field are added to the new collection right away, which is how file pages create a collection.
+func (app *App) handleCollectionCreate(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot create collection"))
+		return
+	}
+	_ = r.ParseForm()
+	name, err := parseCollectionName(r.PostForm.Get("name"))
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	add, err := parseCollectionFileIds(r.PostForm["add"])
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	var collectionId int64
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		if err := app.checkFilesExist(ctx, add); err != nil {
+			return err
+		}
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			tx, err := app.LocalDb.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := tx.QueryRowContext(ctx, `
+				INSERT INTO collection (name)
+				VALUES (?)
+				RETURNING collection_id
+			`, name).Scan(&collectionId); err != nil {
+				return err
+			}
+			if err := addCollectionFilesTx(ctx, tx, collectionId, add); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+	})
+	target := fmt.Sprintf("/collection/%d", collectionId)
+	if len(add) > 0 {
+		target = postRedirectTarget(r, target)
+	}
+	app.finishCollectionWrite(w, r, &p, err, collectionId, target)
+}
+
+// handleCollectionPost handles POST /collection/{collection_id} and POST /api/collection/{collection_id}.
+// Form fields: name to rename, and cover_file_id to set the cover (0 unsets it). Empty fields aren't changed.
+func (app *App) handleCollectionPost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save collection"))
+		return
+	}
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	_ = r.ParseForm()
+	var name string
+	if r.PostForm.Has("name") {
+		if name, err = parseCollectionName(r.PostForm.Get("name")); err != nil {
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+			return
+		}
+	}
+	var cover sql.NullInt64
+	coverString := r.PostForm.Get("cover_file_id")
+	if coverString != "" {
+		coverId, err := strconv.ParseInt(coverString, 10, 64)
+		if err != nil || coverId < 0 {
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid cover_file_id, must be a file id or 0"))
+			return
+		}
+		cover = sql.NullInt64{Int64: coverId, Valid: coverId > 0}
+	}
+	if name == "" && coverString == "" {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("no change given, expected name or cover_file_id"))
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		return app.writeCollection(ctx, collectionId, func(ctx context.Context, tx *sql.Tx) error {
+			if name != "" {
+				if _, err := tx.ExecContext(ctx, `
+					UPDATE collection
+					   SET name = ?
+					 WHERE collection_id = ?
+				`, name, collectionId); err != nil {
+					return err
+				}
+			}
+			if coverString != "" {
+				// The cover must be one of the collection's files
+				res, err := tx.ExecContext(ctx, `
+					UPDATE collection
+					   SET cover_file_id = ?
+					 WHERE collection_id = ?
+					   AND (? IS NULL OR EXISTS (
+					    SELECT 1
+					      FROM collection_file cf
+					     WHERE cf.collection_id = collection.collection_id
+					       AND cf.remote_file_id = ?
+					       ))
+				`, cover, collectionId, cover, cover)
+				if err != nil {
+					return err
+				}
+				if n, err := res.RowsAffected(); err == nil && n == 0 {
+					return errInvalid{fmt.Errorf("file %d is not in the collection", cover.Int64)}
+				}
+			}
+			return nil
+		})
+	})
+	app.finishCollectionWrite(w, r, &p, err, collectionId, postRedirectTarget(r, fmt.Sprintf("/collection/%d", collectionId)))
+}
+
+// handleCollectionDelete handles POST /collection/{collection_id}/delete and DELETE /api/collection/{collection_id}
+func (app *App) handleCollectionDelete(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot delete collection"))
+		return
+	}
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		c, err := app.getCollection(ctx, collectionId)
+		if err != nil {
+			return err
+		}
+		if c.Builtin != "" {
+			return errConflict{fmt.Errorf("%q is built in and can't be deleted", c.Name)}
+		}
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			_, err := app.LocalDb.ExecContext(ctx, `
+				DELETE
+				  FROM collection
+				 WHERE collection_id = ?
+			`, collectionId)
+			return err
+		})
+	})
+	if err == nil && getRenderMode(r.Context()) == RenderJSON {
+		app.handleCollections(w, r)
+		return
+	}
+	app.finishCollectionWrite(w, r, &p, err, collectionId, postRedirectTarget(r, "/collections"))
+}
+
+// handleCollectionFilesPost handles POST /collection/{collection_id}/files and POST /api/collection/{collection_id}/files.
+// Form fields, applied in this order:
+//   - add: file to append; may be repeated
+//   - remove: file to remove; may be repeated
+//   - move and position: file to move, and its new 1-based position
+func (app *App) handleCollectionFilesPost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save collection"))
+		return
+	}
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	_ = r.ParseForm()
+	add, err := parseCollectionFileIds(r.PostForm["add"])
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	remove, err := parseCollectionFileIds(r.PostForm["remove"])
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	var move int64
+	var position int
+	if moveString := r.PostForm.Get("move"); moveString != "" {
+		move, err = strconv.ParseInt(moveString, 10, 64)
+		if err != nil || move <= 0 {
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid move file id: %q", moveString))
+			return
+		}
+		position, err = strconv.Atoi(r.PostForm.Get("position"))
+		if err != nil || position <= 0 {
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid position, must be a positive integer"))
+			return
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 && move == 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("no action given, expected add, remove, or move"))
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		if err := app.checkFilesExist(ctx, add); err != nil {
+			return err
+		}
+		app.bustCache(w)
+		return app.writeCollection(ctx, collectionId, func(ctx context.Context, tx *sql.Tx) error {
+			if err := addCollectionFilesTx(ctx, tx, collectionId, add); err != nil {
+				return err
+			}
+			for _, fileId := range remove {
+				if _, err := tx.ExecContext(ctx, `
+					DELETE
+					  FROM collection_file
+					 WHERE collection_id = ?
+					   AND remote_file_id = ?
+				`, collectionId, fileId); err != nil {
+					return err
+				}
+			}
+			if len(remove) > 0 {
+				if _, err := tx.ExecContext(ctx, `
+					UPDATE collection
+					   SET cover_file_id = NULL
+					 WHERE collection_id = ?
+					   AND cover_file_id IN (SELECT value FROM json_each(?))
+				`, collectionId, jsonArray(remove)); err != nil {
+					return err
+				}
+			}
+			if move != 0 {
+				return moveCollectionFileTx(ctx, tx, collectionId, move, position)
+			}
+			return nil
+		})
+	})
+	app.finishCollectionWrite(w, r, &p, err, collectionId, postRedirectTarget(r, fmt.Sprintf("/collection/%d", collectionId)))
+}
+
+// finishCollectionWrite responds to a collection change with the collection in JSON mode, and otherwise redirects to target
+func (app *App) finishCollectionWrite(w http.ResponseWriter, r *http.Request, p *types.Perf, err error, collectionId int64, target string) {
+	if err != nil {
+		app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderJSON {
+		c, err := app.getCollection(r.Context(), collectionId)
+		if err != nil {
+			app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+			return
+		}
+		model := types.CollectionPage{Collection: c, BasePage: &types.BasePage{Perf: p}}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	if target == "" {
+		target = fmt.Sprintf("/collection/%d", collectionId)
+	}
+	app.httpRedirect(r.Context(), w, r, p, target, http.StatusSeeOther)
+}
+
+// handleCollection handles /collection/{collection_id}
+func (app *App) handleCollection(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable"))
+		return
+	}
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		c, err := app.getCollection(ctx, collectionId)
+		if err != nil {
+			return err
+		}
+		fileIds, err := app.getCollectionFileIds(ctx, collectionId)
+		if err != nil {
+			return err
+		}
+		grf := getGalleryRatingFilter(w, r)
+		frf := getFileRatingFilter(w, r)
+		ftf := getFileTypeFilter(w, r)
+		// Collections are curated by hand, so they are small enough to filter whole and paginate here
+		files, err := app.getCollectionFiles(ctx, fileIds, frf, ftf, -1)
+		if err != nil {
+			return err
+		}
+		page, size := getPageParams(w, r, r.URL)
+		total := len(files)
+		offset := min((page-1)*size, total)
+		files = files[offset:min(offset+size, total)]
+		filterQuery := fileFilterQuery(frf, ftf)
+		for i := range files {
+			files[i].HrefPage = fmt.Sprintf("%s/%d%s", c.HrefPage, files[i].FileId, filterQuery)
+		}
+
+		model := types.CollectionPage{
+			Collection: c,
+			Files:      files,
+			Page:       page,
+			PageSize:   size,
+			Total:      total,
+			HasPrev:    page > 1,
+			HasNext:    offset+len(files) < total,
+			BasePage:   &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
+		}
+		app.render(ctx, w, "collection.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleCollectionFile handles /collection/{collection_id}/{file_id}
+func (app *App) handleCollectionFile(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable"))
+		return
+	}
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	fileId, err := strconv.ParseInt(r.PathValue("file_id"), 10, 64)
+	if err != nil || fileId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("file_id must be a positive integer"))
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		c, err := app.getCollection(ctx, collectionId)
+		if err != nil {
+			return err
+		}
+		fileIds, err := app.getCollectionFileIds(ctx, collectionId)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(fileIds, fileId) {
+			return sql.ErrNoRows
+		}
+		grf := getGalleryRatingFilter(w, r)
+		frf := getFileRatingFilter(w, r)
+		ftf := getFileTypeFilter(w, r)
+		files, err := app.getCollectionFiles(ctx, fileIds, frf, ftf, -1)
+		if err != nil {
+			return err
+		}
+		f, err := app.getFile(ctx, "", fileId)
+		if err != nil {
+			return err
+		}
+		app.populateFileLocalMeta(ctx, &f)
+		fileTags, err := app.getFileTags(ctx, fileId)
+		if err != nil {
+			return err
+		}
+		// The related galleries script only knows gallery and standalone file paths, so load them here
+		albums, err := app.getRelatedAlbums(ctx, f.RipperHost, fileId)
+		if err != nil {
+			return err
+		}
+
+		// Prev/Next by collection order. A file hidden by the filters is still shown, between its visible neighbors.
+		i := slices.IndexFunc(files, func(f types.File) bool { return f.FileId == fileId })
+		var prev, next []types.File
+		if i >= 0 {
+			prev = files[max(i-3, 0):i]
+			next = files[i+1 : min(i+4, len(files))]
+		} else {
+			position := slices.Index(fileIds, fileId)
+			for j := range files {
+				if slices.Index(fileIds, files[j].FileId) > position {
+					i = j
+					break
+				}
+			}
+			if i < 0 {
+				i = len(files)
+			}
+			prev = files[max(i-3, 0):i]
+			next = files[i:min(i+3, len(files))]
+		}
+
+		_, pageSize := getPageParams(w, r, r.URL)
+		filterQuery := fileFilterQuery(frf, ftf)
+		pageQuery := url.Values{}
+		pageQuery.Set("page", strconv.Itoa(i/max(pageSize, 1)+1))
+		pageQuery.Set("size", strconv.Itoa(pageSize))
+		current := c
+		current.HrefPage = c.HrefPage + "?" + pageQuery.Encode()
+		if filterQuery != "" {
+			current.HrefPage += "&" + strings.TrimPrefix(filterQuery, "?")
+		}
+		for _, list := range [][]types.File{prev, next} {
+			for j := range list {
+				list[j].HrefPage = fmt.Sprintf("%s/%d%s", c.HrefPage, list[j].FileId, filterQuery)
+			}
+		}
+		f.HrefPage = fmt.Sprintf("%s/%d%s", c.HrefPage, f.FileId, filterQuery)
+		if f.Filename.Valid {
+			f.HrefMedia = fmt.Sprintf("/media/%s/%s", f.RipperHost, f.Filename.String)
+		}
+
+		model := types.FilePage{
+			File:              f,
+			Prev:              prev,
+			Next:              next,
+			FileTags:          fileTags,
+			Albums:            albums,
+			CurrentCollection: &current,
+			ShowPrevNext:      true,
+			Autoplay:          isClientAutoplayOn(r),
+			ForceFit:          isClientForceFitOn(r),
+			Collections:       app.getFileCollections(ctx, fileId),
+			BasePage:          &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
+		}
+		app.render(ctx, w, "file.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// getRandomCollectionPage picks a random page of a collection other than the current one
+func (app *App) getRandomCollectionPage(ctx context.Context, collectionId int64, page int, size int, frf types.RatingFilter, ftf types.FileTypeFilter) (int64, error) {
+	fileIds, err := app.getCollectionFileIds(ctx, collectionId)
+	if err != nil {
+		return 0, err
+	}
+	files, err := app.getCollectionFiles(ctx, fileIds, frf, ftf, -1)
+	if err != nil {
+		return 0, err
+	}
+	pageCount := getPageCount(int64(len(files)), int64(size))
+	if pageCount <= 1 {
+		return 1, nil
+	}
+	nextPage := rand.Int64N(pageCount-1) + 1
+	if nextPage >= int64(page) {
+		nextPage += 1
+	}
+	return nextPage, nil
+}
+
+// getRandomCollectionFile picks a random visible file of a collection other than the current one
+func (app *App) getRandomCollectionFile(ctx context.Context, collectionId int64, fileId int64, frf types.RatingFilter, ftf types.FileTypeFilter) (int64, error) {
+	fileIds, err := app.getCollectionFileIds(ctx, collectionId)
+	if err != nil {
+		return 0, err
+	}
+	files, err := app.getCollectionFiles(ctx, fileIds, frf, ftf, -1)
+	if err != nil {
+		return 0, err
+	}
+	files = slices.DeleteFunc(files, func(f types.File) bool { return f.FileId == fileId })
+	if len(files) == 0 {
+		return fileId, nil
+	}
+	return files[rand.IntN(len(files))].FileId, nil
+}
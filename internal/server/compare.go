@@ -0,0 +1,443 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	eloInitialScore = 1500.0
+	eloK            = 32.0
+)
+
+// fileScoreSQL is the score of rf, looked up in the JSON object of scores from getFileScoresJSON.
+// The scores are in LocalDb, so they are passed to Db as an argument. Unscored files get unscoredSortValue, so they sort last.
+const fileScoreSQL = `COALESCE(json_extract(?, '$."' || rf.remote_file_id || '"'), -1e9)`
+const unscoredSortValue = -1e9
+
+// fileScoreKeySQL is fileScoreSQL in thousandths of a point, for keyset pagination. Cursors hold it as an integer,
+// so it comes back from the client exactly; a float key could round on the way and skip or repeat rows.
+const fileScoreKeySQL = `CAST(ROUND(` + fileScoreSQL + ` * 1000) AS INTEGER)`
+
+// getFileScoresJSON returns the scores of all scored files as a JSON object by file id, for fileScoreSQL.
+// Errors are logged rather than returned, so listings still work without scores.
+func (app *App) getFileScoresJSON(ctx context.Context) string {
+	if app.LocalDb == nil {
+		return "{}"
+	}
+	var scores string
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, `
+			SELECT COALESCE(json_group_object(CAST(remote_file_id AS TEXT), score), '{}')
+			  FROM file_score
+		`).Scan(&scores)
+	}); err != nil {
+		log.Printf("unable to load file scores: %v", err)
+		return "{}"
+	}
+	return scores
+}
+
+// getFileScore returns the score of a file. Files that were never compared have the initial score.
+func (app *App) getFileScore(ctx context.Context, fileId int64) (types.FileScore, error) {
+	s := types.FileScore{FileId: fileId, Score: eloInitialScore}
+	if app.LocalDb == nil {
+		return s, nil
+	}
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, `
+			SELECT score
+			     , comparisons
+			     , wins
+			     , updated_ts
+			  FROM file_score
+			 WHERE remote_file_id = ?
+		`, fileId).Scan(&s.Score, &s.Comparisons, &s.Wins, &s.UpdatedTs)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, nil
+	}
+	return s, err
+}
+
+// fileSortScore is the value that fileScoreSQL gives a file, for keyset pagination
+func (app *App) fileSortScore(ctx context.Context, fileId int64) (float64, error) {
+	s, err := app.getFileScore(ctx, fileId)
+	if err != nil || s.Comparisons == 0 {
+		return unscoredSortValue, err
+	}
+	return s.Score, nil
+}
+
+func getFileScoreTx(ctx context.Context, tx *sql.Tx, fileId int64) (types.FileScore, error) {
+	s := types.FileScore{FileId: fileId, Score: eloInitialScore}
+	err := tx.QueryRowContext(ctx, `
+		SELECT score
+		     , comparisons
+		     , wins
+		  FROM file_score
+		 WHERE remote_file_id = ?
+	`, fileId).Scan(&s.Score, &s.Comparisons, &s.Wins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, nil
+	}
+	return s, err
+}
+
+func saveFileScoreTx(ctx context.Context, tx *sql.Tx, s *types.FileScore) error {
+	return tx.QueryRowContext(ctx, `
+		INSERT INTO file_score (remote_file_id, score, comparisons, wins)
+		VALUES (?, ?, ?, ?)
+		    ON CONFLICT (remote_file_id) DO UPDATE
+		   SET score       = excluded.score
+		     , comparisons = excluded.comparisons
+		     , wins        = excluded.wins
+		     , updated_ts  = UNIXEPOCH('subsec') * 1000
+		RETURNING updated_ts
+	`, s.FileId, s.Score, s.Comparisons, s.Wins).Scan(&s.UpdatedTs)
+}
+
+// recordComparison logs a comparison and updates the Elo scores of both files
+func (app *App) recordComparison(ctx context.Context, client string, winnerId int64, loserId int64) (winner types.FileScore, loser types.FileScore, err error) {
+	err = app.withSQL(ctx, func(ctx context.Context) error {
+		tx, err := app.LocalDb.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if winner, err = getFileScoreTx(ctx, tx, winnerId); err != nil {
+			return err
+		}
+		if loser, err = getFileScoreTx(ctx, tx, loserId); err != nil {
+			return err
+		}
+		expected := 1 / (1 + math.Pow(10, (loser.Score-winner.Score)/400))
+		delta := eloK * (1 - expected)
+		winner.Score += delta
+		winner.Comparisons++
+		winner.Wins++
+		loser.Score -= delta
+		loser.Comparisons++
+		if err := saveFileScoreTx(ctx, tx, &winner); err != nil {
+			return err
+		}
+		if err := saveFileScoreTx(ctx, tx, &loser); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO comparison (winner_file_id, loser_file_id, client_addr)
+			VALUES (?, ?, ?)
+		`, winnerId, loserId, client); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return winner, loser, err
+}
+
+// getRandomCompareFileId picks a random visible file that matches the filters, other than exclude.
+// It starts from a random id and takes the next match, wrapping around, so files after gaps in the ids are a bit more likely.
+func (app *App) getRandomCompareFileId(ctx context.Context, frf types.RatingFilter, ftf types.FileTypeFilter, exclude int64) (int64, error) {
+	var maxId sql.NullInt64
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT MAX(remote_file_id)
+			  FROM remote_file
+		`).Scan(&maxId)
+	}); err != nil {
+		return 0, err
+	}
+	if !maxId.Valid || maxId.Int64 <= 0 {
+		return 0, sql.ErrNoRows
+	}
+	rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
+	ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
+	blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
+	var fileId int64
+	var err error
+	for _, start := range []int64{rand.Int64N(maxId.Int64) + 1, 0} {
+		args := []any{start, exclude}
+		args = append(args, rfArgs...)
+		args = append(args, ftArgs...)
+		args = append(args, blArgs...)
+		err = app.withSQL(ctx, func(ctx context.Context) error {
+			//language=sqlite
+			return app.Db.QueryRowContext(ctx, replacer.Replace(`
+				SELECT rf.remote_file_id
+				  FROM remote_file rf
+				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				 WHERE rf.remote_file_id >= ?
+				   AND rf.remote_file_id != ?
+				   AND rf.fetched = 1
+				   AND rf.ignored = 0
+				   /*RATING_FILTER*/
+				   /*FILE_TYPE_FILTER*/
+				   /*BLOCKLIST*/
+				 ORDER BY rf.remote_file_id
+				 LIMIT 1
+			`), args...).Scan(&fileId)
+		})
+		if !errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+	}
+	return fileId, err
+}
+
+// getCompareFile loads a file to compare, with the links of a standalone file
+func (app *App) getCompareFile(ctx context.Context, fileId int64) (types.File, types.FileScore, error) {
+	f, err := app.getFile(ctx, "", fileId)
+	if err != nil {
+		return f, types.FileScore{}, err
+	}
+	f.HrefPage = fmt.Sprintf("/file/%s/%d", f.RipperHost, f.FileId)
+	if f.Filename.Valid {
+		f.HrefMedia = fmt.Sprintf("/media/%s/%s", f.RipperHost, f.Filename.String)
+	}
+	app.populateFileLocalMeta(ctx, &f)
+	s, err := app.getFileScore(ctx, fileId)
+	return f, s, err
+}
+
+func (app *App) getCompareCounts(ctx context.Context, model *types.ComparePage) error {
+	return app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, `
+			SELECT (SELECT COUNT(*) FROM comparison)
+			     , (SELECT COUNT(*) FROM file_score)
+		`).Scan(&model.Comparisons, &model.Scored)
+	})
+}
+
+// handleCompareRandom handles /compare. It picks two random files from the current filters and redirects to their comparison,
+// so the pair has a stable URL.
+func (app *App) handleCompareRandom(w http.ResponseWriter, r *http.Request) {
+	frf := getFileRatingFilter(w, r)
+	ftf := getFileTypeFilter(w, r)
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		model := types.ComparePage{
+			Available: app.LocalDb != nil,
+			ReadOnly:  app.DbRw == nil,
+			BasePage:  &types.BasePage{Perf: perf, FileRatingFilter: frf, FileTypeFilter: ftf},
+		}
+		if app.LocalDb != nil {
+			leftId, err := app.getRandomCompareFileId(ctx, frf, ftf, 0)
+			if err == nil {
+				var rightId int64
+				rightId, err = app.getRandomCompareFileId(ctx, frf, ftf, leftId)
+				if err == nil {
+					prefix := "/compare/"
+					if getRenderMode(ctx) == RenderJSON {
+						prefix = "/api/compare/"
+					}
+					http.Redirect(w, r, prefix+strconv.FormatInt(leftId, 10)+"/"+strconv.FormatInt(rightId, 10), http.StatusTemporaryRedirect)
+					return nil
+				}
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			model.Empty = true
+			if err := app.getCompareCounts(ctx, &model); err != nil {
+				return err
+			}
+		}
+		app.render(ctx, w, "compare.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleCompare handles /compare/{left_id}/{right_id}
+func (app *App) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot compare files"))
+		return
+	}
+	leftId, err := strconv.ParseInt(r.PathValue("left_id"), 10, 64)
+	if err != nil || leftId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid file id: %q", r.PathValue("left_id")))
+		return
+	}
+	rightId, err := strconv.ParseInt(r.PathValue("right_id"), 10, 64)
+	if err != nil || rightId <= 0 || rightId == leftId {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid file id: %q", r.PathValue("right_id")))
+		return
+	}
+	frf := getFileRatingFilter(w, r)
+	ftf := getFileTypeFilter(w, r)
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		model := types.ComparePage{
+			Available: true,
+			ReadOnly:  app.DbRw == nil,
+			BasePage:  &types.BasePage{Perf: perf, FileRatingFilter: frf, FileTypeFilter: ftf},
+		}
+		var err error
+		if model.Left, model.LeftScore, err = app.getCompareFile(ctx, leftId); err != nil {
+			return err
+		}
+		if model.Right, model.RightScore, err = app.getCompareFile(ctx, rightId); err != nil {
+			return err
+		}
+		if err := app.getCompareCounts(ctx, &model); err != nil {
+			return err
+		}
+		app.render(ctx, w, "compare.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleComparePost handles POST /compare with the form fields winner and loser
+func (app *App) handleComparePost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save comparison"))
+		return
+	}
+	_ = r.ParseForm()
+	winnerId, err := strconv.ParseInt(r.PostForm.Get("winner"), 10, 64)
+	if err != nil || winnerId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid winner file id: %q", r.PostForm.Get("winner")))
+		return
+	}
+	loserId, err := strconv.ParseInt(r.PostForm.Get("loser"), 10, 64)
+	if err != nil || loserId <= 0 || loserId == winnerId {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid loser file id: %q", r.PostForm.Get("loser")))
+		return
+	}
+	if err := app.checkFilesExist(r.Context(), []int64{winnerId, loserId}); err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusInternalServerError, err)
+		return
+	}
+
+	model := types.CompareResultPage{}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		var err error
+		model.Winner, model.Loser, err = app.recordComparison(ctx, clientAddr(r), winnerId, loserId)
+		return err
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderJSON {
+		model.BasePage = &types.BasePage{Perf: &p}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, postRedirectTarget(r, "/compare"), http.StatusSeeOther)
+}
+
+// quantileRatings maps scores, sorted ascending, to ratings 1-5 with an equal number of files for each rating.
+// Files with equal scores get the same rating.
+func quantileRatings(scores []types.FileScore) []int64 {
+	ratings := make([]int64, len(scores))
+	for i := range scores {
+		if i > 0 && scores[i].Score == scores[i-1].Score {
+			ratings[i] = ratings[i-1]
+			continue
+		}
+		ratings[i] = int64(i*5/len(scores)) + 1
+	}
+	return ratings
+}
+
+// handleCompareRatings handles POST /compare/ratings. It sets the local rating of every file compared at least
+// min_comparisons times (default 1) from the quantile of its score.
+func (app *App) handleCompareRatings(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, there are no scores"))
+		return
+	}
+	if app.DbRw == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusForbidden, errReadOnly{fmt.Errorf("read-only mode, cannot save ratings")})
+		return
+	}
+	_ = r.ParseForm()
+	minComparisons := 1
+	if v := r.PostForm.Get("min_comparisons"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid min_comparisons, must be a positive number: %q", v))
+			return
+		}
+		minComparisons = n
+	}
+
+	var model types.BulkResultPage
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		var scores []types.FileScore
+		if err := app.withSQL(ctx, func(ctx context.Context) error {
+			rows, err := app.LocalDb.QueryContext(ctx, `
+				SELECT remote_file_id
+				     , score
+				  FROM file_score
+				 WHERE comparisons >= ?
+				 ORDER BY score, remote_file_id
+			`, minComparisons)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var s types.FileScore
+				if err := rows.Scan(&s.FileId, &s.Score); err != nil {
+					return err
+				}
+				scores = append(scores, s)
+			}
+			return rows.Err()
+		}); err != nil {
+			return err
+		}
+		model.Selected = len(scores)
+
+		app.bustCache(w)
+		ratings := quantileRatings(scores)
+		changes, err := app.writeAudited(ctx, r, func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error {
+			for i, s := range scores {
+				e, err := lookupFileEntity(ctx, tx, "", s.FileId)
+				if errors.Is(err, sql.ErrNoRows) {
+					model.NotFound++
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := setRatingTx(ctx, tx, e, sql.NullInt64{Int64: ratings[i], Valid: true}, changes); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		model.Rated = changes.count(auditFieldRating, false)
+		model.Changed = int64(len(changes))
+		return err
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderJSON {
+		model.BasePage = &types.BasePage{Perf: &p}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, withChanged(postRedirectTarget(r, "/compare"), model.Changed), http.StatusSeeOther)
+}
@@ -7,9 +7,11 @@ import (
 	"golocalgal/internal/vars"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -17,13 +19,20 @@ import (
 // Config holds configuration for starting the HTTP server.
 type Config struct {
 	Bind            string
-	Dsn             string
+	BaseURL         string // where other programs, such as players of playlists, reach the server; empty derives it from Bind
+	Catalogue       string // one of Catalogues
+	Dsn             string // of the RipMe database, or of the folder index
+	LocalDsn        string
 	MediaRoot       string
 	DfLog           string
 	DfLogRoot       string
+	FollowSymlinks  bool // follow symlinks that leave MediaRoot and DfLogRoot
 	ReadOnly        bool
 	SlowSqlMs       int
 	CorsOrigins     string
+	CoverRule       string
+	AuthSecret      string // shared secret to require; empty keeps the one stored in the LocalGal database, if any
+	AuthLoopback    bool   // let loopback clients in without the shared secret
 	BuildInfo       types.BuildInfo
 	TemplatesFS     embed.FS
 	StaticFSHandler http.Handler
@@ -132,15 +141,39 @@ func GetServerConfig() Config {
 
 	ro := shouldRunReadOnly()
 
+	coverRule := vars.EnvCoverRule.GetValueDefault(CoverRuleLatest)
+	if !slices.Contains(CoverRules, coverRule) {
+		log.Printf("Unknown %s %q, using %q. Expected one of: %s", vars.EnvCoverRule.Key(), coverRule, CoverRuleLatest, strings.Join(CoverRules, ", "))
+		coverRule = CoverRuleLatest
+	}
+
+	catalogue := vars.EnvCatalogue.GetValueDefault(CatalogueRipMe)
+	if !slices.Contains(Catalogues, catalogue) {
+		log.Printf("Unknown %s %q, using %q. Expected one of: %s", vars.EnvCatalogue.Key(), catalogue, CatalogueRipMe, strings.Join(Catalogues, ", "))
+		catalogue = CatalogueRipMe
+	}
+	if catalogue == CatalogueFolders {
+		sqlitePath = "./" + FolderIndexFile
+	}
+
+	dsn := vars.EnvSqliteDsn.GetValueDefault("file:" + sqlitePath)
+
 	serverConfig := Config{
 		Bind:            vars.EnvBind.GetValueDefault("127.0.0.1:5033"),
-		Dsn:             vars.EnvSqliteDsn.GetValueDefault("file:" + sqlitePath),
+		BaseURL:         getBaseURL(),
+		Catalogue:       catalogue,
+		Dsn:             dsn,
+		LocalDsn:        vars.EnvLocalDsn.GetValueDefault(getDefaultLocalDsn(dsn)),
 		MediaRoot:       vars.EnvMediaRoot.GetValueDefault(ripsDir),
 		DfLog:           dfLog,
 		DfLogRoot:       dfLogRoot,
+		FollowSymlinks:  shouldFollowSymlinks(),
 		ReadOnly:        ro,
 		SlowSqlMs:       slowSqlMs,
 		CorsOrigins:     vars.EnvCorsOrigins.GetValueDefault(""),
+		CoverRule:       coverRule,
+		AuthSecret:      getAuthSecret(),
+		AuthLoopback:    shouldExemptLoopback(),
 		BuildInfo:       buildInfo,
 		TemplatesFS:     templatesFS,
 		StaticFSHandler: staticFSHandler,
@@ -148,6 +181,20 @@ func GetServerConfig() Config {
 	return serverConfig
 }
 
+// getBaseURL returns BASE_URL without a trailing slash, or "" when it's unset or not an absolute http or https URL
+func getBaseURL() string {
+	v := strings.TrimRight(vars.EnvBaseUrl.GetValue(), "/")
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Printf("Ignoring %s %q, expected an absolute http or https URL such as http://192.168.1.10:5033", vars.EnvBaseUrl.Key(), v)
+		return ""
+	}
+	return v
+}
+
 func getDefaultDfLogRoot(path string) string {
 	if filepath.IsAbs(path) {
 		return filepath.Clean(filepath.Dir(path))
@@ -159,6 +206,15 @@ func getDefaultDfLogRoot(path string) string {
 	return filepath.Clean(filepath.Dir(filepath.Join(wd, path)))
 }
 
+// getDefaultLocalDsn places the LocalGal database next to the RipMe database
+func getDefaultLocalDsn(dsn string) string {
+	filename := getFileFromDsn(dsn)
+	if filename == "" || filename == ":memory:" {
+		return "file:" + LocalDbFile
+	}
+	return "file:" + filepath.Join(filepath.Dir(filename), LocalDbFile)
+}
+
 func shouldRunReadOnly() bool {
 	// Get from CLI flags first
 	if vars.RoFlag.IsSet {
@@ -174,3 +230,30 @@ func shouldRunReadOnly() bool {
 	}
 	return false // default
 }
+
+func getAuthSecret() string {
+	// Get from CLI flags first
+	if vars.AuthSecretFlag.IsSet {
+		return vars.AuthSecretFlag.Value
+	}
+	// Get from environment second
+	return vars.EnvAuthSecret.GetValue()
+}
+
+func shouldFollowSymlinks() bool {
+	v := vars.EnvFollowSymlinks.GetValue()
+	switch v {
+	case "1", "true", "yes":
+		return true
+	}
+	return false // default
+}
+
+func shouldExemptLoopback() bool {
+	v := vars.EnvAuthLoopback.GetValue()
+	switch v {
+	case "1", "true", "yes":
+		return true
+	}
+	return false // default
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Media is only read through an os.Root of MEDIA_ROOT or DFLOG_ROOT, so neither a request path nor a symlink can reach
+// files outside of them. Symlinks that leave the directory are only followed with FOLLOW_SYMLINKS.
+
+// confinedDir is a directory that files are opened in, and never outside of
+type confinedDir struct {
+	label          string // environment variable of the directory, for logs
+	dir            string // absolute path
+	followSymlinks bool
+	mu             sync.Mutex
+	root           *os.Root // opened on first use, so the directory may be created after starting
+}
+
+func newConfinedDir(label string, dir string, followSymlinks bool) *confinedDir {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = filepath.Clean(dir)
+	}
+	return &confinedDir{label: label, dir: abs, followSymlinks: followSymlinks}
+}
+
+func (d *confinedDir) getRoot() (*os.Root, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.root == nil {
+		root, err := os.OpenRoot(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		d.root = root
+	}
+	return d.root, nil
+}
+
+// open opens name, a path relative to the directory. A missing file is an fs.ErrNotExist error and isn't logged;
+// a path that leaves the directory is refused and logged.
+func (d *confinedDir) open(name string) (*os.File, error) {
+	if !filepath.IsLocal(name) {
+		log.Printf("Refused %q: not a path within %s %s", name, d.label, d.dir)
+		return nil, fs.ErrNotExist
+	}
+	root, err := d.getRoot()
+	if err != nil {
+		return nil, err
+	}
+	f, err := root.Open(name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	if d.followSymlinks {
+		// name is local, so only a symlink can lead out of the directory
+		resolved, evalErr := filepath.EvalSymlinks(filepath.Join(d.dir, name))
+		if evalErr == nil {
+			return os.Open(resolved)
+		}
+		err = evalErr
+	}
+	log.Printf("Refused %q in %s %s: %v", name, d.label, d.dir, err)
+	return nil, err
+}
+
+// rel returns path relative to the directory, or false if it's outside of it
+func (d *confinedDir) rel(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(d.dir, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+func (d *confinedDir) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.root == nil {
+		return nil
+	}
+	err := d.root.Close()
+	d.root = nil
+	return err
+}
+
+// knownFile is a file of the downloaded file log, in MEDIA_ROOT or DFLOG_ROOT
+type knownFile struct {
+	dir  *confinedDir
+	name string // relative to dir
+}
+
+// localPath returns where the file is on disk, or false if it isn't a regular file in its directory
+func (f knownFile) localPath() (string, bool) {
+	file, err := f.dir.open(f.name)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return "", false
+	}
+	return filepath.Join(f.dir.dir, f.name), true
+}
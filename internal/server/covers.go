@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Cover rules choose the thumbnail of galleries without a chosen cover
+const (
+	CoverRuleLatest     string = "latest" // highest file id, the most recently ripped file
+	CoverRuleFirst      string = "first"
+	CoverRuleFirstImage string = "first-image"
+	CoverRuleRated      string = "rated"   // highest local rating, then images, then latest
+	CoverRuleLargest    string = "largest" // most pixels, then most bytes, preferring images
+)
+
+var CoverRules = []string{CoverRuleLatest, CoverRuleFirst, CoverRuleFirstImage, CoverRuleRated, CoverRuleLargest}
+
+// coverRuleOrderBy orders the files of a gallery so that the first one is its automatic cover
+func coverRuleOrderBy(rule string) string {
+	switch rule {
+	case CoverRuleFirst:
+		return "ORDER BY marf.remote_file_id"
+	case CoverRuleFirstImage:
+		return "ORDER BY (mt.name LIKE 'image/%') DESC, marf.remote_file_id"
+	case CoverRuleRated:
+		return "ORDER BY (rf.local_rating IS NULL), rf.local_rating DESC, (mt.name LIKE 'image/%') DESC, marf.remote_file_id DESC"
+	case CoverRuleLargest:
+		return "ORDER BY (mt.name LIKE 'image/%') DESC, COALESCE(rf.width_px * rf.height_px, 0) DESC, COALESCE(rf.bytes, 0) DESC, marf.remote_file_id DESC"
+	default:
+		return "ORDER BY marf.remote_file_id DESC"
+	}
+}
+
+// galleryThumbSQL selects the thumbnail file id of the album in albumIdColumn: the chosen cover if it's still fetched and not ignored,
+// otherwise the first file by the cover rule. It takes one argument, the JSON object of covers from getGalleryCoversJSON.
+// The covers are in LocalDb, so they are passed to Db as an argument, like the scores of fileScoreSQL.
+func galleryThumbSQL(albumIdColumn string, rule string) string {
+	return strings.NewReplacer("/*ALBUM_ID*/", albumIdColumn, "/*ORDER_BY*/", coverRuleOrderBy(rule)).Replace(`COALESCE((
+				    SELECT rf.remote_file_id
+				      FROM map_album_remote_file marf
+				      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
+				     WHERE marf.album_id = /*ALBUM_ID*/
+				       AND marf.remote_file_id = json_extract(?, '$."' || /*ALBUM_ID*/ || '"')
+				       AND rf.fetched = 1
+				       AND rf.ignored = 0
+				       ), (
+				    SELECT rf.remote_file_id
+				      FROM map_album_remote_file marf
+				      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
+				      LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				     WHERE marf.album_id = /*ALBUM_ID*/
+				       AND rf.fetched = 1
+				       AND rf.ignored = 0
+				     /*ORDER_BY*/
+				     LIMIT 1
+				       ))`)
+}
+
+// getGalleryCoversJSON returns the chosen covers of all galleries as a JSON object by album id, for galleryThumbSQL.
+// Errors are logged rather than returned, so listings still work with only the cover rule.
+func (app *App) getGalleryCoversJSON(ctx context.Context) string {
+	if app.LocalDb == nil {
+		return "{}"
+	}
+	var covers string
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, `
+			SELECT COALESCE(json_group_object(CAST(album_id AS TEXT), remote_file_id), '{}')
+			  FROM gallery_cover
+		`).Scan(&covers)
+	}); err != nil {
+		log.Printf("unable to load gallery covers: %v", err)
+		return "{}"
+	}
+	return covers
+}
+
+// getGalleryCover returns the chosen cover of a gallery, or null if the cover rule applies.
+// Errors are logged rather than returned, like getGalleryCoversJSON.
+func (app *App) getGalleryCover(ctx context.Context, albumId int64) types.SqlJsonInt64 {
+	var cover types.SqlJsonInt64
+	if app.LocalDb == nil {
+		return cover
+	}
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, `
+			SELECT remote_file_id
+			  FROM gallery_cover
+			 WHERE album_id = ?
+		`, albumId).Scan(&cover)
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("unable to load gallery cover: %v", err)
+	}
+	return cover
+}
+
+// getGalleryCoverTx is getGalleryCover in a LocalDb transaction, returning errors
+func getGalleryCoverTx(ctx context.Context, tx *sql.Tx, albumId int64) (cover sql.NullInt64, err error) {
+	err = tx.QueryRowContext(ctx, `
+		SELECT remote_file_id
+		  FROM gallery_cover
+		 WHERE album_id = ?
+	`, albumId).Scan(&cover)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cover, nil
+	}
+	return cover, err
+}
+
+// setGalleryCoverTx sets the chosen cover of a gallery, or clears it with null, recording the change if the cover differs
+func setGalleryCoverTx(ctx context.Context, tx *sql.Tx, e auditEntity, cover sql.NullInt64, changes *auditChanges) error {
+	old, err := getGalleryCoverTx(ctx, tx, e.Id)
+	if err != nil {
+		return err
+	}
+	if old == cover {
+		return nil
+	}
+	if !cover.Valid {
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM gallery_cover
+			 WHERE album_id = ?
+		`, e.Id)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO gallery_cover (album_id, remote_file_id)
+			VALUES (?, ?)
+			    ON CONFLICT (album_id) DO UPDATE
+			   SET remote_file_id = excluded.remote_file_id
+			     , updated_ts     = UNIXEPOCH('subsec') * 1000
+		`, e.Id, cover.Int64)
+	}
+	if err != nil {
+		return err
+	}
+	changes.add(e.change(auditFieldCover, coverString(old), coverString(cover)))
+	return nil
+}
+
+// coverString is a cover file id as recorded in the audit log, null for the cover rule
+func coverString(cover sql.NullInt64) sql.NullString {
+	if !cover.Valid {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strconv.FormatInt(cover.Int64, 10), Valid: true}
+}
+
+// handleGalleryCoverPost handles POST /gallery/{ripper_host}/{gid}/cover and POST /api/gallery/{ripper_host}/{gid}/cover.
+// Form field cover_file_id sets the cover to one of the gallery's files, or 0 to go back to the cover rule.
+func (app *App) handleGalleryCoverPost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save cover"))
+		return
+	}
+	ripperHost := r.PathValue("ripper_host")
+	gid := r.PathValue("gid")
+	if ripperHost == "" || gid == "" {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected values for all path parts: /gallery/{ripper_host}/{gid}/cover"))
+		return
+	}
+	coverId, err := strconv.ParseInt(r.FormValue("cover_file_id"), 10, 64)
+	if err != nil || coverId < 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid cover_file_id, must be a file id or 0"))
+		return
+	}
+	var albumId int64
+	var inAlbum bool
+	if err := app.withSQL(r.Context(), func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT a.album_id
+			     , EXISTS (
+			    SELECT 1
+			      FROM map_album_remote_file marf
+			     WHERE marf.album_id = a.album_id
+			       AND marf.remote_file_id = ?
+			       )
+			  FROM album a
+			  JOIN ripper r ON r.ripper_id = a.ripper_id
+			 WHERE r.host = ?
+			   AND a.gid = ?
+		`, coverId, ripperHost, gid).Scan(&albumId, &inAlbum)
+	}); errors.Is(err, sql.ErrNoRows) {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusNotFound, fmt.Errorf("gallery not found"))
+		return
+	} else if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusInternalServerError, err)
+		return
+	}
+	if coverId > 0 && !inAlbum {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("file %d is not in the gallery", coverId))
+		return
+	}
+	e := auditEntity{Type: auditEntityGallery, Id: albumId, RipperHost: ripperHost, Key: gid}
+	cover := sql.NullInt64{Int64: coverId, Valid: coverId > 0}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			tx, err := app.LocalDb.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			var changes auditChanges
+			if err := setGalleryCoverTx(ctx, tx, e, cover, &changes); err != nil {
+				return err
+			}
+			if err := recordAuditTx(ctx, tx, clientAddr(r), changes); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, postRedirectTarget(r, "/gallery/"+ripperHost+"/"+url.PathEscape(gid)), http.StatusSeeOther)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"golocalgal/internal/types"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Writes from a browser must come from a LocalGal page: the Origin or Sec-Fetch-Site of the request must be
+// LocalGal's own, and the request must carry the CSRF token of the client, which every form of a page embeds.
+// Clients that aren't browsers send neither header and can't be tricked into a write by another page, and
+// neither can requests with an Authorization header, which browsers only send cross-origin after a CORS preflight.
+
+const (
+	csrfCookieName = "csrf"
+	csrfFormField  = "csrf"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token of the client, setting a new one when it has none
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return newCSRFToken(w, r)
+}
+
+// newCSRFToken sets a new CSRF token, such as on logging in, so every session has its own
+func newCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	token := rand.Text()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF returns an error if r is a write that a page of another site could have made
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	if r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	site := r.Header.Get("Sec-Fetch-Site")
+	origin := r.Header.Get("Origin")
+	if site == "" && origin == "" {
+		return nil
+	}
+	if site != "" {
+		if site != "same-origin" && site != "none" {
+			return errors.New("cross-site request refused; submit the form from LocalGal's own page")
+		}
+	} else if !isSameOrigin(origin, r) {
+		return errors.New("cross-origin request refused; submit the form from LocalGal's own page")
+	}
+
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return errors.New("missing CSRF cookie; reload the page and try again")
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" && !isJSONBody(r) {
+		token = r.PostFormValue(csrfFormField)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) != 1 {
+		return errors.New("invalid CSRF token; reload the page and try again")
+	}
+	return nil
+}
+
+func isSameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // including "null", from sandboxed and privacy-sensitive contexts
+	}
+	// Only the host, since a reverse proxy may terminate TLS
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// withCSRF refuses writes that fail checkCSRF
+func (app *App) withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkCSRF(r); err != nil {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				r = withRenderMode(r, RenderJSON)
+			}
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusForbidden, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
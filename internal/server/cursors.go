@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// keyset is a sort order that can be paged with cursors instead of OFFSET. Its last key must be unique, such as the row id.
+// Key expressions use /*T*/ for the table alias, so the same keyset can order a CTE and the query that reads it.
+type keyset struct {
+	sort string
+	keys []keysetKey
+}
+
+type keysetKey struct {
+	expr string
+	desc bool
+	args []any // bound each time expr is used, for expressions that take arguments like fileScoreSQL
+}
+
+// cursor is the position after the last row of a page, or before the first row for the previous page.
+// It's sent to clients as an opaque token, see encode and parseCursor.
+type cursor struct {
+	Sort   string `json:"s"`
+	Keys   []any  `json:"k"` // the key values of the row, in keyset order
+	Before bool   `json:"b,omitempty"`
+}
+
+func (k keyset) exprs(alias string) []string {
+	exprs := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		exprs[i] = strings.ReplaceAll(key.expr, "/*T*/", alias+".")
+	}
+	return exprs
+}
+
+// orderBy returns the ORDER BY clause, reversed to read the rows before a cursor
+func (k keyset) orderBy(alias string, reverse bool) (string, []any) {
+	var terms []string
+	var args []any
+	for i, expr := range k.exprs(alias) {
+		if k.keys[i].desc != reverse {
+			expr += " DESC"
+		}
+		terms = append(terms, expr)
+		args = append(args, k.keys[i].args...)
+	}
+	return "ORDER BY " + strings.Join(terms, ", "), args
+}
+
+// keysJSON returns an expression of the key values of a row as a JSON array, to make the cursors of a page from
+func (k keyset) keysJSON(alias string) (string, []any) {
+	var args []any
+	for _, key := range k.keys {
+		args = append(args, key.args...)
+	}
+	return "json_array(" + strings.Join(k.exprs(alias), ", ") + ")", args
+}
+
+// where returns a condition for the rows after the cursor, or before it, in the order of the keyset.
+// Keys compare with IS for equality, so null keys work; null values sort by a separate (x IS NULL) key before them.
+func (k keyset) where(alias string, c *cursor) (string, []any) {
+	if c == nil {
+		return "", nil
+	}
+	exprs := k.exprs(alias)
+	var clause string
+	var args []any
+	for i := len(exprs) - 1; i >= 0; i-- {
+		op := ">"
+		if k.keys[i].desc != c.Before {
+			op = "<"
+		}
+		var keyArgs []any
+		keyArgs = append(keyArgs, k.keys[i].args...)
+		keyArgs = append(keyArgs, c.Keys[i])
+		if clause == "" {
+			clause = fmt.Sprintf("%s %s ?", exprs[i], op)
+			args = keyArgs
+			continue
+		}
+		clause = fmt.Sprintf("%s %s ? OR (%s IS ? AND (%s))", exprs[i], op, exprs[i], clause)
+		args = append(append(append([]any{}, keyArgs...), keyArgs...), args...)
+	}
+	return "AND (" + clause + ")", args
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pageCursors makes the cursors after the last row and before the first row of a page, from the keysJSON of the rows in display order
+func (k keyset) pageCursors(rowKeys []string) (next string, prev string) {
+	if len(rowKeys) == 0 {
+		return "", ""
+	}
+	var first, last []any
+	_ = json.Unmarshal([]byte(rowKeys[0]), &first)
+	_ = json.Unmarshal([]byte(rowKeys[len(rowKeys)-1]), &last)
+	return cursor{Sort: k.sort, Keys: last}.encode(), cursor{Sort: k.sort, Keys: first, Before: true}.encode()
+}
+
+// parseCursor reads the cursor query parameter, nil if there is none. A cursor of another sort order is an error.
+func parseCursor(r *http.Request, k keyset) (*cursor, error) {
+	token := r.URL.Query().Get("cursor")
+	if token == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalid{fmt.Errorf("invalid cursor")}
+	}
+	var c cursor
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil || len(c.Keys) != len(k.keys) {
+		return nil, errInvalid{fmt.Errorf("invalid cursor")}
+	}
+	if c.Sort != k.sort {
+		return nil, errInvalid{fmt.Errorf("cursor is for another sort order, go back to the first page")}
+	}
+	for i, v := range c.Keys {
+		switch v := v.(type) {
+		case nil:
+		case json.Number:
+			// Keys are integers, as floats wouldn't compare equal after a round trip through the cursor
+			n, err := v.Int64()
+			if err != nil {
+				return nil, errInvalid{fmt.Errorf("invalid cursor")}
+			}
+			c.Keys[i] = n
+		case string:
+		default:
+			return nil, errInvalid{fmt.Errorf("invalid cursor")}
+		}
+	}
+	return &c, nil
+}
+
+// readCursorPage puts rows read before a cursor, which come in reverse, back in display order
+func readCursorPage[T any](c *cursor, rows []T, rowKeys []string) {
+	if c != nil && c.Before {
+		slices.Reverse(rows)
+		slices.Reverse(rowKeys)
+	}
+}
+
+// setCursorLinks sets the RFC 8288 Link header of API responses to the next and previous pages
+func setCursorLinks(w http.ResponseWriter, r *http.Request, page int, next string, prev string, hasNext bool, hasPrev bool) {
+	if getRenderMode(r.Context()) != RenderJSON {
+		return
+	}
+	link := func(token string, page int, rel string) string {
+		u := url.URL{Path: r.URL.Path}
+		q := r.URL.Query()
+		q.Set("cursor", token)
+		q.Set("page", strconv.Itoa(page))
+		u.RawQuery = q.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+	}
+	var links []string
+	if hasNext && next != "" {
+		links = append(links, link(next, page+1, "next"))
+	}
+	if hasPrev && prev != "" {
+		links = append(links, link(prev, page-1, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
@@ -232,11 +232,12 @@ func OptimizeDb(ctx context.Context, db *sql.DB) error {
 	return nil
 }
 
-// loadKnownFiles builds knownFilePaths from a log file: each line is a relative or absolute path to a file.
+// loadKnownFiles builds knownFilePaths from a log file: each line is a path to a file, absolute or relative to DfLogRoot.
+// Files outside of DfLogRoot and MediaRoot are skipped.
 func (app *App) loadKnownFiles(ctx context.Context, path string) error {
 	log.Printf("Loading known files")
-	knownFilePaths := map[string][]string{}
-	dir := filepath.Dir(path)
+	knownFilePaths := map[string][]knownFile{}
+	skipped := 0
 	f, err := os.Open(path)
 	if err != nil {
 		log.Printf("known file log open: %v", err)
@@ -255,16 +256,19 @@ func (app *App) loadKnownFiles(ctx context.Context, path string) error {
 			continue
 		}
 		base := filepath.Base(p)
-		target := filepath.Join(dir, p)
+		target := p
 		if !filepath.IsAbs(target) {
-			target = filepath.Join(app.DfLogRoot, target)
-			target = filepath.Clean(target)
-			target, err = filepath.Rel(app.DfLogRoot, target)
-			if err != nil {
-				log.Printf("Not able to resolve clean relative path for %v: %v", p, err)
+			target = filepath.Join(app.DfLogRoot.dir, target)
+		}
+		known, ok := app.knownFileOf(target)
+		if !ok {
+			if skipped == 0 {
+				log.Printf("Skipping known files outside of %s and %s, such as %s", app.DfLogRoot.label, app.MediaRoot.label, target)
 			}
+			skipped++
+			continue
 		}
-		knownFilePaths[base] = append(knownFilePaths[base], target)
+		knownFilePaths[base] = append(knownFilePaths[base], known)
 	}
 	if err := s.Err(); err != nil {
 		log.Printf("known file log scan: %v", err)
@@ -276,5 +280,18 @@ func (app *App) loadKnownFiles(ctx context.Context, path string) error {
 	}
 	app.KnownFilePaths = knownFilePaths
 	log.Printf("known file log loaded %d filenames", len(app.KnownFilePaths))
+	if skipped > 0 {
+		log.Printf("known file log skipped %d files outside of %s and %s", skipped, app.DfLogRoot.label, app.MediaRoot.label)
+	}
 	return nil
 }
+
+// knownFileOf returns the known file at path, in DfLogRoot or else MediaRoot
+func (app *App) knownFileOf(path string) (knownFile, bool) {
+	for _, d := range []*confinedDir{app.DfLogRoot, app.MediaRoot} {
+		if name, ok := d.rel(path); ok {
+			return knownFile{dir: d, name: name}, true
+		}
+	}
+	return knownFile{}, false
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"golocalgal/api"
+	"net/http"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The kinds of errors a handler can return from perfTracker or pass to renderError. renderError picks the
+// HTTP status and API error code from the kind, so a handler doesn't need to check for them itself.
+type (
+	// errInvalid is a request that can't be served as asked, such as an invalid cursor: 400
+	errInvalid struct{ error }
+	// errUnauthorized is a request without a session or the shared secret, when one is required: 401
+	errUnauthorized struct{ error }
+	// errNotFound is a gallery, file, or other resource that doesn't exist: 404
+	errNotFound struct{ error }
+	// errReadOnly is a write while the database is opened read-only: 403
+	errReadOnly struct{ error }
+	// errConflict is a write that conflicts with the current data, such as a tag implication loop: 409
+	errConflict struct{ error }
+	// errPrecondition is a write whose If-Match doesn't match the current ETag: 412
+	errPrecondition struct{ error }
+	// errBusy is a database that stayed locked by another writer, such as RipMe, until the busy timeout: 503
+	errBusy struct{ error }
+)
+
+func (e errInvalid) Unwrap() error      { return e.error }
+func (e errUnauthorized) Unwrap() error { return e.error }
+func (e errNotFound) Unwrap() error     { return e.error }
+func (e errReadOnly) Unwrap() error     { return e.error }
+func (e errConflict) Unwrap() error     { return e.error }
+func (e errPrecondition) Unwrap() error { return e.error }
+func (e errBusy) Unwrap() error         { return e.error }
+
+// errorStatus returns the HTTP status and API error code of err. status is used for errors of no known kind.
+func errorStatus(err error, status int) (int, string) {
+	var (
+		invalid  errInvalid
+		unauth   errUnauthorized
+		notFound errNotFound
+		readOnly errReadOnly
+		conflict errConflict
+		precond  errPrecondition
+		busy     errBusy
+		se       sqlite3.Error
+	)
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest, api.CodeInvalidRequest
+	case errors.As(err, &unauth):
+		return http.StatusUnauthorized, api.CodeUnauthorized
+	case errors.As(err, &notFound), errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, api.CodeNotFound
+	case errors.As(err, &readOnly):
+		return http.StatusForbidden, api.CodeReadOnly
+	case errors.As(err, &conflict):
+		return http.StatusConflict, api.CodeConflict
+	case errors.As(err, &precond):
+		return http.StatusPreconditionFailed, api.CodePrecondition
+	case errors.As(err, &busy):
+		return http.StatusServiceUnavailable, api.CodeBusy
+	case errors.As(err, &se):
+		switch se.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return http.StatusServiceUnavailable, api.CodeBusy
+		case sqlite3.ErrReadonly:
+			return http.StatusForbidden, api.CodeReadOnly
+		case sqlite3.ErrConstraint:
+			return http.StatusConflict, api.CodeConflict
+		}
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return status, api.CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return status, api.CodeUnauthorized
+	case http.StatusNotFound:
+		return status, api.CodeNotFound
+	case http.StatusForbidden:
+		return status, api.CodeForbidden
+	case http.StatusConflict:
+		return status, api.CodeConflict
+	case http.StatusServiceUnavailable:
+		return status, api.CodeUnavailable
+	}
+	return status, api.CodeInternal
+}
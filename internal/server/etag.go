@@ -16,7 +16,7 @@ func computeETag(r *http.Request) string {
 		"page", "size", "sort",
 		"gal_rating_min", "gal_rating_max", "gal_unrated",
 		"file_rating_min", "file_rating_max", "file_unrated",
-		"file_type", "q",
+		"file_type", "q", "profile", "select", "changed", "unblock",
 	}
 
 	// Map of parameters to their corresponding cookie names
@@ -28,6 +28,8 @@ func computeETag(r *http.Request) string {
 		"file_rating_max": "defaultFileRatingMax",
 		"file_unrated":    "defaultFileUnrated",
 		"file_type":       "defaultFileType",
+		"profile":         "profile",
+		"select":          "selectMode",
 	}
 
 	// Sort keys for deterministic output
@@ -49,6 +51,12 @@ func computeETag(r *http.Request) string {
 		}
 	}
 
+	// Pages embed the CSRF token in their forms
+	if c, err := r.Cookie(csrfCookieName); err == nil {
+		h.Write([]byte(csrfCookieName))
+		h.Write([]byte(c.Value))
+	}
+
 	// Bust cache if cacheBust cookie is set
 	if c, err := r.Cookie("cacheBust"); err == nil {
 		h.Write([]byte("cacheBust"))
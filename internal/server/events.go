@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	eventsPollInterval = time.Second      // how often the watcher checks whether the RipMe database changed
+	eventsKeepAlive    = 30 * time.Second // comment lines keep idle streams from being closed by proxies
+	eventMaxGalleries  = 50               // galleries listed in one galleries event; count has the rest
+	eventBuffer        = 64               // events a slow client can fall behind before it misses some
+)
+
+type event struct {
+	id   int64
+	name string // "galleries", "files", or "rating"
+	data any
+}
+
+// eventHub fans change events out to the clients of /api/events
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan event]struct{}
+	lastId int64
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan event]struct{})}
+}
+
+// subscribe returns a channel of the events published from now on. It's closed when the hub closes.
+func (h *eventHub) subscribe() chan event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan event, eventBuffer)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends an event to every client without waiting; a client whose buffer is full misses it.
+// A nil hub is allowed, for writes made from the command line.
+func (h *eventHub) publish(name string, data any) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastId++
+	e := event{id: h.lastId, name: name, data: data}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// close ends every stream, so the server can shut down
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publishRatingEvents sends the rating changes of a write to /api/events
+func (app *App) publishRatingEvents(changes auditChanges) {
+	for _, c := range changes {
+		if c.Field == auditFieldRating {
+			app.events.publish("rating", c)
+		}
+	}
+}
+
+// watchDb polls PRAGMA data_version on a dedicated connection, which changes whenever another connection,
+// such as RipMe's, commits to the database. Galleries and files with higher ids than before are then reported
+// as new, on /api/events and in the log. It runs until ctx is done, and then closes the event streams.
+func (app *App) watchDb(ctx context.Context) {
+	defer app.events.close()
+	conn, err := app.Db.Conn(ctx)
+	if err != nil {
+		log.Printf("watch db: %v (live updates won't be sent)", err)
+		return
+	}
+	defer conn.Close()
+
+	var version, lastAlbumId, lastFileId int64
+	if err := conn.QueryRowContext(ctx, `PRAGMA data_version`).Scan(&version); err != nil {
+		log.Printf("watch db: %v (live updates won't be sent)", err)
+		return
+	}
+	if lastAlbumId, lastFileId, err = getMaxIds(ctx, conn); err != nil {
+		log.Printf("watch db: %v (live updates won't be sent)", err)
+		return
+	}
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var v int64
+		if err := conn.QueryRowContext(ctx, `PRAGMA data_version`).Scan(&v); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("watch db: %v", err)
+			}
+			continue
+		}
+		if v == version {
+			continue
+		}
+		version = v
+		albumId, fileId, err := getMaxIds(ctx, conn)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("watch db: %v", err)
+			}
+			continue
+		}
+		if fileId > lastFileId {
+			var e types.FilesEvent
+			if err := conn.QueryRowContext(ctx, `
+				SELECT COUNT(*)
+				  FROM remote_file
+				 WHERE remote_file_id > ?
+				   AND remote_file_id <= ?
+			`, lastFileId, fileId).Scan(&e.Count); err != nil {
+				log.Printf("watch db: %v", err)
+				continue
+			}
+			lastFileId = fileId
+			log.Printf("Ingest: files added: %d", e.Count)
+			app.events.publish("files", e)
+		}
+		if albumId > lastAlbumId {
+			e, err := getNewGalleries(ctx, conn, lastAlbumId, albumId)
+			if err != nil {
+				log.Printf("watch db: %v", err)
+				continue
+			}
+			lastAlbumId = albumId
+			log.Printf("Ingest: galleries added: %d", e.Count)
+			app.events.publish("galleries", e)
+		}
+	}
+}
+
+func getMaxIds(ctx context.Context, conn *sql.Conn) (albumId int64, fileId int64, err error) {
+	err = conn.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT MAX(album_id) FROM album), 0)
+		     , COALESCE((SELECT MAX(remote_file_id) FROM remote_file), 0)
+	`).Scan(&albumId, &fileId)
+	return albumId, fileId, err
+}
+
+// getNewGalleries lists the galleries with ids in (afterId, maxId]
+func getNewGalleries(ctx context.Context, conn *sql.Conn, afterId int64, maxId int64) (types.GalleriesEvent, error) {
+	e := types.GalleriesEvent{Galleries: []types.Album{}}
+	if err := conn.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		  FROM album
+		 WHERE album_id > ?
+		   AND album_id <= ?
+	`, afterId, maxId).Scan(&e.Count); err != nil {
+		return e, err
+	}
+	rows, err := conn.QueryContext(ctx, `
+		SELECT a.album_id
+		     , r.name AS ripper_name
+		     , r.host AS ripper_host
+		     , a.gid
+		     , a.title
+		     , a.inserted_ts
+		  FROM album a
+		  JOIN ripper r ON r.ripper_id = a.ripper_id
+		 WHERE a.album_id > ?
+		   AND a.album_id <= ?
+		 ORDER BY a.album_id
+		 LIMIT ?
+	`, afterId, maxId, eventMaxGalleries)
+	if err != nil {
+		return e, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a types.Album
+		if err := rows.Scan(&a.AlbumId, &a.RipperName, &a.RipperHost, &a.Gid, &a.Title, &a.InsertedTs); err != nil {
+			return e, err
+		}
+		a.HrefPage = fmt.Sprintf("/gallery/%s/%s", a.RipperHost, a.Gid)
+		e.Galleries = append(e.Galleries, a)
+	}
+	return e, rows.Err()
+}
+
+// handleEvents handles /api/events, a Server-Sent Events stream of galleries and files added to the database,
+// and of ratings changed in LocalGal
+func (app *App) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	ch := app.events.subscribe()
+	defer app.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			// The blocklist is the one of the request that opened the stream
+			if ge, ok := e.data.(types.GalleriesEvent); ok {
+				ge, err := app.withoutBlockedGalleries(r.Context(), ge)
+				if err != nil {
+					log.Printf("event %s: %v", e.name, err)
+					continue
+				}
+				if ge.Count <= 0 {
+					continue
+				}
+				e.data = ge
+			}
+			data, err := json.Marshal(e.data)
+			if err != nil {
+				log.Printf("event %s: %v", e.name, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.name, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
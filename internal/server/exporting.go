@@ -0,0 +1,444 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// exportBatchSize is how many rows of an NDJSON export are read before they are written,
+// so local titles and notes can be looked up for a batch at a time instead of per row
+const exportBatchSize = 500
+
+// tagListSQL is a JSON array of the tags of one gallery or file, for types.Tag
+const tagListSQL = `(SELECT json_group_array(json_object('name', name, 'isLocal', json(CASE WHEN local = 1 THEN 'true' ELSE 'false' END)))
+				          FROM (SELECT t.name, t.local
+				                  FROM /*MAP_TABLE*/ m
+				                  JOIN tag t ON t.tag_id = m.tag_id
+				                 WHERE m./*MAP_ID*/ = /*ID*/
+				                 ORDER BY t.name))`
+
+func tagList(mapTable string, mapId string, id string) string {
+	return strings.NewReplacer("/*MAP_TABLE*/", mapTable, "/*MAP_ID*/", mapId, "/*ID*/", id).Replace(tagListSQL)
+}
+
+// getSince reads the since query parameter, in unix milliseconds, for exports of what was inserted since a previous one
+func getSince(r *http.Request) (int64, error) {
+	v := r.URL.Query().Get("since")
+	if v == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("invalid since, must be unix milliseconds")
+	}
+	return since, nil
+}
+
+// ndjsonWriter writes one JSON object per line, flushing each batch to the client
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	name    string
+	enc     *json.Encoder
+	written bool
+}
+
+func newNdjsonWriter(w http.ResponseWriter, name string) *ndjsonWriter {
+	return &ndjsonWriter{w: w, name: name, enc: json.NewEncoder(w)}
+}
+
+func (nw *ndjsonWriter) write(v any) error {
+	if !nw.written {
+		nw.w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		nw.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="localgal-%s.ndjson"`, nw.name))
+		nw.written = true
+	}
+	return nw.enc.Encode(v)
+}
+
+func (nw *ndjsonWriter) flush() {
+	if f, ok := nw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finishExport reports an export error. Once lines have been sent the status can't change anymore,
+// so the error is only logged and the export ends early.
+func (app *App) finishExport(w http.ResponseWriter, r *http.Request, p *types.Perf, nw *ndjsonWriter, err error) {
+	if err == nil {
+		return
+	}
+	if nw.written {
+		log.Printf("export %s ended early: %v", r.URL.Path, err)
+		return
+	}
+	app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+}
+
+// handleExportGalleries handles /api/export/galleries.ndjson
+func (app *App) handleExportGalleries(w http.ResponseWriter, r *http.Request) {
+	since, err := getSince(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	nw := newNdjsonWriter(w, "galleries")
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		grf := getGalleryRatingFilter(w, r)
+		ftf := getFileTypeFilter(w, r)
+		batch := make([]types.ExportGallery, 0, exportBatchSize)
+		writeBatch := func() error {
+			albums := make([]types.Album, len(batch))
+			for i := range batch {
+				albums[i] = batch[i].Album
+			}
+			app.populateAlbumsLocalMeta(ctx, albums)
+			for i := range batch {
+				batch[i].Album = albums[i]
+				if err := nw.write(&batch[i]); err != nil {
+					return err
+				}
+			}
+			nw.flush()
+			batch = batch[:0]
+			return nil
+		}
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			rfClause, rfArgs := ratingFilterSQL("a.local_rating", grf)
+			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
+			blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+			replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause, "/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule), "/*TAGS*/", tagList("map_album_tag", "album_id", "g.album_id"))
+			args := []any{app.getGalleryCoversJSON(ctx), since}
+			args = append(args, ftArgs...)
+			args = append(args, rfArgs...)
+			args = append(args, blArgs...)
+			// In id order, so rows stream from the table without sorting
+			//language=sqlite
+			rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
+				  WITH g AS (
+				      SELECT a.album_id
+				           , a.ripper_id
+				           , a.gid
+				           , a.uploader
+				           , a.title
+				           , a.description
+				           , a.created_ts
+				           , a.modified_ts
+				           , a.fetch_count
+				           , a.hidden
+				           , a.removed
+				           , a.local_rating
+				           , a.sum_rf_bytes
+				           , a.cnt_rf
+				           , a.last_fetch_ts
+				           , a.inserted_ts
+				           , /*THUMB*/ AS thumb_remote_file_id
+				        FROM album a
+				       WHERE a.inserted_ts >= ?
+				         AND EXISTS(
+				           SELECT 1
+				             FROM map_album_remote_file marf
+				             JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
+				             LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				            WHERE marf.album_id = a.album_id
+				              AND rf.fetched = 1
+				              AND rf.ignored = 0
+				              /*FILE_TYPE_FILTER*/
+				                   )
+				       /*RATING_FILTER*/
+				       /*BLOCKLIST*/
+				             )
+				SELECT g.album_id
+				     , r.name AS ripper_name
+				     , r.host AS ripper_host
+				     , g.gid
+				     , g.uploader
+				     , g.title
+				     , g.description
+				     , g.created_ts
+				     , g.modified_ts
+				     , g.fetch_count
+				     , g.hidden
+				     , g.removed
+				     , g.local_rating
+				     , g.sum_rf_bytes
+				     , g.cnt_rf
+				     , g.last_fetch_ts
+				     , g.inserted_ts
+				     , g.thumb_remote_file_id
+				     , trf.filename
+				     , tmt.name AS thumb_mime_type
+				     , /*TAGS*/ AS tags
+				  FROM g
+				  JOIN ripper r ON r.ripper_id = g.ripper_id
+				  LEFT JOIN remote_file trf ON trf.remote_file_id = g.thumb_remote_file_id
+				  LEFT JOIN mime_type tmt ON tmt.mime_type_id = trf.mime_type_id
+				 ORDER BY g.album_id
+			`), args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var g types.ExportGallery
+				var thumbFileId sql.NullInt64
+				var tags string
+				if err := rows.Scan(
+					&g.AlbumId,
+					&g.RipperName,
+					&g.RipperHost,
+					&g.Gid,
+					&g.Uploader,
+					&g.Title,
+					&g.Description,
+					&g.CreatedTs,
+					&g.ModifiedTs,
+					&g.FetchCount,
+					&g.Hidden,
+					&g.Removed,
+					&g.LocalRating,
+					&g.Bytes,
+					&g.FileCount,
+					&g.LastFetchTs,
+					&g.InsertedTs,
+					&thumbFileId,
+					&g.Thumb.Filename,
+					&g.Thumb.MimeType,
+					&tags,
+				); err != nil {
+					return err
+				}
+				if err := json.Unmarshal([]byte(tags), &g.Tags); err != nil {
+					return err
+				}
+				g.HrefPage = fmt.Sprintf("/gallery/%s/%s", g.RipperHost, g.Gid)
+				if thumbFileId.Valid {
+					g.Thumb.FileId = thumbFileId.Int64
+					g.Thumb.HrefPage = fmt.Sprintf("/media/%s/%s/%d", g.RipperHost, g.Gid, g.Thumb.FileId)
+					if g.Thumb.Filename.Valid {
+						g.Thumb.HrefMedia = fmt.Sprintf("/media/%s/%s/%s", g.RipperHost, g.Gid, g.Thumb.Filename.String)
+					}
+				}
+				batch = append(batch, g)
+				if len(batch) == exportBatchSize {
+					if err := writeBatch(); err != nil {
+						return err
+					}
+				}
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return writeBatch()
+		})
+	})
+	app.finishExport(w, r, &p, nw, err)
+}
+
+// handleExportFiles handles /api/export/files.ndjson
+func (app *App) handleExportFiles(w http.ResponseWriter, r *http.Request) {
+	since, err := getSince(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	nw := newNdjsonWriter(w, "files")
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		frf := getFileRatingFilter(w, r)
+		ftf := getFileTypeFilter(w, r)
+		batch := make([]types.ExportFile, 0, exportBatchSize)
+		writeBatch := func() error {
+			files := make([]types.File, len(batch))
+			for i := range batch {
+				files[i] = batch[i].File
+			}
+			app.populateFilesLocalMeta(ctx, files)
+			for i := range batch {
+				batch[i].File = files[i]
+				if err := nw.write(&batch[i]); err != nil {
+					return err
+				}
+			}
+			nw.flush()
+			batch = batch[:0]
+			return nil
+		}
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
+			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
+			blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+			replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause, "/*TAGS*/", tagList("map_remote_file_tag", "remote_file_id", "rf.remote_file_id"))
+			args := []any{since}
+			args = append(args, rfArgs...)
+			args = append(args, ftArgs...)
+			args = append(args, blArgs...)
+			// map_album_remote_file is keyed by album first, so the galleries of every file are grouped once
+			// rather than looked up per file, which is a scan of the index each time
+			//language=sqlite
+			rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
+				  WITH fa AS MATERIALIZED (
+				      SELECT marf.remote_file_id
+				           , json_group_array(marf.album_id) AS album_ids
+				        FROM map_album_remote_file marf
+				       GROUP BY marf.remote_file_id
+				                          )
+				SELECT rf.remote_file_id
+				     , r.name AS ripper_name
+				     , r.host AS ripper_host
+				     , rf.urlid
+				     , rf.filename
+				     , mt.name AS mime_type
+				     , rf.title
+				     , rf.description
+				     , rf.uploaded_ts
+				     , rf.uploader
+				     , rf.hidden
+				     , rf.removed
+				     , rf.bytes
+				     , rf.local_rating
+				     , rf.inserted_ts
+				     , COALESCE(fa.album_ids, '[]') AS album_ids
+				     , /*TAGS*/ AS tags
+				  FROM remote_file rf
+				  JOIN ripper r ON r.ripper_id = rf.ripper_id
+				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				  LEFT JOIN fa ON fa.remote_file_id = rf.remote_file_id
+				 WHERE rf.fetched = 1
+				   AND rf.ignored = 0
+				   AND rf.inserted_ts >= ?
+				   /*RATING_FILTER*/
+				   /*FILE_TYPE_FILTER*/
+				   /*BLOCKLIST*/
+				 ORDER BY rf.remote_file_id
+			`), args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var f types.ExportFile
+				var albumIds, tags string
+				if err := rows.Scan(
+					&f.FileId,
+					&f.RipperName,
+					&f.RipperHost,
+					&f.Urlid,
+					&f.Filename,
+					&f.MimeType,
+					&f.Title,
+					&f.Description,
+					&f.UploadedTs,
+					&f.Uploader,
+					&f.Hidden,
+					&f.Removed,
+					&f.Bytes,
+					&f.LocalRating,
+					&f.InsertedTs,
+					&albumIds,
+					&tags,
+				); err != nil {
+					return err
+				}
+				if err := json.Unmarshal([]byte(albumIds), &f.AlbumIds); err != nil {
+					return err
+				}
+				if err := json.Unmarshal([]byte(tags), &f.Tags); err != nil {
+					return err
+				}
+				f.HrefPage = fmt.Sprintf("/file/%s/%d", f.RipperHost, f.FileId)
+				if f.Filename.Valid {
+					f.HrefMedia = fmt.Sprintf("/media/%s/%s", f.RipperHost, f.Filename.String)
+				}
+				batch = append(batch, f)
+				if len(batch) == exportBatchSize {
+					if err := writeBatch(); err != nil {
+						return err
+					}
+				}
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return writeBatch()
+		})
+	})
+	app.finishExport(w, r, &p, nw, err)
+}
+
+// handleExportTags handles /api/export/tags.ndjson. Tags have no insert time,
+// so with since only the tags of galleries and files inserted since then are exported, with their total counts.
+func (app *App) handleExportTags(w http.ResponseWriter, r *http.Request) {
+	since, err := getSince(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	nw := newNdjsonWriter(w, "tags")
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			blClause, blArgs := getBlocklist(ctx).tagSQL("t.name")
+			//language=sqlite
+			rows, err := app.Db.QueryContext(ctx, `
+				  WITH at AS (
+				      SELECT mat.tag_id
+				           , COUNT(*) AS cnt
+				        FROM map_album_tag mat
+				       GROUP BY mat.tag_id
+				             )
+				     , ft AS (
+				      SELECT mrft.tag_id
+				           , COUNT(*) AS cnt
+				        FROM map_remote_file_tag mrft
+				       GROUP BY mrft.tag_id
+				             )
+				     , new AS (
+				      SELECT mat.tag_id
+				        FROM album a
+				        JOIN map_album_tag mat ON mat.album_id = a.album_id
+				       WHERE a.inserted_ts >= ?1
+				       UNION
+				      SELECT mrft.tag_id
+				        FROM remote_file rf
+				        JOIN map_remote_file_tag mrft ON mrft.remote_file_id = rf.remote_file_id
+				       WHERE rf.inserted_ts >= ?1
+				              )
+				SELECT t.name
+				     , t.local
+				     , COALESCE(at.cnt, 0) AS gallery_count
+				     , COALESCE(ft.cnt, 0) AS file_count
+				  FROM tag t
+				  LEFT JOIN at ON at.tag_id = t.tag_id
+				  LEFT JOIN ft ON ft.tag_id = t.tag_id
+				 WHERE (?1 = 0
+				    OR t.tag_id IN (SELECT tag_id FROM new))
+				   `+blClause+`
+				 ORDER BY t.tag_id
+			`, append([]any{since}, blArgs...)...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var t types.ExportTag
+				if err := rows.Scan(&t.Name, &t.IsLocal, &t.GalleryCount, &t.FileCount); err != nil {
+					return err
+				}
+				if err := nw.write(&t); err != nil {
+					return err
+				}
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			nw.flush()
+			return nil
+		})
+	})
+	app.finishExport(w, r, &p, nw, err)
+}
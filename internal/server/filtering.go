@@ -81,17 +81,18 @@ func parseFileTypeValue(s string) string {
 	}
 }
 
-func getRatingFilterWithPrefix(w http.ResponseWriter, r *http.Request, minParam, maxParam, unratedParam, minCookie, maxCookie, unratedCookie string) types.RatingFilter {
-	rf := types.RatingFilter{}
+// getRatingFilterWithPrefix resolves a rating filter from, in order of precedence, the query, cookies, and the profile default
+func getRatingFilterWithPrefix(w http.ResponseWriter, r *http.Request, profileDefault types.RatingFilter, minParam, maxParam, unratedParam, minCookie, maxCookie, unratedCookie string) types.RatingFilter {
+	rf := profileDefault
 
 	// Read cookie defaults
-	if c, err := r.Cookie(minCookie); err == nil {
+	if c, err := getDefaultCookie(r, minCookie); err == nil {
 		rf.Min = parseRatingValue(c.Value)
 	}
-	if c, err := r.Cookie(maxCookie); err == nil {
+	if c, err := getDefaultCookie(r, maxCookie); err == nil {
 		rf.Max = parseRatingValue(c.Value)
 	}
-	if c, err := r.Cookie(unratedCookie); err == nil {
+	if c, err := getDefaultCookie(r, unratedCookie); err == nil {
 		rf.Unrated = parseUnratedValue(c.Value)
 	}
 
@@ -182,18 +183,20 @@ func getRatingFilterWithPrefix(w http.ResponseWriter, r *http.Request, minParam,
 }
 
 func getGalleryRatingFilter(w http.ResponseWriter, r *http.Request) types.RatingFilter {
-	return getRatingFilterWithPrefix(w, r, "gal_rating_min", "gal_rating_max", "gal_unrated", "defaultGalRatingMin", "defaultGalRatingMax", "defaultGalUnrated")
+	profile := getRequestProfile(r.Context()).Profile
+	return getRatingFilterWithPrefix(w, r, profile.GalleryRatingFilter, "gal_rating_min", "gal_rating_max", "gal_unrated", "defaultGalRatingMin", "defaultGalRatingMax", "defaultGalUnrated")
 }
 
 func getFileRatingFilter(w http.ResponseWriter, r *http.Request) types.RatingFilter {
-	return getRatingFilterWithPrefix(w, r, "file_rating_min", "file_rating_max", "file_unrated", "defaultFileRatingMin", "defaultFileRatingMax", "defaultFileUnrated")
+	profile := getRequestProfile(r.Context()).Profile
+	return getRatingFilterWithPrefix(w, r, profile.FileRatingFilter, "file_rating_min", "file_rating_max", "file_unrated", "defaultFileRatingMin", "defaultFileRatingMax", "defaultFileUnrated")
 }
 
 func getFileTypeFilter(w http.ResponseWriter, r *http.Request) types.FileTypeFilter {
-	ft := types.FileTypeFilter{}
+	ft := getRequestProfile(r.Context()).Profile.FileTypeFilter
 
 	// Read cookie default
-	if c, err := r.Cookie("defaultFileType"); err == nil {
+	if c, err := getDefaultCookie(r, "defaultFileType"); err == nil {
 		ft.Type = parseFileTypeValue(c.Value)
 	}
 
@@ -5,12 +5,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"golocalgal/api"
 	"golocalgal/internal/types"
 	"math/rand/v2"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -46,8 +47,14 @@ func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
 		var fileCount int
 		var tagCount int
 
+		bl := getBlocklist(ctx)
+		blGallery, blGalleryArgs := bl.gallerySQL("a")
+		blFile, blFileArgs := bl.fileSQL("rf")
+		blTag, blTagArgs := bl.tagSQL("t.name")
+		replacer := strings.NewReplacer("/*BLOCKLIST_GALLERY*/", blGallery, "/*BLOCKLIST_FILE*/", blFile, "/*BLOCKLIST_TAG*/", blTag)
+		args := append(append(append([]any{}, blGalleryArgs...), blFileArgs...), blTagArgs...)
 		err := app.withSQL(ctx, func(ctx context.Context) error {
-			return app.Db.QueryRowContext(ctx, `
+			return app.Db.QueryRowContext(ctx, replacer.Replace(`
 				SELECT (
 				           SELECT page_size
 				             FROM PRAGMA_PAGE_SIZE()
@@ -55,32 +62,38 @@ func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
 				           SELECT page_count
 				             FROM PRAGMA_PAGE_COUNT()
 				           ) AS main_db_bytes
-				     , COALESCE((
-				                    SELECT version
-				                      FROM flyway_schema_history
-				                     WHERE success = 1
-				                     ORDER BY installed_rank DESC
-				                     LIMIT 1
-				                ), 'unknown') AS schema_version
 				     , (
 				    SELECT COUNT(*)
-				      FROM album
+				      FROM album a
+				     WHERE 1 = 1
+				       /*BLOCKLIST_GALLERY*/
 				       ) AS album_count
 				     , (
 				    SELECT COUNT(*)
-				      FROM remote_file
+				      FROM remote_file rf
+				     WHERE 1 = 1
+				       /*BLOCKLIST_FILE*/
 				       ) AS file_count
 				     , (
 				    SELECT COUNT(*)
-				      FROM tag
+				      FROM tag t
+				     WHERE 1 = 1
+				       /*BLOCKLIST_TAG*/
 				       ) AS tag_count
-			`).Scan(&dbBytes, &schemaVersion, &albumCount, &fileCount, &tagCount)
+			`), args...).Scan(&dbBytes, &albumCount, &fileCount, &tagCount)
 		})
 		if err != nil {
 			return err
 		}
+		if err := app.withSQL(ctx, func(ctx context.Context) (err error) {
+			schemaVersion, err = app.catalogue.schemaVersion(ctx)
+			return err
+		}); err != nil {
+			return err
+		}
 
 		model := types.StatsPage{
+			Catalogue:     app.catalogue.name(),
 			DbBytes:       dbBytes,
 			SchemaVersion: schemaVersion,
 			GalleryCount:  albumCount,
@@ -99,14 +112,23 @@ func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
-	if !(r.URL.Path == "/" || r.URL.Path == "/api/galleries") {
+	if !(r.URL.Path == "/" || r.URL.Path == "/api/galleries" || r.URL.Path == api.BasePath+"/galleries") {
 		app.renderError(r.Context(), w, &types.Perf{}, http.StatusNotFound, nil)
 		return
 	}
+	sort := getSortGalleries(w, r)
+	ks := galleryKeyset(sort)
+	c, err := parseCursor(r, ks)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
 		page, size := getPageParams(w, r, r.URL)
 		offset := (page - 1) * size
-		sort := getSortGalleries(w, r)
+		if c != nil {
+			offset = 0
+		}
 		grf := getGalleryRatingFilter(w, r)
 		frf := getFileRatingFilter(w, r)
 		ftf := getFileTypeFilter(w, r)
@@ -116,32 +138,26 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 		var list []types.Album
+		var rowKeys []string
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			var orderByPage string
-			var orderByAgg string
-			switch sort {
-			case SortFetched:
-				orderByPage = "ORDER BY (a.last_fetch_ts IS NULL), a.last_fetch_ts DESC, a.inserted_ts DESC, a.album_id DESC"
-				orderByAgg = "ORDER BY (p.last_fetch_ts IS NULL), p.last_fetch_ts DESC, p.inserted_ts DESC, p.album_id DESC"
-			case SortUploaded:
-				orderByPage = "ORDER BY (a.created_ts IS NULL), (a.modified_ts IS NULL), a.created_ts DESC, a.modified_ts DESC, a.album_id DESC"
-				orderByAgg = "ORDER BY (p.created_ts IS NULL), (p.modified_ts IS NULL), p.created_ts DESC, p.modified_ts DESC, p.album_id DESC"
-			case SortBytes:
-				orderByPage = "ORDER BY a.sum_rf_bytes DESC, a.album_id DESC"
-				orderByAgg = "ORDER BY p.sum_rf_bytes DESC, p.album_id DESC"
-			case SortItems:
-				orderByPage = "ORDER BY a.cnt_rf DESC, a.album_id DESC"
-				orderByAgg = "ORDER BY p.cnt_rf DESC, p.album_id DESC"
-			default:
-				orderByPage = "ORDER BY (a.last_fetch_ts IS NULL), a.last_fetch_ts DESC, a.inserted_ts DESC, a.album_id DESC"
-				orderByAgg = "ORDER BY (p.last_fetch_ts IS NULL), p.last_fetch_ts DESC, p.inserted_ts DESC, p.album_id DESC"
-			}
+			// Rows before a cursor are read in reverse, then put back in display order
+			reverse := c != nil && c.Before
+			orderByPage, orderByPageArgs := ks.orderBy("a", reverse)
+			orderByAgg, orderByAggArgs := ks.orderBy("p", reverse)
+			cursorClause, cursorArgs := ks.where("a", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("p")
 			rfClause, rfArgs := ratingFilterSQL("a.local_rating", grf)
 			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-			replacer := strings.NewReplacer("/*ORDER_BY_PAGE*/", orderByPage, "/*ORDER_BY_AGG*/", orderByAgg, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
-			args := append([]any{}, rfArgs...)
-			args = append(args, ftArgs...)
-			args = append(args, size, offset)
+			blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+			replacer := strings.NewReplacer("/*ORDER_BY_PAGE*/", orderByPage, "/*ORDER_BY_AGG*/", orderByAgg, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*THUMB*/", galleryThumbSQL("p.album_id", app.CoverRule))
+			args := append([]any{}, ftArgs...)
+			args = append(args, rfArgs...)
+			args = append(args, blArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderByPageArgs...)
+			args = append(args, size, offset, app.getGalleryCoversJSON(ctx))
+			args = append(args, cursorKeysArgs...)
+			args = append(args, orderByAggArgs...)
 			//language=sqlite
 			rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
 				  WITH page AS (
@@ -173,6 +189,8 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 				              /*FILE_TYPE_FILTER*/
 				                   )
 				       /*RATING_FILTER*/
+				       /*BLOCKLIST*/
+				       /*CURSOR*/
 				-- ORDER BY a.album_id
 				/*ORDER_BY_PAGE*/
 				       LIMIT ? OFFSET ?
@@ -213,16 +231,8 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 				    --, COALESCE(agg.file_count, 0) AS file_count
 				    --, COALESCE(agg.album_bytes, 0) AS album_bytes
 				    --, agg.thumb_remote_file_id
-				     , (
-				    SELECT rf.remote_file_id
-				      FROM map_album_remote_file marf
-				      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-				     WHERE marf.album_id = p.album_id
-				       AND rf.fetched = 1
-				       AND rf.ignored = 0
-				     ORDER BY marf.remote_file_id DESC
-				     LIMIT 1
-				       ) AS thumb_remote_file_id
+				     , /*THUMB*/ AS thumb_remote_file_id
+				     , /*CURSOR_KEYS*/ AS cursor_keys
 				  FROM page p
 				  JOIN ripper r ON r.ripper_id = p.ripper_id
 				  -- ORDER BY p.album_id
@@ -236,6 +246,7 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 				var a types.Album
 				var f types.File
 				var thumbFileId sql.NullInt64
+				var rowKey string
 				if err := rows.Scan(
 					&a.AlbumId,
 					&a.RipperId,
@@ -256,9 +267,11 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 					&a.LastFetchTs,
 					&a.InsertedTs,
 					&thumbFileId,
+					&rowKey,
 				); err != nil {
 					return err
 				}
+				rowKeys = append(rowKeys, rowKey)
 				// If an album has no fetched files, thumb_remote_file_id will be null
 				if thumbFileId.Valid {
 					f.FileId = thumbFileId.Int64
@@ -270,6 +283,7 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 		}); err != nil {
 			return err
 		}
+		readCursorPage(c, list, rowKeys)
 		for i := range list {
 			thumb := list[i].Thumb
 			if err := app.withSQL(ctx, func(ctx context.Context) error {
@@ -295,21 +309,26 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 				list[i].Thumb.HrefMedia = fmt.Sprintf("/media/%s/%s/%s", list[i].RipperHost, list[i].Gid, list[i].Thumb.Filename.String)
 			}
 		}
+		app.populateAlbumsLocalMeta(ctx, list)
 		// For speed, unfetched and ignored files are included in the total album count
 		// Albums without files are not included in the list, but are included in the page size,
 		// so to prevent the next page button from being shown when the last page has empty albums,
 		// calculate HasNext based on the total page count instead of using the list size
 		totalPageCount := getPageCount(int64(total), int64(size))
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 		model := types.BrowsePage{
-			Albums:   list,
-			Page:     page,
-			PageSize: size,
-			Total:    total,
-			HasPrev:  page > 1,
-			HasNext:  totalPageCount > int64(page),
-			Sort:     sort,
-			BasePage: &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
+			Albums:     list,
+			Page:       page,
+			PageSize:   size,
+			Total:      total,
+			HasPrev:    page > 1,
+			HasNext:    totalPageCount > int64(page),
+			NextCursor: nextCursor,
+			PrevCursor: prevCursor,
+			Sort:       sort,
+			BasePage:   &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 		}
+		setCursorLinks(w, r, page, nextCursor, prevCursor, model.HasNext, model.HasPrev)
 		app.render(ctx, w, "browse.gohtml", &model)
 		return nil
 	})
@@ -322,14 +341,17 @@ func (app *App) handleBrowse(w http.ResponseWriter, r *http.Request) {
 func (app *App) getTotalAlbumCount(ctx context.Context, rf types.RatingFilter) (int, error) {
 	var total int
 	rfClause, rfArgs := ratingFilterSQL("a.local_rating", rf)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause)
+	blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause)
 	err := app.withSQL(ctx, func(ctx context.Context) error {
 		args := append([]any{}, rfArgs...)
+		args = append(args, blArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
 			SELECT COUNT(*)
 			  FROM album a
 			 WHERE a.cnt_rf > 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 		`), args...).Scan(&total)
 	})
 	return total, err
@@ -344,57 +366,26 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
-		var a types.Album
-		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			return app.Db.QueryRowContext(ctx, `
-				SELECT a.album_id
-				     , a.ripper_id
-				     , r.name AS ripper_name
-				     , r.host AS ripper_host
-				     , a.gid
-				     , a.uploader
-				     , a.title
-				     , a.description
-				     , a.created_ts
-				     , a.modified_ts
-				     , a.fetch_count
-				     , a.hidden
-				     , a.removed
-				     , a.local_rating
-				     , a.sum_rf_bytes
-				     , a.cnt_rf
-				     , a.last_fetch_ts
-				     , a.inserted_ts
-				  FROM album a
-				  JOIN ripper r ON r.ripper_id = a.ripper_id
-				 WHERE r.host = ?
-				   AND a.gid = ?
-			`, ripperHost, gid).Scan(
-				&a.AlbumId,
-				&a.RipperId,
-				&a.RipperName,
-				&a.RipperHost,
-				&a.Gid,
-				&a.Uploader,
-				&a.Title,
-				&a.Description,
-				&a.CreatedTs,
-				&a.ModifiedTs,
-				&a.FetchCount,
-				&a.Hidden,
-				&a.Removed,
-				&a.LocalRating,
-				&a.Bytes,
-				&a.FileCount,
-				&a.LastFetchTs,
-				&a.InsertedTs,
-			)
-		}); err != nil {
+		a, err := app.getAlbum(ctx, ripperHost, gid)
+		if err != nil {
+			return err
+		}
+		if err := app.checkGalleryBlocked(ctx, a.AlbumId); err != nil {
 			return err
 		}
 		page, size := getPageParams(w, r, r.URL)
 		offset := (page - 1) * size
 		sort := getSortFiles(w, r)
+		ks := fileKeyset(sort, func() string { return app.getFileScoresJSON(ctx) })
+		c, err := parseCursor(r, ks)
+		if err != nil {
+			return err
+		}
+		// A cursor replaces the offset, the page number is still used to show it
+		queryOffset := offset
+		if c != nil {
+			queryOffset = 0
+		}
 		grf := getGalleryRatingFilter(w, r)
 		frf := getFileRatingFilter(w, r)
 		ftf := getFileTypeFilter(w, r)
@@ -415,26 +406,25 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 		//	return err
 		//}
 		var files []types.File
+		var rowKeys []string
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			var orderBy string
-			switch sort {
 			// TODO: order by local_rating?
-			case SortFetched:
-				orderBy = "ORDER BY rf.inserted_ts DESC, rf.remote_file_id DESC"
-			case SortBytes:
-				orderBy = "ORDER BY (rf.bytes IS NULL), rf.bytes DESC, rf.remote_file_id DESC"
-			case SortUploaded:
-				orderBy = "ORDER BY (rf.uploaded_ts IS NULL), rf.uploaded_ts DESC, rf.remote_file_id DESC"
-			default:
-				orderBy = "ORDER BY rf.inserted_ts DESC, rf.remote_file_id DESC"
-			}
+			// Rows before a cursor are read in reverse, then put back in display order
+			orderBy, orderArgs := ks.orderBy("rf", c != nil && c.Before)
+			cursorClause, cursorArgs := ks.where("rf", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("rf")
 			rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
 			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-			replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
-			args := []any{a.AlbumId}
+			blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+			replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys)
+			args := append([]any{}, cursorKeysArgs...)
+			args = append(args, a.AlbumId)
 			args = append(args, rfArgs...)
 			args = append(args, ftArgs...)
-			args = append(args, size, offset)
+			args = append(args, blArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderArgs...)
+			args = append(args, size, queryOffset)
 			rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
 				SELECT rf.remote_file_id
 				     --, r.name AS ripper_name
@@ -451,6 +441,7 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 				     , rf.bytes
 				     , rf.local_rating
 				     , rf.inserted_ts
+				     , /*CURSOR_KEYS*/ AS cursor_keys
 				  FROM map_album_remote_file marf
 				  JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
 				  -- JOIN ripper r ON r.ripper_id = rf.ripper_id
@@ -460,6 +451,8 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 				   AND rf.ignored = 0
 				   /*RATING_FILTER*/
 				   /*FILE_TYPE_FILTER*/
+				   /*BLOCKLIST*/
+				   /*CURSOR*/
 				 -- ORDER BY marf.remote_file_id
 				 /*ORDER_BY*/
 				 LIMIT ? OFFSET ?
@@ -470,6 +463,7 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 			defer rows.Close()
 			for rows.Next() {
 				var f types.File
+				var rowKey string
 				if err := rows.Scan(
 					&f.FileId,
 					//&f.RipperName, // TODO just take the value from the album we already fetched
@@ -486,39 +480,23 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 					&f.Bytes,
 					&f.LocalRating,
 					&f.InsertedTs,
+					&rowKey,
 				); err != nil {
 					return err
 				}
 				f.AlbumId = a.AlbumId
 				files = append(files, f)
+				rowKeys = append(rowKeys, rowKey)
 			}
 			return rows.Err()
 		}); err != nil {
 			return err
 		}
+		readCursorPage(c, files, rowKeys)
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 		// Fetch tags for album and distinct tags from its files
-		var albumTags []types.Tag
-		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			rows, e := app.Db.QueryContext(ctx, `
-				SELECT t.tag_id, t.name
-				  FROM map_album_tag mat
-				  JOIN tag t ON t.tag_id = mat.tag_id
-				 WHERE mat.album_id = ?
-				 ORDER BY t.name
-			`, a.AlbumId)
-			if e != nil {
-				return e
-			}
-			defer rows.Close()
-			for rows.Next() {
-				var t types.Tag
-				if err := rows.Scan(&t.TagId, &t.Name); err != nil {
-					return err
-				}
-				albumTags = append(albumTags, t)
-			}
-			return rows.Err()
-		}); err != nil {
+		albumTags, err := app.getAlbumTags(ctx, a.AlbumId)
+		if err != nil {
 			return err
 		}
 
@@ -530,16 +508,20 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 				files[i].HrefMedia = fmt.Sprintf("/media/%s/%s/%s", a.RipperHost, a.Gid, files[i].Filename.String)
 			}
 		}
+		app.populateFilesLocalMeta(ctx, files)
 
 		var totalFiltered int
-		if frf.Active() || ftf.Active() {
+		blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+		filtered := frf.Active() || ftf.Active() || blClause != ""
+		if filtered {
 			if err := app.withSQL(ctx, func(ctx context.Context) error {
 				rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
 				ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-				replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+				replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
 				args := []any{a.AlbumId}
 				args = append(args, rfArgs...)
 				args = append(args, ftArgs...)
+				args = append(args, blArgs...)
 				return app.Db.QueryRowContext(ctx, replacer.Replace(`
 					SELECT COUNT(*)
 					  FROM remote_file rf
@@ -550,15 +532,25 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 					   AND rf.ignored = 0
 					   /*RATING_FILTER*/
 					   /*FILE_TYPE_FILTER*/
+					   /*BLOCKLIST*/
 				`), args...).Scan(&totalFiltered)
 			}); err != nil {
 				return err
 			}
-		} else {
-			totalFiltered = a.FileCount
 		}
-		totalUnfiltered := a.FileCount
-		albumBytes := a.Bytes
+		albumTotals, err := app.getAlbumFileTotals(ctx, a.AlbumId)
+		if err != nil {
+			return err
+		}
+		totalUnfiltered := albumTotals.Count
+		albumBytes := albumTotals.Bytes
+		ignoredCount, ignoredBytes := albumTotals.IgnoredCount, albumTotals.IgnoredBytes
+		if !filtered {
+			totalFiltered = totalUnfiltered
+		}
+
+		hasPrev, hasNext := page > 1, offset+len(files) < totalFiltered
+		setCursorLinks(w, r, page, nextCursor, prevCursor, hasNext, hasPrev)
 
 		asyncFileTags := isClientJsOn(r)
 		if asyncFileTags {
@@ -569,12 +561,17 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 				PageSize:        size,
 				Total:           totalFiltered,
 				TotalUnfiltered: totalUnfiltered,
-				HasPrev:         page > 1,
-				HasNext:         offset+len(files) < totalFiltered,
+				HasPrev:         hasPrev,
+				HasNext:         hasNext,
+				NextCursor:      nextCursor,
+				PrevCursor:      prevCursor,
 				AlbumTags:       albumTags,
 				AsyncFileTags:   true,
 				AlbumBytes:      albumBytes,
+				IgnoredCount:    ignoredCount,
+				IgnoredBytes:    ignoredBytes,
 				Sort:            sort,
+				CoverRule:       app.CoverRule,
 				BasePage:        &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 			}
 			app.render(ctx, w, "gallery.gohtml", &model)
@@ -586,18 +583,24 @@ func (app *App) handleGallery(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 		model := types.GalleryPage{
-			Album:      a,
-			Files:      files,
-			Page:       page,
-			PageSize:   size,
-			Total:      totalFiltered,
-			HasPrev:    page > 1,
-			HasNext:    offset+len(files) < totalFiltered,
-			AlbumTags:  albumTags,
-			FileTags:   fileTags,
-			AlbumBytes: albumBytes,
-			Sort:       sort,
-			BasePage:   &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
+			Album:           a,
+			Files:           files,
+			Page:            page,
+			PageSize:        size,
+			Total:           totalFiltered,
+			TotalUnfiltered: totalUnfiltered,
+			HasPrev:         hasPrev,
+			HasNext:         hasNext,
+			NextCursor:      nextCursor,
+			PrevCursor:      prevCursor,
+			AlbumTags:       albumTags,
+			FileTags:        fileTags,
+			AlbumBytes:      albumBytes,
+			IgnoredCount:    ignoredCount,
+			IgnoredBytes:    ignoredBytes,
+			Sort:            sort,
+			CoverRule:       app.CoverRule,
+			BasePage:        &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 		}
 		app.render(ctx, w, "gallery.gohtml", &model)
 		return nil
@@ -638,11 +641,21 @@ func (app *App) handleGalleryFileTagsFragment(w http.ResponseWriter, r *http.Req
 }
 
 func (app *App) getGalleryFileTags(ctx context.Context, ripperHost string, gid string) ([]types.Tag, error) {
+	rel, err := app.getTagRelations(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var fileTags []types.Tag
+	blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		// Tags with relations are counted once per group they belong to
 		rows, e := app.Db.QueryContext(ctx, `
-				SELECT t.name, COUNT(*) AS count
+				  WITH `+tagGroupCTE+`
+				SELECT COALESCE(g.grp, t.name) AS name
+				     , IIF(g.grp IS NULL, t.local, 0) AS local
+				     , COUNT(DISTINCT rf.remote_file_id) AS count
 				  FROM tag t
+				  LEFT JOIN tag_group g ON g.member = t.name
 				  JOIN map_remote_file_tag mrft ON mrft.tag_id = t.tag_id
 				  JOIN map_album_remote_file marf ON marf.remote_file_id = mrft.remote_file_id
 				  JOIN album a ON a.album_id = marf.album_id
@@ -652,17 +665,18 @@ func (app *App) getGalleryFileTags(ctx context.Context, ripperHost string, gid s
 				   AND r.host = ?
 				   AND rf.fetched = 1
 				   AND rf.ignored = 0
-				 GROUP BY t.tag_id
+				   `+blClause+`
+				 GROUP BY 1, 2
 				 ORDER BY count DESC
 				 LIMIT 100 -- some albums might have a million tags...
-			`, gid, ripperHost)
+			`, append([]any{rel.groupPairsJSON(), gid, ripperHost}, blArgs...)...)
 		if e != nil {
 			return e
 		}
 		defer rows.Close()
 		for rows.Next() {
 			var t types.Tag
-			if err := rows.Scan(&t.Name, &t.Count); err != nil {
+			if err := rows.Scan(&t.Name, &t.IsLocal, &t.Count); err != nil {
 				return err
 			}
 			fileTags = append(fileTags, t)
@@ -730,6 +744,8 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 		}); err != nil {
 			return err
 		}
+		a.CoverFileId = app.getGalleryCover(ctx, a.AlbumId)
+		app.populateAlbumLocalMeta(ctx, &a)
 		var f types.File
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
 			return app.Db.QueryRowContext(ctx, `
@@ -776,16 +792,29 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 		}); err != nil {
 			return err
 		}
+		if err := app.checkFileBlocked(ctx, f.FileId); err != nil {
+			return err
+		}
 
 		sort := getSortFiles(w, r)
 		grf := getGalleryRatingFilter(w, r)
 		frf := getFileRatingFilter(w, r)
 		ftf := getFileTypeFilter(w, r)
+		var scores string
+		var targetScore float64
+		if sort == SortScore {
+			scores = app.getFileScoresJSON(ctx)
+			var err error
+			if targetScore, err = app.fileSortScore(ctx, f.FileId); err != nil {
+				return err
+			}
+		}
 		// Prev/Next within this album by remote_file_id
 		var prev []types.File
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
 			var prevOrderKey1 string
 			var prevOrderKey2 string
+			var orderArgs []any
 			switch sort {
 			case SortFetched:
 				prevOrderKey1 = `
@@ -805,6 +834,13 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				       ORDER BY (rf.bytes IS NULL) DESC, rf.bytes ASC, rf.remote_file_id ASC
 				`
 				prevOrderKey2 = "ORDER BY (rf.bytes IS NULL) ASC, rf.bytes DESC, rf.remote_file_id DESC"
+			case SortScore:
+				prevOrderKey1 = `
+				         AND (` + fileScoreSQL + `, rf.remote_file_id) > (?, t.remote_file_id)
+				       ORDER BY ` + fileScoreSQL + ` ASC, rf.remote_file_id ASC
+				`
+				prevOrderKey2 = "ORDER BY " + fileScoreSQL + " DESC, rf.remote_file_id DESC"
+				orderArgs = append(orderArgs, scores, targetScore, scores, scores)
 			default:
 				prevOrderKey1 = `
 				         AND (rf.inserted_ts, rf.remote_file_id) > (t.inserted_ts, t.remote_file_id)
@@ -815,6 +851,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 
 			rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
 			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
+			blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 			replacer := strings.NewReplacer(
 				"/*PREV_ORDER_KEY_INNER*/",
 				prevOrderKey1,
@@ -824,10 +861,14 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				rfClause,
 				"/*FILE_TYPE_FILTER*/",
 				ftClause,
+				"/*BLOCKLIST*/",
+				blClause,
 			)
 			args := []any{f.FileId, a.AlbumId}
 			args = append(args, rfArgs...)
 			args = append(args, ftArgs...)
+			args = append(args, blArgs...)
+			args = append(args, orderArgs...)
 			//language=sqlite
 			rows, e := app.Db.QueryContext(ctx, replacer.Replace(`
 				-- Step 1: On the mapping table, seek previous remote_file_id values (< current) with ORDER BY DESC LIMIT 3 using PK (album_id, remote_file_id).
@@ -864,6 +905,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				         AND rf.ignored = 0
 				         /*RATING_FILTER*/
 				         /*FILE_TYPE_FILTER*/
+				         /*BLOCKLIST*/
 				         /*PREV_ORDER_KEY_INNER*/
 				       LIMIT 3
 				                   )
@@ -903,6 +945,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 		var next []types.File
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
 			var nextOrderKey string
+			var orderArgs []any
 			switch sort {
 			case SortFetched:
 				nextOrderKey = `
@@ -919,6 +962,12 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				   AND (COALESCE(rf.bytes,0), rf.remote_file_id) < (COALESCE(t.bytes,0), t.remote_file_id)
 				 ORDER BY (rf.bytes IS NULL) ASC, rf.bytes DESC, rf.remote_file_id DESC
 				`
+			case SortScore:
+				nextOrderKey = `
+				   AND (` + fileScoreSQL + `, rf.remote_file_id) < (?, t.remote_file_id)
+				 ORDER BY ` + fileScoreSQL + ` DESC, rf.remote_file_id DESC
+				`
+				orderArgs = append(orderArgs, scores, targetScore, scores)
 			default:
 				nextOrderKey = `
 				   AND (rf.inserted_ts, rf.remote_file_id) < (t.inserted_ts, t.remote_file_id)
@@ -928,10 +977,13 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 
 			rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
 			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-			replacer := strings.NewReplacer("/*NEXT_ORDER_KEY*/", nextOrderKey, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+			blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+			replacer := strings.NewReplacer("/*NEXT_ORDER_KEY*/", nextOrderKey, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
 			args := []any{f.FileId, a.AlbumId}
 			args = append(args, rfArgs...)
 			args = append(args, ftArgs...)
+			args = append(args, blArgs...)
+			args = append(args, orderArgs...)
 			//language=sqlite
 			rows, e := app.Db.QueryContext(ctx, replacer.Replace(`
 				  WITH target AS (
@@ -964,6 +1016,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				   AND rf.ignored = 0
 				   /*RATING_FILTER*/
 				   /*FILE_TYPE_FILTER*/
+				   /*BLOCKLIST*/
 				   /*NEXT_ORDER_KEY*/
 				 LIMIT 3
 			`), args...)
@@ -1003,7 +1056,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				-- Step 1: Drive from map_remote_file_tag to use PK (remote_file_id, tag_id) for fast lookup by file id.
 				-- Step 2: Join to tag to fetch tag names for display.
 				-- Step 3: Order alphabetically.
-				SELECT t.tag_id, t.name
+				SELECT t.tag_id, t.name, t.local
 				  FROM map_remote_file_tag mrft
 				  JOIN tag t ON t.tag_id = mrft.tag_id
 				 WHERE mrft.remote_file_id = ?
@@ -1015,7 +1068,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 			defer rows.Close()
 			for rows.Next() {
 				var t types.Tag
-				if err := rows.Scan(&t.TagId, &t.Name); err != nil {
+				if err := rows.Scan(&t.TagId, &t.Name, &t.IsLocal); err != nil {
 					return err
 				}
 				fileTags = append(fileTags, t)
@@ -1049,7 +1102,8 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 			}
 			rfClause, rfArgs := ratingFilterSQL("rf.local_rating", frf)
 			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-			replacer := strings.NewReplacer("/*PREV_FILTER_KEY*/", prevFilterKey, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+			blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+			replacer := strings.NewReplacer("/*PREV_FILTER_KEY*/", prevFilterKey, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
 			//language=sqlite
 			replaced := replacer.Replace(`
 				  WITH target AS (
@@ -1070,11 +1124,13 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				   AND rf.ignored = 0
 				   /*RATING_FILTER*/
 				   /*FILE_TYPE_FILTER*/
+				   /*BLOCKLIST*/
 				  /*PREV_FILTER_KEY*/
 			`)
 			args := []any{f.FileId, a.AlbumId}
 			args = append(args, rfArgs...)
 			args = append(args, ftArgs...)
+			args = append(args, blArgs...)
 			return app.Db.QueryRowContext(ctx, replaced, args...).Scan(&rank)
 		}); err != nil {
 			return err
@@ -1117,6 +1173,9 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				next[i].HrefMedia = fmt.Sprintf("/media/%s/%s/%s", a.RipperHost, a.Gid, next[i].Filename.String)
 			}
 		}
+		app.populateFileLocalMeta(ctx, &f)
+		app.populateFilesLocalMeta(ctx, prev)
+		app.populateFilesLocalMeta(ctx, next)
 
 		autoplay := isClientAutoplayOn(r)
 		asyncAlbums := isClientJsOn(r)
@@ -1132,6 +1191,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 				ShowPrevNext: true,
 				Autoplay:     autoplay,
 				ForceFit:     forceFit,
+				Collections:  app.getFileCollections(ctx, f.FileId),
 				BasePage:     &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 			}
 			app.render(ctx, w, "file.gohtml", &model)
@@ -1152,6 +1212,7 @@ func (app *App) handleGalleryFile(w http.ResponseWriter, r *http.Request) {
 			ShowPrevNext: true,
 			Autoplay:     autoplay,
 			ForceFit:     forceFit,
+			Collections:  app.getFileCollections(ctx, f.FileId),
 			BasePage:     &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 		}
 		app.render(ctx, w, "file.gohtml", &model)
@@ -1179,72 +1240,17 @@ func (app *App) handleFileStandalone(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
-		var f types.File
-		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			f.RipperHost = ripperHost
-			return app.Db.QueryRowContext(ctx, `
-				SELECT rf.remote_file_id
-				     , rf.urlid
-				     , rf.filename
-				     , mt.name AS mime_type
-				     , rf.bytes
-				     , rf.title
-				     , rf.description
-				     , rf.uploaded_ts
-				     , rf.uploader
-				     , rf.hidden
-				     , rf.removed
-				     , rf.local_rating
-				     , rf.inserted_ts
-				  FROM remote_file rf
-				  JOIN ripper r ON r.ripper_id = rf.ripper_id
-				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
-				 WHERE r.host = ?
-				   AND rf.remote_file_id = ?
-				   AND rf.fetched = 1
-				   AND rf.ignored = 0
-			`, ripperHost, fileId).Scan(
-				&f.FileId,
-				&f.Urlid,
-				&f.Filename,
-				&f.MimeType,
-				&f.Bytes,
-				&f.Title,
-				&f.Description,
-				&f.UploadedTs,
-				&f.Uploader,
-				&f.Hidden,
-				&f.Removed,
-				&f.LocalRating,
-				&f.InsertedTs,
-			)
-		}); err != nil {
+		f, err := app.getFile(ctx, ripperHost, fileId)
+		if err != nil {
 			return err
 		}
-
-		var fileTags []types.Tag
+		if err := app.checkFileBlocked(ctx, f.FileId); err != nil {
+			return err
+		}
+		app.populateFileLocalMeta(ctx, &f)
 		// Standalone file view: no Prev/Next
-		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			rows, e := app.Db.QueryContext(ctx, `
-					SELECT t.tag_id, t.name
-					  FROM map_remote_file_tag m
-					  JOIN tag t ON t.tag_id = m.tag_id
-					 WHERE m.remote_file_id = ?
-					 ORDER BY t.name
-				`, f.FileId)
-			if e != nil {
-				return e
-			}
-			defer rows.Close()
-			for rows.Next() {
-				var t types.Tag
-				if err := rows.Scan(&t.TagId, &t.Name); err != nil {
-					return err
-				}
-				fileTags = append(fileTags, t)
-			}
-			return rows.Err()
-		}); err != nil {
+		fileTags, err := app.getFileTags(ctx, f.FileId)
+		if err != nil {
 			return err
 		}
 		asyncAlbums := isClientJsOn(r) || getRenderMode(ctx) == RenderJSON
@@ -1271,6 +1277,7 @@ func (app *App) handleFileStandalone(w http.ResponseWriter, r *http.Request) {
 			Albums:       albums,
 			ShowPrevNext: false,
 			ForceFit:     forceFit,
+			Collections:  app.getFileCollections(ctx, f.FileId),
 			BasePage:     &types.BasePage{Perf: perf},
 		}
 		app.render(ctx, w, "file.gohtml", &model)
@@ -1282,6 +1289,167 @@ func (app *App) handleFileStandalone(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getAlbum loads a gallery with its cover and local title and notes
+func (app *App) getAlbum(ctx context.Context, ripperHost string, gid string) (types.Album, error) {
+	var a types.Album
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT a.album_id
+			     , a.ripper_id
+			     , r.name AS ripper_name
+			     , r.host AS ripper_host
+			     , a.gid
+			     , a.uploader
+			     , a.title
+			     , a.description
+			     , a.created_ts
+			     , a.modified_ts
+			     , a.fetch_count
+			     , a.hidden
+			     , a.removed
+			     , a.local_rating
+			     , a.sum_rf_bytes
+			     , a.cnt_rf
+			     , a.last_fetch_ts
+			     , a.inserted_ts
+			  FROM album a
+			  JOIN ripper r ON r.ripper_id = a.ripper_id
+			 WHERE r.host = ?
+			   AND a.gid = ?
+		`, ripperHost, gid).Scan(
+			&a.AlbumId,
+			&a.RipperId,
+			&a.RipperName,
+			&a.RipperHost,
+			&a.Gid,
+			&a.Uploader,
+			&a.Title,
+			&a.Description,
+			&a.CreatedTs,
+			&a.ModifiedTs,
+			&a.FetchCount,
+			&a.Hidden,
+			&a.Removed,
+			&a.LocalRating,
+			&a.Bytes,
+			&a.FileCount,
+			&a.LastFetchTs,
+			&a.InsertedTs,
+		)
+	}); err != nil {
+		return a, err
+	}
+	a.CoverFileId = app.getGalleryCover(ctx, a.AlbumId)
+	app.populateAlbumLocalMeta(ctx, &a)
+	return a, nil
+}
+
+func (app *App) getAlbumTags(ctx context.Context, albumId int64) ([]types.Tag, error) {
+	var albumTags []types.Tag
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, e := app.Db.QueryContext(ctx, `
+			SELECT t.tag_id, t.name, t.local
+			  FROM map_album_tag mat
+			  JOIN tag t ON t.tag_id = mat.tag_id
+			 WHERE mat.album_id = ?
+			 ORDER BY t.name
+		`, albumId)
+		if e != nil {
+			return e
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t types.Tag
+			if err := rows.Scan(&t.TagId, &t.Name, &t.IsLocal); err != nil {
+				return err
+			}
+			albumTags = append(albumTags, t)
+		}
+		return rows.Err()
+	})
+	return albumTags, err
+}
+
+// getFile loads a visible file outside of any gallery. An empty ripperHost matches any host.
+func (app *App) getFile(ctx context.Context, ripperHost string, fileId int64) (types.File, error) {
+	return app.lookupFile(ctx, ripperHost, fileId, false)
+}
+
+// lookupFile is getFile, optionally including ignored and unfetched files, as writes to them are allowed
+func (app *App) lookupFile(ctx context.Context, ripperHost string, fileId int64, includeIgnored bool) (types.File, error) {
+	var f types.File
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT rf.remote_file_id
+			     , r.name AS ripper_name
+			     , r.host AS ripper_host
+			     , rf.urlid
+			     , rf.filename
+			     , mt.name AS mime_type
+			     , rf.bytes
+			     , rf.title
+			     , rf.description
+			     , rf.uploaded_ts
+			     , rf.uploader
+			     , rf.hidden
+			     , rf.removed
+			     , rf.ignored
+			     , rf.local_rating
+			     , rf.inserted_ts
+			  FROM remote_file rf
+			  JOIN ripper r ON r.ripper_id = rf.ripper_id
+			  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+			 WHERE (? = '' OR r.host = ?)
+			   AND rf.remote_file_id = ?
+			   AND (? OR (rf.fetched = 1 AND rf.ignored = 0))
+		`, ripperHost, ripperHost, fileId, includeIgnored).Scan(
+			&f.FileId,
+			&f.RipperName,
+			&f.RipperHost,
+			&f.Urlid,
+			&f.Filename,
+			&f.MimeType,
+			&f.Bytes,
+			&f.Title,
+			&f.Description,
+			&f.UploadedTs,
+			&f.Uploader,
+			&f.Hidden,
+			&f.Removed,
+			&f.Ignored,
+			&f.LocalRating,
+			&f.InsertedTs,
+		)
+	})
+	return f, err
+}
+
+func (app *App) getFileTags(ctx context.Context, fileId int64) ([]types.Tag, error) {
+	var fileTags []types.Tag
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, e := app.Db.QueryContext(ctx, `
+			SELECT t.tag_id, t.name, t.local
+			  FROM map_remote_file_tag m
+			  JOIN tag t ON t.tag_id = m.tag_id
+			 WHERE m.remote_file_id = ?
+			 ORDER BY t.name
+		`, fileId)
+		if e != nil {
+			return e
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t types.Tag
+			if err := rows.Scan(&t.TagId, &t.Name, &t.IsLocal); err != nil {
+				return err
+			}
+			fileTags = append(fileTags, t)
+		}
+		return rows.Err()
+	})
+	return fileTags, err
+}
+
 // handleFileStandalone handles /file/{ripper_host}/{file_id}/galleries/
 func (app *App) handleFileGalleryFragment(w http.ResponseWriter, r *http.Request) {
 	// ripperHost is not necessary for now, but want to keep to make replacing file_id with urlid easy in the future
@@ -1320,7 +1488,9 @@ func (app *App) handleFileGalleryFragment(w http.ResponseWriter, r *http.Request
 func (app *App) getRelatedAlbums(ctx context.Context, ripperHost string, fileId int64) ([]types.Album, error) {
 	var albums []types.Album
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
-		rows, e := app.Db.QueryContext(ctx, `
+		replacer := strings.NewReplacer("/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule))
+		//language=sqlite
+		rows, e := app.Db.QueryContext(ctx, replacer.Replace(`
 			SELECT a.album_id
 			     , a.ripper_id
 			     , r.name AS ripper_name
@@ -1337,23 +1507,14 @@ func (app *App) getRelatedAlbums(ctx context.Context, ripperHost string, fileId
 			     , a.last_fetch_ts
 			     , a.inserted_ts
 			     , a.cnt_rf
-			     , (
-			    SELECT rf.remote_file_id
-			      FROM map_album_remote_file marf
-			      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-			     WHERE marf.album_id = a.album_id
-			       AND rf.fetched = 1
-			       AND rf.ignored = 0
-			-- ORDER BY rf.remote_file_id ASC
-			     LIMIT 1
-			       ) AS thumb
+			     , /*THUMB*/ AS thumb
 			  FROM album a
 			  JOIN ripper r ON r.ripper_id = a.ripper_id
 			  JOIN map_album_remote_file marf ON marf.album_id = a.album_id
 			 WHERE marf.remote_file_id = ?
 			   AND r.host = ?
 			 ORDER BY a.album_id
-		`, fileId, ripperHost)
+		`), app.getGalleryCoversJSON(ctx), fileId, ripperHost)
 		if e != nil {
 			return e
 		}
@@ -1414,6 +1575,7 @@ func (app *App) getRelatedAlbums(ctx context.Context, ripperHost string, fileId
 			albums[i].Thumb.HrefMedia = fmt.Sprintf("/media/%s/%s/%s", albums[i].RipperHost, albums[i].Gid, albums[i].Thumb.Filename.String)
 		}
 	}
+	app.populateAlbumsLocalMeta(ctx, albums)
 	return albums, nil
 }
 
@@ -1424,33 +1586,78 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 		app.renderError(r.Context(), w, &types.Perf{}, 500, err)
 		return
 	}
+	var redirect string
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
-		var t types.Tag
-		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			return app.Db.QueryRowContext(ctx, `
-				SELECT tag_id, name
-				  FROM tag
-				 WHERE name = ?
-			`, tag).Scan(&t.TagId, &t.Name)
-		}); err != nil {
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
 			return err
 		}
+		// An alias has no page of its own
+		if c := rel.canonicalName(tag); c != tag {
+			redirect = "/tag/" + url.QueryEscape(c)
+			if getRenderMode(ctx) == RenderJSON {
+				redirect = "/api" + redirect
+			}
+			return nil
+		}
+		bl := getBlocklist(ctx)
+		if bl.blocksTag(tag) {
+			return errBlocked("tag")
+		}
+
+		// A local tag may share its name with a remote tag; ?local=1 prefers the local one
+		t, tagIds, err := app.getTagWithMembers(ctx, rel, tag, r.URL.Query().Get("local") == "1")
+		if err != nil {
+			return err
+		}
+		tagIdsJson := jsonArray(tagIds)
+		blGallery, blGalleryArgs := bl.gallerySQL("a")
+		blFile, blFileArgs := bl.fileSQL("rf")
 		// Albums for tag (with pagination)
 		page, size := getPageParams(w, r, r.URL)
 		offset := (page - 1) * size
+		ks := tagGalleryKeyset()
+		c, err := parseCursor(r, ks)
+		if err != nil {
+			return err
+		}
+		// A cursor replaces the offset, the page number is still used to show it
+		queryOffset := offset
+		if c != nil {
+			queryOffset = 0
+		}
 		var total int
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
 			return app.Db.QueryRowContext(ctx, `
 				SELECT COUNT(*)
 				  FROM album a
-				  JOIN map_album_tag mat ON mat.album_id = a.album_id AND mat.tag_id = ?
-			`, t.TagId).Scan(&total)
+				 WHERE a.album_id IN (
+				     SELECT mat.album_id
+				       FROM map_album_tag mat
+				      WHERE mat.tag_id IN (SELECT value FROM json_each(?))
+				                     )
+				   `+blGallery+`
+			`, append([]any{tagIdsJson}, blGalleryArgs...)...).Scan(&total)
 		}); err != nil {
 			return err
 		}
 		var albums []types.Album
+		var rowKeys []string
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			rows, e := app.Db.QueryContext(ctx, `
+			// Rows before a cursor are read in reverse, then put back in display order
+			orderBy, orderByArgs := ks.orderBy("a", c != nil && c.Before)
+			cursorClause, cursorArgs := ks.where("a", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("a")
+			replacer := strings.NewReplacer("/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule), "/*BLOCKLIST*/", blGallery, "/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys)
+			args := []any{app.getGalleryCoversJSON(ctx)}
+			args = append(args, cursorKeysArgs...)
+			args = append(args, tagIdsJson)
+			args = append(args, blGalleryArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderByArgs...)
+			args = append(args, size, queryOffset)
+			//language=sqlite
+			rows, e := app.Db.QueryContext(ctx, replacer.Replace(`
 				SELECT a.album_id
 				     , a.ripper_id
 				     , r.name AS ripper_name
@@ -1467,24 +1674,28 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 				     , a.last_fetch_ts
 				     , a.inserted_ts
 				     , COALESCE(cnt.c, 0) AS file_count
-				     , rf.remote_file_id AS thumb
+				     , /*THUMB*/ AS thumb
+				     , /*CURSOR_KEYS*/ AS cursor_keys
 				  FROM album a
 				  JOIN ripper r ON r.ripper_id = a.ripper_id
-				  JOIN map_album_tag mat ON mat.album_id = a.album_id AND mat.tag_id = ?
-				  LEFT JOIN (
-				          SELECT m.album_id, COUNT(*) c, m.remote_file_id AS min_rf
+				  JOIN (
+				          SELECT m.album_id, COUNT(*) c
 				            FROM map_album_remote_file m
 				            JOIN remote_file rf2 ON rf2.remote_file_id = m.remote_file_id
 				           WHERE rf2.fetched = 1
 				             AND rf2.ignored = 0
 				           GROUP BY m.album_id
 				            ) cnt ON a.album_id = cnt.album_id
-				  LEFT JOIN remote_file rf ON rf.remote_file_id = cnt.min_rf
-				 WHERE rf.fetched = 1
-				   AND rf.ignored = 0
-				 ORDER BY a.album_id
+				 WHERE a.album_id IN (
+				     SELECT mat.album_id
+				       FROM map_album_tag mat
+				      WHERE mat.tag_id IN (SELECT value FROM json_each(?))
+				                     )
+				   /*BLOCKLIST*/
+				   /*CURSOR*/
+				 /*ORDER_BY*/
 				 LIMIT ? OFFSET ?
-			`, t.TagId, size, offset)
+			`), args...)
 			if e != nil {
 				return e
 			}
@@ -1492,6 +1703,7 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 			for rows.Next() {
 				var a types.Album
 				var f types.File
+				var rowKey string
 				if err := rows.Scan(
 					&a.AlbumId,
 					&a.RipperId,
@@ -1510,16 +1722,20 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 					&a.InsertedTs,
 					&a.FileCount,
 					&f.FileId,
+					&rowKey,
 				); err != nil {
 					return err
 				}
 				a.Thumb = f
 				albums = append(albums, a)
+				rowKeys = append(rowKeys, rowKey)
 			}
 			return rows.Err()
 		}); err != nil {
 			return err
 		}
+		readCursorPage(c, albums, rowKeys)
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 		for i := range albums {
 			thumb := albums[i].Thumb
 			if err := app.withSQL(ctx, func(ctx context.Context) error {
@@ -1537,9 +1753,13 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 		}
 		// TODO: Add albums containing files for tag
 
-		// Files for tag
+		// Files for tag, in the sort of their playlist
+		sort := getSortFiles(w, r)
 		var files []types.File
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
+			orderBy, orderByArgs := fileKeyset(sort, func() string { return app.getFileScoresJSON(ctx) }).orderBy("rf", false)
+			args := append([]any{tagIdsJson}, blFileArgs...)
+			args = append(args, orderByArgs...)
 			rows, e := app.Db.QueryContext(ctx, `
 				SELECT rf.remote_file_id
 				     , r.name AS ripper_name
@@ -1556,14 +1776,18 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 				     , rf.inserted_ts
 				  FROM remote_file rf
 				  JOIN ripper r ON r.ripper_id = rf.ripper_id
-				  JOIN map_remote_file_tag m ON m.remote_file_id = rf.remote_file_id
 				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
-				 WHERE m.tag_id = ?
+				 WHERE rf.remote_file_id IN (
+				     SELECT m.remote_file_id
+				       FROM map_remote_file_tag m
+				      WHERE m.tag_id IN (SELECT value FROM json_each(?))
+				                            )
 				   AND rf.fetched = 1
 				   AND rf.ignored = 0
-				 ORDER BY m.remote_file_id
+				   `+blFile+`
+				 `+orderBy+`
 				 LIMIT 100 -- TODO paginate files too
-			`, t.TagId)
+			`, args...)
 			if e != nil {
 				return e
 			}
@@ -1606,7 +1830,12 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 				files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
 			}
 		}
-		model := types.TagDetailPage{Tag: t, Albums: albums, Files: files, Page: page, PageSize: size, Total: total, HasPrev: page > 1, HasNext: offset+len(albums) < total, BasePage: &types.BasePage{Perf: perf}}
+		app.populateAlbumsLocalMeta(ctx, albums)
+		app.populateFilesLocalMeta(ctx, files)
+		// The tags that imply a blocked tag are blocked too, but its parents aren't
+		children := slices.DeleteFunc(slices.Clone(rel.children[tag]), bl.blocksTag)
+		model := types.TagDetailPage{Tag: t, Aliases: rel.aliases[tag], Parents: rel.parents[tag], Children: children, Albums: albums, Files: files, Sort: sort, Page: page, PageSize: size, Total: total, HasPrev: page > 1, HasNext: offset+len(albums) < total, NextCursor: nextCursor, PrevCursor: prevCursor, BasePage: &types.BasePage{Perf: perf}}
+		setCursorLinks(w, r, page, nextCursor, prevCursor, model.HasNext, model.HasPrev)
 		app.render(ctx, w, "tag.gohtml", &model)
 		return nil
 	})
@@ -1614,32 +1843,78 @@ func (app *App) handleTagDetail(w http.ResponseWriter, r *http.Request) {
 		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
 		return
 	}
+	if redirect != "" {
+		app.httpRedirect(r.Context(), w, r, &p, redirect, http.StatusFound)
+	}
+}
+
+// getTagWithMembers returns the tag of a name, and the ids of it and every other tag that counts as it
+func (app *App) getTagWithMembers(ctx context.Context, rel tagRelations, tag string, wantLocal bool) (types.Tag, []int64, error) {
+	var t types.Tag
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT tag_id, name, local
+			  FROM tag
+			 WHERE name = ?
+			 ORDER BY (local = ?) DESC
+			 LIMIT 1
+		`, tag, wantLocal).Scan(&t.TagId, &t.Name, &t.IsLocal)
+	})
+	if errors.Is(err, sql.ErrNoRows) && rel.isGroup(tag) {
+		// Nothing is tagged with the name itself, but its aliases or the tags that imply it are
+		t = types.Tag{Name: tag}
+	} else if err != nil {
+		return t, nil, err
+	}
+	tagIds, err := app.getTagIds(ctx, slices.DeleteFunc(rel.members(tag), func(name string) bool { return name == tag }))
+	if err != nil {
+		return t, nil, err
+	}
+	if t.TagId != 0 {
+		tagIds = append(tagIds, t.TagId)
+	}
+	return t, tagIds, nil
 }
 
 func (app *App) handleTags(w http.ResponseWriter, r *http.Request) {
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		bl := getBlocklist(ctx)
+		blTag, blTagArgs := bl.tagSQL("t.name")
 		var imageTags []types.Tag
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			rows, err := app.Db.QueryContext(ctx, `
+			// Blocked files aren't counted. Checking each file is slow, so the join is only made with a blocklist.
+			blFile, blFileArgs := bl.fileSQL("rf")
+			blJoin := ""
+			if blFile != "" {
+				blJoin = "JOIN remote_file rf ON rf.remote_file_id = mrft.remote_file_id"
+			}
+			replacer := strings.NewReplacer("/*BLOCKLIST_JOIN*/", blJoin, "/*BLOCKLIST_FILE*/", blFile, "/*BLOCKLIST_TAG*/", blTag)
+			args := append(append([]any{}, blFileArgs...), blTagArgs...)
+			rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
 				SELECT t.tag_id
 				     , t.name
+				     , t.local
 				     , (
 				    SELECT COUNT(*)
 				      FROM map_remote_file_tag mrft
 				      --JOIN remote_file rf ON rf.remote_file_id = mrft.remote_file_id
+				      /*BLOCKLIST_JOIN*/
 				     WHERE t.tag_id = mrft.tag_id -- AND rf.fetched = 1
 				    -- filtering on fetched here is quite slow
+				       /*BLOCKLIST_FILE*/
 				       ) AS cnt
 				  FROM tag t
+				 WHERE 1 = 1
+				   /*BLOCKLIST_TAG*/
 				 ORDER BY cnt DESC, t.name ASC
-			`)
+			`), args...)
 			if err != nil {
 				return err
 			}
 			defer rows.Close()
 			for rows.Next() {
 				var t types.Tag
-				if err := rows.Scan(&t.TagId, &t.Name, &t.Count); err != nil {
+				if err := rows.Scan(&t.TagId, &t.Name, &t.IsLocal, &t.Count); err != nil {
 					return err
 				}
 				imageTags = append(imageTags, t)
@@ -1650,22 +1925,30 @@ func (app *App) handleTags(w http.ResponseWriter, r *http.Request) {
 		}
 		var albumTags []types.Tag
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
-			rows, err := app.Db.QueryContext(ctx, `
+			blGallery, blGalleryArgs := bl.gallerySQL("a")
+			replacer := strings.NewReplacer("/*BLOCKLIST_GALLERY*/", blGallery, "/*BLOCKLIST_TAG*/", blTag)
+			args := append(append([]any{}, blGalleryArgs...), blTagArgs...)
+			rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
 				SELECT t.tag_id
 				     , t.name
+				     , t.local
 				     , COUNT(t.tag_id) AS cnt
 				  FROM map_album_tag mat
 				  JOIN tag t ON t.tag_id = mat.tag_id
+				  JOIN album a ON a.album_id = mat.album_id
+				 WHERE 1 = 1
+				   /*BLOCKLIST_GALLERY*/
+				   /*BLOCKLIST_TAG*/
 				 GROUP BY mat.tag_id, t.name
 				 ORDER BY cnt DESC, t.name ASC
-			`)
+			`), args...)
 			if err != nil {
 				return err
 			}
 			defer rows.Close()
 			for rows.Next() {
 				var t types.Tag
-				if err := rows.Scan(&t.TagId, &t.Name, &t.Count); err != nil {
+				if err := rows.Scan(&t.TagId, &t.Name, &t.IsLocal, &t.Count); err != nil {
 					return err
 				}
 				albumTags = append(albumTags, t)
@@ -1674,6 +1957,16 @@ func (app *App) handleTags(w http.ResponseWriter, r *http.Request) {
 		}); err != nil {
 			return err
 		}
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
+			return err
+		}
+		if imageTags, err = app.applyTagRelations(ctx, rel, imageTags, "map_remote_file_tag", "remote_file_id", true); err != nil {
+			return err
+		}
+		if albumTags, err = app.applyTagRelations(ctx, rel, albumTags, "map_album_tag", "album_id", true); err != nil {
+			return err
+		}
 		model := types.TagsPage{ImageTags: imageTags, AlbumTags: albumTags, BasePage: &types.BasePage{Perf: perf}}
 		app.render(ctx, w, "tags.gohtml", &model)
 		return nil
@@ -1702,7 +1995,12 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 		var albumIdMatches []types.Album
 		{ // Just a block for code folding
 			if err := app.withSQL(ctx, func(ctx context.Context) error {
-				rows, err := app.Db.QueryContext(ctx, `
+				blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+				replacer := strings.NewReplacer("/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule), "/*BLOCKLIST*/", blClause)
+				args := []any{app.getGalleryCoversJSON(ctx), searchQuery}
+				args = append(args, blArgs...)
+				//language=sqlite
+				rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
 					SELECT a.album_id
 					     , a.ripper_id
 					     , r.name AS ripper_name
@@ -1721,21 +2019,13 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 					     , a.cnt_rf
 					     , a.last_fetch_ts
 					     , a.inserted_ts
-					     , (
-					    SELECT rf.remote_file_id
-					      FROM map_album_remote_file marf
-					      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-					     WHERE marf.album_id = a.album_id
-					       AND rf.fetched = 1
-					       AND rf.ignored = 0
-					     ORDER BY marf.remote_file_id DESC
-					     LIMIT 1
-					       ) AS thumb_remote_file_id
+					     , /*THUMB*/ AS thumb_remote_file_id
 					  FROM album a
 					  JOIN ripper r ON r.ripper_id = a.ripper_id
 					 WHERE a.gid COLLATE NOCASE = ?
+					   /*BLOCKLIST*/
 					 ORDER BY a.album_id DESC
-				`, searchQuery)
+				`), args...)
 				if err != nil {
 					return err
 				}
@@ -1803,11 +2093,13 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 					albumIdMatches[i].Thumb.HrefMedia = fmt.Sprintf("/media/%s/%s/%s", albumIdMatches[i].RipperHost, albumIdMatches[i].Gid, albumIdMatches[i].Thumb.Filename.String)
 				}
 			}
+			app.populateAlbumsLocalMeta(ctx, albumIdMatches)
 		}
 
 		var fileIdMatches []types.File
 		{
 			if err := app.withSQL(ctx, func(ctx context.Context) error {
+				blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 				rows, err := app.Db.QueryContext(ctx, `
 					SELECT rf.remote_file_id
 					     , r.name AS ripper_name
@@ -1830,8 +2122,9 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 					 WHERE rf.urlid COLLATE NOCASE = ?
 					   AND rf.fetched = 1
 					   AND rf.ignored = 0
+					   `+blClause+`
 					 ORDER BY rf.remote_file_id DESC
-				`, searchQuery)
+				`, append([]any{searchQuery}, blArgs...)...)
 				if err != nil {
 					return err
 				}
@@ -1865,6 +2158,7 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 			}); err != nil {
 				return err
 			}
+			app.populateFilesLocalMeta(ctx, fileIdMatches)
 		}
 
 		var userIdMatches []types.User
@@ -1896,6 +2190,9 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 					if err := rows.Scan(&u.UserName, &u.RipperHost); err != nil {
 						return err
 					}
+					if getBlocklist(ctx).blocksUploader(u.RipperHost, u.UserName) {
+						continue
+					}
 					userIdMatches = append(userIdMatches, u)
 				}
 				return rows.Err()
@@ -1915,7 +2212,7 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		albums, err := app.getSearchAlbumsPage(ctx, searchQuery, size, offset, SortRank, grf)
+		albums, _, err := app.getSearchAlbumsPage(ctx, searchQuery, size, offset, searchGalleryKeyset(SortRank), nil, grf)
 		if err != nil {
 			return err
 		}
@@ -1927,7 +2224,7 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		files, err := app.getSearchFilesPage(ctx, searchQuery, size, offset, SortRank, frf, ftf)
+		files, _, err := app.getSearchFilesPage(ctx, searchQuery, size, offset, searchFileKeyset(SortRank, nil), nil, frf, ftf)
 		if err != nil {
 			return err
 		}
@@ -2012,10 +2309,21 @@ func (app *App) handleSearchGalleries(w http.ResponseWriter, r *http.Request) {
 		}
 
 		order := getSortSearchGalleries(w, r)
-		albums, err := app.getSearchAlbumsPage(ctx, searchQuery, size, offset, order, grf)
+		ks := searchGalleryKeyset(order)
+		c, err := parseCursor(r, ks)
 		if err != nil {
 			return err
 		}
+		// A cursor replaces the offset, the page number is still used to show it
+		queryOffset := offset
+		if c != nil {
+			queryOffset = 0
+		}
+		albums, rowKeys, err := app.getSearchAlbumsPage(ctx, searchQuery, size, queryOffset, ks, c, grf)
+		if err != nil {
+			return err
+		}
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 
 		model := types.SearchPage{
 			Query:       searchQuery,
@@ -2024,12 +2332,15 @@ func (app *App) handleSearchGalleries(w http.ResponseWriter, r *http.Request) {
 			FilesTotal:  filesTotal,
 			TagsTotal:   tagsTotal,
 			HasPrev:     page > 1,
-			HasNext:     offset+len(albums) < albumsTotal,
+			HasNext:     offset+len(rowKeys) < albumsTotal,
+			NextCursor:  nextCursor,
+			PrevCursor:  prevCursor,
 			Page:        page,
 			PageSize:    size,
 			Sort:        order,
 			BasePage:    &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf},
 		}
+		setCursorLinks(w, r, page, nextCursor, prevCursor, model.HasNext, model.HasPrev)
 		app.render(ctx, w, "search_galleries.gohtml", &model)
 		return nil
 	})
@@ -2084,10 +2395,21 @@ func (app *App) handleSearchFiles(w http.ResponseWriter, r *http.Request) {
 		}
 
 		order := getSortSearchFiles(w, r)
-		files, err := app.getSearchFilesPage(ctx, searchQuery, size, offset, order, frf, ftf)
+		ks := searchFileKeyset(order, func() string { return app.getFileScoresJSON(ctx) })
+		c, err := parseCursor(r, ks)
+		if err != nil {
+			return err
+		}
+		// A cursor replaces the offset, the page number is still used to show it
+		queryOffset := offset
+		if c != nil {
+			queryOffset = 0
+		}
+		files, rowKeys, err := app.getSearchFilesPage(ctx, searchQuery, size, queryOffset, ks, c, frf, ftf)
 		if err != nil {
 			return err
 		}
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 
 		model := types.SearchPage{
 			Query:       searchQuery,
@@ -2097,11 +2419,14 @@ func (app *App) handleSearchFiles(w http.ResponseWriter, r *http.Request) {
 			TagsTotal:   tagsTotal,
 			HasPrev:     page > 1,
 			HasNext:     offset+len(files) < filesTotal,
+			NextCursor:  nextCursor,
+			PrevCursor:  prevCursor,
 			Page:        page,
 			PageSize:    size,
 			Sort:        order,
 			BasePage:    &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 		}
+		setCursorLinks(w, r, page, nextCursor, prevCursor, model.HasNext, model.HasPrev)
 		app.render(ctx, w, "search_files.gohtml", &model)
 		return nil
 	})
@@ -2195,6 +2520,9 @@ func (app *App) handleUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		if getBlocklist(ctx).blocksUploader(ripperHost, userName) {
+			return errBlocked("uploader")
+		}
 		size := 10
 		offset := 0
 		grf := getGalleryRatingFilter(w, r)
@@ -2207,7 +2535,7 @@ func (app *App) handleUser(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		albums, err := app.getUserAlbumsPage(ctx, ripperHost, userName, size, offset, SortFetched, grf)
+		albums, _, err := app.getUserAlbumsPage(ctx, ripperHost, userName, size, offset, galleryKeyset(SortFetched), nil, grf)
 		if err != nil {
 			return err
 		}
@@ -2218,7 +2546,7 @@ func (app *App) handleUser(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		files, err := app.getUserFilesPage(ctx, ripperHost, userName, size, offset, SortFetched, frf, ftf)
+		files, _, err := app.getUserFilesPage(ctx, ripperHost, userName, size, offset, fileKeyset(SortFetched, nil), nil, frf, ftf)
 		if err != nil {
 			return err
 		}
@@ -2251,15 +2579,28 @@ func (app *App) handleUserGalleries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		if getBlocklist(ctx).blocksUploader(ripperHost, userName) {
+			return errBlocked("uploader")
+		}
 		page, size := getPageParams(w, r, r.URL)
 		offset := (page - 1) * size
 		order := getSortGalleries(w, r)
+		ks := galleryKeyset(order)
+		c, err := parseCursor(r, ks)
+		if err != nil {
+			return err
+		}
+		// A cursor replaces the offset, the page number is still used to show it
+		queryOffset := offset
+		if c != nil {
+			queryOffset = 0
+		}
 		grf := getGalleryRatingFilter(w, r)
 		frf := getFileRatingFilter(w, r)
 		ftf := getFileTypeFilter(w, r)
 
 		var albumsTotal int
-		albumsTotal, err := app.getUserAlbumHits(ctx, ripperHost, userName, grf)
+		albumsTotal, err = app.getUserAlbumHits(ctx, ripperHost, userName, grf)
 		if err != nil {
 			return err
 		}
@@ -2270,10 +2611,11 @@ func (app *App) handleUserGalleries(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		albums, err := app.getUserAlbumsPage(ctx, ripperHost, userName, size, offset, order, grf)
+		albums, rowKeys, err := app.getUserAlbumsPage(ctx, ripperHost, userName, size, queryOffset, ks, c, grf)
 		if err != nil {
 			return err
 		}
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 
 		model := types.UserPage{
 			Host:        ripperHost,
@@ -2282,12 +2624,15 @@ func (app *App) handleUserGalleries(w http.ResponseWriter, r *http.Request) {
 			AlbumsTotal: albumsTotal,
 			FilesTotal:  filesTotal,
 			HasPrev:     page > 1,
-			HasNext:     offset+len(albums) < albumsTotal,
+			HasNext:     offset+len(rowKeys) < albumsTotal,
+			NextCursor:  nextCursor,
+			PrevCursor:  prevCursor,
 			Page:        page,
 			PageSize:    size,
 			Sort:        order,
 			BasePage:    &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 		}
+		setCursorLinks(w, r, page, nextCursor, prevCursor, model.HasNext, model.HasPrev)
 		app.render(ctx, w, "user_galleries.gohtml", &model)
 		return nil
 	})
@@ -2306,15 +2651,28 @@ func (app *App) handleUserFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		if getBlocklist(ctx).blocksUploader(ripperHost, userName) {
+			return errBlocked("uploader")
+		}
 		page, size := getPageParams(w, r, r.URL)
 		offset := (page - 1) * size
 		order := getSortFiles(w, r)
+		ks := fileKeyset(order, func() string { return app.getFileScoresJSON(ctx) })
+		c, err := parseCursor(r, ks)
+		if err != nil {
+			return err
+		}
+		// A cursor replaces the offset, the page number is still used to show it
+		queryOffset := offset
+		if c != nil {
+			queryOffset = 0
+		}
 		grf := getGalleryRatingFilter(w, r)
 		frf := getFileRatingFilter(w, r)
 		ftf := getFileTypeFilter(w, r)
 
 		var albumsTotal int
-		albumsTotal, err := app.getUserAlbumHits(ctx, ripperHost, userName, grf)
+		albumsTotal, err = app.getUserAlbumHits(ctx, ripperHost, userName, grf)
 		if err != nil {
 			return err
 		}
@@ -2325,10 +2683,11 @@ func (app *App) handleUserFiles(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		files, err := app.getUserFilesPage(ctx, ripperHost, userName, size, offset, order, frf, ftf)
+		files, rowKeys, err := app.getUserFilesPage(ctx, ripperHost, userName, size, queryOffset, ks, c, frf, ftf)
 		if err != nil {
 			return err
 		}
+		nextCursor, prevCursor := ks.pageCursors(rowKeys)
 
 		model := types.UserPage{
 			Host:        ripperHost,
@@ -2338,11 +2697,14 @@ func (app *App) handleUserFiles(w http.ResponseWriter, r *http.Request) {
 			AlbumsTotal: albumsTotal,
 			HasPrev:     page > 1,
 			HasNext:     offset+len(files) < filesTotal,
+			NextCursor:  nextCursor,
+			PrevCursor:  prevCursor,
 			Page:        page,
 			PageSize:    size,
 			Sort:        order,
 			BasePage:    &types.BasePage{Perf: perf, GalleryRatingFilter: grf, FileRatingFilter: frf, FileTypeFilter: ftf},
 		}
+		setCursorLinks(w, r, page, nextCursor, prevCursor, model.HasNext, model.HasPrev)
 		app.render(ctx, w, "user_files.gohtml", &model)
 		return nil
 	})
@@ -2415,13 +2777,15 @@ func (app *App) handleRandomGallery(w http.ResponseWriter, r *http.Request) {
 		grfClause, grfArgs := ratingFilterSQL("a.local_rating", grf)
 		rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
 		ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-		replacer := strings.NewReplacer("/*GALLERY_RATING_FILTER*/", grfClause, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+		blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+		replacer := strings.NewReplacer("/*GALLERY_RATING_FILTER*/", grfClause, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
 
-		if grf.Active() || rf.Active() || ftf.Active() {
+		if grf.Active() || rf.Active() || ftf.Active() || blClause != "" {
 			// Fast path: try twice with independent random seeds
 			var found bool
 			for range 2 {
 				args := append([]any{}, grfArgs...)
+				args = append(args, blArgs...)
 				args = append(args, rfArgs...)
 				args = append(args, ftArgs...)
 				err := app.withSQL(ctx, func(ctx context.Context) error {
@@ -2431,6 +2795,7 @@ func (app *App) handleRandomGallery(w http.ResponseWriter, r *http.Request) {
 						  JOIN ripper r ON r.ripper_id = a.ripper_id
 						 WHERE a.album_id >= (ABS(RANDOM()) % (SELECT MAX(album_id) FROM album))
 						   /*GALLERY_RATING_FILTER*/
+						   /*BLOCKLIST*/
 						   AND EXISTS (
 						       SELECT 1 FROM remote_file rf
 						         JOIN map_album_remote_file marf ON rf.remote_file_id = marf.remote_file_id
@@ -2458,6 +2823,7 @@ func (app *App) handleRandomGallery(w http.ResponseWriter, r *http.Request) {
 				args := append([]any{}, rfArgs...)
 				args = append(args, ftArgs...)
 				args = append(args, grfArgs...)
+				args = append(args, blArgs...)
 				if err := app.withSQL(ctx, func(ctx context.Context) error {
 					return app.Db.QueryRowContext(ctx, replacer.Replace(`
 						WITH filtered AS (
@@ -2475,6 +2841,7 @@ func (app *App) handleRandomGallery(w http.ResponseWriter, r *http.Request) {
 						            /*FILE_TYPE_FILTER*/
 						     )
 						     /*GALLERY_RATING_FILTER*/
+						     /*BLOCKLIST*/
 						),
 						row_count AS (
 						    SELECT COUNT(*) AS cnt FROM filtered
@@ -2519,16 +2886,18 @@ func (app *App) handleRandomFile(w http.ResponseWriter, r *http.Request) {
 		var fileId int64
 		var gid sql.NullString
 
-		if rf.Active() || ftf.Active() {
+		blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+		if rf.Active() || ftf.Active() || blClause != "" {
 			rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
 			ftClause, ftArgs := fileTypeFilterSQL("mt.name", ftf)
-			replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+			replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause)
 			// Fast path: try twice with independent random seeds
 			var found bool
 			for range 2 {
 				args := append([]any{}, rfArgs...)
 				args = append(args, rfArgs...)
 				args = append(args, ftArgs...)
+				args = append(args, blArgs...)
 				err := app.withSQL(ctx, func(ctx context.Context) error {
 					return app.Db.QueryRowContext(ctx, replacer.Replace(`
 						SELECT r.host
@@ -2557,6 +2926,7 @@ func (app *App) handleRandomFile(w http.ResponseWriter, r *http.Request) {
 						   AND rf.ignored = 0
 						   /*RATING_FILTER*/
 						   /*FILE_TYPE_FILTER*/
+						   /*BLOCKLIST*/
 						 ORDER BY rf.remote_file_id
 						 LIMIT 1
 					`), args...).Scan(&ripperHost, &fileId, &gid)
@@ -2573,6 +2943,7 @@ func (app *App) handleRandomFile(w http.ResponseWriter, r *http.Request) {
 				// Slow fallback: CTE COUNT + OFFSET (guaranteed uniform)
 				args := append([]any{}, rfArgs...)
 				args = append(args, ftArgs...)
+				args = append(args, blArgs...)
 				if err := app.withSQL(ctx, func(ctx context.Context) error {
 					return app.Db.QueryRowContext(ctx, replacer.Replace(`
 						WITH filtered AS (
@@ -2584,6 +2955,7 @@ func (app *App) handleRandomFile(w http.ResponseWriter, r *http.Request) {
 						       AND rf.ignored = 0
 						       /*RATING_FILTER*/
 						       /*FILE_TYPE_FILTER*/
+						       /*BLOCKLIST*/
 						),
 						row_count AS (
 						    SELECT COUNT(*) AS cnt FROM filtered
@@ -2665,20 +3037,17 @@ var matchBrowse = regexp.MustCompile(`^/[^/]*$`)
 // handleRandomPage selects a random page within the current set of pages.
 func (app *App) handleRandomPage(w http.ResponseWriter, r *http.Request) {
 	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
-		referer := r.Referer()
-		if len(referer) == 0 {
+		// The link sends its page as from, since pages send no Referer
+		from := r.URL.Query().Get("from")
+		if !isLocalPath(from) {
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return nil
 		}
-		parsedUrl, err := url.Parse(referer)
+		parsedUrl, err := url.Parse(from)
 		if err != nil {
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return nil
 		}
-		if r.Host != parsedUrl.Host {
-			// Request came from some other server. Suspicious!
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		}
 		path := parsedUrl.Path
 		if len(path) == 0 {
 			// Go back
@@ -2712,6 +3081,28 @@ func (app *App) handleRandomPage(w http.ResponseWriter, r *http.Request) {
 			app.httpRedirect(ctx, w, r, perf, fmt.Sprintf("/gallery/%s/%s?page=%d&size=%d&sort=%s", ripperHost, gid, nextPage, size, sort), http.StatusTemporaryRedirect)
 			return nil
 		}
+		if m := matchCollectionFile.FindStringSubmatch(path); m != nil {
+			collectionId, _ := strconv.ParseInt(m[1], 10, 64)
+			fileId, _ := strconv.ParseInt(m[2], 10, 64)
+			ftf := getUrlFileTypeFilter(parsedUrl)
+			nextFileId, err := app.getRandomCollectionFile(ctx, collectionId, fileId, frf, ftf)
+			if err != nil {
+				return err
+			}
+			app.httpRedirect(ctx, w, r, perf, fmt.Sprintf("/collection/%d/%d", collectionId, nextFileId), http.StatusTemporaryRedirect)
+			return nil
+		}
+		if m := matchCollection.FindStringSubmatch(path); m != nil {
+			collectionId, _ := strconv.ParseInt(m[1], 10, 64)
+			page, size := getPageParams(w, r, parsedUrl)
+			ftf := getUrlFileTypeFilter(parsedUrl)
+			nextPage, err := app.getRandomCollectionPage(ctx, collectionId, page, size, frf, ftf)
+			if err != nil {
+				return err
+			}
+			app.httpRedirect(ctx, w, r, perf, fmt.Sprintf("/collection/%d?page=%d&size=%d", collectionId, nextPage, size), http.StatusTemporaryRedirect)
+			return nil
+		}
 		if matchFile.MatchString(path) {
 			http.Redirect(w, r, "/random/file", http.StatusTemporaryRedirect)
 			return nil
@@ -2775,12 +3166,15 @@ func (app *App) handleRandomPage(w http.ResponseWriter, r *http.Request) {
 func (app *App) getRandomGalleryFilePage(ctx context.Context, ripperHost string, gid string, fileId string, rf types.RatingFilter) (int64, error) {
 	var nextFileId sql.NullInt64
 	rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause)
+	blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause)
 	err := app.withSQL(ctx, func(ctx context.Context) error {
 		args := []any{ripperHost, gid, fileId}
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		args = append(args, ripperHost, gid, fileId)
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
 			  WITH row_count AS (
 			      SELECT COUNT(*) cnt
@@ -2794,6 +3188,7 @@ func (app *App) getRandomGalleryFilePage(ctx context.Context, ripperHost string,
 			         AND rf.fetched = 1
 			         AND rf.ignored = 0
 			         /*RATING_FILTER*/
+			         /*BLOCKLIST*/
 			                    )
 			SELECT rf.remote_file_id
 			  FROM remote_file rf
@@ -2810,6 +3205,7 @@ func (app *App) getRandomGalleryFilePage(ctx context.Context, ripperHost string,
 			   AND rf.fetched = 1
 			   AND rf.ignored = 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 			 LIMIT 1 OFFSET CASE
 			                    WHEN (
 			                             SELECT cnt
@@ -2834,11 +3230,13 @@ func (app *App) getRandomGalleryFilePage(ctx context.Context, ripperHost string,
 func (app *App) getRandomGalleryPage(ctx context.Context, ripperHost string, gid string, page int, size int, rf types.RatingFilter, ft types.FileTypeFilter) (int64, error) {
 	var count int64
 	rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
+	blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 	ftClause, ftArgs := fileTypeFilterSQL("mt.name", ft)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*FILE_TYPE_FILTER*/", ftClause)
 	err := app.withSQL(ctx, func(ctx context.Context) error {
 		args := []any{ripperHost, gid}
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		args = append(args, ftArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
 			SELECT COUNT(*)
@@ -2852,6 +3250,7 @@ func (app *App) getRandomGalleryPage(ctx context.Context, ripperHost string, gid
 			   AND rf.fetched = 1
 			   AND rf.ignored = 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 			   /*FILE_TYPE_FILTER*/
 		`), args...).Scan(&count)
 	})
@@ -2921,24 +3320,6 @@ func (app *App) getRandomBrowsePage(ctx context.Context, page int, size int, rf
 	return nextPage, nil
 }
 
-func (app *App) cleanJoin(elem ...string) string {
-	// absolute paths can't be joined; discard all paths prior to the last absolute path
-	lastAbsoluteIndex := 0
-	for i := 0; i < len(elem); i++ {
-		if strings.HasPrefix(elem[i], "/") {
-			lastAbsoluteIndex = i
-		}
-	}
-	joined := filepath.Join(elem[lastAbsoluteIndex:]...)
-	// prevent path traversal by resolving and ensuring it stays under mediaRoot
-	absRoot, _ := filepath.Abs(app.MediaRoot)
-	absJoined, _ := filepath.Abs(joined)
-	if !strings.HasPrefix(absJoined, absRoot) {
-		return absRoot
-	}
-	return absJoined
-}
-
 var filesystemSafeRe = regexp.MustCompile("[^a-zA-Z0-9-.,_ ]")
 
 // from ripme Utils.filesystemSafe; used on gid
@@ -2961,10 +3342,6 @@ func sanitizedFilename(filename string) string {
 
 // handleFilePost handles POST /file/{ripper_host}/{file_id}
 func (app *App) handleFilePost(w http.ResponseWriter, r *http.Request) {
-	if app.DbRw == nil {
-		app.renderError(r.Context(), w, &types.Perf{}, http.StatusForbidden, fmt.Errorf("database is read-only, cannot save rating"))
-		return
-	}
 	ripperHost := r.PathValue("ripper_host")
 	fileIdString := r.PathValue("file_id")
 	if ripperHost == "" || fileIdString == "" {
@@ -2976,104 +3353,26 @@ func (app *App) handleFilePost(w http.ResponseWriter, r *http.Request) {
 		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid file id"))
 		return
 	}
-	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
-		app.bustCache(w)
-		ratingString := r.FormValue("rating")
-		if ratingString == "unset" {
-			return app.withSQL(ctx, func(ctx context.Context) error {
-				_, err := app.DbRw.ExecContext(ctx, `
-					UPDATE remote_file
-					   SET local_rating = NULL
-					  FROM ripper r
-					 WHERE remote_file_id = ?
-					   AND r.ripper_id = remote_file.ripper_id
-					   AND r.host = ?
-				`, fileId, ripperHost)
-				return err
-			})
-		}
-		if len(ratingString) > 0 {
-			rating, err := strconv.Atoi(ratingString)
-			if err != nil || rating < 1 || rating > 5 {
-				return fmt.Errorf(`invalid rating, must be 1-5 or "unset"`)
-				// TODO change perfTracker callback to be (statusCode, error)
-				//return app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid rating, must be 1-5 or unset"))
-			}
-			return app.withSQL(ctx, func(ctx context.Context) error {
-				_, err := app.DbRw.ExecContext(ctx, `
-					UPDATE remote_file
-					   SET local_rating = ?
-					  FROM ripper r
-					 WHERE remote_file_id = ?
-					   AND r.ripper_id = remote_file.ripper_id
-					   AND r.host = ?
-				`, rating, fileId, ripperHost)
-				return err
-			})
-		}
-		return nil
-	})
+	u, err := readEntityUpdate(r, readRatingForm)
 	if err != nil {
-		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
 		return
 	}
-
-	app.httpRedirect(r.Context(), w, r, &p, r.Referer(), http.StatusSeeOther)
+	app.saveEntityUpdate(w, r, app.fileTarget(ripperHost, fileId), u)
 }
 
 // handleGalleryPost handles POST /gallery/{ripper_host}/{gid}
 func (app *App) handleGalleryPost(w http.ResponseWriter, r *http.Request) {
-	if app.DbRw == nil {
-		app.renderError(r.Context(), w, &types.Perf{}, http.StatusForbidden, fmt.Errorf("database is read-only, cannot save rating"))
-		return
-	}
 	ripperHost := r.PathValue("ripper_host")
 	gid := r.PathValue("gid")
 	if ripperHost == "" || gid == "" {
 		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected values for all path parts: /gallery/{ripper_host}/{gid}"))
 		return
 	}
-	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
-		app.bustCache(w)
-		ratingString := r.FormValue("rating")
-		if ratingString == "unset" {
-			return app.withSQL(ctx, func(ctx context.Context) error {
-				_, err := app.DbRw.ExecContext(ctx, `
-					UPDATE album
-					   SET local_rating = NULL
-					  FROM ripper r
-					 WHERE gid = ?
-					   AND r.ripper_id = album.ripper_id
-					   AND r.host = ?
-				`, gid, ripperHost)
-				return err
-			})
-		}
-		if len(ratingString) > 0 {
-			rating, err := strconv.Atoi(ratingString)
-			if err != nil || rating < 1 || rating > 5 {
-				return fmt.Errorf(`invalid rating, must be 1-5 or "unset"`)
-				// TODO change perfTracker callback to be (statusCode, error)
-				//return app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid rating, must be 1-5 or unset"))
-			}
-			return app.withSQL(ctx, func(ctx context.Context) error {
-				_, err := app.DbRw.ExecContext(ctx, `
-					UPDATE album
-					   SET local_rating = ?
-					  FROM ripper r
-					 WHERE gid = ?
-					   AND r.ripper_id = album.ripper_id
-					   AND r.host = ?
-				`, rating, gid, ripperHost)
-				return err
-			})
-		}
-		return nil
-	})
+	u, err := readEntityUpdate(r, readRatingForm)
 	if err != nil {
-		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
 		return
 	}
-
-	app.httpRedirect(r.Context(), w, r, &p, r.Referer(), http.StatusSeeOther)
+	app.saveEntityUpdate(w, r, app.galleryTarget(ripperHost, gid), u)
 }
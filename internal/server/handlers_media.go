@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"golocalgal/internal/types"
 	"net/http"
+	"path/filepath"
 	"strings"
 )
 
@@ -25,8 +26,11 @@ func (app *App) handleMedia(w http.ResponseWriter, r *http.Request) {
 		// path after /media/
 		rest := strings.TrimPrefix(r.URL.Path, "/media/")
 		rest = strings.TrimLeft(rest, "/")
+		if known, ok := app.catalogue.mediaFile(ctx, rest); ok && sendMedia(known, w, r) {
+			return nil
+		}
 		parts := strings.Split(rest, "/")
-		var tryFiles []string
+		var tryFiles []knownFile
 		// /media/{ripper_host}/{gid}/{filename}
 		if len(parts) >= 3 {
 			ripperHost = parts[0]
@@ -34,53 +38,47 @@ func (app *App) handleMedia(w http.ResponseWriter, r *http.Request) {
 			name = parts[2]
 
 			// prefer direct path under mediaRoot/ripperHost_gid/
-			preferredPath := app.cleanJoin(app.MediaRoot, ripperHost+"_"+gid, name)
+			preferredPath := knownFile{app.MediaRoot, filepath.Join(ripperHost+"_"+gid, name)}
 			tryFiles = append(tryFiles, preferredPath)
 
 			// first fallback: ripme-mangled path
 			mangledGid := filesystemSafe(gid)
 			mangledName = sanitizedFilename(name)
 			if mangledGid != gid || mangledName != name {
-				mangledPath := app.cleanJoin(app.MediaRoot, ripperHost+"_"+mangledGid, mangledName)
+				mangledPath := knownFile{app.MediaRoot, filepath.Join(ripperHost+"_"+mangledGid, mangledName)}
 				tryFiles = append(tryFiles, mangledPath)
 			}
 
 			// fallback to knownFilePaths by name
 			if list, ok := app.KnownFilePaths[name]; ok {
-				for _, p := range list {
-					tryFiles = append(tryFiles, app.cleanJoin(app.DfLogRoot, p))
-				}
+				tryFiles = append(tryFiles, list...)
 			}
 		} else if len(parts) >= 2 { // fallback: /media/{ripper_host}/{filename}
 			ripperHost = parts[0]
 			name = parts[1]
 			// prefer direct path under mediaRoot
-			tryFiles = append(tryFiles, app.cleanJoin(app.MediaRoot, ripperHost, name))
+			tryFiles = append(tryFiles, knownFile{app.MediaRoot, filepath.Join(ripperHost, name)})
 
 			// first fallback: ripme-mangled path
 			mangledName = sanitizedFilename(name)
 			if mangledName != name {
-				mangledPath := app.cleanJoin(app.MediaRoot, ripperHost, mangledName)
+				mangledPath := knownFile{app.MediaRoot, filepath.Join(ripperHost, mangledName)}
 				tryFiles = append(tryFiles, mangledPath)
 			}
 
 			// fallback to knownFilePaths by name
 			if list, ok := app.KnownFilePaths[name]; ok {
-				for _, p := range list {
-					tryFiles = append(tryFiles, app.cleanJoin(app.DfLogRoot, p))
-				}
+				tryFiles = append(tryFiles, list...)
 			}
 		} else if len(parts) == 1 && parts[0] != "" { // last resort: find by filename only
 			name = parts[0]
 			if list, ok := app.KnownFilePaths[name]; ok {
-				for _, p := range list {
-					tryFiles = append(tryFiles, app.cleanJoin(app.DfLogRoot, p))
-				}
+				tryFiles = append(tryFiles, list...)
 			}
 		}
 
 		for _, fp := range tryFiles {
-			sent := sendFile(fp, w, r)
+			sent := sendMedia(fp, w, r)
 			if sent {
 				return nil
 			}
@@ -105,18 +103,18 @@ func (app *App) handleMedia(w http.ResponseWriter, r *http.Request) {
 				`, ripperHost, name, mangledName).Scan(&oldestGid)
 			})
 			if err == nil && oldestGid != gid {
-				preferredPathOldestGid := app.cleanJoin(app.MediaRoot, ripperHost+"_"+oldestGid, name)
+				preferredPathOldestGid := knownFile{app.MediaRoot, filepath.Join(ripperHost+"_"+oldestGid, name)}
 				tryFiles = append(tryFiles, preferredPathOldestGid)
 				mangledOldestGid := filesystemSafe(oldestGid)
 				if mangledOldestGid != oldestGid || mangledName != name {
-					mangledPath := app.cleanJoin(app.MediaRoot, ripperHost+"_"+mangledOldestGid, mangledName)
+					mangledPath := knownFile{app.MediaRoot, filepath.Join(ripperHost+"_"+mangledOldestGid, mangledName)}
 					tryFiles = append(tryFiles, mangledPath)
 				}
 			}
 		}
 
 		for _, fp := range tryFiles {
-			sent := sendFile(fp, w, r)
+			sent := sendMedia(fp, w, r)
 			if sent {
 				return nil
 			}
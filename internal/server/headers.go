@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Pages may only load from LocalGal itself, so a gallery description or filename can't make the browser fetch
+// anything remote, and only scripts carrying the nonce of the response run, which every <script> of a page embeds.
+// Files under /media/ come from rips, so they are sandboxed: an SVG or HTML file opened from there runs no script
+// and doesn't get LocalGal's origin.
+
+const (
+	pagePolicy = "default-src 'self'; script-src 'nonce-%s'; style-src 'self' 'unsafe-inline'; object-src 'none'; " +
+		"base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+	mediaPolicy = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; " +
+		"frame-ancestors 'none'; sandbox"
+	permissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=(), usb=(), serial=(), bluetooth=()"
+)
+
+type cspNonceKey struct{}
+
+// cspNonce returns the nonce that scripts of the page need, or "" outside of withSecurityHeaders
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// withSecurityHeaders sets the Content-Security-Policy and other security headers of every response
+func (app *App) withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Permissions-Policy", permissionsPolicy)
+		h.Set("X-Frame-Options", "DENY") // frame-ancestors, for browsers without CSP
+		if strings.HasPrefix(r.URL.Path, "/media/") {
+			h.Set("Content-Security-Policy", mediaPolicy)
+			next.ServeHTTP(w, r)
+			return
+		}
+		nonce := rand.Text()
+		h.Set("Content-Security-Policy", fmt.Sprintf(pagePolicy, nonce))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+	})
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"golocalgal/internal/types"
+	"net/http"
+	"strings"
+)
+
+// parseIgnored validates the ignored form field: "1" to ignore, "0" to unignore, empty to leave alone
+func parseIgnored(value string) error {
+	if value != "" && value != "0" && value != "1" {
+		return fmt.Errorf(`invalid ignored value, must be 0 or 1`)
+	}
+	return nil
+}
+
+// setGalleryIgnoredTx sets the ignored flag of every file in a gallery, recording one change per file.
+// Files in several galleries are ignored everywhere, since ignored is a property of the file.
+// Unfetched files are left alone, because LocalGal never shows them.
+func setGalleryIgnoredTx(ctx context.Context, tx *sql.Tx, e auditEntity, ignored bool, changes *auditChanges) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT rf.remote_file_id
+		  FROM map_album_remote_file marf
+		  JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
+		 WHERE marf.album_id = ?
+		   AND rf.fetched = 1
+		   AND rf.ignored != ?
+	`, e.Id, ignored)
+	if err != nil {
+		return err
+	}
+	var fileIds []int64
+	for rows.Next() {
+		var fileId int64
+		if err := rows.Scan(&fileId); err != nil {
+			rows.Close()
+			return err
+		}
+		fileIds = append(fileIds, fileId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, fileId := range fileIds {
+		fe, err := lookupFileEntity(ctx, tx, "", fileId)
+		if err != nil {
+			return err
+		}
+		if err := setFileIgnoredTx(ctx, tx, fe, ignored, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// albumFileTotals counts and sizes the fetched files of an album, split by whether they are ignored
+type albumFileTotals struct {
+	Count        int
+	Bytes        int64
+	IgnoredCount int
+	IgnoredBytes int64
+}
+
+// getAlbumFileTotals computes exact totals for one album.
+// album.cnt_rf and album.sum_rf_bytes are maintained by RipMe and include unfetched and ignored files,
+// so they only suit listings where counting every album would be too slow.
+func (app *App) getAlbumFileTotals(ctx context.Context, albumId int64) (albumFileTotals, error) {
+	var t albumFileTotals
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		return app.Db.QueryRowContext(ctx, `
+			SELECT COALESCE(SUM(rf.ignored = 0), 0)
+			     , COALESCE(SUM(IIF(rf.ignored = 0, rf.bytes, 0)), 0)
+			     , COALESCE(SUM(rf.ignored = 1), 0)
+			     , COALESCE(SUM(IIF(rf.ignored = 1, rf.bytes, 0)), 0)
+			  FROM map_album_remote_file marf
+			  JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
+			 WHERE marf.album_id = ?
+			   AND rf.fetched = 1
+		`, albumId).Scan(&t.Count, &t.Bytes, &t.IgnoredCount, &t.IgnoredBytes)
+	})
+	return t, err
+}
+
+// postRedirectTarget returns where to send the client after a form post: the next form field, which forms set to
+// their page, or else fallback. Pages send no Referer, see withSecurityHeaders, so it can't be used.
+func postRedirectTarget(r *http.Request, fallback string) string {
+	if next := r.PostFormValue("next"); isLocalPath(next) {
+		return next
+	}
+	return fallback
+}
+
+// isLocalPath reports whether p is a path on this server. Only local paths are redirected to, so forms and links
+// can't be used as an open redirect.
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// handleIgnored handles /ignored
+func (app *App) handleIgnored(w http.ResponseWriter, r *http.Request) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		page, size := getPageParams(w, r, r.URL)
+		offset := (page - 1) * size
+
+		var total int
+		if err := app.withSQL(ctx, func(ctx context.Context) error {
+			return app.Db.QueryRowContext(ctx, `
+				SELECT COUNT(*)
+				  FROM remote_file rf
+				 WHERE rf.fetched = 1
+				   AND rf.ignored = 1
+			`).Scan(&total)
+		}); err != nil {
+			return err
+		}
+
+		var files []types.File
+		if err := app.withSQL(ctx, func(ctx context.Context) error {
+			rows, err := app.Db.QueryContext(ctx, `
+				SELECT rf.remote_file_id
+				     , r.name AS ripper_name
+				     , r.host AS ripper_host
+				     , rf.urlid
+				     , rf.filename
+				     , mt.name AS mime_type
+				     , rf.title
+				     , rf.hidden
+				     , rf.removed
+				     , rf.bytes
+				     , rf.local_rating
+				     , rf.inserted_ts
+				  FROM remote_file rf
+				  JOIN ripper r ON r.ripper_id = rf.ripper_id
+				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				 WHERE rf.fetched = 1
+				   AND rf.ignored = 1
+				 ORDER BY rf.remote_file_id DESC
+				 LIMIT ? OFFSET ?
+			`, size, offset)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var f types.File
+				if err := rows.Scan(
+					&f.FileId,
+					&f.RipperName,
+					&f.RipperHost,
+					&f.Urlid,
+					&f.Filename,
+					&f.MimeType,
+					&f.Title,
+					&f.Hidden,
+					&f.Removed,
+					&f.Bytes,
+					&f.LocalRating,
+					&f.InsertedTs,
+				); err != nil {
+					return err
+				}
+				files = append(files, f)
+			}
+			return rows.Err()
+		}); err != nil {
+			return err
+		}
+		for i := range files {
+			// The file page hides ignored files, so link straight to the media
+			if files[i].Filename.Valid {
+				files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
+				files[i].HrefPage = files[i].HrefMedia
+			}
+		}
+
+		model := types.IgnoredPage{
+			Files:    files,
+			Page:     page,
+			PageSize: size,
+			Total:    total,
+			HasPrev:  page > 1,
+			HasNext:  offset+len(files) < total,
+			ReadOnly: app.DbRw == nil,
+			BasePage: &types.BasePage{Perf: perf},
+		}
+		app.render(ctx, w, "ignored.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+const LocalDbFile = "localgal.sqlite"
+
+// localDbMigrations holds the schema of the LocalGal database.
+// The database is owned by LocalGal, unlike the RipMe database, so it is created if it doesn't exist.
+// Each entry is applied once, in order, and recorded in PRAGMA user_version. Only ever append to this list.
+var localDbMigrations = []string{
+	// 1: named filter profiles
+	`
+	CREATE TABLE filter_profile
+	(
+	    name                  TEXT    NOT NULL PRIMARY KEY,
+	    gal_rating_min        INTEGER NOT NULL DEFAULT 0,
+	    gal_rating_max        INTEGER NOT NULL DEFAULT 0,
+	    gal_unrated           TEXT    NOT NULL DEFAULT '',
+	    file_rating_min       INTEGER NOT NULL DEFAULT 0,
+	    file_rating_max       INTEGER NOT NULL DEFAULT 0,
+	    file_unrated          TEXT    NOT NULL DEFAULT '',
+	    file_type             TEXT    NOT NULL DEFAULT '',
+	    sort_galleries        TEXT    NOT NULL DEFAULT '',
+	    sort_files            TEXT    NOT NULL DEFAULT '',
+	    sort_search_galleries TEXT    NOT NULL DEFAULT '',
+	    sort_search_files     TEXT    NOT NULL DEFAULT '',
+	    page_size             INTEGER NOT NULL DEFAULT 0,
+	    updated_ts            INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	`,
+	// 2: audit log of changes to the RipMe database
+	`
+	CREATE TABLE audit_log
+	(
+	    audit_id    INTEGER PRIMARY KEY,
+	    ts          INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    entity_type TEXT    NOT NULL,
+	    entity_id   INTEGER NOT NULL,
+	    ripper_host TEXT    NOT NULL,
+	    entity_key  TEXT    NOT NULL,
+	    field       TEXT    NOT NULL,
+	    old_value   TEXT,
+	    new_value   TEXT,
+	    client_addr TEXT    NOT NULL DEFAULT '',
+	    undo_of     INTEGER REFERENCES audit_log,
+	    undone_ts   INTEGER
+	);
+	CREATE INDEX audit_log_entity ON audit_log (entity_type, entity_id);
+	`,
+	// 3: tag aliases and implications, by tag name so they apply to remote and local tags alike
+	`
+	CREATE TABLE tag_alias
+	(
+	    alias_name     TEXT    NOT NULL PRIMARY KEY,
+	    canonical_name TEXT    NOT NULL,
+	    inserted_ts    INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    CHECK (alias_name != canonical_name)
+	);
+	CREATE TABLE tag_implication
+	(
+	    child_name  TEXT    NOT NULL,
+	    parent_name TEXT    NOT NULL,
+	    inserted_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    PRIMARY KEY (child_name, parent_name),
+	    CHECK (child_name != parent_name)
+	);
+	`,
+	// 4: user-curated collections of files, with a built-in favorites collection
+	`
+	CREATE TABLE collection
+	(
+	    collection_id INTEGER PRIMARY KEY,
+	    name          TEXT    NOT NULL,
+	    builtin       TEXT UNIQUE,
+	    cover_file_id INTEGER,
+	    created_ts    INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    updated_ts    INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE TABLE collection_file
+	(
+	    collection_id  INTEGER NOT NULL REFERENCES collection ON DELETE CASCADE,
+	    remote_file_id INTEGER NOT NULL,
+	    position       INTEGER NOT NULL,
+	    added_ts       INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    PRIMARY KEY (collection_id, remote_file_id)
+	);
+	CREATE INDEX collection_file_position ON collection_file (collection_id, position);
+	INSERT INTO collection (name, builtin) VALUES ('Favorites', 'favorites');
+	`,
+	// 5: pairwise comparisons and the Elo score of each compared file
+	`
+	CREATE TABLE file_score
+	(
+	    remote_file_id INTEGER PRIMARY KEY,
+	    score          REAL    NOT NULL,
+	    comparisons    INTEGER NOT NULL DEFAULT 0,
+	    wins           INTEGER NOT NULL DEFAULT 0,
+	    updated_ts     INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE TABLE comparison
+	(
+	    comparison_id  INTEGER PRIMARY KEY,
+	    ts             INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    winner_file_id INTEGER NOT NULL,
+	    loser_file_id  INTEGER NOT NULL,
+	    client_addr    TEXT    NOT NULL DEFAULT ''
+	);
+	`,
+	// 6: chosen gallery covers, overriding the cover rule
+	`
+	CREATE TABLE gallery_cover
+	(
+	    album_id       INTEGER PRIMARY KEY,
+	    remote_file_id INTEGER NOT NULL,
+	    updated_ts     INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	`,
+	// 7: local titles and notes of galleries and files, searchable like RipMe's titles and descriptions.
+	// The full-text tables read through views that name notes "description", so column filters work the same in both searches.
+	`
+	CREATE TABLE gallery_meta
+	(
+	    album_id   INTEGER PRIMARY KEY,
+	    title      TEXT    NOT NULL DEFAULT '',
+	    notes      TEXT    NOT NULL DEFAULT '',
+	    updated_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE TABLE file_meta
+	(
+	    remote_file_id INTEGER PRIMARY KEY,
+	    title          TEXT    NOT NULL DEFAULT '',
+	    notes          TEXT    NOT NULL DEFAULT '',
+	    updated_ts     INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE VIEW gallery_meta_fts5_content AS SELECT album_id, title, notes AS description FROM gallery_meta;
+	CREATE VIEW file_meta_fts5_content AS SELECT remote_file_id, title, notes AS description FROM file_meta;
+	CREATE VIRTUAL TABLE gallery_meta_fts5 USING fts5(title, description, content='gallery_meta_fts5_content', content_rowid='album_id');
+	CREATE VIRTUAL TABLE file_meta_fts5 USING fts5(title, description, content='file_meta_fts5_content', content_rowid='remote_file_id');
+	CREATE TRIGGER gallery_meta_ai AFTER INSERT ON gallery_meta BEGIN
+	    INSERT INTO gallery_meta_fts5 (rowid, title, description) VALUES (new.album_id, new.title, new.notes);
+	END;
+	CREATE TRIGGER gallery_meta_ad AFTER DELETE ON gallery_meta BEGIN
+	    INSERT INTO gallery_meta_fts5 (gallery_meta_fts5, rowid, title, description) VALUES ('delete', old.album_id, old.title, old.notes);
+	END;
+	CREATE TRIGGER gallery_meta_au AFTER UPDATE ON gallery_meta BEGIN
+	    INSERT INTO gallery_meta_fts5 (gallery_meta_fts5, rowid, title, description) VALUES ('delete', old.album_id, old.title, old.notes);
+	    INSERT INTO gallery_meta_fts5 (rowid, title, description) VALUES (new.album_id, new.title, new.notes);
+	END;
+	CREATE TRIGGER file_meta_ai AFTER INSERT ON file_meta BEGIN
+	    INSERT INTO file_meta_fts5 (rowid, title, description) VALUES (new.remote_file_id, new.title, new.notes);
+	END;
+	CREATE TRIGGER file_meta_ad AFTER DELETE ON file_meta BEGIN
+	    INSERT INTO file_meta_fts5 (file_meta_fts5, rowid, title, description) VALUES ('delete', old.remote_file_id, old.title, old.notes);
+	END;
+	CREATE TRIGGER file_meta_au AFTER UPDATE ON file_meta BEGIN
+	    INSERT INTO file_meta_fts5 (file_meta_fts5, rowid, title, description) VALUES ('delete', old.remote_file_id, old.title, old.notes);
+	    INSERT INTO file_meta_fts5 (rowid, title, description) VALUES (new.remote_file_id, new.title, new.notes);
+	END;
+	`,
+	// 8: LocalGal settings, such as the hash of the shared secret
+	`
+	CREATE TABLE setting
+	(
+	    name       TEXT    NOT NULL PRIMARY KEY,
+	    value      TEXT    NOT NULL,
+	    updated_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	`,
+	// 9: blocklist of tags, uploaders, ripper hosts, and galleries that are hidden everywhere
+	`
+	CREATE TABLE blocked_tag
+	(
+	    name        TEXT    NOT NULL PRIMARY KEY,
+	    inserted_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE TABLE blocked_uploader
+	(
+	    ripper_host TEXT    NOT NULL,
+	    uploader    TEXT    NOT NULL,
+	    inserted_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000),
+	    PRIMARY KEY (ripper_host, uploader)
+	);
+	CREATE TABLE blocked_host
+	(
+	    ripper_host TEXT    NOT NULL PRIMARY KEY,
+	    inserted_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	CREATE TABLE blocked_gallery
+	(
+	    album_id    INTEGER PRIMARY KEY,
+	    inserted_ts INTEGER NOT NULL DEFAULT (UNIXEPOCH('subsec') * 1000)
+	);
+	`,
+}
+
+// GetLocalDb opens the LocalGal database, creating and migrating it as needed
+func GetLocalDb(ctx context.Context, dsn string) (*sql.DB, error) {
+	log.Printf("Using SQLite DSN for %s: %s", "localgal", dsn)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		log.Printf("open local db: %v", err)
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // small and rarely written; one connection avoids SQLITE_BUSY
+	if err := migrateDb(ctx, db, "local db", localDbMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateDb applies the migrations that db hasn't had yet, recording them in PRAGMA user_version
+func migrateDb(ctx context.Context, db *sql.DB, label string, migrations []string) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("unable to check %s schema version: %w", label, err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%s schema version is newer than this version of localgal supports. supported: %d; found: %d", label, len(migrations), version)
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("unable to migrate %s to version %d: %w", label, i+1, err)
+		}
+		// PRAGMA doesn't accept bind parameters
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("unable to migrate %s to version %d: %w", label, i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("%s migrated to version %d", label, i+1)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	localTitleMaxLength = 200
+	localNotesMaxLength = 10000
+)
+
+// localMetaTable is where the local titles and notes of one entity type are stored in LocalDb, keyed by the RipMe id
+type localMetaTable struct {
+	table    string
+	idColumn string
+	fts      string
+}
+
+var (
+	galleryMeta = localMetaTable{table: "gallery_meta", idColumn: "album_id", fts: "gallery_meta_fts5"}
+	fileMeta    = localMetaTable{table: "file_meta", idColumn: "remote_file_id", fts: "file_meta_fts5"}
+)
+
+func (t localMetaTable) replace(query string) string {
+	return strings.NewReplacer("/*TABLE*/", t.table, "/*ID*/", t.idColumn, "/*FTS*/", t.fts).Replace(query)
+}
+
+type localMeta struct {
+	Title types.SqlJsonString
+	Notes types.SqlJsonString
+}
+
+// getLocalMetas returns the local titles and notes of the given ids. Ids without any are left out.
+// Errors are logged rather than returned, so pages still work with only RipMe's titles.
+func (app *App) getLocalMetas(ctx context.Context, t localMetaTable, ids []int64) map[int64]localMeta {
+	metas := make(map[int64]localMeta)
+	if app.LocalDb == nil || len(ids) == 0 {
+		return metas
+	}
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, t.replace(`
+			SELECT /*ID*/
+			     , NULLIF(title, '')
+			     , NULLIF(notes, '')
+			  FROM /*TABLE*/
+			 WHERE /*ID*/ IN (SELECT value FROM json_each(?))
+		`), jsonArray(ids))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var m localMeta
+			if err := rows.Scan(&id, &m.Title, &m.Notes); err != nil {
+				return err
+			}
+			metas[id] = m
+		}
+		return rows.Err()
+	}); err != nil {
+		log.Printf("unable to load local titles and notes: %v", err)
+	}
+	return metas
+}
+
+// getLocalMeta returns the local title and notes of one id, empty if it has none.
+// Unlike getLocalMetas, errors are returned, as it's read to put the title and notes back after a failed update.
+func (app *App) getLocalMeta(ctx context.Context, t localMetaTable, id int64) (title string, notes string, err error) {
+	err = app.withSQL(ctx, func(ctx context.Context) error {
+		return app.LocalDb.QueryRowContext(ctx, t.replace(`
+			SELECT title
+			     , notes
+			  FROM /*TABLE*/
+			 WHERE /*ID*/ = ?
+		`), id).Scan(&title, &notes)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	return title, notes, err
+}
+
+// populateAlbumsLocalMeta sets the local title and notes of each album
+func (app *App) populateAlbumsLocalMeta(ctx context.Context, albums []types.Album) {
+	ids := make([]int64, len(albums))
+	for i := range albums {
+		ids[i] = albums[i].AlbumId
+	}
+	metas := app.getLocalMetas(ctx, galleryMeta, ids)
+	for i := range albums {
+		m := metas[albums[i].AlbumId]
+		albums[i].LocalTitle, albums[i].Notes = m.Title, m.Notes
+	}
+}
+
+// populateFilesLocalMeta sets the local title and notes of each file
+func (app *App) populateFilesLocalMeta(ctx context.Context, files []types.File) {
+	ids := make([]int64, len(files))
+	for i := range files {
+		ids[i] = files[i].FileId
+	}
+	metas := app.getLocalMetas(ctx, fileMeta, ids)
+	for i := range files {
+		m := metas[files[i].FileId]
+		files[i].LocalTitle, files[i].Notes = m.Title, m.Notes
+	}
+}
+
+// populateAlbumLocalMeta sets the local title and notes of one album
+func (app *App) populateAlbumLocalMeta(ctx context.Context, a *types.Album) {
+	m := app.getLocalMetas(ctx, galleryMeta, []int64{a.AlbumId})[a.AlbumId]
+	a.LocalTitle, a.Notes = m.Title, m.Notes
+}
+
+// populateFileLocalMeta sets the local title and notes of one file
+func (app *App) populateFileLocalMeta(ctx context.Context, f *types.File) {
+	m := app.getLocalMetas(ctx, fileMeta, []int64{f.FileId})[f.FileId]
+	f.LocalTitle, f.Notes = m.Title, m.Notes
+}
+
+// getLocalSearchMatches returns the ids whose local title or notes match a full-text query, as a JSON object of BM25 scores by id.
+// The matches are in LocalDb, so they are passed to the RipMe search queries as an argument, which add them to their own matches.
+// Unlike the other LocalDb lookups, errors are returned, so an invalid query is reported like the RipMe search reports it.
+func (app *App) getLocalSearchMatches(ctx context.Context, t localMetaTable, searchQuery string) (string, error) {
+	if app.LocalDb == nil {
+		return "{}", nil
+	}
+	var matches string
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		// Materialized, as BM25 can't be used once the aggregate flattens it
+		return app.LocalDb.QueryRowContext(ctx, t.replace(`
+			  WITH m AS MATERIALIZED (
+			      SELECT ROWID AS id
+			           , BM25(/*FTS*/, 9.0, 6.0) AS score
+			        FROM /*FTS*/
+			       WHERE /*FTS*/ MATCH ?
+			       )
+			SELECT COALESCE(json_group_object(CAST(m.id AS TEXT), m.score), '{}')
+			  FROM m
+		`), searchQuery).Scan(&matches)
+	})
+	return matches, err
+}
+
+// parseLocalMeta reads the title and notes form fields. A field that isn't given is nil, and is left unchanged; an empty field clears it.
+func parseLocalMeta(r *http.Request) (title *string, notes *string, err error) {
+	_ = r.ParseForm()
+	if r.PostForm.Has("title") {
+		v, err := cleanLocalTitle(r.PostForm.Get("title"))
+		if err != nil {
+			return nil, nil, err
+		}
+		title = &v
+	}
+	if r.PostForm.Has("notes") {
+		v, err := cleanLocalNotes(r.PostForm.Get("notes"))
+		if err != nil {
+			return nil, nil, err
+		}
+		notes = &v
+	}
+	if title == nil && notes == nil {
+		return nil, nil, fmt.Errorf("no change given, expected title or notes")
+	}
+	return title, notes, nil
+}
+
+func cleanLocalTitle(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if utf8.RuneCountInString(v) > localTitleMaxLength {
+		return "", fmt.Errorf("title is too long, must be at most %d characters", localTitleMaxLength)
+	}
+	return v, nil
+}
+
+func cleanLocalNotes(v string) (string, error) {
+	v = strings.TrimSpace(strings.ReplaceAll(v, "\r\n", "\n"))
+	if utf8.RuneCountInString(v) > localNotesMaxLength {
+		return "", fmt.Errorf("notes are too long, must be at most %d characters", localNotesMaxLength)
+	}
+	return v, nil
+}
+
+// saveLocalMeta sets the given fields of a gallery or file, and returns the changes to record in the audit log
+func (app *App) saveLocalMeta(ctx context.Context, e auditEntity, title *string, notes *string) (auditChanges, error) {
+	var changes auditChanges
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		tx, err := app.LocalDb.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := setLocalMetaTx(ctx, tx, e.metaTable(), e, title, notes, &changes); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return changes, err
+}
+
+// getLocalMetaTx is getLocalMeta in a LocalDb transaction
+func getLocalMetaTx(ctx context.Context, tx *sql.Tx, t localMetaTable, id int64) (title string, notes string, err error) {
+	err = tx.QueryRowContext(ctx, t.replace(`
+		SELECT title
+		     , notes
+		  FROM /*TABLE*/
+		 WHERE /*ID*/ = ?
+	`), id).Scan(&title, &notes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	return title, notes, err
+}
+
+// setLocalMetaTx sets the given fields of an entity, recording the ones that differ. Rows left without a title and notes are deleted.
+func setLocalMetaTx(ctx context.Context, tx *sql.Tx, t localMetaTable, e auditEntity, title *string, notes *string, changes *auditChanges) error {
+	oldTitle, oldNotes, err := getLocalMetaTx(ctx, tx, t, e.Id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, t.replace(`
+		INSERT INTO /*TABLE*/ (/*ID*/, title, notes)
+		VALUES (?, COALESCE(?, ''), COALESCE(?, ''))
+		    ON CONFLICT (/*ID*/) DO UPDATE
+		   SET title      = COALESCE(?, title)
+		     , notes      = COALESCE(?, notes)
+		     , updated_ts = UNIXEPOCH('subsec') * 1000
+	`), e.Id, title, notes, title, notes); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, t.replace(`
+		DELETE FROM /*TABLE*/
+		 WHERE /*ID*/ = ?
+		   AND title = ''
+		   AND notes = ''
+	`), e.Id); err != nil {
+		return err
+	}
+	if title != nil && *title != oldTitle {
+		changes.add(e.change(auditFieldTitle, metaString(oldTitle), metaString(*title)))
+	}
+	if notes != nil && *notes != oldNotes {
+		changes.add(e.change(auditFieldNotes, metaString(oldNotes), metaString(*notes)))
+	}
+	return nil
+}
+
+// metaString is a title or notes as recorded in the audit log, null when empty
+func metaString(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+// metaTable returns the table of the entity's local title and notes
+func (e auditEntity) metaTable() localMetaTable {
+	if e.Type == auditEntityGallery {
+		return galleryMeta
+	}
+	return fileMeta
+}
+
+// handleGalleryMetaPost handles POST /gallery/{ripper_host}/{gid}/meta and POST /api/gallery/{ripper_host}/{gid}/meta.
+// Form fields: title and notes, see parseLocalMeta.
+func (app *App) handleGalleryMetaPost(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	gid := r.PathValue("gid")
+	if ripperHost == "" || gid == "" {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected values for all path parts: /gallery/{ripper_host}/{gid}/meta"))
+		return
+	}
+	u, err := readEntityUpdate(r, readMetaForm)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	app.saveEntityUpdate(w, r, app.galleryTarget(ripperHost, gid), u)
+}
+
+// handleFileMetaPost handles POST /file/{ripper_host}/{file_id}/meta and POST /api/file/{ripper_host}/{file_id}/meta.
+// Form fields: title and notes, see parseLocalMeta.
+func (app *App) handleFileMetaPost(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	fileId, err := strconv.ParseInt(r.PathValue("file_id"), 10, 64)
+	if ripperHost == "" || err != nil || fileId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected a ripper host and a positive file id: /file/{ripper_host}/{file_id}/meta"))
+		return
+	}
+	u, err := readEntityUpdate(r, readMetaForm)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	app.saveEntityUpdate(w, r, app.fileTarget(ripperHost, fileId), u)
+}
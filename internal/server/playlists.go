@@ -0,0 +1,456 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Playlists of the files of a gallery, search, uploader, or tag, for players such as mpv and VLC. Entries are absolute
+// /media/ URLs, with a media token when a shared secret is set, in the order and with the filters of the page they come from. Loopback clients may ask for ?paths=1
+// to get the paths of the files on disk instead, so the player reads them directly.
+
+const (
+	PlaylistM3U8 = "m3u8"
+	PlaylistXSPF = "xspf"
+)
+
+var PlaylistFormats = []string{PlaylistM3U8, PlaylistXSPF}
+
+// maxPlaylistFiles is the most files in one playlist
+const maxPlaylistFiles = 10000
+
+type playlist struct {
+	name  string // of the download, without the extension
+	title string
+	files []types.File
+}
+
+// playlistEntry is one file of a playlist
+type playlistEntry struct {
+	location   string // absolute URL, or a path on disk
+	title      string
+	durationMs int64 // 0 if unknown
+}
+
+// parsePlaylistFile splits the last segment of a playlist path, such as {gid}.m3u8, into the name and the format
+func parsePlaylistFile(file string) (string, string, bool) {
+	for _, format := range PlaylistFormats {
+		if name, ok := strings.CutSuffix(file, "."+format); ok && name != "" {
+			return name, format, true
+		}
+	}
+	return "", "", false
+}
+
+func errPlaylistFormat() error {
+	return errNotFound{fmt.Errorf("expected a playlist ending in .%s or .%s", PlaylistM3U8, PlaylistXSPF)}
+}
+
+// handlePlaylistGallery handles /playlist/gallery/{ripper_host}/{gid}.{format}
+func (app *App) handlePlaylistGallery(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	gid, format, ok := parsePlaylistFile(r.PathValue("file"))
+	app.servePlaylist(w, r, format, func(ctx context.Context) (playlist, error) {
+		if !ok {
+			return playlist{}, errPlaylistFormat()
+		}
+		a, err := app.getAlbum(ctx, ripperHost, gid)
+		if err != nil {
+			return playlist{}, err
+		}
+		if err := app.checkGalleryBlocked(ctx, a.AlbumId); err != nil {
+			return playlist{}, err
+		}
+		app.populateAlbumLocalMeta(ctx, &a)
+		files, err := app.getPlaylistFiles(ctx, `rf.remote_file_id IN (
+				     SELECT marf.remote_file_id
+				       FROM map_album_remote_file marf
+				      WHERE marf.album_id = ?
+				                            )`, []any{a.AlbumId}, getSortFiles(w, r), getFileRatingFilter(w, r), getFileTypeFilter(w, r))
+		if err != nil {
+			return playlist{}, err
+		}
+		for i := range files {
+			files[i].HrefMedia = fmt.Sprintf("/media/%s/%s/%s", a.RipperHost, a.Gid, files[i].Filename.String)
+		}
+		title := a.Gid
+		if a.LocalTitle.Valid {
+			title = a.LocalTitle.String
+		} else if a.Title.Valid {
+			title = a.Title.String
+		}
+		return playlist{name: "gallery-" + a.Gid, title: title, files: files}, nil
+	})
+}
+
+// handlePlaylistSearch handles /playlist/search.{format}?q=
+func (app *App) handlePlaylistSearch(w http.ResponseWriter, r *http.Request) {
+	_, format, ok := parsePlaylistFile(path.Base(r.URL.Path))
+	searchQuery := r.URL.Query().Get("q")
+	app.servePlaylist(w, r, format, func(ctx context.Context) (playlist, error) {
+		if !ok {
+			return playlist{}, errPlaylistFormat()
+		}
+		if searchQuery == "" {
+			return playlist{}, errInvalid{fmt.Errorf("expected a search query: ?q=")}
+		}
+		ks := searchFileKeyset(getSortSearchFiles(w, r), func() string { return app.getFileScoresJSON(ctx) })
+		files, _, err := app.getSearchFilesPage(ctx, searchQuery, maxPlaylistFiles, 0, ks, nil, getFileRatingFilter(w, r), getFileTypeFilter(w, r))
+		var se sqlite3.Error
+		if errors.As(err, &se) && se.Code == sqlite3.ErrError {
+			// A query that isn't valid FTS5 syntax
+			return playlist{}, errInvalid{err}
+		}
+		if err != nil {
+			return playlist{}, err
+		}
+		for i := range files {
+			files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
+		}
+		return playlist{name: "search", title: "Search: " + searchQuery, files: files}, nil
+	})
+}
+
+// handlePlaylistUser handles /playlist/user/{ripper_host}/{user_name}.{format}
+func (app *App) handlePlaylistUser(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	userName, format, ok := parsePlaylistFile(r.PathValue("file"))
+	app.servePlaylist(w, r, format, func(ctx context.Context) (playlist, error) {
+		if !ok {
+			return playlist{}, errPlaylistFormat()
+		}
+		if getBlocklist(ctx).blocksUploader(ripperHost, userName) {
+			return playlist{}, errBlocked("uploader")
+		}
+		ks := fileKeyset(getSortFiles(w, r), func() string { return app.getFileScoresJSON(ctx) })
+		files, _, err := app.getUserFilesPage(ctx, ripperHost, userName, maxPlaylistFiles, 0, ks, nil, getFileRatingFilter(w, r), getFileTypeFilter(w, r))
+		if err != nil {
+			return playlist{}, err
+		}
+		for i := range files {
+			files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
+		}
+		return playlist{name: "user-" + userName, title: userName + " - " + ripperHost, files: files}, nil
+	})
+}
+
+// handlePlaylistTag handles /playlist/tag/{tag_name}.{format}
+func (app *App) handlePlaylistTag(w http.ResponseWriter, r *http.Request) {
+	tag, format, ok := parsePlaylistFile(r.PathValue("file"))
+	app.servePlaylist(w, r, format, func(ctx context.Context) (playlist, error) {
+		if !ok {
+			return playlist{}, errPlaylistFormat()
+		}
+		tag, err := url.QueryUnescape(tag)
+		if err != nil {
+			return playlist{}, errInvalid{err}
+		}
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
+			return playlist{}, err
+		}
+		tag = rel.canonicalName(tag)
+		if getBlocklist(ctx).blocksTag(tag) {
+			return playlist{}, errBlocked("tag")
+		}
+		_, tagIds, err := app.getTagWithMembers(ctx, rel, tag, r.URL.Query().Get("local") == "1")
+		if err != nil {
+			return playlist{}, err
+		}
+		files, err := app.getPlaylistFiles(ctx, `rf.remote_file_id IN (
+				     SELECT m.remote_file_id
+				       FROM map_remote_file_tag m
+				      WHERE m.tag_id IN (SELECT value FROM json_each(?))
+				                            )`, []any{jsonArray(tagIds)}, getSortFiles(w, r), getFileRatingFilter(w, r), getFileTypeFilter(w, r))
+		if err != nil {
+			return playlist{}, err
+		}
+		for i := range files {
+			files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
+		}
+		return playlist{name: "tag-" + tag, title: "Tag: " + tag, files: files}, nil
+	})
+}
+
+// servePlaylist writes the playlist that get reads in format
+func (app *App) servePlaylist(w http.ResponseWriter, r *http.Request, format string, get func(ctx context.Context) (playlist, error)) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		pl, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		entries, err := app.getPlaylistEntries(ctx, r, pl.files)
+		if err != nil {
+			return err
+		}
+		body := encodeM3U8(pl.title, entries)
+		contentType := "application/vnd.apple.mpegurl"
+		if format == PlaylistXSPF {
+			if body, err = encodeXSPF(pl.title, entries); err != nil {
+				return err
+			}
+			contentType = "application/xspf+xml"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "localgal-" + filesystemSafe(pl.name) + "." + format}))
+		w.Header().Set("Cache-Control", "no-store")
+		_, err = w.Write(body)
+		return err
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// getPlaylistFiles reads up to maxPlaylistFiles files that match where and the filters, in the order of sort
+func (app *App) getPlaylistFiles(ctx context.Context, where string, whereArgs []any, sort string, rf types.RatingFilter, ft types.FileTypeFilter) ([]types.File, error) {
+	var files []types.File
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		ks := fileKeyset(sort, func() string { return app.getFileScoresJSON(ctx) })
+		orderBy, orderArgs := ks.orderBy("rf", false)
+		rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
+		ftClause, ftArgs := fileTypeFilterSQL("mt.name", ft)
+		blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
+		replacer := strings.NewReplacer("/*WHERE*/", where, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause, "/*BLOCKLIST*/", blClause, "/*ORDER_BY*/", orderBy)
+		args := append([]any{}, whereArgs...)
+		args = append(args, rfArgs...)
+		args = append(args, ftArgs...)
+		args = append(args, blArgs...)
+		args = append(args, orderArgs...)
+		args = append(args, maxPlaylistFiles)
+		rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
+			SELECT rf.remote_file_id
+			     , r.name AS ripper_name
+			     , r.host AS ripper_host
+			     , rf.urlid
+			     , rf.filename
+			     , mt.name AS mime_type
+			     , rf.title
+			  FROM remote_file rf
+			  JOIN ripper r ON r.ripper_id = rf.ripper_id
+			  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+			 WHERE /*WHERE*/
+			   AND rf.fetched = 1
+			   AND rf.ignored = 0
+			   /*RATING_FILTER*/
+			   /*FILE_TYPE_FILTER*/
+			   /*BLOCKLIST*/
+			 /*ORDER_BY*/
+			 LIMIT ?
+		`), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var f types.File
+			if err := rows.Scan(&f.FileId, &f.RipperName, &f.RipperHost, &f.Urlid, &f.Filename, &f.MimeType, &f.Title); err != nil {
+				return err
+			}
+			files = append(files, f)
+		}
+		return rows.Err()
+	})
+	return files, err
+}
+
+// getFileDurations returns the durations of the files that have one, in milliseconds by file id
+func (app *App) getFileDurations(ctx context.Context, ids []int64) (map[int64]int64, error) {
+	durations := make(map[int64]int64)
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT remote_file_id
+			     , duration_ms
+			  FROM remote_file
+			 WHERE remote_file_id IN (SELECT value FROM json_each(?))
+			   AND duration_ms > 0
+		`, jsonArray(ids))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, ms int64
+			if err := rows.Scan(&id, &ms); err != nil {
+				return err
+			}
+			durations[id] = ms
+		}
+		return rows.Err()
+	})
+	return durations, err
+}
+
+// getPlaylistEntries makes the entries of files, which have their HrefMedia set. Files without a filename are left
+// out, since they have no media URL.
+func (app *App) getPlaylistEntries(ctx context.Context, r *http.Request, files []types.File) ([]playlistEntry, error) {
+	app.populateFilesLocalMeta(ctx, files)
+	ids := make([]int64, len(files))
+	for i := range files {
+		ids[i] = files[i].FileId
+	}
+	durations, err := app.getFileDurations(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	// Paths on disk are only for a player on the same machine
+	wantPaths := r.URL.Query().Get("paths") == "1" && isLoopbackAddr(r.RemoteAddr)
+	baseURL := app.mediaBaseURL(r)
+	now := time.Now()
+	entries := make([]playlistEntry, 0, len(files))
+	for _, f := range files {
+		if !f.Filename.Valid || f.Filename.String == "" {
+			continue
+		}
+		e := playlistEntry{durationMs: durations[f.FileId]}
+		switch {
+		case f.LocalTitle.Valid:
+			e.title = f.LocalTitle.String
+		case f.Title.Valid && f.Title.String != "":
+			e.title = f.Title.String
+		default:
+			e.title = path.Base(f.Filename.String)
+		}
+		mediaPath := strings.TrimPrefix(f.HrefMedia, "/media/")
+		if wantPaths {
+			e.location, _ = app.localMediaPath(ctx, mediaPath)
+		}
+		if e.location == "" {
+			segments := strings.Split(mediaPath, "/")
+			for i := range segments {
+				segments[i] = url.PathEscape(segments[i])
+			}
+			e.location = baseURL + "/media/" + strings.Join(segments, "/")
+			// Players can't log in, so each URL carries its own token
+			if app.auth != nil {
+				e.location += "?token=" + url.QueryEscape(app.auth.newMediaToken("/media/"+mediaPath, now))
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// mediaBaseURL is where players reach the server: BASE_URL, or else the bind address, with the address the request
+// came in on when binding to all of them. The Host header isn't used, since clients can send any.
+func (app *App) mediaBaseURL(r *http.Request) string {
+	if app.baseURL != "" {
+		return app.baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(app.bind)
+	if err != nil {
+		return scheme + "://" + app.bind
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+		if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if h, _, err := net.SplitHostPort(local.String()); err == nil {
+				host = h
+			}
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// localMediaPath finds the file of a media path on disk, where handleMedia looks for it before searching the database
+func (app *App) localMediaPath(ctx context.Context, mediaPath string) (string, bool) {
+	var tryFiles []knownFile
+	if known, ok := app.catalogue.mediaFile(ctx, mediaPath); ok {
+		tryFiles = append(tryFiles, known)
+	}
+	parts := strings.Split(mediaPath, "/")
+	name := parts[len(parts)-1]
+	switch len(parts) {
+	case 3:
+		tryFiles = append(tryFiles,
+			knownFile{app.MediaRoot, filepath.Join(parts[0]+"_"+parts[1], name)},
+			knownFile{app.MediaRoot, filepath.Join(parts[0]+"_"+filesystemSafe(parts[1]), sanitizedFilename(name))})
+	case 2:
+		tryFiles = append(tryFiles,
+			knownFile{app.MediaRoot, filepath.Join(parts[0], name)},
+			knownFile{app.MediaRoot, filepath.Join(parts[0], sanitizedFilename(name))})
+	}
+	tryFiles = append(tryFiles, app.KnownFilePaths[name]...)
+	for _, f := range tryFiles {
+		if p, ok := f.localPath(); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// playlistText keeps a title on one line
+func playlistText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func encodeM3U8(title string, entries []playlistEntry) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if title != "" {
+		fmt.Fprintf(&b, "#PLAYLIST:%s\n", playlistText(title))
+	}
+	for _, e := range entries {
+		seconds := "-1"
+		if e.durationMs > 0 {
+			seconds = strconv.FormatFloat(float64(e.durationMs)/1000, 'f', -1, 64)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,%s\n%s\n", seconds, playlistText(e.title), e.location)
+	}
+	return []byte(b.String())
+}
+
+type xspfPlaylist struct {
+	XMLName   xml.Name `xml:"http://xspf.org/ns/0/ playlist"`
+	Version   string   `xml:"version,attr"`
+	Title     string   `xml:"title,omitempty"`
+	TrackList struct {
+		Tracks []xspfTrack `xml:"track"`
+	} `xml:"trackList"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+func encodeXSPF(title string, entries []playlistEntry) ([]byte, error) {
+	pl := xspfPlaylist{Version: "1", Title: playlistText(title)}
+	for _, e := range entries {
+		location := e.location
+		if !strings.Contains(location, "://") {
+			// XSPF locations are URIs, so a path on disk becomes a file: URI
+			p := filepath.ToSlash(location)
+			if !strings.HasPrefix(p, "/") {
+				p = "/" + p
+			}
+			location = (&url.URL{Scheme: "file", Path: p}).String()
+		}
+		pl.TrackList.Tracks = append(pl.TrackList.Tracks, xspfTrack{Location: location, Title: playlistText(e.title), Duration: e.durationMs})
+	}
+	body, err := xml.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
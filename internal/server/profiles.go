@@ -0,0 +1,456 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	maxProfileNameLength = 64
+	profileCookieMaxAge  = 365 * 24 * time.Hour
+)
+
+// profileCookieNames are the cookies that a selected profile replaces
+var profileCookieNames = []string{
+	"defaultGalRatingMin", "defaultGalRatingMax", "defaultGalUnrated",
+	"defaultFileRatingMin", "defaultFileRatingMax", "defaultFileUnrated",
+	"defaultFileType",
+	"defaultSortGalleries", "defaultSortFiles", "defaultSortSearchGalleries", "defaultSortSearchFiles",
+	"defaultPageSize",
+}
+
+type profileKey struct{}
+
+type requestProfile struct {
+	Profile types.FilterProfile // zero value when no profile is active
+	// IgnoreCookies is set when a profile was selected by this request,
+	// so that older cookie defaults don't override the freshly selected profile
+	IgnoreCookies bool
+}
+
+func getRequestProfile(ctx context.Context) requestProfile {
+	v, _ := ctx.Value(profileKey{}).(requestProfile)
+	return v
+}
+
+// getDefaultCookie reads a filter/sort default cookie, unless a profile was just selected
+func getDefaultCookie(r *http.Request, name string) (*http.Cookie, error) {
+	if getRequestProfile(r.Context()).IgnoreCookies {
+		return nil, http.ErrNoCookie
+	}
+	return r.Cookie(name)
+}
+
+// withProfile resolves the active filter profile from ?profile=name or the profile cookie.
+// Selecting a profile with ?profile= clears the default cookies, so that the profile values take effect.
+func (app *App) withProfile(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/media/") || strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var rp requestProfile
+		var name string
+		if c, err := r.Cookie("profile"); err == nil {
+			name = c.Value
+		}
+		query := r.URL.Query()
+		if query.Has("profile") {
+			name = strings.TrimSpace(query.Get("profile"))
+			rp.IgnoreCookies = true
+			for _, cookieName := range profileCookieNames {
+				if _, err := r.Cookie(cookieName); err == nil {
+					http.SetCookie(w, &http.Cookie{
+						Name:     cookieName,
+						Path:     "/",
+						SameSite: http.SameSiteStrictMode,
+						MaxAge:   -1,
+					})
+				}
+			}
+		}
+
+		if name != "" && app.LocalDb != nil {
+			profile, err := app.getProfile(r.Context(), name)
+			if err == nil {
+				rp.Profile = profile
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("load filter profile %q: %v", name, err)
+			}
+		}
+
+		// Unlike the filter cookies, which last hours, the profile cookie lasts a year, so the profile survives browser restarts
+		if rp.Profile.Name == "" {
+			if _, err := r.Cookie("profile"); err == nil {
+				http.SetCookie(w, &http.Cookie{
+					Name:     "profile",
+					Path:     "/",
+					SameSite: http.SameSiteStrictMode,
+					MaxAge:   -1,
+				})
+			}
+		} else if query.Has("profile") {
+			http.SetCookie(w, &http.Cookie{
+				Name:     "profile",
+				Value:    rp.Profile.Name,
+				Path:     "/",
+				SameSite: http.SameSiteStrictMode,
+				MaxAge:   int(profileCookieMaxAge.Seconds()),
+			})
+		}
+
+		ctx := context.WithValue(r.Context(), profileKey{}, rp)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+const profileColumns = `
+	       name
+	     , gal_rating_min
+	     , gal_rating_max
+	     , gal_unrated
+	     , file_rating_min
+	     , file_rating_max
+	     , file_unrated
+	     , file_type
+	     , sort_galleries
+	     , sort_files
+	     , sort_search_galleries
+	     , sort_search_files
+	     , page_size
+	     , updated_ts
+`
+
+func scanProfile(row interface{ Scan(...any) error }) (types.FilterProfile, error) {
+	var p types.FilterProfile
+	err := row.Scan(
+		&p.Name,
+		&p.GalleryRatingFilter.Min,
+		&p.GalleryRatingFilter.Max,
+		&p.GalleryRatingFilter.Unrated,
+		&p.FileRatingFilter.Min,
+		&p.FileRatingFilter.Max,
+		&p.FileRatingFilter.Unrated,
+		&p.FileTypeFilter.Type,
+		&p.SortGalleries,
+		&p.SortFiles,
+		&p.SortSearchGalleries,
+		&p.SortSearchFiles,
+		&p.PageSize,
+		&p.UpdatedTs,
+	)
+	return p, err
+}
+
+func (app *App) getProfile(ctx context.Context, name string) (types.FilterProfile, error) {
+	var p types.FilterProfile
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		var err error
+		p, err = scanProfile(app.LocalDb.QueryRowContext(ctx, `
+			SELECT `+profileColumns+`
+			  FROM filter_profile
+			 WHERE name = ?
+		`, name))
+		return err
+	})
+	return p, err
+}
+
+func (app *App) getProfiles(ctx context.Context) ([]types.FilterProfile, error) {
+	var list []types.FilterProfile
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT `+profileColumns+`
+			  FROM filter_profile
+			 ORDER BY name
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			p, err := scanProfile(rows)
+			if err != nil {
+				return err
+			}
+			list = append(list, p)
+		}
+		return rows.Err()
+	})
+	return list, err
+}
+
+// getProfileNames lists profile names for the navigation dropdown; errors only get logged
+func (app *App) getProfileNames(ctx context.Context) []string {
+	if app.LocalDb == nil {
+		return nil
+	}
+	var names []string
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT name
+			  FROM filter_profile
+			 ORDER BY name
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Printf("list filter profiles: %v", err)
+	}
+	return names
+}
+
+func parseProfileName(s string) (string, error) {
+	name := strings.TrimSpace(s)
+	if name == "" {
+		return "", fmt.Errorf("profile name is required")
+	}
+	if len(name) > maxProfileNameLength {
+		return "", fmt.Errorf("profile name is too long, maximum %d bytes", maxProfileNameLength)
+	}
+	if strings.ContainsFunc(name, func(r rune) bool { return r == '/' || unicode.IsControl(r) }) {
+		return "", fmt.Errorf("profile name must not contain slashes or control characters")
+	}
+	return name, nil
+}
+
+// parseProfileForm reads a profile from form values, which use the same names as the filter query parameters.
+// Invalid values are treated as unset, like the filter query parameters.
+func parseProfileForm(r *http.Request) (types.FilterProfile, error) {
+	name, err := parseProfileName(r.FormValue("name"))
+	if err != nil {
+		return types.FilterProfile{}, err
+	}
+	validSort := func(s string, validSorts []string) string {
+		if slices.Contains(validSorts, s) {
+			return s
+		}
+		return SortDefault
+	}
+	p := types.FilterProfile{
+		Name: name,
+		GalleryRatingFilter: types.RatingFilter{
+			Min:     parseRatingValue(r.FormValue("gal_rating_min")),
+			Max:     parseRatingValue(r.FormValue("gal_rating_max")),
+			Unrated: parseUnratedValue(r.FormValue("gal_unrated")),
+		},
+		FileRatingFilter: types.RatingFilter{
+			Min:     parseRatingValue(r.FormValue("file_rating_min")),
+			Max:     parseRatingValue(r.FormValue("file_rating_max")),
+			Unrated: parseUnratedValue(r.FormValue("file_unrated")),
+		},
+		FileTypeFilter:      types.FileTypeFilter{Type: parseFileTypeValue(r.FormValue("file_type"))},
+		SortGalleries:       validSort(r.FormValue("sort_galleries"), GallerySorts),
+		SortFiles:           validSort(r.FormValue("sort_files"), FileSorts),
+		SortSearchGalleries: validSort(r.FormValue("sort_search_galleries"), GallerySearchSorts),
+		SortSearchFiles:     validSort(r.FormValue("sort_search_files"), FileSearchSorts),
+	}
+	if size := atoiDefault(r.FormValue("size"), 0); size >= 1 && size <= 200 {
+		p.PageSize = size
+	}
+	for _, rf := range []*types.RatingFilter{&p.GalleryRatingFilter, &p.FileRatingFilter} {
+		if rf.Min > 0 && rf.Max > 0 && rf.Min > rf.Max {
+			rf.Min, rf.Max = rf.Max, rf.Min
+		}
+	}
+	return p, nil
+}
+
+// handlePreferences handles /preferences and /api/profiles
+func (app *App) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		// No filter query parameters are expected here, so these are the current defaults
+		_, size := getPageParams(w, r, r.URL)
+		current := types.FilterProfile{
+			Name:                getRequestProfile(ctx).Profile.Name,
+			GalleryRatingFilter: getGalleryRatingFilter(w, r),
+			FileRatingFilter:    getFileRatingFilter(w, r),
+			FileTypeFilter:      getFileTypeFilter(w, r),
+			SortGalleries:       getSortGalleries(w, r),
+			SortFiles:           getSortFiles(w, r),
+			SortSearchGalleries: getSortSearchGalleries(w, r),
+			SortSearchFiles:     getSortSearchFiles(w, r),
+			PageSize:            size,
+		}
+
+		var profiles []types.FilterProfile
+		if app.LocalDb != nil {
+			var err error
+			profiles, err = app.getProfiles(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		edit := current
+		edit.Name = ""
+		if editName := r.URL.Query().Get("edit"); editName != "" {
+			for _, profile := range profiles {
+				if profile.Name == editName {
+					edit = profile
+				}
+			}
+		}
+
+		model := types.PreferencesPage{
+			Profiles:           profiles,
+			Current:            current,
+			Edit:               edit,
+			Available:          app.LocalDb != nil,
+			GallerySorts:       GallerySorts,
+			FileSorts:          FileSorts,
+			GallerySearchSorts: GallerySearchSorts,
+			FileSearchSorts:    FileSearchSorts,
+			BasePage:           &types.BasePage{Perf: perf, GalleryRatingFilter: current.GalleryRatingFilter, FileRatingFilter: current.FileRatingFilter, FileTypeFilter: current.FileTypeFilter},
+		}
+		app.render(ctx, w, "preferences.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleProfile handles GET /api/profiles/{name}
+func (app *App) handleProfile(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable"))
+		return
+	}
+	name := r.PathValue("name")
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		profile, err := app.getProfile(ctx, name)
+		if err != nil {
+			return err
+		}
+		app.render(ctx, w, "", &profile)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleProfilePost handles POST /preferences/profiles and POST /api/profiles
+func (app *App) handleProfilePost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save profile"))
+		return
+	}
+	profile, err := parseProfileForm(r)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		err := app.withSQL(ctx, func(ctx context.Context) error {
+			_, err := app.LocalDb.ExecContext(ctx, `
+				INSERT INTO filter_profile ( name, gal_rating_min, gal_rating_max, gal_unrated
+				                           , file_rating_min, file_rating_max, file_unrated, file_type
+				                           , sort_galleries, sort_files, sort_search_galleries, sort_search_files
+				                           , page_size)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				    ON CONFLICT (name) DO UPDATE
+				    SET gal_rating_min        = excluded.gal_rating_min
+				      , gal_rating_max        = excluded.gal_rating_max
+				      , gal_unrated           = excluded.gal_unrated
+				      , file_rating_min       = excluded.file_rating_min
+				      , file_rating_max       = excluded.file_rating_max
+				      , file_unrated          = excluded.file_unrated
+				      , file_type             = excluded.file_type
+				      , sort_galleries        = excluded.sort_galleries
+				      , sort_files            = excluded.sort_files
+				      , sort_search_galleries = excluded.sort_search_galleries
+				      , sort_search_files     = excluded.sort_search_files
+				      , page_size             = excluded.page_size
+				      , updated_ts            = UNIXEPOCH('subsec') * 1000
+			`, profile.Name,
+				profile.GalleryRatingFilter.Min, profile.GalleryRatingFilter.Max, profile.GalleryRatingFilter.Unrated,
+				profile.FileRatingFilter.Min, profile.FileRatingFilter.Max, profile.FileRatingFilter.Unrated,
+				profile.FileTypeFilter.Type,
+				profile.SortGalleries, profile.SortFiles, profile.SortSearchGalleries, profile.SortSearchFiles,
+				profile.PageSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if getRenderMode(ctx) == RenderJSON {
+			profile, err = app.getProfile(ctx, profile.Name)
+			if err != nil {
+				return err
+			}
+			app.render(ctx, w, "", &profile)
+		}
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderHTML {
+		app.httpRedirect(r.Context(), w, r, &p, postRedirectTarget(r, "/preferences"), http.StatusSeeOther)
+	}
+}
+
+// handleProfileDelete handles POST /preferences/profiles/delete and DELETE /api/profiles/{name}
+func (app *App) handleProfileDelete(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot delete profile"))
+		return
+	}
+	name := r.PathValue("name")
+	if name == "" {
+		name = r.FormValue("name")
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			res, err := app.LocalDb.ExecContext(ctx, `
+				DELETE
+				  FROM filter_profile
+				 WHERE name = ?
+			`, name)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return sql.ErrNoRows
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderJSON {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, postRedirectTarget(r, "/preferences"), http.StatusSeeOther)
+}
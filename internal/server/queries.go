@@ -11,10 +11,12 @@ import (
 func (app *App) getUserAlbumHits(ctx context.Context, host string, uploader string, rf types.RatingFilter) (int, error) {
 	var albumsTotal int
 	rfClause, rfArgs := ratingFilterSQL("a.local_rating", rf)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause)
+	blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause)
 	err := app.withSQL(ctx, func(ctx context.Context) error {
 		args := []any{host, uploader}
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
 			SELECT COUNT(*)
 			  FROM album a
@@ -23,34 +25,35 @@ func (app *App) getUserAlbumHits(ctx context.Context, host string, uploader stri
 			   AND a.uploader = ?
 			   AND a.cnt_rf > 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 		`), args...).Scan(&albumsTotal)
 	})
 	return albumsTotal, err
 }
 
-func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, uploader string, size int, offset int, order string, rf types.RatingFilter) ([]types.Album, error) {
+// getUserAlbumsPage returns a page of the galleries of a user in the order of ks, after or before c if it isn't nil.
+// The keysJSON of the rows are returned in display order too, for ks.pageCursors.
+func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, uploader string, size int, offset int, ks keyset, c *cursor, rf types.RatingFilter) ([]types.Album, []string, error) {
 	var albums []types.Album
+	var rowKeys []string
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
 		var rows *sql.Rows
 		var err error
 
-		var orderBy string
-		switch order {
-		case SortFetched:
-			orderBy = "ORDER BY a.inserted_ts DESC, a.album_id DESC"
-		case SortUploaded:
-			orderBy = "ORDER BY a.created_ts DESC, a.album_id DESC"
-		case SortBytes:
-			orderBy = "ORDER BY a.sum_rf_bytes DESC, a.album_id DESC"
-		case SortItems:
-			orderBy = "ORDER BY a.cnt_rf DESC, a.album_id DESC"
-		default:
-			orderBy = "ORDER BY a.inserted_ts DESC, a.album_id DESC"
-		}
+		// Rows before a cursor are read in reverse, then put back in display order
+		orderBy, orderByArgs := ks.orderBy("a", c != nil && c.Before)
+		cursorClause, cursorArgs := ks.where("a", c)
+		cursorKeys, cursorKeysArgs := ks.keysJSON("a")
 		rfClause, rfArgs := ratingFilterSQL("a.local_rating", rf)
-		replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*RATING_FILTER*/", rfClause)
-		args := []any{ripperHost, uploader}
+		blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+		replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule))
+		args := []any{app.getGalleryCoversJSON(ctx)}
+		args = append(args, cursorKeysArgs...)
+		args = append(args, ripperHost, uploader)
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
+		args = append(args, cursorArgs...)
+		args = append(args, orderByArgs...)
 		args = append(args, size, offset)
 		//language=sqlite
 		rows, err = app.Db.QueryContext(ctx, replacer.Replace(`
@@ -72,21 +75,15 @@ func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, upload
 			     , a.cnt_rf
 			     , a.last_fetch_ts
 			     , a.inserted_ts
-			     , (
-			    SELECT rf.remote_file_id
-			      FROM map_album_remote_file marf
-			      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-			     WHERE marf.album_id = a.album_id
-			       AND rf.fetched = 1
-			       AND rf.ignored = 0
-			     ORDER BY marf.remote_file_id DESC
-			     LIMIT 1
-			       ) AS thumb_remote_file_id
+			     , /*THUMB*/ AS thumb_remote_file_id
+			     , /*CURSOR_KEYS*/ AS cursor_keys
 			  FROM album a
 			  JOIN ripper r ON r.ripper_id = a.ripper_id
 			 WHERE r.host = ?
 			   AND a.uploader = ?
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
+			   /*CURSOR*/
 			/*ORDER_BY*/
 			 LIMIT ? OFFSET ?
 		`), args...)
@@ -99,6 +96,7 @@ func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, upload
 			var a types.Album
 			var f types.File
 			var thumbFileId sql.NullInt64
+			var rowKey string
 			if err := rows.Scan(
 				&a.AlbumId,
 				&a.RipperId,
@@ -119,9 +117,12 @@ func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, upload
 				&a.LastFetchTs,
 				&a.InsertedTs,
 				&thumbFileId,
+				&rowKey,
 			); err != nil {
 				return err
 			}
+			// Albums without a thumb are still where the page ends, for its cursors
+			rowKeys = append(rowKeys, rowKey)
 			// If an album has no fetched files, thumb_remote_file_id will be null
 			if thumbFileId.Valid {
 				f.FileId = thumbFileId.Int64
@@ -131,8 +132,9 @@ func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, upload
 		}
 		return rows.Err()
 	}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	readCursorPage(c, albums, rowKeys)
 	for i := range albums {
 		thumb := albums[i].Thumb
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
@@ -146,7 +148,7 @@ func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, upload
 				   AND rf.ignored = 0
 			`, thumb.FileId).Scan(&thumb.Filename, &thumb.MimeType)
 		}); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		albums[i].Thumb = thumb
 	}
@@ -158,17 +160,20 @@ func (app *App) getUserAlbumsPage(ctx context.Context, ripperHost string, upload
 			albums[i].Thumb.HrefMedia = fmt.Sprintf("/media/%s/%s/%s", albums[i].RipperHost, albums[i].Gid, albums[i].Thumb.Filename.String)
 		}
 	}
-	return albums, nil
+	app.populateAlbumsLocalMeta(ctx, albums)
+	return albums, rowKeys, nil
 }
 
 func (app *App) getUserFileHits(ctx context.Context, host string, uploader string, rf types.RatingFilter, ft types.FileTypeFilter) (int, error) {
 	var filesTotal int
 	rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
+	blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 	ftClause, ftArgs := fileTypeFilterSQL("mt.name", ft)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*FILE_TYPE_FILTER*/", ftClause)
 	err := app.withSQL(ctx, func(ctx context.Context) error {
 		args := []any{host, uploader}
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		args = append(args, ftArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
 			SELECT COUNT(*)
@@ -180,35 +185,37 @@ func (app *App) getUserFileHits(ctx context.Context, host string, uploader strin
 			   AND rf.fetched = 1
 			   AND rf.ignored = 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 			   /*FILE_TYPE_FILTER*/
 		`), args...).Scan(&filesTotal)
 	})
 	return filesTotal, err
 }
 
-func (app *App) getUserFilesPage(ctx context.Context, host string, uploader string, size int, offset int, order string, rf types.RatingFilter, ft types.FileTypeFilter) ([]types.File, error) {
+// getUserFilesPage returns a page of the files of a user in the order of ks, after or before c if it isn't nil.
+// The keysJSON of the rows are returned in display order too, for ks.pageCursors.
+func (app *App) getUserFilesPage(ctx context.Context, host string, uploader string, size int, offset int, ks keyset, c *cursor, rf types.RatingFilter, ft types.FileTypeFilter) ([]types.File, []string, error) {
 	var files []types.File
+	var rowKeys []string
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
 		var rows *sql.Rows
 		var err error
 
-		var orderBy string
-		switch order {
-		case SortBytes:
-			orderBy = "ORDER BY rf.bytes DESC, rf.remote_file_id DESC"
-		case SortFetched:
-			orderBy = "ORDER BY rf.inserted_ts DESC, rf.remote_file_id DESC"
-		case SortUploaded:
-			orderBy = "ORDER BY rf.uploaded_ts DESC, rf.remote_file_id DESC"
-		default:
-			orderBy = "ORDER BY rf.inserted_ts DESC, rf.remote_file_id DESC"
-		}
+		// Rows before a cursor are read in reverse, then put back in display order
+		orderBy, orderByArgs := ks.orderBy("rf", c != nil && c.Before)
+		cursorClause, cursorArgs := ks.where("rf", c)
+		cursorKeys, cursorKeysArgs := ks.keysJSON("rf")
 		rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
+		blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 		ftClause, ftArgs := fileTypeFilterSQL("mt.name", ft)
-		replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
-		args := []any{host, uploader}
+		replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*FILE_TYPE_FILTER*/", ftClause)
+		args := append([]any{}, cursorKeysArgs...)
+		args = append(args, host, uploader)
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		args = append(args, ftArgs...)
+		args = append(args, cursorArgs...)
+		args = append(args, orderByArgs...)
 		args = append(args, size, offset)
 		//language=sqlite
 		rows, err = app.Db.QueryContext(ctx, replacer.Replace(`
@@ -227,6 +234,7 @@ func (app *App) getUserFilesPage(ctx context.Context, host string, uploader stri
 			     , rf.bytes
 			     , rf.local_rating
 			     , rf.inserted_ts
+			     , /*CURSOR_KEYS*/ AS cursor_keys
 			  FROM remote_file rf
 			  JOIN ripper r ON r.ripper_id = rf.ripper_id
 			  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
@@ -235,7 +243,9 @@ func (app *App) getUserFilesPage(ctx context.Context, host string, uploader stri
 			   AND rf.fetched = 1
 			   AND rf.ignored = 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 			   /*FILE_TYPE_FILTER*/
+			   /*CURSOR*/
 			/*ORDER_BY*/
 			 LIMIT ? OFFSET ?
 		`), args...)
@@ -246,6 +256,7 @@ func (app *App) getUserFilesPage(ctx context.Context, host string, uploader stri
 		defer rows.Close()
 		for rows.Next() {
 			var f types.File
+			var rowKey string
 			if err := rows.Scan(
 				&f.FileId,
 				&f.RipperName,
@@ -262,20 +273,24 @@ func (app *App) getUserFilesPage(ctx context.Context, host string, uploader stri
 				&f.Bytes,
 				&f.LocalRating,
 				&f.InsertedTs,
+				&rowKey,
 			); err != nil {
 				return err
 			}
 			files = append(files, f)
+			rowKeys = append(rowKeys, rowKey)
 		}
 		return rows.Err()
 	}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	readCursorPage(c, files, rowKeys)
 	for i := range files {
 		files[i].HrefPage = fmt.Sprintf("/file/%s/%d", files[i].RipperHost, files[i].FileId)
 		if files[i].Filename.Valid {
 			files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
 		}
 	}
-	return files, nil
+	app.populateFilesLocalMeta(ctx, files)
+	return files, rowKeys, nil
 }
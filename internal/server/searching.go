@@ -12,8 +12,13 @@ import (
 func (app *App) getSearchAlbumHits(ctx context.Context, searchQuery string, evictCache bool, rf types.RatingFilter) (int, error) {
 	var err error
 	var albumsTotal int
+	localMatches, err := app.getLocalSearchMatches(ctx, galleryMeta, searchQuery)
+	if err != nil {
+		return 0, err
+	}
 	maxCacheAgeMs := 300000 // 5 minutes
-	queryHash := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s", searchQuery, rf.Min, rf.Max, rf.Unrated))))
+	// Local matches and the blocklist are part of the key, so editing local titles and notes doesn't leave stale counts
+	queryHash := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s|%s", searchQuery, rf.Min, rf.Max, rf.Unrated, localMatches, getBlocklist(ctx).key()))))
 
 	// 1: Evict old entries
 	err = app.withSQL(ctx, func(ctx context.Context) error {
@@ -48,24 +53,34 @@ func (app *App) getSearchAlbumHits(ctx context.Context, searchQuery string, evic
 
 	// 3: No entry was cached; get total hits
 	rfClause, rfArgs := ratingFilterSQL("a.local_rating", rf)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause)
+	blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause)
 	err = app.withSQL(ctx, func(ctx context.Context) error {
-		args := []any{searchQuery}
+		args := []any{searchQuery, localMatches}
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
+			  WITH hits AS (
+			      SELECT af5.ROWID AS album_id
+			        FROM album_fts5 af5
+			       WHERE album_fts5 MATCH ?
+			       UNION
+			      SELECT CAST(lm.key AS INTEGER)
+			        FROM json_each(?) lm
+			               )
 			SELECT COUNT(*)
-			  FROM album_fts5 af5
-			  JOIN album a ON a.album_id = af5.ROWID
-			 WHERE album_fts5 MATCH ?
-			   /*RATING_FILTER*/
-			   AND EXISTS(
+			  FROM hits h
+			  JOIN album a ON a.album_id = h.album_id
+			 WHERE EXISTS(
 			     SELECT 1
 			       FROM map_album_remote_file marf
 			       JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-			      WHERE marf.album_id = af5.ROWID
+			      WHERE marf.album_id = h.album_id
 			        AND rf.fetched = 1
 			        AND rf.ignored = 0
 			             )
+			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 		`), args...).Scan(&albumsTotal)
 	})
 	if err != nil {
@@ -82,39 +97,77 @@ func (app *App) getSearchAlbumHits(ctx context.Context, searchQuery string, evic
 	})
 	return albumsTotal, err
 }
-func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, size int, offset int, order string, rf types.RatingFilter) ([]types.Album, error) {
+
+// getSearchAlbumsPage returns a page of galleries in the order of ks, after or before c if it isn't nil.
+// The keysJSON of the rows are returned in display order too, for ks.pageCursors.
+func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, size int, offset int, ks keyset, c *cursor, rf types.RatingFilter) ([]types.Album, []string, error) {
 	var albums []types.Album
+	var rowKeys []string
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
 		var rows *sql.Rows
 		var err error
 
+		localMatches, err := app.getLocalSearchMatches(ctx, galleryMeta, searchQuery)
+		if err != nil {
+			return err
+		}
 		rfClause, rfArgs := ratingFilterSQL("a.local_rating", rf)
-		if order == SortRank || order == SortDefault {
-			// Need to compute bm25 for ranked sort, but no need to enumerate all matches
-			replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause)
-			args := []any{searchQuery}
+		blClause, blArgs := getBlocklist(ctx).gallerySQL("a")
+		// Rows before a cursor are read in reverse, then put back in display order
+		reverse := c != nil && c.Before
+		if ks.sort == SortRank {
+			// Need to compute bm25 for ranked sort; the page is cut from the matches before joining the rest of the album
+			orderByPage, orderByPageArgs := ks.orderBy("m", reverse)
+			orderBy, orderByArgs := ks.orderBy("p", reverse)
+			cursorClause, cursorArgs := ks.where("m", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("p")
+			replacer := strings.NewReplacer("/*ORDER_BY_PAGE*/", orderByPage, "/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule))
+			args := []any{searchQuery, localMatches}
 			args = append(args, rfArgs...)
-			args = append(args, size, offset)
+			args = append(args, blArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderByPageArgs...)
+			args = append(args, size, offset, app.getGalleryCoversJSON(ctx))
+			args = append(args, cursorKeysArgs...)
+			args = append(args, orderByArgs...)
 			rows, err = app.Db.QueryContext(ctx, replacer.Replace(`
-				  WITH matches AS (
-				      SELECT af5.ROWID
+				  WITH hits AS (
+				      SELECT af5.ROWID AS album_id
 				           , BM25(album_fts5, 9.0, 6.0) AS score
 				        FROM album_fts5 af5
-				        JOIN album a ON a.album_id = af5.ROWID
 				       WHERE album_fts5 MATCH ?
-				         /*RATING_FILTER*/
-				         AND EXISTS(
+				       UNION ALL
+				      SELECT CAST(lm.key AS INTEGER)
+				           , lm.value
+				        FROM json_each(?) lm
+				               )
+				     , matches AS (
+				      SELECT h.album_id
+				           , MIN(h.score) AS score
+				        FROM hits h
+				        JOIN album a ON a.album_id = h.album_id
+				       WHERE EXISTS(
 				           SELECT 1
 				             FROM map_album_remote_file marf
 				             JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-				            WHERE marf.album_id = af5.ROWID
+				            WHERE marf.album_id = h.album_id
 				              AND rf.fetched = 1
 				              AND rf.ignored = 0
 				                   )
-				       ORDER BY score
-				       LIMIT ? OFFSET ?
+				         /*RATING_FILTER*/
+				         /*BLOCKLIST*/
+				       GROUP BY h.album_id
 				                  )
-				SELECT m.score
+				     , page AS (
+				      SELECT m.album_id
+				           , m.score
+				        FROM matches m
+				       WHERE TRUE
+				         /*CURSOR*/
+				       /*ORDER_BY_PAGE*/
+				       LIMIT ? OFFSET ?
+				               )
+				SELECT p.score
 				     , a.album_id
 				     , a.ripper_id
 				     , r.name AS ripper_name
@@ -141,54 +194,51 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 				--       AND rf.fetched = 1
 				--       AND rf.ignored = 0
 				--       ) AS file_count
-				     , (
-				    SELECT rf.remote_file_id
-				      FROM map_album_remote_file marf
-				      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-				     WHERE marf.album_id = a.album_id
-				       AND rf.fetched = 1
-				       AND rf.ignored = 0
-				     ORDER BY marf.remote_file_id DESC
-				     LIMIT 1
-				       ) AS thumb_remote_file_id
-				  FROM matches m
-				  JOIN album a ON a.album_id = m.ROWID
+				     , /*THUMB*/ AS thumb_remote_file_id
+				     , /*CURSOR_KEYS*/ AS cursor_keys
+				  FROM page p
+				  JOIN album a ON a.album_id = p.album_id
 				  JOIN ripper r ON r.ripper_id = a.ripper_id
-				 ORDER BY m.score
+				 /*ORDER_BY*/
 			`), args...)
 		} else {
 			// Need to enumerate all matches for nonranked sort, but no need to compute bm25
-			var orderBy string
-			switch order {
-			case SortFetched:
-				orderBy = "ORDER BY a.inserted_ts DESC, a.album_id DESC"
-			case SortUploaded:
-				orderBy = "ORDER BY a.created_ts DESC, a.album_id DESC"
-			case SortBytes:
-				orderBy = "ORDER BY a.sum_rf_bytes DESC, a.album_id DESC"
-			case SortItems:
-				orderBy = "ORDER BY a.cnt_rf DESC, a.album_id DESC"
-			}
-			replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*RATING_FILTER*/", rfClause)
-			args := []any{searchQuery}
+			orderBy, orderByArgs := ks.orderBy("a", reverse)
+			cursorClause, cursorArgs := ks.where("a", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("a")
+			replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*THUMB*/", galleryThumbSQL("a.album_id", app.CoverRule))
+			args := []any{searchQuery, localMatches}
 			args = append(args, rfArgs...)
+			args = append(args, blArgs...)
+			args = append(args, app.getGalleryCoversJSON(ctx))
+			args = append(args, cursorKeysArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderByArgs...)
 			args = append(args, size, offset)
 			//language=sqlite
 			rows, err = app.Db.QueryContext(ctx, replacer.Replace(`
-				  WITH matches AS (
-				      SELECT af5.ROWID
+				  WITH hits AS (
+				      SELECT af5.ROWID AS album_id
 				        FROM album_fts5 af5
-				        JOIN album a ON a.album_id = af5.ROWID
 				       WHERE album_fts5 MATCH ?
-				         /*RATING_FILTER*/
-				         AND EXISTS(
+				       UNION
+				      SELECT CAST(lm.key AS INTEGER)
+				        FROM json_each(?) lm
+				               )
+				     , matches AS (
+				      SELECT h.album_id
+				        FROM hits h
+				        JOIN album a ON a.album_id = h.album_id
+				       WHERE EXISTS(
 				           SELECT 1
 				             FROM map_album_remote_file marf
 				             JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-				            WHERE marf.album_id = af5.ROWID
+				            WHERE marf.album_id = h.album_id
 				              AND rf.fetched = 1
 				              AND rf.ignored = 0
 				                   )
+				         /*RATING_FILTER*/
+				         /*BLOCKLIST*/
 				                  )
 				SELECT 0 -- placeholder value for score
 				     , a.album_id
@@ -217,19 +267,13 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 				--       AND rf.fetched = 1
 				--       AND rf.ignored = 0
 				--       ) AS file_count
-				     , (
-				    SELECT rf.remote_file_id
-				      FROM map_album_remote_file marf
-				      JOIN remote_file rf ON rf.remote_file_id = marf.remote_file_id
-				     WHERE marf.album_id = a.album_id
-				       AND rf.fetched = 1
-				       AND rf.ignored = 0
-				     ORDER BY marf.remote_file_id DESC
-				     LIMIT 1
-				       ) AS thumb_remote_file_id
+				     , /*THUMB*/ AS thumb_remote_file_id
+				     , /*CURSOR_KEYS*/ AS cursor_keys
 				  FROM matches m
-				  JOIN album a ON a.album_id = m.ROWID
+				  JOIN album a ON a.album_id = m.album_id
 				  JOIN ripper r ON r.ripper_id = a.ripper_id
+				 WHERE TRUE
+				   /*CURSOR*/
 				 --ORDER BY m.score
 				  /*ORDER_BY*/
 				 LIMIT ? OFFSET ?
@@ -245,6 +289,7 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 			var f types.File
 			var thumbFileId sql.NullInt64
 			var score *float64
+			var rowKey string
 			if err := rows.Scan(
 				&score,
 				&a.AlbumId,
@@ -266,9 +311,12 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 				&a.LastFetchTs,
 				&a.InsertedTs,
 				&thumbFileId,
+				&rowKey,
 			); err != nil {
 				return err
 			}
+			// Albums without a thumb are still where the page ends, for its cursors
+			rowKeys = append(rowKeys, rowKey)
 			// If an album has no fetched files, thumb_remote_file_id will be null
 			if thumbFileId.Valid {
 				f.FileId = thumbFileId.Int64
@@ -278,8 +326,9 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 		}
 		return rows.Err()
 	}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	readCursorPage(c, albums, rowKeys)
 	for i := range albums {
 		thumb := albums[i].Thumb
 		if err := app.withSQL(ctx, func(ctx context.Context) error {
@@ -293,7 +342,7 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 				   AND rf.ignored = 0
 			`, thumb.FileId).Scan(&thumb.Filename, &thumb.MimeType)
 		}); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		albums[i].Thumb = thumb
 	}
@@ -305,14 +354,20 @@ func (app *App) getSearchAlbumsPage(ctx context.Context, searchQuery string, siz
 			albums[i].Thumb.HrefMedia = fmt.Sprintf("/media/%s/%s/%s", albums[i].RipperHost, albums[i].Gid, albums[i].Thumb.Filename.String)
 		}
 	}
-	return albums, nil
+	app.populateAlbumsLocalMeta(ctx, albums)
+	return albums, rowKeys, nil
 }
 
 func (app *App) getSearchFileHits(ctx context.Context, searchQuery string, evictCache bool, rf types.RatingFilter, ft types.FileTypeFilter) (int, error) {
 	var err error
 	var filesTotal int
+	localMatches, err := app.getLocalSearchMatches(ctx, fileMeta, searchQuery)
+	if err != nil {
+		return 0, err
+	}
 	maxCacheAgeMs := 300000 // 5 minutes
-	queryHash := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s", searchQuery, rf.Min, rf.Max, rf.Unrated, ft.Type))))
+	// Local matches and the blocklist are part of the key, so editing local titles and notes doesn't leave stale counts
+	queryHash := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s|%s|%s", searchQuery, rf.Min, rf.Max, rf.Unrated, ft.Type, localMatches, getBlocklist(ctx).key()))))
 
 	// 1: Evict old entries
 	err = app.withSQL(ctx, func(ctx context.Context) error {
@@ -347,21 +402,31 @@ func (app *App) getSearchFileHits(ctx context.Context, searchQuery string, evict
 
 	// 3: No entry was cached; get total hits
 	rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
+	blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 	ftClause, ftArgs := fileTypeFilterSQL("mt.name", ft)
-	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
+	replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*FILE_TYPE_FILTER*/", ftClause)
 	err = app.withSQL(ctx, func(ctx context.Context) error {
-		args := []any{searchQuery}
+		args := []any{searchQuery, localMatches}
 		args = append(args, rfArgs...)
+		args = append(args, blArgs...)
 		args = append(args, ftArgs...)
 		return app.Db.QueryRowContext(ctx, replacer.Replace(`
+			  WITH hits AS (
+			      SELECT rff5.ROWID AS remote_file_id
+			        FROM remote_file_fts5 rff5
+			       WHERE remote_file_fts5 MATCH ?
+			       UNION
+			      SELECT CAST(lm.key AS INTEGER)
+			        FROM json_each(?) lm
+			               )
 			SELECT COUNT(*)
-			  FROM remote_file_fts5 rff5
-			  JOIN remote_file rf ON rf.remote_file_id = rff5.ROWID
+			  FROM hits h
+			  JOIN remote_file rf ON rf.remote_file_id = h.remote_file_id
 			  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
-			 WHERE remote_file_fts5 MATCH ?
-			   AND rf.fetched = 1
+			 WHERE rf.fetched = 1
 			   AND rf.ignored = 0
 			   /*RATING_FILTER*/
+			   /*BLOCKLIST*/
 			   /*FILE_TYPE_FILTER*/
 		`), args...).Scan(&filesTotal)
 	})
@@ -380,36 +445,70 @@ func (app *App) getSearchFileHits(ctx context.Context, searchQuery string, evict
 	return filesTotal, err
 }
 
-func (app *App) getSearchFilesPage(ctx context.Context, searchQuery string, size int, offset int, order string, rf types.RatingFilter, ft types.FileTypeFilter) ([]types.File, error) {
+// getSearchFilesPage returns a page of files in the order of ks, after or before c if it isn't nil.
+// The keysJSON of the rows are returned in display order too, for ks.pageCursors.
+func (app *App) getSearchFilesPage(ctx context.Context, searchQuery string, size int, offset int, ks keyset, c *cursor, rf types.RatingFilter, ft types.FileTypeFilter) ([]types.File, []string, error) {
 	var files []types.File
+	var rowKeys []string
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
 		var rows *sql.Rows
 		var err error
 
+		localMatches, err := app.getLocalSearchMatches(ctx, fileMeta, searchQuery)
+		if err != nil {
+			return err
+		}
 		rfClause, rfArgs := ratingFilterSQL("rf.local_rating", rf)
+		blClause, blArgs := getBlocklist(ctx).fileSQL("rf")
 		ftClause, ftArgs := fileTypeFilterSQL("mt.name", ft)
-		if order == SortRank || order == SortDefault {
-			// Need to compute bm25 for ranked sort, but no need to enumerate all matches
-			replacer := strings.NewReplacer("/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
-			args := []any{searchQuery}
+		// Rows before a cursor are read in reverse, then put back in display order
+		reverse := c != nil && c.Before
+		if ks.sort == SortRank {
+			// Need to compute bm25 for ranked sort; the page is cut from the matches before joining the rest of the file
+			orderByPage, orderByPageArgs := ks.orderBy("m", reverse)
+			orderBy, orderByArgs := ks.orderBy("p", reverse)
+			cursorClause, cursorArgs := ks.where("m", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("p")
+			replacer := strings.NewReplacer("/*ORDER_BY_PAGE*/", orderByPage, "/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*FILE_TYPE_FILTER*/", ftClause)
+			args := []any{searchQuery, localMatches}
 			args = append(args, rfArgs...)
+			args = append(args, blArgs...)
 			args = append(args, ftArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderByPageArgs...)
 			args = append(args, size, offset)
+			args = append(args, cursorKeysArgs...)
+			args = append(args, orderByArgs...)
 			rows, err = app.Db.QueryContext(ctx, replacer.Replace(`
-				  WITH matches AS (
-				      SELECT rff5.ROWID, BM25(remote_file_fts5, 9.0, 6.0) AS score
+				  WITH hits AS (
+				      SELECT rff5.ROWID AS remote_file_id, BM25(remote_file_fts5, 9.0, 6.0) AS score
 				        FROM remote_file_fts5 rff5
-				        JOIN remote_file rf ON rf.remote_file_id = rff5.ROWID
-				        LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
 				       WHERE remote_file_fts5 MATCH ?
-				         AND rf.fetched = 1
+				       UNION ALL
+				      SELECT CAST(lm.key AS INTEGER), lm.value
+				        FROM json_each(?) lm
+				               )
+				     , matches AS (
+				      SELECT h.remote_file_id, MIN(h.score) AS score
+				        FROM hits h
+				        JOIN remote_file rf ON rf.remote_file_id = h.remote_file_id
+				        LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				       WHERE rf.fetched = 1
 				         AND rf.ignored = 0
 				         /*RATING_FILTER*/
+				         /*BLOCKLIST*/
 				         /*FILE_TYPE_FILTER*/
-				       ORDER BY score, rf.remote_file_id DESC
-				       LIMIT ? OFFSET ?
+				       GROUP BY h.remote_file_id
 				                  )
-				SELECT m.score
+				     , page AS (
+				      SELECT m.remote_file_id, m.score
+				        FROM matches m
+				       WHERE TRUE
+				         /*CURSOR*/
+				       /*ORDER_BY_PAGE*/
+				       LIMIT ? OFFSET ?
+				               )
+				SELECT p.score
 				     , rf.remote_file_id
 				     , r.name AS ripper_name
 				     , r.host AS ripper_host
@@ -425,39 +524,46 @@ func (app *App) getSearchFilesPage(ctx context.Context, searchQuery string, size
 				     , rf.bytes
 				     , rf.local_rating
 				     , rf.inserted_ts
-				  FROM matches m
-				  JOIN remote_file rf ON rf.remote_file_id = m.ROWID
+				     , /*CURSOR_KEYS*/ AS cursor_keys
+				  FROM page p
+				  JOIN remote_file rf ON rf.remote_file_id = p.remote_file_id
 				  JOIN ripper r ON r.ripper_id = rf.ripper_id
 				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
-				 ORDER BY m.score, rf.remote_file_id DESC
+				 /*ORDER_BY*/
 			`), args...)
 		} else {
 			// Need to enumerate all matches for nonranked sort, but no need to compute bm25
-			var orderBy string
-			switch order {
-			case SortBytes:
-				orderBy = "ORDER BY rf.bytes DESC, rf.remote_file_id DESC"
-			case SortFetched:
-				orderBy = "ORDER BY rf.inserted_ts DESC, rf.remote_file_id DESC"
-			case SortUploaded:
-				orderBy = "ORDER BY rf.uploaded_ts DESC, rf.remote_file_id DESC"
-			}
-			replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*RATING_FILTER*/", rfClause, "/*FILE_TYPE_FILTER*/", ftClause)
-			args := []any{searchQuery}
+			orderBy, orderByArgs := ks.orderBy("rf", reverse)
+			cursorClause, cursorArgs := ks.where("rf", c)
+			cursorKeys, cursorKeysArgs := ks.keysJSON("rf")
+			replacer := strings.NewReplacer("/*ORDER_BY*/", orderBy, "/*CURSOR*/", cursorClause, "/*CURSOR_KEYS*/", cursorKeys, "/*RATING_FILTER*/", rfClause, "/*BLOCKLIST*/", blClause, "/*FILE_TYPE_FILTER*/", ftClause)
+			args := []any{searchQuery, localMatches}
 			args = append(args, rfArgs...)
+			args = append(args, blArgs...)
 			args = append(args, ftArgs...)
+			args = append(args, cursorKeysArgs...)
+			args = append(args, cursorArgs...)
+			args = append(args, orderByArgs...)
 			args = append(args, size, offset)
 			//language=sqlite
 			rows, err = app.Db.QueryContext(ctx, replacer.Replace(`
-				  WITH matches AS (
-				      SELECT rff5.ROWID
+				  WITH hits AS (
+				      SELECT rff5.ROWID AS remote_file_id
 				        FROM remote_file_fts5 rff5
-				        JOIN remote_file rf ON rf.remote_file_id = rff5.ROWID
-				        LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
 				       WHERE remote_file_fts5 MATCH ?
-				         AND rf.fetched = 1
+				       UNION
+				      SELECT CAST(lm.key AS INTEGER)
+				        FROM json_each(?) lm
+				               )
+				     , matches AS (
+				      SELECT h.remote_file_id
+				        FROM hits h
+				        JOIN remote_file rf ON rf.remote_file_id = h.remote_file_id
+				        LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				       WHERE rf.fetched = 1
 				         AND rf.ignored = 0
 				         /*RATING_FILTER*/
+				         /*BLOCKLIST*/
 				         /*FILE_TYPE_FILTER*/
 				                  )
 				SELECT 0 -- placeholder value for score
@@ -476,10 +582,13 @@ func (app *App) getSearchFilesPage(ctx context.Context, searchQuery string, size
 				     , rf.bytes
 				     , rf.local_rating
 				     , rf.inserted_ts
+				     , /*CURSOR_KEYS*/ AS cursor_keys
 				  FROM matches m
-				  JOIN remote_file rf ON rf.remote_file_id = m.ROWID
+				  JOIN remote_file rf ON rf.remote_file_id = m.remote_file_id
 				  JOIN ripper r ON r.ripper_id = rf.ripper_id
 				  LEFT JOIN mime_type mt ON mt.mime_type_id = rf.mime_type_id
+				 WHERE TRUE
+				   /*CURSOR*/
 				 --ORDER BY m.score
 				  /*ORDER_BY*/
 				 LIMIT ? OFFSET ?
@@ -493,6 +602,7 @@ func (app *App) getSearchFilesPage(ctx context.Context, searchQuery string, size
 		for rows.Next() {
 			var f types.File
 			var score *float64
+			var rowKey string
 			if err := rows.Scan(
 				&score,
 				&f.FileId,
@@ -510,72 +620,92 @@ func (app *App) getSearchFilesPage(ctx context.Context, searchQuery string, size
 				&f.Bytes,
 				&f.LocalRating,
 				&f.InsertedTs,
+				&rowKey,
 			); err != nil {
 				return err
 			}
 			files = append(files, f)
+			rowKeys = append(rowKeys, rowKey)
 		}
 		return rows.Err()
 	}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	readCursorPage(c, files, rowKeys)
 	for i := range files {
 		files[i].HrefPage = fmt.Sprintf("/file/%s/%d", files[i].RipperHost, files[i].FileId)
 		if files[i].Filename.Valid {
 			files[i].HrefMedia = fmt.Sprintf("/media/%s/%s", files[i].RipperHost, files[i].Filename.String)
 		}
 	}
-	return files, nil
+	app.populateFilesLocalMeta(ctx, files)
+	return files, rowKeys, nil
 }
 
 func (app *App) getSearchTagHits(ctx context.Context, searchQuery string) (int, error) {
 	var err error
 	var tagsTotal int
 	// Not bothering to cache tags; there should be few enough that search is cheap
+	blClause, blArgs := getBlocklist(ctx).tagSQL("t.name")
 	err = app.withSQL(ctx, func(ctx context.Context) error {
 		return app.Db.QueryRowContext(ctx, `
 			SELECT COUNT(*)
 			  FROM tag_fts5 tf5
 			  JOIN tag t ON t.tag_id = tf5.ROWID
 			 WHERE tag_fts5 MATCH ?
-			   AND t.local = 0 -- TODO show local tags separately
-		`, searchQuery).Scan(&tagsTotal)
+			   `+blClause+`
+		`, append([]any{searchQuery}, blArgs...)...).Scan(&tagsTotal)
 	})
 	return tagsTotal, err
 }
 
-// app.getSearchTagsPage searches for tags. If limit is -1, sqlite returns unlimited matches
+// app.getSearchTagsPage searches for tags, local tags included and marked. If limit is -1, sqlite returns unlimited matches
 func (app *App) getSearchTagsPage(ctx context.Context, searchQuery string, limit int) ([]types.Tag, error) {
 	//limitString := "ALL"
 	//if limit > 0 {
 	//	limitString = strconv.Itoa(limit)
 	//}
 	var tags []types.Tag
+	bl := getBlocklist(ctx)
+	blTag, blTagArgs := bl.tagSQL("t.name")
+	// Blocked files aren't counted. Checking each file is slow, so the join is only made with a blocklist.
+	blFile, blFileArgs := bl.fileSQL("rf")
+	blJoin := ""
+	if blFile != "" {
+		blJoin = "JOIN remote_file rf ON rf.remote_file_id = mrft.remote_file_id"
+	}
+	replacer := strings.NewReplacer("/*BLOCKLIST_TAG*/", blTag, "/*BLOCKLIST_JOIN*/", blJoin, "/*BLOCKLIST_FILE*/", blFile)
+	args := []any{searchQuery}
+	args = append(args, blTagArgs...)
+	args = append(args, limit)
+	args = append(args, blFileArgs...)
 	if err := app.withSQL(ctx, func(ctx context.Context) error {
-		rows, err := app.Db.QueryContext(ctx, `
+		rows, err := app.Db.QueryContext(ctx, replacer.Replace(`
 			  WITH matches AS (
 			      SELECT tf5.ROWID, BM25(tag_fts5) AS score
 			        FROM tag_fts5 tf5
 			        JOIN tag t ON t.tag_id = tf5.ROWID
 			       WHERE tag_fts5 MATCH ?
-			         AND t.local = 0 -- TODO show local tags separately
+			         /*BLOCKLIST_TAG*/
 			       ORDER BY score
 			       LIMIT ?
 			                  )
 			SELECT m.score
 			     , t.name
+			     , t.local
 			     , (
 			    SELECT COUNT(*)
 			      FROM map_remote_file_tag mrft
+			      /*BLOCKLIST_JOIN*/
 			     WHERE t.tag_id = mrft.tag_id
 			    --AND rf.fetched = 1
 			    -- filtering on fetched here is quite slow
+			       /*BLOCKLIST_FILE*/
 			       ) AS cnt
 			  FROM matches m
 			  JOIN tag t ON t.tag_id = m.ROWID
-			 WHERE t.local = 0 -- TODO show local tags separately
 			 ORDER BY cnt DESC, m.score
-		`, searchQuery, limit)
+		`), args...)
 		if err != nil {
 			return err
 		}
@@ -586,6 +716,7 @@ func (app *App) getSearchTagsPage(ctx context.Context, searchQuery string, limit
 			if err := rows.Scan(
 				&score,
 				&t.Name,
+				&t.IsLocal,
 				&t.Count,
 			); err != nil {
 				return err
@@ -596,5 +727,10 @@ func (app *App) getSearchTagsPage(ctx context.Context, searchQuery string, limit
 	}); err != nil {
 		return nil, err
 	}
-	return tags, nil
+	rel, err := app.getTagRelations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Aliases that match are shown as their canonical tag
+	return app.applyTagRelations(ctx, rel, tags, "map_remote_file_tag", "remote_file_id", false)
 }
@@ -6,16 +6,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"golocalgal/api"
 	"golocalgal/internal/types"
+	"golocalgal/internal/vars"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,14 +26,22 @@ type App struct {
 	Db              *sql.DB // Db is for read-only operations to the main database. Db may have many connections.
 	DbRw            *sql.DB // DbRw is for read-write operations to the main database. DbRw has a single connection.
 	CacheDb         *sql.DB
+	LocalDb         *sql.DB   // LocalDb is for data owned by LocalGal, such as filter profiles and the audit log. LocalDb has a single connection.
+	catalogue       catalogue // where the main database comes from, see Catalogues
 	Tpl             *template.Template
 	StaticFSHandler http.Handler
 	CorsOrigins     string
+	bind            string // see Config.Bind
+	baseURL         string // see Config.BaseURL
 	BuildInfo       types.BuildInfo
-	MediaRoot       string
-	DfLogRoot       string
+	MediaRoot       *confinedDir // media is only read from MediaRoot and DfLogRoot
+	DfLogRoot       *confinedDir
 	SlowSqlMs       int
-	KnownFilePaths  map[string][]string
+	CoverRule       string                 // automatic gallery thumbnail when no cover is chosen, one of CoverRules
+	KnownFilePaths  map[string][]knownFile // files of the downloaded file log by filename
+	events          *eventHub              // change events for /api/events, see watchDb
+	auth            *auth                  // nil when no shared secret is required
+	entityWriteMu   sync.Mutex             // held by writes to a gallery or file from their If-Match check to their commit
 }
 
 // Controller controls a running server instance for the GUI
@@ -71,47 +81,52 @@ func StartServer(cfg Config) (*Controller, error) {
 
 	app := &App{
 		SlowSqlMs:       cfg.SlowSqlMs,
-		DfLogRoot:       cfg.DfLogRoot,
-		MediaRoot:       cfg.MediaRoot,
+		DfLogRoot:       newConfinedDir(vars.EnvDflogRoot.Key(), cfg.DfLogRoot, cfg.FollowSymlinks),
+		MediaRoot:       newConfinedDir(vars.EnvMediaRoot.Key(), cfg.MediaRoot, cfg.FollowSymlinks),
 		CorsOrigins:     cfg.CorsOrigins,
+		bind:            cfg.Bind,
+		baseURL:         cfg.BaseURL,
+		CoverRule:       cfg.CoverRule,
 		BuildInfo:       cfg.BuildInfo,
 		StaticFSHandler: cfg.StaticFSHandler,
+		events:          newEventHub(),
 	}
 
-	cfg.Dsn = DsnWithReadOnly(cfg.Dsn)
-	cfg.Dsn = DsnWithDefaultTimeout(cfg.Dsn)
-	cfg.Dsn = DsnWithForeignKeys(cfg.Dsn)
-
-	app.Db, err = GetDb(cfg.Dsn, "read-only")
+	app.catalogue = newCatalogue(app, cfg.Catalogue)
+	app.Db, app.DbRw, err = app.catalogue.open(context.Background(), cfg)
 	if err != nil {
 		return nil, err
 	}
-	app.Db.SetMaxOpenConns(0) // 0 is unlimited; fine for read-only
-
-	if !cfg.ReadOnly {
-		dsnRw := DsnWithReadWrite(cfg.Dsn)
-		app.DbRw, err = GetDb(dsnRw, "read-write")
-		if err == nil {
-			app.DbRw.SetMaxOpenConns(1) // sqlite doesn't handle simultaneous writes well
-		} else {
-			log.Printf("open rw db: %v (ratings/tags won't be savable)", err)
-		}
-	}
 
-	dbFilename := getFileFromDsn(cfg.Dsn)
-	if err = initDB(context.Background(), app.Db, dbFilename); err != nil {
-		log.Printf("init db: %v", err)
+	app.CacheDb, err = GetCacheDb(context.Background())
+	if err != nil {
 		return nil, err
 	}
 
-	if err := checkMinimumDbSchemaVersion(context.Background(), app.Db); err != nil {
+	// The LocalGal database is writable even in read-only mode; read-only only protects the RipMe database
+	localDsn := DsnWithDefaultTimeout(cfg.LocalDsn)
+	localDsn = DsnWithForeignKeys(localDsn)
+	app.LocalDb, err = GetLocalDb(context.Background(), localDsn)
+	if err != nil {
+		// The stored shared secret is in the LocalGal database, so starting without it would let everyone in
+		if cfg.AuthSecret == "" {
+			return nil, fmt.Errorf("open local db: %w. It may hold the shared secret, so the server won't start without it unless %s is set", err, vars.EnvAuthSecret.Key())
+		}
+		log.Printf("open local db: %v (filter profiles, history, collections, comparisons, gallery covers, local titles and notes, and the blocklist won't be available)", err)
+	}
+	if err := checkLocalDbCatalogue(context.Background(), app.LocalDb, cfg.Catalogue); err != nil {
 		return nil, err
 	}
 
-	app.CacheDb, err = GetCacheDb(context.Background())
+	app.auth, err = loadAuth(context.Background(), app.LocalDb, cfg.AuthSecret, cfg.AuthLoopback)
 	if err != nil {
 		return nil, err
 	}
+	if app.auth != nil {
+		log.Printf("A shared secret is required to log in")
+	} else if !isLoopbackBind(cfg.Bind) {
+		log.Printf("Listening beyond loopback without a shared secret; anyone who can reach %s can browse and change ratings. Set %s to require one", cfg.Bind, vars.EnvAuthSecret.Key())
+	}
 
 	app.Tpl = template.Must(template.New("").Funcs(template.FuncMap{
 		"dict": func(values ...interface{}) (map[string]interface{}, error) {
@@ -184,6 +199,7 @@ func StartServer(cfg Config) (*Controller, error) {
 		"appVersion":   func() string { return app.BuildInfo.Version },
 		"appCommit":    func() string { return app.BuildInfo.Commit },
 		"appBuildDate": func() string { return app.BuildInfo.BuildDate },
+		"authEnabled":  func() bool { return app.auth != nil },
 	}).ParseFS(cfg.TemplatesFS, "templates/*.gohtml", "templates/fragments/*.gohtml"))
 
 	mux := app.newMux()
@@ -196,19 +212,21 @@ func StartServer(cfg Config) (*Controller, error) {
 	ctrl := Controller{app: app, srv: srv, ctx: ctx, cancel: cancel, ready: make(chan struct{})}
 
 	go func() {
-		if err := app.loadKnownFiles(ctx, cfg.DfLog); err != nil {
+		if err := app.catalogue.load(ctx, cfg); err != nil {
 			if ctx.Err() != nil {
-				log.Println("startup canceled while loading known files")
+				log.Println("startup canceled while loading the catalogue")
 				cancel(ctx.Err())
 				return
 			}
-			log.Printf("loading known files error: %v", err)
+			log.Printf("loading catalogue error: %v", err)
 		}
 		if err := ctx.Err(); err != nil {
 			// Canceled before starting server; do not attempt to listen
 			cancel(err)
 			return
 		}
+		// Started after the catalogue is loaded, so its first scan is the baseline rather than a flood of events
+		go app.watchDb(ctx)
 		ln, err := net.Listen("tcp", cfg.Bind)
 		if err != nil {
 			cancel(err)
@@ -250,6 +268,18 @@ func (c *Controller) Stop(ctx context.Context) error {
 			firstErr = err
 		}
 	}
+	if c != nil && c.app != nil && c.app.LocalDb != nil {
+		if err := c.app.LocalDb.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if c != nil && c.app != nil {
+		for _, d := range []*confinedDir{c.app.MediaRoot, c.app.DfLogRoot} {
+			if err := d.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
 	return firstErr
 }
 
@@ -258,12 +288,23 @@ func (app *App) newMux() http.Handler {
 	mux.HandleFunc("/", app.handleBrowse)
 	mux.HandleFunc("/gallery/{ripper_host}/{gid}", app.withETag(app.handleGallery))
 	mux.HandleFunc("POST /gallery/{ripper_host}/{gid}", app.handleGalleryPost)
+	mux.HandleFunc("POST /gallery/{ripper_host}/{gid}/tags", app.handleGalleryTagsPost)
+	mux.HandleFunc("POST /gallery/{ripper_host}/{gid}/cover", app.handleGalleryCoverPost)
+	mux.HandleFunc("POST /gallery/{ripper_host}/{gid}/meta", app.handleGalleryMetaPost)
 	mux.HandleFunc("/gallery/{ripper_host}/{gid}/{file_id}", app.handleGalleryFile)
 	mux.HandleFunc("/gallery-file-tags/{ripper_host}/{gid}", app.handleGalleryFileTagsFragment)
 	mux.HandleFunc("/file/{ripper_host}/{file_id}", app.handleFileStandalone)
 	mux.HandleFunc("/file/{ripper_host}/{file_id}/galleries", app.handleFileGalleryFragment)
 	mux.HandleFunc("POST /file/{ripper_host}/{file_id}", app.handleFilePost)
+	mux.HandleFunc("POST /file/{ripper_host}/{file_id}/tags", app.handleFileTagsPost)
+	mux.HandleFunc("POST /file/{ripper_host}/{file_id}/meta", app.handleFileMetaPost)
+	mux.HandleFunc("POST /files/bulk", app.handleFilesBulkPost)
 	mux.HandleFunc("/tags", app.handleTags)
+	mux.HandleFunc("GET /tags/relations", app.handleTagRelations)
+	mux.HandleFunc("POST /tags/aliases", app.handleTagAliasPost)
+	mux.HandleFunc("POST /tags/aliases/delete", app.handleTagAliasDelete)
+	mux.HandleFunc("POST /tags/implications", app.handleTagImplicationPost)
+	mux.HandleFunc("POST /tags/implications/delete", app.handleTagImplicationDelete)
 	mux.HandleFunc("/tag/{tag_name}", app.handleTagDetail)
 	mux.HandleFunc("/search", app.withETag(app.handleSearch))
 	mux.HandleFunc("/search/galleries", app.withETag(app.handleSearchGalleries))
@@ -276,17 +317,62 @@ func (app *App) newMux() http.Handler {
 	mux.HandleFunc("/random/file", app.handleRandomFile)
 	mux.HandleFunc("/random/page", app.handleRandomPage)
 	mux.HandleFunc("/stats", app.handleStats)
-
-	mux.HandleFunc("GET /api/", app.asApi(app.handle404))
+	mux.HandleFunc("/ignored", app.handleIgnored)
+	mux.HandleFunc("GET /blocklist", app.handleBlocklist)
+	mux.HandleFunc("POST /blocklist", app.handleBlocklistPost)
+	mux.HandleFunc("POST /blocklist/delete", app.handleBlocklistDelete)
+	mux.HandleFunc("GET /history", app.handleHistory)
+	mux.HandleFunc("POST /history/undo", app.handleHistoryUndoLast)
+	mux.HandleFunc("POST /history/{audit_id}/undo", app.handleHistoryUndo)
+	mux.HandleFunc("GET /collections", app.handleCollections)
+	mux.HandleFunc("POST /collections", app.handleCollectionCreate)
+	mux.HandleFunc("GET /collection/{collection_id}", app.handleCollection)
+	mux.HandleFunc("POST /collection/{collection_id}", app.handleCollectionPost)
+	mux.HandleFunc("POST /collection/{collection_id}/delete", app.handleCollectionDelete)
+	mux.HandleFunc("POST /collection/{collection_id}/files", app.handleCollectionFilesPost)
+	mux.HandleFunc("GET /collection/{collection_id}/{file_id}", app.handleCollectionFile)
+	mux.HandleFunc("GET /compare", app.handleCompareRandom)
+	mux.HandleFunc("POST /compare", app.handleComparePost)
+	mux.HandleFunc("POST /compare/ratings", app.handleCompareRatings)
+	mux.HandleFunc("GET /compare/{left_id}/{right_id}", app.handleCompare)
+	mux.HandleFunc("GET /playlist/gallery/{ripper_host}/{file}", app.handlePlaylistGallery)
+	mux.HandleFunc("GET /playlist/search.m3u8", app.handlePlaylistSearch)
+	mux.HandleFunc("GET /playlist/search.xspf", app.handlePlaylistSearch)
+	mux.HandleFunc("GET /playlist/user/{ripper_host}/{file}", app.handlePlaylistUser)
+	mux.HandleFunc("GET /playlist/tag/{file}", app.handlePlaylistTag)
+	mux.HandleFunc("GET /preferences", app.handlePreferences)
+	mux.HandleFunc("POST /preferences/profiles", app.handleProfilePost)
+	mux.HandleFunc("POST /preferences/profiles/delete", app.handleProfileDelete)
+
+	mux.HandleFunc("/api/", app.asApi(app.handle404))
+	app.registerApiV1(mux)
 	mux.HandleFunc("GET /api/galleries", app.asApi(app.handleBrowse))
 	mux.HandleFunc("GET /api/gallery/{ripper_host}/{gid}", app.asApi(app.handleGallery))
 	mux.HandleFunc("POST /api/gallery/{ripper_host}/{gid}", app.asApi(app.handleGalleryPost))
+	mux.HandleFunc("PATCH /api/gallery/{ripper_host}/{gid}", app.asApi(app.handleGalleryPatch))
+	mux.HandleFunc("POST /api/gallery/{ripper_host}/{gid}/tags", app.asApi(app.handleGalleryTagsPost))
+	mux.HandleFunc("POST /api/gallery/{ripper_host}/{gid}/cover", app.asApi(app.handleGalleryCoverPost))
+	mux.HandleFunc("POST /api/gallery/{ripper_host}/{gid}/meta", app.asApi(app.handleGalleryMetaPost))
 	mux.HandleFunc("GET /api/gallery/{ripper_host}/{gid}/{file_id}", app.asApi(app.handleGalleryFile))
 	mux.HandleFunc("GET /api/gallery-file-tags/{ripper_host}/{gid}", app.asApi(app.handleGalleryFileTagsFragment))
 	mux.HandleFunc("GET /api/file/{ripper_host}/{file_id}", app.asApi(app.handleFileStandalone))
 	mux.HandleFunc("GET /api/file/{ripper_host}/{file_id}/galleries", app.asApi(app.handleFileGalleryFragment))
 	mux.HandleFunc("POST /api/file/{ripper_host}/{file_id}", app.asApi(app.handleFilePost))
+	mux.HandleFunc("PATCH /api/file/{ripper_host}/{file_id}", app.asApi(app.handleFilePatch))
+	mux.HandleFunc("POST /api/file/{ripper_host}/{file_id}/tags", app.asApi(app.handleFileTagsPost))
+	mux.HandleFunc("POST /api/file/{ripper_host}/{file_id}/meta", app.asApi(app.handleFileMetaPost))
+	mux.HandleFunc("POST /api/files/bulk", app.asApi(app.handleFilesBulkPost))
+	mux.HandleFunc("GET /api/export/user-data", app.asApi(app.handleExportUserData))
+	mux.HandleFunc("GET /api/events", app.asApi(app.handleEvents))
+	mux.HandleFunc("GET /api/export/galleries.ndjson", app.asApi(app.handleExportGalleries))
+	mux.HandleFunc("GET /api/export/files.ndjson", app.asApi(app.handleExportFiles))
+	mux.HandleFunc("GET /api/export/tags.ndjson", app.asApi(app.handleExportTags))
 	mux.HandleFunc("GET /api/tags", app.asApi(app.handleTags))
+	mux.HandleFunc("GET /api/tags/relations", app.asApi(app.handleTagRelations))
+	mux.HandleFunc("POST /api/tags/aliases", app.asApi(app.handleTagAliasPost))
+	mux.HandleFunc("DELETE /api/tags/aliases", app.asApi(app.handleTagAliasDelete))
+	mux.HandleFunc("POST /api/tags/implications", app.asApi(app.handleTagImplicationPost))
+	mux.HandleFunc("DELETE /api/tags/implications", app.asApi(app.handleTagImplicationDelete))
 	mux.HandleFunc("GET /api/tag/{tag_name}", app.asApi(app.handleTagDetail))
 	mux.HandleFunc("GET /api/search", app.asApi(app.handleSearch))
 	mux.HandleFunc("GET /api/search/galleries", app.asApi(app.handleSearchGalleries))
@@ -298,6 +384,28 @@ func (app *App) newMux() http.Handler {
 	mux.HandleFunc("GET /api/random/gallery", app.asApi(app.handleRandomGallery))
 	mux.HandleFunc("GET /api/random/file", app.asApi(app.handleRandomFile))
 	mux.HandleFunc("GET /api/stats", app.asApi(app.handleStats))
+	mux.HandleFunc("GET /api/ignored", app.asApi(app.handleIgnored))
+	mux.HandleFunc("GET /api/blocklist", app.asApi(app.handleBlocklist))
+	mux.HandleFunc("POST /api/blocklist", app.asApi(app.handleBlocklistPost))
+	mux.HandleFunc("DELETE /api/blocklist", app.asApi(app.handleBlocklistDelete))
+	mux.HandleFunc("GET /api/history", app.asApi(app.handleHistory))
+	mux.HandleFunc("POST /api/history/undo", app.asApi(app.handleHistoryUndoLast))
+	mux.HandleFunc("POST /api/history/{audit_id}/undo", app.asApi(app.handleHistoryUndo))
+	mux.HandleFunc("GET /api/collections", app.asApi(app.handleCollections))
+	mux.HandleFunc("POST /api/collections", app.asApi(app.handleCollectionCreate))
+	mux.HandleFunc("GET /api/collection/{collection_id}", app.asApi(app.handleCollection))
+	mux.HandleFunc("POST /api/collection/{collection_id}", app.asApi(app.handleCollectionPost))
+	mux.HandleFunc("DELETE /api/collection/{collection_id}", app.asApi(app.handleCollectionDelete))
+	mux.HandleFunc("POST /api/collection/{collection_id}/files", app.asApi(app.handleCollectionFilesPost))
+	mux.HandleFunc("GET /api/collection/{collection_id}/{file_id}", app.asApi(app.handleCollectionFile))
+	mux.HandleFunc("GET /api/compare", app.asApi(app.handleCompareRandom))
+	mux.HandleFunc("POST /api/compare", app.asApi(app.handleComparePost))
+	mux.HandleFunc("POST /api/compare/ratings", app.asApi(app.handleCompareRatings))
+	mux.HandleFunc("GET /api/compare/{left_id}/{right_id}", app.asApi(app.handleCompare))
+	mux.HandleFunc("GET /api/profiles", app.asApi(app.handlePreferences))
+	mux.HandleFunc("POST /api/profiles", app.asApi(app.handleProfilePost))
+	mux.HandleFunc("GET /api/profiles/{name}", app.asApi(app.handleProfile))
+	mux.HandleFunc("DELETE /api/profiles/{name}", app.asApi(app.handleProfileDelete))
 
 	mux.HandleFunc("/media/", app.handleMedia)
 
@@ -306,6 +414,9 @@ func (app *App) newMux() http.Handler {
 	mux.HandleFunc("/static/", app.handleStatic)
 
 	mux.HandleFunc("/about", app.handleAbout)
+	mux.HandleFunc("GET /login", app.handleLogin)
+	mux.HandleFunc("POST /login", app.handleLoginPost)
+	mux.HandleFunc("POST /logout", app.handleLogout)
 	//mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
 	//	app.renderError(r.Context(), w, &types.Perf{}, http.StatusInternalServerError, fmt.Errorf("foobar"))
 	//})
@@ -313,9 +424,15 @@ func (app *App) newMux() http.Handler {
 
 	var wrapped http.Handler
 	wrapped = app.logMiddleware(mux)
-	wrapped = app.corsMiddleware(mux)
-	wrapped = app.tinyOptimizeDb(mux)
-	wrapped = app.reqCtx(mux)
+	wrapped = app.tinyOptimizeDb(wrapped)
+	wrapped = app.reqCtx(wrapped)
+	wrapped = app.withProfile(wrapped)
+	wrapped = app.withBlocklist(wrapped)
+	wrapped = app.withCSRF(wrapped)
+	wrapped = app.withAuth(wrapped)
+	// Outside withAuth, so preflights, which never carry credentials, are answered, and errors are readable cross-origin
+	wrapped = app.corsMiddleware(wrapped)
+	wrapped = app.withSecurityHeaders(wrapped)
 	return wrapped
 }
 
@@ -368,8 +485,10 @@ func (app *App) corsMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", app.CorsOrigins)
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,HEAD,OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PATCH,DELETE,HEAD,OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,If-Match,X-CSRF-Token")
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -440,6 +559,8 @@ func (app *App) setAndCheckETag(w http.ResponseWriter, r *http.Request) bool {
 	w.Header().Set("ETag", etag)
 	if match := r.Header.Get("If-None-Match"); match != "" {
 		if match == etag {
+			// The cached page embeds the nonce of the cached policy, which a new one would replace
+			w.Header().Del("Content-Security-Policy")
 			w.WriteHeader(http.StatusNotModified)
 			return true
 		}
@@ -467,6 +588,20 @@ func (app *App) render(ctx context.Context, w http.ResponseWriter, name string,
 		basePage := basePager.GetBasePage()
 		if req, ok := ctx.Value(requestKey{}).(*http.Request); ok {
 			basePage.PinHeader = isClientPinHeaderOn(req)
+			if getRenderMode(ctx) == RenderHTML {
+				basePage.SelectMode = getSelectMode(w, req)
+				basePage.SelectToggleHref = selectToggleHref(req.URL, basePage.SelectMode)
+				basePage.CSRFToken = csrfToken(w, req)
+				basePage.CSPNonce = cspNonce(ctx)
+				basePage.Here = herePath(req)
+			}
+			if changed, err := strconv.Atoi(req.URL.Query().Get("changed")); err == nil {
+				basePage.Notice = fmt.Sprintf("Changed %d row(s)", changed)
+			}
+		}
+		basePage.Profile = getRequestProfile(ctx).Profile.Name
+		if getRenderMode(ctx) == RenderHTML {
+			basePage.ProfileNames = app.getProfileNames(ctx)
 		}
 		p := basePage.Perf
 		pageTime := time.Since(p.Start)
@@ -485,6 +620,15 @@ func (app *App) render(ctx context.Context, w http.ResponseWriter, name string,
 		w.Header().Set("X-App-Version", app.BuildInfo.Version)
 		w.Header().Set("X-App-Commit", app.BuildInfo.Commit)
 		w.Header().Set("X-App-Build-Date", app.BuildInfo.BuildDate)
+		status := http.StatusOK
+		if operationId, ok := getApiOperation(ctx); ok {
+			data, status = apiV1Body(operationId, data)
+		}
+		// Galleries and files have ETags for If-Match, see apiETag
+		if etag := apiETag(data); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		w.WriteHeader(status)
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
 		_ = enc.Encode(data)
@@ -534,6 +678,11 @@ func (app *App) renderFragment(ctx context.Context, w http.ResponseWriter, name
 		w.Header().Set("X-App-Version", app.BuildInfo.Version)
 		w.Header().Set("X-App-Commit", app.BuildInfo.Commit)
 		w.Header().Set("X-App-Build-Date", app.BuildInfo.BuildDate)
+		if operationId, ok := getApiOperation(ctx); ok {
+			var status int
+			data, status = apiV1Body(operationId, data)
+			w.WriteHeader(status)
+		}
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
 		_ = enc.Encode(data)
@@ -568,10 +717,13 @@ func (app *App) renderError(ctx context.Context, w http.ResponseWriter, perf *ty
 	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 		return
 	}
+	status, code := errorStatus(err, status)
 	if errors.Is(err, sql.ErrNoRows) {
-		status = http.StatusNotFound
 		err = nil
 	}
+	if code == api.CodeBusy {
+		w.Header().Set("Retry-After", "1")
+	}
 	statusText := fmt.Sprintf("%d %s", status, http.StatusText(status))
 	model := types.ErrorPage{StatusText: statusText, BasePage: &types.BasePage{Perf: perf}}
 	if err != nil {
@@ -581,19 +733,27 @@ func (app *App) renderError(ctx context.Context, w http.ResponseWriter, perf *ty
 	}
 	if req, ok := ctx.Value(requestKey{}).(*http.Request); ok {
 		model.BasePage.PinHeader = isClientPinHeaderOn(req)
+		if getRenderMode(ctx) == RenderHTML {
+			model.BasePage.CSRFToken = csrfToken(w, req)
+			model.BasePage.CSPNonce = cspNonce(ctx)
+			model.BasePage.Here = herePath(req)
+		}
 	}
-	w.WriteHeader(status)
-	renderMode := getRenderMode(ctx)
-	if renderMode == RenderJSON {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// API clients get problem details with a stable code rather than the error page
+	if getRenderMode(ctx) == RenderJSON {
+		w.Header().Set("Content-Type", "application/problem+json")
 		w.Header().Set("X-App-Version", app.BuildInfo.Version)
-		w.Header().Set("X-App-Commit", app.BuildInfo.Commit)
-		w.Header().Set("X-App-Build-Date", app.BuildInfo.BuildDate)
+		if _, ok := getApiOperation(ctx); !ok {
+			w.Header().Set("X-App-Commit", app.BuildInfo.Commit)
+			w.Header().Set("X-App-Build-Date", app.BuildInfo.BuildDate)
+		}
+		w.WriteHeader(status)
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
-		_ = enc.Encode(model)
+		_ = enc.Encode(api.Error{Title: http.StatusText(status), Status: status, Code: code, Detail: model.Message, Message: model.Message})
 		return
 	}
+	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 	tpl := "error.gohtml"
@@ -622,12 +782,27 @@ func (app *App) httpRedirect(ctx context.Context, w http.ResponseWriter, r *http
 	w.Header().Set("X-App-Page-Time-Ms", pageTimeStr)
 	w.Header().Set("X-App-Sql-Time-Ms", sqlTimeStr)
 	w.Header().Set("X-App-Sql-Count", sqlCountStr)
+	// The versioned API has no page to go back to
+	if _, ok := getApiOperation(ctx); ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	http.Redirect(w, r, url, code)
 }
 
-// sendFile sends a static file to the client. true = sent, false = not sent
-func sendFile(file string, w http.ResponseWriter, r *http.Request) bool {
-	st, err := os.Stat(file)
+// sendMedia sends a media file to the client. true = sent, false = not sent
+func sendMedia(file knownFile, w http.ResponseWriter, r *http.Request) bool {
+	f, err := file.dir.open(file.name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return sendFile(f, w, r)
+}
+
+// sendFile sends an open file to the client. true = sent, false = not sent
+func sendFile(f *os.File, w http.ResponseWriter, r *http.Request) bool {
+	st, err := f.Stat()
 	if err != nil || !st.Mode().IsRegular() {
 		return false
 	}
@@ -650,11 +825,6 @@ func sendFile(file string, w http.ResponseWriter, r *http.Request) bool {
 		}
 	}
 	// Use ServeContent to respect range requests
-	f, err := os.Open(file)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	http.ServeContent(w, r, filepath.Base(file), st.ModTime(), f)
+	http.ServeContent(w, r, st.Name(), st.ModTime(), f)
 	return true
 }
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCORSPreflight sends a cross-origin client's requests through the middleware of newMux, with a shared secret set
+func TestCORSPreflight(t *testing.T) {
+	const origin = "https://ui.example"
+	a, err := loadAuth(context.Background(), nil, "hunter2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{CorsOrigins: origin, auth: a}
+	h := app.newMux()
+
+	// The preflight of a PATCH with a bearer token and If-Match
+	r := httptest.NewRequest(http.MethodOptions, "/api/gallery/example.com/1", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+	r.Header.Set("Access-Control-Request-Headers", "authorization,content-type,if-match")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+		t.Errorf("preflight Access-Control-Allow-Origin %q, want %q", got, origin)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodPatch) {
+		t.Errorf("preflight Access-Control-Allow-Methods %q doesn't allow PATCH", got)
+	}
+	allowed := strings.Split(w.Header().Get("Access-Control-Allow-Headers"), ",")
+	for _, header := range []string{"Authorization", "Content-Type", "If-Match", "X-CSRF-Token"} {
+		found := false
+		for _, a := range allowed {
+			found = found || strings.EqualFold(strings.TrimSpace(a), header)
+		}
+		if !found {
+			t.Errorf("preflight Access-Control-Allow-Headers %q doesn't allow %s", allowed, header)
+		}
+	}
+
+	// Without the token, the client can still read why it was refused
+	r = httptest.NewRequest(http.MethodGet, "/api/gallery/example.com/1", nil)
+	r.Header.Set("Origin", origin)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d without a token, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+		t.Errorf("Access-Control-Allow-Origin %q without a token, want %q", got, origin)
+	}
+}
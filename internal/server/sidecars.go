@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Downloaders such as gallery-dl and yt-dlp save the metadata of each file next to it as a JSON sidecar: gallery-dl's
+// --write-metadata as {file}.json, and yt-dlp's --write-info-json as {file without extension}.info.json. gallery-dl's
+// --write-info-json saves the metadata of a folder as info.json. The folder catalogue reads them into the titles,
+// descriptions, uploaders, dates, and tags of its files and galleries. Each site names its fields differently, so the
+// common names are tried in turn.
+
+const maxSidecarBytes = 4 << 20
+
+// folderSidecarName is the sidecar of a folder, for its gallery
+const folderSidecarName = "info.json"
+
+// sidecar is the metadata of a file or gallery read from its JSON sidecar
+type sidecar struct {
+	title       string
+	description string
+	uploader    string
+	sourceUrl   string
+	uploadedTs  int64 // unix milliseconds, or 0 if unknown
+	tags        []string
+}
+
+// fileSidecarNames are the sidecars that the file p may have, in order of preference.
+// A file named like the folder sidecar, such as info.mp4, doesn't get noExt.json, which is its folder's.
+func fileSidecarNames(p string) []string {
+	noExt := strings.TrimSuffix(p, path.Ext(p))
+	names := []string{p + ".json", noExt + ".info.json"}
+	if path.Base(noExt+".json") != folderSidecarName {
+		names = append(names, noExt+".json")
+	}
+	return names
+}
+
+// findSidecar returns the first of names that exists in fsys, and its modified time in unix milliseconds
+func findSidecar(fsys fs.FS, names []string) (string, int64, bool) {
+	for _, name := range names {
+		info, err := fs.Stat(fsys, name)
+		if err == nil && info.Mode().IsRegular() {
+			return name, info.ModTime().UnixMilli(), true
+		}
+	}
+	return "", 0, false
+}
+
+func readSidecar(fsys fs.FS, name string) (sidecar, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return sidecar{}, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSidecarBytes+1))
+	if err != nil {
+		return sidecar{}, err
+	}
+	if len(data) > maxSidecarBytes {
+		return sidecar{}, fmt.Errorf("%s: sidecar is larger than %d bytes", name, maxSidecarBytes)
+	}
+	s, err := parseSidecar(data)
+	if err != nil {
+		return sidecar{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return s, nil
+}
+
+func parseSidecar(data []byte) (sidecar, error) {
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return sidecar{}, err
+	}
+	s := sidecar{
+		title:       sidecarString(m, "title"),
+		description: sidecarString(m, "description", "content", "caption"),
+		uploader:    sidecarName(m, "uploader", "author", "user", "username", "artist", "owner"),
+		sourceUrl:   sidecarString(m, "webpage_url", "post_url", "source", "url"),
+		uploadedTs:  sidecarTs(m),
+	}
+	for _, key := range []string{"tags", "hashtags"} {
+		for _, name := range sidecarTags(m[key]) {
+			if checkTagName(name) == nil && !slices.Contains(s.tags, name) {
+				s.tags = append(s.tags, name)
+			}
+		}
+	}
+	return s, nil
+}
+
+// sidecarString returns the first of keys that is a non-empty string
+func sidecarString(m map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := m[key].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// sidecarName returns the first of keys that is a name, or an object with a name, such as gallery-dl's author
+func sidecarName(m map[string]any, keys ...string) string {
+	for _, key := range keys {
+		switch v := m[key].(type) {
+		case string:
+			if strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		case map[string]any:
+			if name := sidecarString(v, "name", "username", "nick"); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// sidecarTs returns the upload time: yt-dlp's timestamp or upload_date, or gallery-dl's date, which is in UTC
+func sidecarTs(m map[string]any) int64 {
+	if v, ok := m["timestamp"].(float64); ok && v > 0 {
+		return int64(v * 1000)
+	}
+	if v, ok := m["date"].(string); ok {
+		for _, layout := range []string{time.DateTime, time.RFC3339, "2006-01-02T15:04:05", time.DateOnly} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UnixMilli()
+			}
+		}
+	}
+	if v, ok := m["upload_date"].(string); ok {
+		if t, err := time.Parse("20060102", v); err == nil {
+			return t.UnixMilli()
+		}
+	}
+	return 0
+}
+
+// sidecarTags returns the tags of a list of names or of objects with names, a comma or space separated string, or
+// an object of such lists by category
+func sidecarTags(v any) []string {
+	var tags []string
+	switch v := v.(type) {
+	case string:
+		sep := strings.Fields
+		if strings.Contains(v, ",") {
+			sep = func(s string) []string { return strings.Split(s, ",") }
+		}
+		for _, name := range sep(v) {
+			if name = strings.TrimSpace(name); name != "" {
+				tags = append(tags, name)
+			}
+		}
+	case []any:
+		for _, e := range v {
+			switch e := e.(type) {
+			case string:
+				if name := strings.TrimSpace(e); name != "" {
+					tags = append(tags, name)
+				}
+			case map[string]any:
+				if name := sidecarString(e, "name"); name != "" {
+					tags = append(tags, name)
+				}
+			}
+		}
+	case map[string]any:
+		categories := make([]string, 0, len(v))
+		for category := range v {
+			categories = append(categories, category)
+		}
+		slices.Sort(categories)
+		for _, category := range categories {
+			tags = append(tags, sidecarTags(v[category])...)
+		}
+	}
+	return tags
+}
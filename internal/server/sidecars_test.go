@@ -0,0 +1,23 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFileSidecarNames(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		want []string
+	}{
+		{"a/clip.mp4", []string{"a/clip.mp4.json", "a/clip.info.json", "a/clip.json"}},
+		{"photo.jpg", []string{"photo.jpg.json", "photo.info.json", "photo.json"}},
+		// info.json is the folder's sidecar, not the file's
+		{"a/info.mp4", []string{"a/info.mp4.json", "a/info.info.json"}},
+		{"info.jpg", []string{"info.jpg.json", "info.info.json"}},
+	} {
+		if got := fileSidecarNames(tc.file); !slices.Equal(got, tc.want) {
+			t.Errorf("fileSidecarNames(%q) = %q, want %q", tc.file, got, tc.want)
+		}
+	}
+}
@@ -13,21 +13,25 @@ const (
 
 	SortItems string = "items"
 	SortBytes string = "bytes"
+	SortScore string = "score" // Elo score from /compare, files only
 
 	SortRank    string = "rank"
 	SortDefault string = ""
 )
 
 var GallerySorts = []string{SortFetched, SortUploaded, SortBytes, SortItems}
-var FileSorts = []string{SortFetched, SortUploaded, SortBytes}
+var FileSorts = []string{SortFetched, SortUploaded, SortBytes, SortScore}
 var GallerySearchSorts = []string{SortRank, SortFetched, SortUploaded, SortBytes, SortItems}
-var FileSearchSorts = []string{SortRank, SortFetched, SortUploaded, SortBytes}
+var FileSearchSorts = []string{SortRank, SortFetched, SortUploaded, SortBytes, SortScore}
 
-func getSort(w http.ResponseWriter, r *http.Request, cookieName string, validSorts []string) string {
+// getSort resolves a sort from, in order of precedence, the query, the cookie, and the profile default
+func getSort(w http.ResponseWriter, r *http.Request, cookieName string, profileSort string, validSorts []string) string {
 	var defaultSortValue string
-	defaultSort, err := r.Cookie(cookieName)
+	defaultSort, err := getDefaultCookie(r, cookieName)
 	if err == nil && slices.Contains(validSorts, defaultSort.Value) {
 		defaultSortValue = defaultSort.Value
+	} else if slices.Contains(validSorts, profileSort) {
+		defaultSortValue = profileSort
 	} else {
 		defaultSortValue = ""
 	}
@@ -55,19 +59,19 @@ func getSort(w http.ResponseWriter, r *http.Request, cookieName string, validSor
 }
 
 func getSortGalleries(w http.ResponseWriter, r *http.Request) string {
-	return getSort(w, r, "defaultSortGalleries", GallerySorts)
+	return getSort(w, r, "defaultSortGalleries", getRequestProfile(r.Context()).Profile.SortGalleries, GallerySorts)
 }
 
 func getSortFiles(w http.ResponseWriter, r *http.Request) string {
-	return getSort(w, r, "defaultSortFiles", FileSorts)
+	return getSort(w, r, "defaultSortFiles", getRequestProfile(r.Context()).Profile.SortFiles, FileSorts)
 }
 
 func getSortSearchGalleries(w http.ResponseWriter, r *http.Request) string {
-	return getSort(w, r, "defaultSortSearchGalleries", GallerySearchSorts)
+	return getSort(w, r, "defaultSortSearchGalleries", getRequestProfile(r.Context()).Profile.SortSearchGalleries, GallerySearchSorts)
 }
 
 func getSortSearchFiles(w http.ResponseWriter, r *http.Request) string {
-	return getSort(w, r, "defaultSortSearchFiles", FileSearchSorts)
+	return getSort(w, r, "defaultSortSearchFiles", getRequestProfile(r.Context()).Profile.SortSearchFiles, FileSearchSorts)
 }
 
 func getUrlSort(u *url.URL, validSorts []string) string {
@@ -93,3 +97,59 @@ func getUrlSortSearchGalleries(u *url.URL) string {
 func getUrlSortSearchFiles(u *url.URL) string {
 	return getUrlSort(u, FileSearchSorts)
 }
+
+// galleryKeyset is the order of the browse and user pages, on album columns
+func galleryKeyset(sort string) keyset {
+	switch sort {
+	case SortUploaded:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "(/*T*/created_ts IS NULL)"}, {expr: "(/*T*/modified_ts IS NULL)"}, {expr: "/*T*/created_ts", desc: true}, {expr: "/*T*/modified_ts", desc: true}, {expr: "/*T*/album_id", desc: true}}}
+	case SortBytes:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "/*T*/sum_rf_bytes", desc: true}, {expr: "/*T*/album_id", desc: true}}}
+	case SortItems:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "/*T*/cnt_rf", desc: true}, {expr: "/*T*/album_id", desc: true}}}
+	default:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "(/*T*/last_fetch_ts IS NULL)"}, {expr: "/*T*/last_fetch_ts", desc: true}, {expr: "/*T*/inserted_ts", desc: true}, {expr: "/*T*/album_id", desc: true}}}
+	}
+}
+
+// fileKeyset is the order of the files of a gallery or user, on remote_file columns. scoresJSON is only used by the score sort.
+func fileKeyset(sort string, scoresJSON func() string) keyset {
+	switch sort {
+	case SortBytes:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "(/*T*/bytes IS NULL)"}, {expr: "/*T*/bytes", desc: true}, {expr: "/*T*/remote_file_id", desc: true}}}
+	case SortUploaded:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "(/*T*/uploaded_ts IS NULL)"}, {expr: "/*T*/uploaded_ts", desc: true}, {expr: "/*T*/remote_file_id", desc: true}}}
+	case SortScore:
+		// fileScoreKeySQL is written for the rf alias
+		return keyset{sort: sort, keys: []keysetKey{{expr: fileScoreKeySQL, desc: true, args: []any{scoresJSON()}}, {expr: "/*T*/remote_file_id", desc: true}}}
+	default:
+		return keyset{sort: sort, keys: []keysetKey{{expr: "/*T*/inserted_ts", desc: true}, {expr: "/*T*/remote_file_id", desc: true}}}
+	}
+}
+
+// rankKeyset is the rank sort of search results, on the score of a matches CTE and the id column of its rows.
+// BM25 scores are floats, so the key is the score in millionths to round-trip through cursors exactly.
+func rankKeyset(idColumn string) keyset {
+	return keyset{sort: SortRank, keys: []keysetKey{{expr: "CAST(ROUND(/*T*/score * 1000000) AS INTEGER)"}, {expr: "/*T*/" + idColumn, desc: true}}}
+}
+
+// searchGalleryKeyset is the order of gallery search results: rankKeyset on the matches CTE, otherwise galleryKeyset
+func searchGalleryKeyset(sort string) keyset {
+	if sort == SortRank || sort == SortDefault {
+		return rankKeyset("album_id")
+	}
+	return galleryKeyset(sort)
+}
+
+// searchFileKeyset is the order of file search results: rankKeyset on the matches CTE, otherwise fileKeyset
+func searchFileKeyset(sort string, scoresJSON func() string) keyset {
+	if sort == SortRank || sort == SortDefault {
+		return rankKeyset("remote_file_id")
+	}
+	return fileKeyset(sort, scoresJSON)
+}
+
+// tagGalleryKeyset is the order of the galleries of a tag page
+func tagGalleryKeyset() keyset {
+	return keyset{sort: "id", keys: []keysetKey{{expr: "/*T*/album_id"}}}
+}
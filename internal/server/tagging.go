@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxTagNameLength = 200
+
+// parseTagNames reads tag names from form values. Each value may hold a comma-separated list.
+func parseTagNames(values []string) ([]string, error) {
+	var names []string
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if err := checkTagName(name); err != nil {
+				return nil, err
+			}
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// checkTagName validates a trimmed, non-empty tag name
+func checkTagName(name string) error {
+	if len(name) > maxTagNameLength {
+		return fmt.Errorf("tag name is too long, maximum %d bytes", maxTagNameLength)
+	}
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return fmt.Errorf("tag name must not contain control characters")
+	}
+	return nil
+}
+
+// mapTable returns the tag map table of a file or gallery. Never populated from user input.
+func (e auditEntity) mapTable() (table string, idColumn string) {
+	if e.Type == auditEntityGallery {
+		return "map_album_tag", "album_id"
+	}
+	return "map_remote_file_tag", "remote_file_id"
+}
+
+// editLocalTagsTx adds and removes local tags on a file or gallery, recording each mapping added or removed.
+// Only local tags are ever removed; remote tags belong to RipMe.
+func editLocalTagsTx(ctx context.Context, tx *sql.Tx, e auditEntity, add []string, remove []string, changes *auditChanges) error {
+	mapTable, idColumn := e.mapTable()
+	for _, name := range add {
+		tagId, err := getOrCreateLocalTag(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			INSERT OR IGNORE
+			  INTO %s (%s, tag_id)
+			VALUES (?, ?)
+		`, mapTable, idColumn), e.Id, tagId)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			changes.add(e.change(auditFieldTag, sql.NullString{}, sql.NullString{String: name, Valid: true}))
+		}
+	}
+
+	for _, name := range remove {
+		var tagId int64
+		err := tx.QueryRowContext(ctx, `
+			SELECT tag_id
+			  FROM tag
+			 WHERE name = ?
+			   AND local = 1
+		`, name).Scan(&tagId)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			DELETE
+			  FROM %s
+			 WHERE %s = ?
+			   AND tag_id = ?
+		`, mapTable, idColumn), e.Id, tagId)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			changes.add(e.change(auditFieldTag, sql.NullString{String: name, Valid: true}, sql.NullString{}))
+		}
+		if err := deleteLocalTagIfUnused(ctx, tx, tagId, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getOrCreateLocalTag finds or creates a local tag, keeping tag_fts5 in sync.
+// tag_fts5 is an external content table, so rows written outside RipMe must be indexed manually, unless triggers do it,
+// see tagsIndexedByTriggers.
+func getOrCreateLocalTag(ctx context.Context, tx *sql.Tx, name string) (int64, error) {
+	var tagId int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT tag_id
+		  FROM tag
+		 WHERE name = ?
+		   AND local = 1
+	`, name).Scan(&tagId)
+	if err == nil {
+		return tagId, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO tag (name, local)
+		VALUES (?, 1)
+		RETURNING tag_id
+	`, name).Scan(&tagId)
+	if err != nil {
+		return 0, err
+	}
+	indexed, err := tagsIndexedByTriggers(ctx, tx)
+	if err != nil || indexed {
+		return tagId, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO tag_fts5 (rowid, name)
+		VALUES (?, ?)
+	`, tagId, name); err != nil {
+		return 0, err
+	}
+	return tagId, nil
+}
+
+// deleteLocalTagIfUnused removes a local tag that no file or album uses anymore, so /tags doesn't list it
+func deleteLocalTagIfUnused(ctx context.Context, tx *sql.Tx, tagId int64, name string) error {
+	var used bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS(
+		           SELECT 1
+		             FROM map_remote_file_tag
+		            WHERE tag_id = ?
+		       )
+		    OR EXISTS(
+		           SELECT 1
+		             FROM map_album_tag
+		            WHERE tag_id = ?
+		       )
+	`, tagId, tagId).Scan(&used); err != nil {
+		return err
+	}
+	if used {
+		return nil
+	}
+	indexed, err := tagsIndexedByTriggers(ctx, tx)
+	if err != nil {
+		return err
+	}
+	// The delete command must receive the indexed values to remove them from an external content table
+	if !indexed {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO tag_fts5 (tag_fts5, rowid, name)
+			VALUES ('delete', ?, ?)
+		`, tagId, name); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE
+		  FROM tag
+		 WHERE tag_id = ?
+		   AND local = 1
+	`, tagId)
+	return err
+}
+
+// tagsIndexedByTriggers reports whether triggers on tag keep tag_fts5 in sync, as in the folder index. Writing the
+// index again would corrupt it. RipMe has no such triggers.
+func tagsIndexedByTriggers(ctx context.Context, tx *sql.Tx) (bool, error) {
+	var indexed bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS(
+		           SELECT 1
+		             FROM sqlite_master
+		            WHERE type = 'trigger'
+		              AND name = 'tag_ai'
+		       )
+	`).Scan(&indexed)
+	return indexed, err
+}
+
+// handleFileTagsPost handles POST /file/{ripper_host}/{file_id}/tags
+func (app *App) handleFileTagsPost(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	fileIdString := r.PathValue("file_id")
+	if ripperHost == "" || fileIdString == "" {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected values for all path parts: /file/{ripper_host}/{file_id}/tags"))
+		return
+	}
+	fileId, err := strconv.ParseInt(fileIdString, 10, 64)
+	if err != nil || fileId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("invalid file id"))
+		return
+	}
+	u, err := readEntityUpdate(r, readTagsForm)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	app.saveEntityUpdate(w, r, app.fileTarget(ripperHost, fileId), u)
+}
+
+// handleGalleryTagsPost handles POST /gallery/{ripper_host}/{gid}/tags
+func (app *App) handleGalleryTagsPost(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	gid := r.PathValue("gid")
+	if ripperHost == "" || gid == "" {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected values for all path parts: /gallery/{ripper_host}/{gid}/tags"))
+		return
+	}
+	u, err := readEntityUpdate(r, readTagsForm)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	app.saveEntityUpdate(w, r, app.galleryTarget(ripperHost, gid), u)
+}
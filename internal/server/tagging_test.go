@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// ripmeTagSchema is the part of the RipMe schema that local tags touch. RipMe indexes tags itself, without triggers.
+const ripmeTagSchema = `
+	CREATE TABLE tag
+	(
+	    tag_id INTEGER PRIMARY KEY,
+	    name   TEXT    NOT NULL,
+	    local  INTEGER NOT NULL DEFAULT 0,
+	    UNIQUE (name, local)
+	);
+	CREATE TABLE map_remote_file_tag (remote_file_id INTEGER NOT NULL, tag_id INTEGER NOT NULL);
+	CREATE TABLE map_album_tag (album_id INTEGER NOT NULL, tag_id INTEGER NOT NULL);
+	CREATE VIRTUAL TABLE tag_fts5 USING fts5(name, content='tag', content_rowid='tag_id');
+`
+
+// TestLocalTagIndex adds and removes a local tag in each catalogue's schema, and checks tag_fts5 after each
+func TestLocalTagIndex(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		migrations []string
+	}{
+		{"ripme", []string{ripmeTagSchema}},
+		{"folder index", folderIndexMigrations},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.sqlite"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+			if err := migrateDb(ctx, db, tc.name, tc.migrations); err != nil {
+				t.Fatal(err)
+			}
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			tagId, err := getOrCreateLocalTag(ctx, tx, "quokka")
+			if err != nil {
+				t.Fatalf("add tag: %v", err)
+			}
+			checkTagIndex(t, tx)
+			if got := matchTag(t, tx, "quokka"); got != tagId {
+				t.Errorf("tag_fts5 finds tag %d after adding it, want %d", got, tagId)
+			}
+
+			if err := deleteLocalTagIfUnused(ctx, tx, tagId, "quokka"); err != nil {
+				t.Fatalf("remove tag: %v", err)
+			}
+			checkTagIndex(t, tx)
+			if got := matchTag(t, tx, "quokka"); got != 0 {
+				t.Errorf("tag_fts5 finds tag %d after removing it", got)
+			}
+		})
+	}
+}
+
+// checkTagIndex fails the test when tag_fts5 is corrupt or doesn't match the tag table
+func checkTagIndex(t *testing.T, tx *sql.Tx) {
+	t.Helper()
+	if _, err := tx.Exec(`INSERT INTO tag_fts5 (tag_fts5, rank) VALUES ('integrity-check', 1)`); err != nil {
+		t.Fatalf("tag_fts5 integrity-check: %v", err)
+	}
+}
+
+// matchTag returns the id of the tag that tag_fts5 finds for query, or 0 when it finds none
+func matchTag(t *testing.T, tx *sql.Tx, query string) int64 {
+	t.Helper()
+	var tagId int64
+	err := tx.QueryRow(`SELECT rowid FROM tag_fts5 WHERE tag_fts5 MATCH ?`, query).Scan(&tagId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		t.Fatal(err)
+	}
+	return tagId
+}
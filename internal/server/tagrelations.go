@@ -0,0 +1,696 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"golocalgal/internal/types"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// tagRelations holds the tag aliases and implications stored in LocalDb.
+// Implications are resolved to canonical names, so an implication on an alias applies to its canonical tag.
+type tagRelations struct {
+	canonical map[string]string   // alias -> canonical
+	aliases   map[string][]string // canonical -> aliases
+	parents   map[string][]string // canonical child -> canonical parents
+	children  map[string][]string // canonical parent -> canonical children
+}
+
+// getTagRelations loads the tag relations. Without LocalDb there are none.
+func (app *App) getTagRelations(ctx context.Context) (tagRelations, error) {
+	rel := tagRelations{
+		canonical: map[string]string{},
+		aliases:   map[string][]string{},
+		parents:   map[string][]string{},
+		children:  map[string][]string{},
+	}
+	if app.LocalDb == nil {
+		return rel, nil
+	}
+	aliases, err := app.getTagAliases(ctx)
+	if err != nil {
+		return rel, err
+	}
+	implications, err := app.getTagImplications(ctx)
+	if err != nil {
+		return rel, err
+	}
+	for _, a := range aliases {
+		rel.canonical[a.Alias] = a.Canonical
+		rel.aliases[a.Canonical] = append(rel.aliases[a.Canonical], a.Alias)
+	}
+	for _, i := range implications {
+		child, parent := rel.canonicalName(i.Child), rel.canonicalName(i.Parent)
+		// Aliasing can turn an implication into a loop or a duplicate after it was saved
+		if child == parent || slices.Contains(rel.parents[child], parent) {
+			continue
+		}
+		rel.parents[child] = append(rel.parents[child], parent)
+		rel.children[parent] = append(rel.children[parent], child)
+	}
+	return rel, nil
+}
+
+func (app *App) getTagAliases(ctx context.Context) ([]types.TagAlias, error) {
+	var aliases []types.TagAlias
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT alias_name
+			     , canonical_name
+			  FROM tag_alias
+			 ORDER BY canonical_name, alias_name
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var a types.TagAlias
+			if err := rows.Scan(&a.Alias, &a.Canonical); err != nil {
+				return err
+			}
+			aliases = append(aliases, a)
+		}
+		return rows.Err()
+	})
+	return aliases, err
+}
+
+func (app *App) getTagImplications(ctx context.Context) ([]types.TagImplication, error) {
+	var implications []types.TagImplication
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.LocalDb.QueryContext(ctx, `
+			SELECT child_name
+			     , parent_name
+			  FROM tag_implication
+			 ORDER BY parent_name, child_name
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var i types.TagImplication
+			if err := rows.Scan(&i.Child, &i.Parent); err != nil {
+				return err
+			}
+			implications = append(implications, i)
+		}
+		return rows.Err()
+	})
+	return implications, err
+}
+
+func (rel tagRelations) isEmpty() bool {
+	return len(rel.canonical) == 0 && len(rel.parents) == 0
+}
+
+// canonicalName returns the tag that name is an alias of, or name itself.
+// Aliases are kept one level deep when saved, so one lookup is enough.
+func (rel tagRelations) canonicalName(name string) string {
+	if c, ok := rel.canonical[name]; ok {
+		return c
+	}
+	return name
+}
+
+// isGroup reports whether a canonical name has aliases or implications, so its counts must be merged
+func (rel tagRelations) isGroup(name string) bool {
+	return len(rel.aliases[name]) > 0 || len(rel.parents[name]) > 0 || len(rel.children[name]) > 0
+}
+
+// groupNames returns every canonical name that has aliases or implications
+func (rel tagRelations) groupNames() []string {
+	var names []string
+	for _, m := range []map[string][]string{rel.aliases, rel.parents, rel.children} {
+		for name := range m {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// walkTagRelations follows next transitively from name, returning every name reached except name itself
+func walkTagRelations(name string, next map[string][]string) []string {
+	var reached []string
+	queue := []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, n := range next[current] {
+			if n != name && !slices.Contains(reached, n) {
+				reached = append(reached, n)
+				queue = append(queue, n)
+			}
+		}
+	}
+	return reached
+}
+
+// ancestors returns the tags that name implies, directly or indirectly
+func (rel tagRelations) ancestors(name string) []string {
+	return walkTagRelations(rel.canonicalName(name), rel.parents)
+}
+
+// members returns every tag name that counts as name:
+// its canonical name and aliases, and the tags that imply it, with their aliases
+func (rel tagRelations) members(name string) []string {
+	c := rel.canonicalName(name)
+	var names []string
+	for _, n := range append([]string{c}, walkTagRelations(c, rel.children)...) {
+		names = append(names, n)
+		names = append(names, rel.aliases[n]...)
+	}
+	return names
+}
+
+// groupPairsJSON returns [member, group] pairs for every related tag name, for the tag_group CTE.
+// A member counts toward its canonical tag and every tag that it implies; an alias doesn't count as itself.
+func (rel tagRelations) groupPairsJSON() string {
+	pairs := [][2]string{}
+	add := func(member string, canonical string) {
+		pairs = append(pairs, [2]string{member, canonical})
+		for _, a := range rel.ancestors(canonical) {
+			pairs = append(pairs, [2]string{member, a})
+		}
+	}
+	for alias, c := range rel.canonical {
+		add(alias, c)
+	}
+	for _, c := range rel.groupNames() {
+		add(c, c)
+	}
+	return jsonArray(pairs)
+}
+
+func jsonArray[T any](values []T) string {
+	if values == nil {
+		return "[]"
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// tagGroupCTE maps tag names to the names they count as, using the groupPairsJSON parameter
+const tagGroupCTE = `
+	tag_group AS (
+	    SELECT json_extract(j.value, '$[0]') AS member
+	         , json_extract(j.value, '$[1]') AS grp
+	      FROM json_each(?) j
+	             )
+`
+
+// applyTagRelations merges aliases into their canonical tags and counts implied tags in a tag listing.
+// Tags that belong to a group are replaced by one entry per group, counted without duplicates.
+// With allGroups, groups that aren't in the listing are added too. The result is sorted by count.
+func (app *App) applyTagRelations(ctx context.Context, rel tagRelations, tags []types.Tag, mapTable string, idColumn string, allGroups bool) ([]types.Tag, error) {
+	if rel.isEmpty() {
+		return tags, nil
+	}
+	var out []types.Tag
+	var groups []string
+	for _, t := range tags {
+		c := rel.canonicalName(t.Name)
+		if c == t.Name && !rel.isGroup(c) {
+			out = append(out, t)
+			continue
+		}
+		if !slices.Contains(groups, c) {
+			groups = append(groups, c)
+		}
+	}
+	if allGroups {
+		for _, c := range rel.groupNames() {
+			if !slices.Contains(groups, c) {
+				groups = append(groups, c)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return out, nil
+	}
+
+	// Blocked tags aren't listed, and blocked galleries and files aren't counted
+	bl := getBlocklist(ctx)
+	blTag, blTagArgs := bl.tagSQL("t.name")
+	var blJoin, blItem string
+	var blItemArgs []any
+	switch mapTable {
+	case "map_remote_file_tag":
+		if blItem, blItemArgs = bl.fileSQL("bl_item"); blItem != "" {
+			blJoin = "JOIN remote_file bl_item ON bl_item.remote_file_id = m.remote_file_id"
+		}
+	case "map_album_tag":
+		if blItem, blItemArgs = bl.gallerySQL("bl_item"); blItem != "" {
+			blJoin = "JOIN album bl_item ON bl_item.album_id = m.album_id"
+		}
+	}
+	args := []any{rel.groupPairsJSON(), jsonArray(groups)}
+	args = append(args, blTagArgs...)
+	args = append(args, blItemArgs...)
+	counts := map[string]int{}
+	// mapTable and idColumn are never populated from user input
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, fmt.Sprintf(`
+			  WITH %s
+			SELECT g.grp
+			     , COUNT(DISTINCT m.%s) AS cnt
+			  FROM tag_group g
+			  JOIN tag t ON t.name = g.member
+			  JOIN %s m ON m.tag_id = t.tag_id
+			  %s
+			 WHERE g.grp IN (SELECT value FROM json_each(?))
+			   %s
+			   %s
+			 GROUP BY g.grp
+		`, tagGroupCTE, idColumn, mapTable, blJoin, blTag, blItem), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var count int
+			if err := rows.Scan(&name, &count); err != nil {
+				return err
+			}
+			counts[name] = count
+		}
+		return rows.Err()
+	}); err != nil {
+		return nil, err
+	}
+	for _, c := range groups {
+		if counts[c] > 0 && !bl.blocksTag(c) {
+			out = append(out, types.Tag{Name: c, Count: counts[c]})
+		}
+	}
+	slices.SortStableFunc(out, func(a, b types.Tag) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	return out, nil
+}
+
+// getTagIds returns the ids of the tags with the given names, local or not
+func (app *App) getTagIds(ctx context.Context, names []string) ([]int64, error) {
+	var ids []int64
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT tag_id
+			  FROM tag
+			 WHERE name IN (SELECT value FROM json_each(?))
+		`, jsonArray(names))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
+
+// normaliseTagName reduces a tag name to a key for merge suggestions:
+// lowercase, with underscores and hyphens as spaces, and each word without a plural ending
+func normaliseTagName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '_' || r == '-' || unicode.IsSpace(r)
+	})
+	for i, w := range words {
+		switch {
+		case len(w) > 4 && strings.HasSuffix(w, "ies"):
+			words[i] = w[:len(w)-3] + "y"
+		case len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss"):
+			words[i] = w[:len(w)-1]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// getTagMergeSuggestions finds tags with the same normalised name that aren't aliased to one tag yet
+func (app *App) getTagMergeSuggestions(ctx context.Context, rel tagRelations) ([]types.TagMergeSuggestion, error) {
+	var names []string
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT DISTINCT name
+			  FROM tag
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return rows.Err()
+	}); err != nil {
+		return nil, err
+	}
+
+	byKey := map[string][]string{}
+	for _, name := range names {
+		key := normaliseTagName(name)
+		if key != "" {
+			byKey[key] = append(byKey[key], name)
+		}
+	}
+	var candidates []string
+	for key, group := range byKey {
+		var canonicals []string
+		for _, name := range group {
+			if c := rel.canonicalName(name); !slices.Contains(canonicals, c) {
+				canonicals = append(canonicals, c)
+			}
+		}
+		if len(canonicals) > 1 {
+			candidates = append(candidates, group...)
+		} else {
+			delete(byKey, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	counts := map[string]int{}
+	if err := app.withSQL(ctx, func(ctx context.Context) error {
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT t.name
+			     , (
+			    SELECT COUNT(*)
+			      FROM map_remote_file_tag mrft
+			     WHERE mrft.tag_id = t.tag_id
+			       ) + (
+			    SELECT COUNT(*)
+			      FROM map_album_tag mat
+			     WHERE mat.tag_id = t.tag_id
+			       ) AS cnt
+			  FROM tag t
+			 WHERE t.name IN (SELECT value FROM json_each(?))
+		`, jsonArray(candidates))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var count int
+			if err := rows.Scan(&name, &count); err != nil {
+				return err
+			}
+			counts[name] += count
+		}
+		return rows.Err()
+	}); err != nil {
+		return nil, err
+	}
+
+	var suggestions []types.TagMergeSuggestion
+	for key, group := range byKey {
+		var tags []types.Tag
+		for _, name := range group {
+			tags = append(tags, types.Tag{Name: name, Count: counts[name]})
+		}
+		// A tag that already has aliases stays canonical, whatever its count
+		slices.SortFunc(tags, func(a, b types.Tag) int {
+			aCanonical, bCanonical := len(rel.aliases[a.Name]) > 0, len(rel.aliases[b.Name]) > 0
+			if aCanonical != bCanonical {
+				if aCanonical {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Name, b.Name))
+		})
+		s := types.TagMergeSuggestion{Key: key, Canonical: tags[0]}
+		for _, t := range tags[1:] {
+			if rel.canonicalName(t.Name) != tags[0].Name {
+				s.Aliases = append(s.Aliases, t)
+			}
+		}
+		suggestions = append(suggestions, s)
+	}
+	slices.SortFunc(suggestions, func(a, b types.TagMergeSuggestion) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return suggestions, nil
+}
+
+// handleTagRelations handles /tags/relations
+func (app *App) handleTagRelations(w http.ResponseWriter, r *http.Request) {
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		model := types.TagRelationsPage{
+			Available: app.LocalDb != nil,
+			BasePage:  &types.BasePage{Perf: perf},
+		}
+		if app.LocalDb != nil {
+			var err error
+			if model.Aliases, err = app.getTagAliases(ctx); err != nil {
+				return err
+			}
+			if model.Implications, err = app.getTagImplications(ctx); err != nil {
+				return err
+			}
+		}
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
+			return err
+		}
+		if model.Suggestions, err = app.getTagMergeSuggestions(ctx, rel); err != nil {
+			return err
+		}
+		app.render(ctx, w, "tag_relations.gohtml", &model)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// parseTagNameField reads one tag name from a form field. Unlike parseTagNames, commas are part of the name.
+func parseTagNameField(r *http.Request, field string) (string, error) {
+	name := strings.TrimSpace(r.FormValue(field))
+	if name == "" {
+		return "", fmt.Errorf("expected a tag name in %s", field)
+	}
+	return name, checkTagName(name)
+}
+
+// handleTagAliasPost handles POST /tags/aliases and POST /api/tags/aliases.
+// The alias field may be repeated to merge several tags into one canonical tag.
+func (app *App) handleTagAliasPost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save tag alias"))
+		return
+	}
+	canonical, err := parseTagNameField(r, "canonical")
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	_ = r.ParseForm()
+	var aliases []string
+	for _, v := range r.Form["alias"] {
+		alias := strings.TrimSpace(v)
+		if alias == "" {
+			continue
+		}
+		if err := checkTagName(alias); err != nil {
+			app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+			return
+		}
+		aliases = append(aliases, alias)
+	}
+	if len(aliases) == 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected a tag name in alias"))
+		return
+	}
+
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
+			return err
+		}
+		// Point at the end of an existing alias, so aliases stay one level deep
+		canonical = rel.canonicalName(canonical)
+		for _, alias := range aliases {
+			if alias == canonical {
+				return errConflict{fmt.Errorf("%q can't be an alias of itself", alias)}
+			}
+		}
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			tx, err := app.LocalDb.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			for _, alias := range aliases {
+				if _, err := tx.ExecContext(ctx, `
+					INSERT INTO tag_alias (alias_name, canonical_name)
+					VALUES (?, ?)
+					    ON CONFLICT (alias_name) DO UPDATE
+					    SET canonical_name = excluded.canonical_name
+				`, alias, canonical); err != nil {
+					return err
+				}
+				// Aliases of the new alias move to its canonical tag
+				if _, err := tx.ExecContext(ctx, `
+					UPDATE tag_alias
+					   SET canonical_name = ?
+					 WHERE canonical_name = ?
+				`, canonical, alias); err != nil {
+					return err
+				}
+			}
+			// A canonical tag is never an alias
+			if _, err := tx.ExecContext(ctx, `
+				DELETE
+				  FROM tag_alias
+				 WHERE alias_name = ?
+			`, canonical); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+	})
+	app.finishTagRelationWrite(w, r, &p, err)
+}
+
+// handleTagAliasDelete handles POST /tags/aliases/delete and DELETE /api/tags/aliases?alias=
+func (app *App) handleTagAliasDelete(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot delete tag alias"))
+		return
+	}
+	alias := r.FormValue("alias")
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			res, err := app.LocalDb.ExecContext(ctx, `
+				DELETE
+				  FROM tag_alias
+				 WHERE alias_name = ?
+			`, alias)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return sql.ErrNoRows
+			}
+			return nil
+		})
+	})
+	app.finishTagRelationWrite(w, r, &p, err)
+}
+
+// handleTagImplicationPost handles POST /tags/implications and POST /api/tags/implications
+func (app *App) handleTagImplicationPost(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot save tag implication"))
+		return
+	}
+	child, err := parseTagNameField(r, "child")
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	parent, err := parseTagNameField(r, "parent")
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		rel, err := app.getTagRelations(ctx)
+		if err != nil {
+			return err
+		}
+		child, parent := rel.canonicalName(child), rel.canonicalName(parent)
+		if child == parent {
+			return errConflict{fmt.Errorf("%q can't imply itself", child)}
+		}
+		if slices.Contains(rel.ancestors(parent), child) {
+			return errConflict{fmt.Errorf("%q already implies %q, so this would be a loop", parent, child)}
+		}
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			_, err := app.LocalDb.ExecContext(ctx, `
+				INSERT OR IGNORE
+				  INTO tag_implication (child_name, parent_name)
+				VALUES (?, ?)
+			`, child, parent)
+			return err
+		})
+	})
+	app.finishTagRelationWrite(w, r, &p, err)
+}
+
+// handleTagImplicationDelete handles POST /tags/implications/delete and DELETE /api/tags/implications?child=&parent=
+func (app *App) handleTagImplicationDelete(w http.ResponseWriter, r *http.Request) {
+	if app.LocalDb == nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, fmt.Errorf("local database is unavailable, cannot delete tag implication"))
+		return
+	}
+	child := r.FormValue("child")
+	parent := r.FormValue("parent")
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		app.bustCache(w)
+		return app.withSQL(ctx, func(ctx context.Context) error {
+			res, err := app.LocalDb.ExecContext(ctx, `
+				DELETE
+				  FROM tag_implication
+				 WHERE child_name = ?
+				   AND parent_name = ?
+			`, child, parent)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return sql.ErrNoRows
+			}
+			return nil
+		})
+	})
+	app.finishTagRelationWrite(w, r, &p, err)
+}
+
+// finishTagRelationWrite responds to a tag relation write: the updated relations in JSON mode, otherwise a redirect
+func (app *App) finishTagRelationWrite(w http.ResponseWriter, r *http.Request, p *types.Perf, err error) {
+	if err != nil {
+		app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+		return
+	}
+	if getRenderMode(r.Context()) == RenderJSON {
+		model := types.TagRelationsPage{Available: true, BasePage: &types.BasePage{Perf: p}}
+		if model.Aliases, err = app.getTagAliases(r.Context()); err == nil {
+			model.Implications, err = app.getTagImplications(r.Context())
+		}
+		if err != nil {
+			app.renderError(r.Context(), w, p, http.StatusInternalServerError, err)
+			return
+		}
+		app.render(r.Context(), w, "", &model)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, p, postRedirectTarget(r, "/tags/relations"), http.StatusSeeOther)
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golocalgal/api"
+	"golocalgal/internal/types"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const maxUpdateBytes = 1 << 20
+
+// entityUpdate is a change to a gallery or file, read from a form or from a JSON api.Update
+type entityUpdate struct {
+	setRating bool
+	rating    sql.NullInt64
+	ignored   string // "1", "0", or "" to leave alone, see parseIgnored
+	add       []string
+	remove    []string
+	title     *string // nil to leave alone, see parseLocalMeta
+	notes     *string
+}
+
+// changesRipme reports whether the update writes to the RipMe database, rather than only to LocalDb
+func (u entityUpdate) changesRipme() bool {
+	return u.setRating || u.ignored != "" || len(u.add) > 0 || len(u.remove) > 0
+}
+
+func (u entityUpdate) changesMeta() bool {
+	return u.title != nil || u.notes != nil
+}
+
+// isJSONBody reports whether the request body is JSON rather than a form
+func isJSONBody(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// readEntityUpdate reads the body of a write to a gallery or file. A JSON body can change any field on every endpoint;
+// a form only has the fields of its endpoint, which readForm reads. A nil readForm only takes JSON.
+func readEntityUpdate(r *http.Request, readForm func(r *http.Request, u *entityUpdate) error) (entityUpdate, error) {
+	var u entityUpdate
+	if !isJSONBody(r) {
+		if readForm == nil {
+			return u, fmt.Errorf("expected an application/json body")
+		}
+		return u, readForm(r, &u)
+	}
+	var body api.Update
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxUpdateBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		return u, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	var err error
+	if body.Rating != nil {
+		if *body.Rating < 0 || *body.Rating > 5 {
+			return u, fmt.Errorf("invalid rating, must be 1-5, or 0 to unset")
+		}
+		u.setRating, u.rating = true, sql.NullInt64{Int64: *body.Rating, Valid: *body.Rating != 0}
+	}
+	if body.Ignored != nil {
+		u.ignored = "0"
+		if *body.Ignored {
+			u.ignored = "1"
+		}
+	}
+	if u.add, err = parseTagNames(body.AddTags); err != nil {
+		return u, err
+	}
+	if u.remove, err = parseTagNames(body.RemoveTags); err != nil {
+		return u, err
+	}
+	if body.Title != nil {
+		v, err := cleanLocalTitle(*body.Title)
+		if err != nil {
+			return u, err
+		}
+		u.title = &v
+	}
+	if body.Notes != nil {
+		v, err := cleanLocalNotes(*body.Notes)
+		if err != nil {
+			return u, err
+		}
+		u.notes = &v
+	}
+	return u, nil
+}
+
+// readRatingForm reads the rating and ignored form fields
+func readRatingForm(r *http.Request, u *entityUpdate) (err error) {
+	if u.setRating, u.rating, err = parseRating(r.FormValue("rating")); err != nil {
+		return err
+	}
+	u.ignored = r.FormValue("ignored")
+	return parseIgnored(u.ignored)
+}
+
+// readTagsForm reads the add and remove form fields, each a list of local tags
+func readTagsForm(r *http.Request, u *entityUpdate) (err error) {
+	_ = r.ParseForm()
+	if u.add, err = parseTagNames(r.PostForm["add"]); err != nil {
+		return err
+	}
+	u.remove, err = parseTagNames(r.PostForm["remove"])
+	return err
+}
+
+// readMetaForm reads the title and notes form fields
+func readMetaForm(r *http.Request, u *entityUpdate) (err error) {
+	u.title, u.notes, err = parseLocalMeta(r)
+	return err
+}
+
+// entityTarget is the gallery or file a write is to
+type entityTarget struct {
+	name   string // "gallery" or "file", for messages
+	lookup func(ctx context.Context, tx *sql.Tx) (auditEntity, error)
+	entity func(ctx context.Context) (auditEntity, error) // without a RipMe transaction, for LocalDb writes in read-only mode
+	state  func(ctx context.Context) (any, error)         // the api type returned after a write
+	href   string                                         // page of the gallery or file, where form posts go back to by default
+}
+
+func (app *App) galleryTarget(ripperHost string, gid string) entityTarget {
+	return entityTarget{
+		name: "gallery",
+		href: "/gallery/" + ripperHost + "/" + url.PathEscape(gid),
+		lookup: func(ctx context.Context, tx *sql.Tx) (auditEntity, error) {
+			return lookupGalleryEntity(ctx, tx, ripperHost, gid)
+		},
+		entity: func(ctx context.Context) (e auditEntity, err error) {
+			e = auditEntity{Type: auditEntityGallery, RipperHost: ripperHost, Key: gid}
+			err = app.withSQL(ctx, func(ctx context.Context) error {
+				return app.Db.QueryRowContext(ctx, `
+					SELECT a.album_id
+					  FROM album a
+					  JOIN ripper r ON r.ripper_id = a.ripper_id
+					 WHERE r.host = ?
+					   AND a.gid = ?
+				`, ripperHost, gid).Scan(&e.Id)
+			})
+			return e, err
+		},
+		state: func(ctx context.Context) (any, error) {
+			a, err := app.getAlbum(ctx, ripperHost, gid)
+			if err != nil {
+				return nil, err
+			}
+			tags, err := app.getAlbumTags(ctx, a.AlbumId)
+			if err != nil {
+				return nil, err
+			}
+			return api.GalleryInfo{Gallery: apiGallery(a), Tags: apiTags(tags)}, nil
+		},
+	}
+}
+
+func (app *App) fileTarget(ripperHost string, fileId int64) entityTarget {
+	return entityTarget{
+		name: "file",
+		href: fmt.Sprintf("/file/%s/%d", ripperHost, fileId),
+		lookup: func(ctx context.Context, tx *sql.Tx) (auditEntity, error) {
+			return lookupFileEntity(ctx, tx, ripperHost, fileId)
+		},
+		entity: func(ctx context.Context) (e auditEntity, err error) {
+			e = auditEntity{Type: auditEntityFile, RipperHost: ripperHost, Key: strconv.FormatInt(fileId, 10)}
+			err = app.withSQL(ctx, func(ctx context.Context) error {
+				return app.Db.QueryRowContext(ctx, `
+					SELECT rf.remote_file_id
+					  FROM remote_file rf
+					  JOIN ripper r ON r.ripper_id = rf.ripper_id
+					 WHERE r.host = ?
+					   AND rf.remote_file_id = ?
+				`, ripperHost, fileId).Scan(&e.Id)
+			})
+			return e, err
+		},
+		state: func(ctx context.Context) (any, error) {
+			f, err := app.lookupFile(ctx, ripperHost, fileId, true)
+			if err != nil {
+				return nil, err
+			}
+			app.populateFileLocalMeta(ctx, &f)
+			if f.Filename.Valid {
+				f.HrefMedia = fmt.Sprintf("/media/%s/%s", f.RipperHost, f.Filename.String)
+			}
+			tags, err := app.getFileTags(ctx, f.FileId)
+			if err != nil {
+				return nil, err
+			}
+			return api.FileDetail{File: apiFile(f), Tags: apiTags(tags)}, nil
+		},
+	}
+}
+
+// checkWritable returns why u can't be saved with the databases that are open, if it can't
+func (app *App) checkWritable(u entityUpdate) error {
+	if app.DbRw == nil {
+		if u.setRating || u.ignored != "" {
+			return errReadOnly{fmt.Errorf("database is read-only, cannot save rating")}
+		}
+		if len(u.add) > 0 || len(u.remove) > 0 {
+			return errReadOnly{fmt.Errorf("database is read-only, cannot save tags")}
+		}
+	}
+	if app.LocalDb == nil && u.changesMeta() {
+		return fmt.Errorf("local database is unavailable, cannot save title and notes")
+	}
+	return nil
+}
+
+// checkIfMatch compares the If-Match header with the current ETag, so a client can't overwrite a change it hasn't seen
+func checkIfMatch(r *http.Request, name string, etag string) error {
+	match := r.Header.Get("If-Match")
+	if match == "" || strings.TrimSpace(match) == "*" {
+		return nil
+	}
+	for _, m := range strings.Split(match, ",") {
+		if strings.TrimSpace(m) == etag {
+			return nil
+		}
+	}
+	return errPrecondition{fmt.Errorf("the %s changed since it was read, its ETag is now %s", name, etag)}
+}
+
+// respondsWithState reports whether a write answers with the state of the gallery or file. Forms are redirected,
+// and the versioned API's POSTs answer 204 No Content, as they always have.
+func respondsWithState(r *http.Request) bool {
+	if getRenderMode(r.Context()) != RenderJSON {
+		return false
+	}
+	_, v1 := getApiOperation(r.Context())
+	return !v1 || r.Method == http.MethodPatch
+}
+
+// saveEntityUpdate writes u to the gallery or file t, and then responds with its state, see respondsWithState,
+// or redirects back to the form's page, see postRedirectTarget
+func (app *App) saveEntityUpdate(w http.ResponseWriter, r *http.Request, t entityTarget, u entityUpdate) {
+	if err := app.checkWritable(u); err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusServiceUnavailable, err)
+		return
+	}
+	var state any
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		// Held from the If-Match check to the end of the write, so two clients that read the same ETag can't both write
+		app.entityWriteMu.Lock()
+		defer app.entityWriteMu.Unlock()
+		if r.Header.Get("If-Match") != "" {
+			current, err := t.state(ctx)
+			if err != nil {
+				return err
+			}
+			if err := checkIfMatch(r, t.name, apiETag(current)); err != nil {
+				return err
+			}
+		}
+		app.bustCache(w)
+		// The title and notes are in LocalDb and the rest in the RipMe database, so they can't be written in one
+		// transaction. They're written first, and put back if the RipMe write fails, so a failed update changes nothing.
+		// Their changes are recorded in the audit log once both writes succeeded.
+		var undoMeta func() error
+		var metaChanges auditChanges
+		if u.changesMeta() {
+			e, err := t.entity(ctx)
+			if errors.Is(err, sql.ErrNoRows) {
+				return errNotFound{fmt.Errorf("%s not found", t.name)}
+			} else if err != nil {
+				return err
+			}
+			title, notes, err := app.getLocalMeta(ctx, e.metaTable(), e.Id)
+			if err != nil {
+				return err
+			}
+			if metaChanges, err = app.saveLocalMeta(ctx, e, u.title, u.notes); err != nil {
+				return err
+			}
+			undoMeta = func() error {
+				_, err := app.saveLocalMeta(context.WithoutCancel(ctx), e, &title, &notes)
+				return err
+			}
+		}
+		if u.changesRipme() {
+			if _, err := app.writeAudited(ctx, r, func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error {
+				e, err := t.lookup(ctx, tx)
+				if err != nil {
+					return err
+				}
+				if u.ignored != "" {
+					setIgnoredTx := setFileIgnoredTx
+					if e.Type == auditEntityGallery {
+						setIgnoredTx = setGalleryIgnoredTx
+					}
+					if err := setIgnoredTx(ctx, tx, e, u.ignored == "1", changes); err != nil {
+						return err
+					}
+				}
+				if u.setRating {
+					if err := setRatingTx(ctx, tx, e, u.rating, changes); err != nil {
+						return err
+					}
+				}
+				if len(u.add) > 0 || len(u.remove) > 0 {
+					return editLocalTagsTx(ctx, tx, e, u.add, u.remove, changes)
+				}
+				return nil
+			}); err != nil {
+				if undoMeta != nil {
+					if undoErr := undoMeta(); undoErr != nil {
+						return fmt.Errorf("%w (the title and notes were saved, putting them back failed: %v)", err, undoErr)
+					}
+				}
+				return err
+			}
+		}
+		if err := app.recordAudit(ctx, clientAddr(r), metaChanges); err != nil {
+			log.Printf("unable to record audit log: %v", err)
+		}
+		if respondsWithState(r) {
+			var err error
+			state, err = t.state(ctx)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+	if state != nil {
+		app.render(r.Context(), w, "", state)
+		return
+	}
+	app.httpRedirect(r.Context(), w, r, &p, postRedirectTarget(r, t.href), http.StatusSeeOther)
+}
+
+// handleGalleryPatch handles PATCH /api/gallery/{ripper_host}/{gid}: an api.Update of any of the gallery's fields
+func (app *App) handleGalleryPatch(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	gid := r.PathValue("gid")
+	if ripperHost == "" || gid == "" {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected values for all path parts: /gallery/{ripper_host}/{gid}"))
+		return
+	}
+	u, err := readEntityUpdate(r, nil)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	app.saveEntityUpdate(w, r, app.galleryTarget(ripperHost, gid), u)
+}
+
+// handleFilePatch handles PATCH /api/file/{ripper_host}/{file_id}: an api.Update of any of the file's fields
+func (app *App) handleFilePatch(w http.ResponseWriter, r *http.Request) {
+	ripperHost := r.PathValue("ripper_host")
+	fileId, err := strconv.ParseInt(r.PathValue("file_id"), 10, 64)
+	if ripperHost == "" || err != nil || fileId <= 0 {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, fmt.Errorf("expected a ripper host and a positive file id: /file/{ripper_host}/{file_id}"))
+		return
+	}
+	u, err := readEntityUpdate(r, nil)
+	if err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	app.saveEntityUpdate(w, r, app.fileTarget(ripperHost, fileId), u)
+}
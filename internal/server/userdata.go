@@ -0,0 +1,559 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golocalgal/internal/types"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const userDataVersion = 1
+
+const (
+	UserDataFormatJson = "json"
+	UserDataFormatCsv  = "csv"
+)
+
+// Import conflict policies, for entries that already have a value in the database
+const (
+	ImportPolicyKeep       = "keep"        // only fill in ratings that are unset; tags and ignores are only added
+	ImportPolicyOverwrite  = "overwrite"   // make the database match the import exactly
+	ImportPolicyKeepHigher = "keep-higher" // like keep, but a higher imported rating replaces a lower one
+)
+
+var userDataCsvHeader = []string{"type", "ripper_host", "gid", "urlid", "filename", "local_rating", "ignored", "local_tags"}
+
+func checkUserDataFormat(format string) error {
+	if format != UserDataFormatJson && format != UserDataFormatCsv {
+		return fmt.Errorf("invalid format %q, must be %q or %q", format, UserDataFormatJson, UserDataFormatCsv)
+	}
+	return nil
+}
+
+func checkImportPolicy(policy string) error {
+	switch policy {
+	case ImportPolicyKeep, ImportPolicyOverwrite, ImportPolicyKeepHigher:
+		return nil
+	}
+	return fmt.Errorf("invalid policy %q, must be %q, %q, or %q", policy, ImportPolicyKeep, ImportPolicyOverwrite, ImportPolicyKeepHigher)
+}
+
+// getUserData reads every gallery and file that has a local rating, local tags, or is ignored
+func (app *App) getUserData(ctx context.Context) (types.UserData, error) {
+	data := types.UserData{
+		Version:    userDataVersion,
+		ExportedTs: time.Now().UnixMilli(),
+		Galleries:  []types.UserDataGallery{},
+		Files:      []types.UserDataFile{},
+	}
+	err := app.withSQL(ctx, func(ctx context.Context) error {
+		//language=sqlite
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT r.host
+			     , a.gid
+			     , a.local_rating
+			     , (SELECT json_group_array(name)
+			          FROM (SELECT t.name
+			                  FROM map_album_tag mat
+			                  JOIN tag t ON t.tag_id = mat.tag_id
+			                 WHERE mat.album_id = a.album_id
+			                   AND t.local = 1
+			                 ORDER BY t.name)) AS local_tags
+			  FROM album a
+			  JOIN ripper r ON r.ripper_id = a.ripper_id
+			 WHERE a.local_rating IS NOT NULL
+			    OR EXISTS (SELECT 1
+			                 FROM map_album_tag mat
+			                 JOIN tag t ON t.tag_id = mat.tag_id
+			                WHERE mat.album_id = a.album_id
+			                  AND t.local = 1)
+			 ORDER BY r.host, a.gid
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var g types.UserDataGallery
+			var tags string
+			if err := rows.Scan(&g.RipperHost, &g.Gid, &g.LocalRating, &tags); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(tags), &g.LocalTags); err != nil {
+				return err
+			}
+			data.Galleries = append(data.Galleries, g)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return data, err
+	}
+
+	err = app.withSQL(ctx, func(ctx context.Context) error {
+		//language=sqlite
+		rows, err := app.Db.QueryContext(ctx, `
+			SELECT r.host
+			     , COALESCE(rf.urlid, '')
+			     , COALESCE(rf.filename, '')
+			     , rf.local_rating
+			     , rf.ignored
+			     , (SELECT json_group_array(name)
+			          FROM (SELECT t.name
+			                  FROM map_remote_file_tag mrft
+			                  JOIN tag t ON t.tag_id = mrft.tag_id
+			                 WHERE mrft.remote_file_id = rf.remote_file_id
+			                   AND t.local = 1
+			                 ORDER BY t.name)) AS local_tags
+			  FROM remote_file rf
+			  JOIN ripper r ON r.ripper_id = rf.ripper_id
+			 WHERE rf.local_rating IS NOT NULL
+			    OR rf.ignored = 1
+			    OR EXISTS (SELECT 1
+			                 FROM map_remote_file_tag mrft
+			                 JOIN tag t ON t.tag_id = mrft.tag_id
+			                WHERE mrft.remote_file_id = rf.remote_file_id
+			                  AND t.local = 1)
+			 ORDER BY r.host, rf.urlid, rf.filename
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var f types.UserDataFile
+			var tags string
+			if err := rows.Scan(&f.RipperHost, &f.Urlid, &f.Filename, &f.LocalRating, &f.Ignored, &tags); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(tags), &f.LocalTags); err != nil {
+				return err
+			}
+			data.Files = append(data.Files, f)
+		}
+		return rows.Err()
+	})
+	return data, err
+}
+
+func writeUserData(w io.Writer, data types.UserData, format string) error {
+	if format == UserDataFormatCsv {
+		return writeUserDataCsv(w, data)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+// writeUserDataCsv writes one row per gallery or file. Tags are joined with commas, which tag names can't contain.
+func writeUserDataCsv(w io.Writer, data types.UserData) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(userDataCsvHeader); err != nil {
+		return err
+	}
+	for _, g := range data.Galleries {
+		if err := cw.Write([]string{"gallery", g.RipperHost, g.Gid, "", "", ratingString(g.LocalRating.NullInt64).String, "", strings.Join(g.LocalTags, ",")}); err != nil {
+			return err
+		}
+	}
+	for _, f := range data.Files {
+		if err := cw.Write([]string{"file", f.RipperHost, "", f.Urlid, f.Filename, ratingString(f.LocalRating.NullInt64).String, boolString(f.Ignored).String, strings.Join(f.LocalTags, ",")}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readUserData(r io.Reader, format string) (types.UserData, error) {
+	var data types.UserData
+	if format == UserDataFormatCsv {
+		return readUserDataCsv(r)
+	}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return data, fmt.Errorf("unable to read user data: %w", err)
+	}
+	if data.Version > userDataVersion {
+		return data, fmt.Errorf("user data version is newer than this version of localgal supports. supported: %d; found: %d", userDataVersion, data.Version)
+	}
+	return data, nil
+}
+
+func readUserDataCsv(r io.Reader) (types.UserData, error) {
+	data := types.UserData{Version: userDataVersion}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(userDataCsvHeader)
+	header, err := cr.Read()
+	if err != nil {
+		return data, fmt.Errorf("unable to read user data header: %w", err)
+	}
+	if !slices.Equal(header, userDataCsvHeader) {
+		return data, fmt.Errorf("unexpected user data header, expected: %s", strings.Join(userDataCsvHeader, ","))
+	}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return data, fmt.Errorf("unable to read user data: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		_, rating, err := parseRating(record[5])
+		if err != nil {
+			return data, fmt.Errorf("line %d: %w", line, err)
+		}
+		var tags []string
+		if record[7] != "" {
+			tags = strings.Split(record[7], ",")
+		}
+		switch record[0] {
+		case "gallery":
+			data.Galleries = append(data.Galleries, types.UserDataGallery{
+				RipperHost:  record[1],
+				Gid:         record[2],
+				LocalRating: types.SqlJsonInt64{NullInt64: rating},
+				LocalTags:   tags,
+			})
+		case "file":
+			data.Files = append(data.Files, types.UserDataFile{
+				RipperHost:  record[1],
+				Urlid:       record[3],
+				Filename:    record[4],
+				LocalRating: types.SqlJsonInt64{NullInt64: rating},
+				Ignored:     record[6] == "1",
+				LocalTags:   tags,
+			})
+		default:
+			return data, fmt.Errorf("line %d: invalid type %q, must be \"gallery\" or \"file\"", line, record[0])
+		}
+	}
+	return data, nil
+}
+
+// checkUserData validates the imported values before anything is written
+func checkUserData(data types.UserData) error {
+	check := func(kind string, key string, rating types.SqlJsonInt64, tags []string) error {
+		if rating.Valid && (rating.Int64 < 1 || rating.Int64 > 5) {
+			return fmt.Errorf("%s %s: invalid rating %d, must be 1-5", kind, key, rating.Int64)
+		}
+		for _, tag := range tags {
+			if err := checkTagName(tag); err != nil {
+				return fmt.Errorf("%s %s: %w", kind, key, err)
+			}
+		}
+		return nil
+	}
+	for _, g := range data.Galleries {
+		if g.RipperHost == "" || g.Gid == "" {
+			return fmt.Errorf("gallery entries need a ripper host and gid")
+		}
+		if err := check("gallery", g.RipperHost+"/"+g.Gid, g.LocalRating, g.LocalTags); err != nil {
+			return err
+		}
+	}
+	for _, f := range data.Files {
+		if f.RipperHost == "" || (f.Urlid == "" && f.Filename == "") {
+			return fmt.Errorf("file entries need a ripper host and urlid or filename")
+		}
+		if err := check("file", f.RipperHost+"/"+f.Urlid+f.Filename, f.LocalRating, f.LocalTags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupUserDataFiles finds the files of each imported entry: by urlid if it has one, otherwise by filename.
+// Neither is unique in the RipMe schema, so every match is returned. The result is keyed by the index of the entry.
+// remote_file isn't indexed by urlid or filename, so the entries go in an indexed temp table, and remote_file is scanned once.
+func lookupUserDataFiles(ctx context.Context, tx *sql.Tx, files []types.UserDataFile) (map[int][]auditEntity, error) {
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE import_file AS
+		SELECT j.key
+		     , json_extract(j.value, '$.ripperHost')           AS host
+		     , COALESCE(json_extract(j.value, '$.urlid'), '')    AS urlid
+		     , COALESCE(json_extract(j.value, '$.filename'), '') AS filename
+		  FROM json_each(?) j;
+		CREATE INDEX temp.import_file_urlid ON import_file (host, urlid);
+		CREATE INDEX temp.import_file_filename ON import_file (host, filename);
+	`, jsonArray(files)); err != nil {
+		return nil, err
+	}
+	defer tx.ExecContext(ctx, "DROP TABLE temp.import_file")
+
+	//language=sqlite
+	rows, err := tx.QueryContext(ctx, `
+		SELECT e.key
+		     , rf.remote_file_id
+		     , r.host
+		  FROM import_file e
+		  JOIN ripper r ON r.host = e.host
+		  JOIN remote_file rf ON rf.ripper_id = r.ripper_id AND rf.urlid = e.urlid
+		 WHERE e.urlid != ''
+		 UNION ALL
+		SELECT e.key
+		     , rf.remote_file_id
+		     , r.host
+		  FROM import_file e
+		  JOIN ripper r ON r.host = e.host
+		  JOIN remote_file rf ON rf.ripper_id = r.ripper_id AND rf.filename = e.filename
+		 WHERE e.urlid = ''
+		 ORDER BY 1, 2
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entities := map[int][]auditEntity{}
+	for rows.Next() {
+		var i int
+		e := auditEntity{Type: auditEntityFile}
+		if err := rows.Scan(&i, &e.Id, &e.RipperHost); err != nil {
+			return nil, err
+		}
+		e.Key = strconv.FormatInt(e.Id, 10)
+		entities[i] = append(entities[i], e)
+	}
+	return entities, rows.Err()
+}
+
+// importRatingTx applies an imported rating according to the conflict policy
+func importRatingTx(ctx context.Context, tx *sql.Tx, e auditEntity, rating sql.NullInt64, policy string, changes *auditChanges) error {
+	if policy == ImportPolicyOverwrite {
+		return setRatingTx(ctx, tx, e, rating, changes)
+	}
+	if !rating.Valid {
+		return nil
+	}
+	table, idColumn := e.table()
+	var current sql.NullInt64
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT local_rating
+		  FROM %s
+		 WHERE %s = ?
+	`, table, idColumn), e.Id).Scan(&current); err != nil {
+		return err
+	}
+	if !current.Valid || (policy == ImportPolicyKeepHigher && rating.Int64 > current.Int64) {
+		return setRatingTx(ctx, tx, e, rating, changes)
+	}
+	return nil
+}
+
+// importTagsTx adds the imported local tags. With the overwrite policy, local tags missing from the import are removed.
+func importTagsTx(ctx context.Context, tx *sql.Tx, e auditEntity, tags []string, policy string, changes *auditChanges) error {
+	var remove []string
+	if policy == ImportPolicyOverwrite {
+		mapTable, idColumn := e.mapTable()
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+			SELECT t.name
+			  FROM %s m
+			  JOIN tag t ON t.tag_id = m.tag_id
+			 WHERE m.%s = ?
+			   AND t.local = 1
+		`, mapTable, idColumn), e.Id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			if !slices.Contains(tags, name) {
+				remove = append(remove, name)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return editLocalTagsTx(ctx, tx, e, tags, remove, changes)
+}
+
+// importUserData applies user data to the RipMe database. Changes are recorded in the audit log, so an import can be undone from the history page.
+// With dryRun, nothing is written and the result lists the changes that would be made.
+func (app *App) importUserData(ctx context.Context, client string, data types.UserData, policy string, dryRun bool) (types.UserDataImportResult, error) {
+	result := types.UserDataImportResult{
+		DryRun:    dryRun,
+		Policy:    policy,
+		Galleries: len(data.Galleries),
+		Files:     len(data.Files),
+	}
+	if err := checkImportPolicy(policy); err != nil {
+		return result, err
+	}
+	if err := checkUserData(data); err != nil {
+		return result, err
+	}
+	changes, err := app.writeAuditedAs(ctx, client, dryRun, func(ctx context.Context, tx *sql.Tx, changes *auditChanges) error {
+		for _, g := range data.Galleries {
+			e, err := lookupGalleryEntity(ctx, tx, g.RipperHost, g.Gid)
+			if errors.Is(err, sql.ErrNoRows) {
+				result.NotFound++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := importRatingTx(ctx, tx, e, g.LocalRating.NullInt64, policy, changes); err != nil {
+				return err
+			}
+			if err := importTagsTx(ctx, tx, e, g.LocalTags, policy, changes); err != nil {
+				return err
+			}
+		}
+		matches, err := lookupUserDataFiles(ctx, tx, data.Files)
+		if err != nil {
+			return err
+		}
+		for i, f := range data.Files {
+			entities := matches[i]
+			if len(entities) == 0 {
+				result.NotFound++
+				continue
+			}
+			for _, e := range entities {
+				if err := importRatingTx(ctx, tx, e, f.LocalRating.NullInt64, policy, changes); err != nil {
+					return err
+				}
+				if f.Ignored || policy == ImportPolicyOverwrite {
+					if err := setFileIgnoredTx(ctx, tx, e, f.Ignored, changes); err != nil {
+						return err
+					}
+				}
+				if err := importTagsTx(ctx, tx, e, f.LocalTags, policy, changes); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if changes == nil {
+		changes = auditChanges{}
+	}
+	for i := range changes {
+		c := &changes[i]
+		if c.HrefEntity == "" {
+			c.HrefEntity = entityHref(c.EntityType, c.RipperHost, c.EntityKey)
+		}
+	}
+	result.Changes = changes
+	return result, err
+}
+
+func (app *App) handleExportUserData(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = UserDataFormatJson
+	}
+	if err := checkUserDataFormat(format); err != nil {
+		app.renderError(r.Context(), w, &types.Perf{}, http.StatusBadRequest, err)
+		return
+	}
+	p, err := app.perfTracker(r.Context(), func(ctx context.Context, perf *types.Perf) error {
+		data, err := app.getUserData(ctx)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="localgal-user-data.%s"`, format))
+		if format == UserDataFormatCsv {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			return writeUserDataCsv(w, data)
+		}
+		app.render(ctx, w, "", &data)
+		return nil
+	})
+	if err != nil {
+		app.renderError(r.Context(), w, &p, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// openUserDataApp opens the databases needed to export or import user data from the command line
+func openUserDataApp(ctx context.Context, cfg Config, write bool) (*App, error) {
+	app := &App{SlowSqlMs: cfg.SlowSqlMs}
+	dsn := DsnWithDefaultTimeout(cfg.Dsn)
+	dsn = DsnWithForeignKeys(dsn)
+	var err error
+	app.Db, err = GetDb(DsnWithReadOnly(dsn), "read-only")
+	if err != nil {
+		return nil, err
+	}
+	if !write {
+		return app, nil
+	}
+	app.DbRw, err = GetDb(DsnWithReadWrite(dsn), "read-write")
+	if err != nil {
+		app.closeDbs()
+		return nil, err
+	}
+	app.DbRw.SetMaxOpenConns(1)
+	localDsn := DsnWithDefaultTimeout(cfg.LocalDsn)
+	localDsn = DsnWithForeignKeys(localDsn)
+	app.LocalDb, err = GetLocalDb(ctx, localDsn)
+	if err != nil {
+		log.Printf("open local db: %v (the import won't be recorded in history)", err)
+	}
+	return app, nil
+}
+
+func (app *App) closeDbs() {
+	for _, db := range []*sql.DB{app.Db, app.DbRw, app.LocalDb} {
+		if db != nil {
+			_ = db.Close()
+		}
+	}
+}
+
+// ExportUserData writes local ratings, local tags, and ignored files to w as JSON or CSV
+func ExportUserData(ctx context.Context, cfg Config, w io.Writer, format string) error {
+	if err := checkUserDataFormat(format); err != nil {
+		return err
+	}
+	app, err := openUserDataApp(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer app.closeDbs()
+	data, err := app.getUserData(ctx)
+	if err != nil {
+		return err
+	}
+	return writeUserData(w, data, format)
+}
+
+// ImportUserData reads user data exported by ExportUserData and applies it with the given conflict policy.
+// With dryRun, nothing is written and the result lists the changes that would be made.
+func ImportUserData(ctx context.Context, cfg Config, r io.Reader, format string, policy string, dryRun bool) (types.UserDataImportResult, error) {
+	if err := checkUserDataFormat(format); err != nil {
+		return types.UserDataImportResult{}, err
+	}
+	if err := checkImportPolicy(policy); err != nil {
+		return types.UserDataImportResult{}, err
+	}
+	if cfg.ReadOnly && !dryRun {
+		return types.UserDataImportResult{}, fmt.Errorf("unable to import in read-only mode")
+	}
+	data, err := readUserData(r, format)
+	if err != nil {
+		return types.UserDataImportResult{}, err
+	}
+	app, err := openUserDataApp(ctx, cfg, true)
+	if err != nil {
+		return types.UserDataImportResult{}, err
+	}
+	defer app.closeDbs()
+	return app.importUserData(ctx, "cli", data, policy, dryRun)
+}
@@ -23,7 +23,10 @@ func atoiDefault(s string, def int) int {
 
 func getPageParams(w http.ResponseWriter, r *http.Request, url *url.URL) (page, size int) {
 	defaultPageSize := DefaultPageSize
-	defaultSize, err := r.Cookie("defaultPageSize")
+	if profileSize := getRequestProfile(r.Context()).Profile.PageSize; profileSize > 0 {
+		defaultPageSize = profileSize
+	}
+	defaultSize, err := getDefaultCookie(r, "defaultPageSize")
 	if err == nil {
 		defaultPageSize = atoiDefault(defaultSize.Value, defaultPageSize)
 	}
@@ -42,6 +42,21 @@ func (f FileTypeFilter) Active() bool {
 	return f.Type != FileTypeAll
 }
 
+// FilterProfile is a named set of filter, sort, and page size defaults stored by LocalGal.
+// Zero values mean "no default", the same as an absent cookie.
+type FilterProfile struct {
+	Name                string         `json:"name"`
+	GalleryRatingFilter RatingFilter   `json:"galleryRatingFilter,omitzero"`
+	FileRatingFilter    RatingFilter   `json:"fileRatingFilter,omitzero"`
+	FileTypeFilter      FileTypeFilter `json:"fileTypeFilter,omitzero"`
+	SortGalleries       string         `json:"sortGalleries,omitempty,omitzero"`
+	SortFiles           string         `json:"sortFiles,omitempty,omitzero"`
+	SortSearchGalleries string         `json:"sortSearchGalleries,omitempty,omitzero"`
+	SortSearchFiles     string         `json:"sortSearchFiles,omitempty,omitzero"`
+	PageSize            int            `json:"pageSize,omitempty,omitzero"`
+	UpdatedTs           int64          `json:"updatedTs,omitempty,omitzero"`
+}
+
 type Album struct {
 	AlbumId     int64         `json:"albumId,omitempty,omitzero"`
 	RipperId    int64         `json:"-"`
@@ -62,7 +77,10 @@ type Album struct {
 	FileCount   int           `json:"fileCount,omitempty,omitzero"`
 	Bytes       int64         `json:"bytes,omitempty,omitzero"`
 	HrefPage    string        `json:"hrefPage,omitempty,omitzero"`
-	Thumb       File          `json:"thumb,omitempty,omitzero"` // representative file for album thumbnail tile
+	Thumb       File          `json:"thumb,omitempty,omitzero"`       // representative file for album thumbnail tile
+	CoverFileId SqlJsonInt64  `json:"coverFileId,omitempty,omitzero"` // chosen cover; null when the cover rule picks the thumbnail
+	LocalTitle  SqlJsonString `json:"localTitle,omitempty,omitzero"`  // shown instead of Title
+	Notes       SqlJsonString `json:"notes,omitempty,omitzero"`
 }
 
 type File struct {
@@ -78,12 +96,15 @@ type File struct {
 	Uploader    SqlJsonString `json:"uploader,omitempty,omitzero"`
 	Hidden      bool          `json:"hidden,omitempty,omitzero"`
 	Removed     bool          `json:"removed,omitempty,omitzero"`
+	Ignored     bool          `json:"ignored,omitempty,omitzero"` // only loaded where ignored files are included
 	Bytes       SqlJsonInt64  `json:"bytes,omitempty,omitzero"`
 	LocalRating SqlJsonInt64  `json:"localRating,omitempty,omitzero"`
 	InsertedTs  int64         `json:"insertedTs,omitempty,omitzero"`
 	HrefPage    string        `json:"hrefPage,omitempty,omitzero"`
 	HrefMedia   string        `json:"hrefMedia,omitempty,omitzero"`
 	AlbumId     int64         `json:"-"`
+	LocalTitle  SqlJsonString `json:"localTitle,omitempty,omitzero"` // shown instead of Title
+	Notes       SqlJsonString `json:"notes,omitempty,omitzero"`
 }
 
 type Tag struct {
@@ -93,6 +114,145 @@ type Tag struct {
 	Count   int    `json:"count,omitempty,omitzero"` // optional usage count for tag listings
 }
 
+// TagAlias makes a tag count as its canonical tag
+type TagAlias struct {
+	Alias     string `json:"alias"`
+	Canonical string `json:"canonical"`
+}
+
+// TagImplication makes everything tagged with Child count as tagged with Parent too
+type TagImplication struct {
+	Child  string `json:"child"`
+	Parent string `json:"parent"`
+}
+
+// BlockedUploader is an uploader of a ripper host that is on the blocklist
+type BlockedUploader struct {
+	RipperHost string `json:"ripperHost"`
+	Uploader   string `json:"uploader"`
+}
+
+// BlockedGallery is a gallery that is on the blocklist. Title is empty when the gallery is no longer in the RipMe database.
+type BlockedGallery struct {
+	AlbumId    int64         `json:"albumId"`
+	RipperHost string        `json:"ripperHost,omitempty"`
+	Gid        string        `json:"gid,omitempty"`
+	Title      SqlJsonString `json:"title,omitempty,omitzero"`
+}
+
+// TagMergeSuggestion lists tags whose names normalise to the same key, with the most used tag as the canonical one
+type TagMergeSuggestion struct {
+	Key       string `json:"key"`
+	Canonical Tag    `json:"canonical"`
+	Aliases   []Tag  `json:"aliases"`
+}
+
+// UserData is the user data that LocalGal keeps in the RipMe database: local ratings, local tags, and ignored files.
+// Entries are keyed by ripper host and gid or urlid/filename rather than row ids, so they can be imported into a rebuilt database.
+type UserData struct {
+	Version    int               `json:"version"`
+	ExportedTs int64             `json:"exportedTs"`
+	Galleries  []UserDataGallery `json:"galleries"`
+	Files      []UserDataFile    `json:"files"`
+}
+
+type UserDataGallery struct {
+	RipperHost  string       `json:"ripperHost"`
+	Gid         string       `json:"gid"`
+	LocalRating SqlJsonInt64 `json:"localRating,omitzero"`
+	LocalTags   []string     `json:"localTags,omitempty"`
+}
+
+type UserDataFile struct {
+	RipperHost  string       `json:"ripperHost"`
+	Urlid       string       `json:"urlid,omitempty"`    // preferred key on import
+	Filename    string       `json:"filename,omitempty"` // key on import when there is no urlid
+	LocalRating SqlJsonInt64 `json:"localRating,omitzero"`
+	Ignored     bool         `json:"ignored,omitempty"`
+	LocalTags   []string     `json:"localTags,omitempty"`
+}
+
+// UserDataImportResult reports what an import changed, or would change in a dry run
+type UserDataImportResult struct {
+	DryRun    bool           `json:"dryRun"`
+	Policy    string         `json:"policy"`
+	Galleries int            `json:"galleries"` // gallery entries read
+	Files     int            `json:"files"`     // file entries read
+	NotFound  int            `json:"notFound"`  // entries that match nothing in the database
+	Changes   []HistoryEntry `json:"changes"`
+}
+
+// ExportGallery is one line of the galleries NDJSON export
+type ExportGallery struct {
+	Album
+	Tags []Tag `json:"tags"`
+}
+
+// ExportFile is one line of the files NDJSON export
+type ExportFile struct {
+	File
+	AlbumIds []int64 `json:"albumIds"` // galleries the file is in, by the albumId of the galleries export
+	Tags     []Tag   `json:"tags"`
+}
+
+// ExportTag is one line of the tags NDJSON export
+type ExportTag struct {
+	Tag
+	GalleryCount int `json:"galleryCount"`
+	FileCount    int `json:"fileCount"`
+}
+
+// GalleriesEvent is sent on /api/events when galleries are added to the database
+type GalleriesEvent struct {
+	Count     int     `json:"count"`
+	Galleries []Album `json:"galleries"` // the first of the new galleries, oldest first
+}
+
+// FilesEvent is sent on /api/events when files are added to the database
+type FilesEvent struct {
+	Count int `json:"count"`
+}
+
+// FileScore is the Elo score of a file, from pairwise comparisons
+type FileScore struct {
+	FileId      int64   `json:"fileId"`
+	Score       float64 `json:"score"`
+	Comparisons int     `json:"comparisons"`
+	Wins        int     `json:"wins"`
+	UpdatedTs   int64   `json:"updatedTs,omitzero"`
+}
+
+// Collection is a user-curated, ordered list of files from any galleries
+type Collection struct {
+	CollectionId int64        `json:"collectionId"`
+	Name         string       `json:"name"`
+	Builtin      string       `json:"builtin,omitempty,omitzero"` // "favorites" for the built-in favorites collection, which can't be deleted
+	CoverFileId  SqlJsonInt64 `json:"coverFileId,omitempty,omitzero"`
+	FileCount    int          `json:"fileCount"` // includes ignored files, like gallery tiles
+	CreatedTs    int64        `json:"createdTs"`
+	UpdatedTs    int64        `json:"updatedTs"`
+	Thumb        File         `json:"thumb,omitzero"`
+	HrefPage     string       `json:"hrefPage,omitempty,omitzero"`
+	Contains     bool         `json:"contains,omitempty,omitzero"` // whether the file being viewed is in the collection
+}
+
+// HistoryEntry is one change recorded in the audit log
+type HistoryEntry struct {
+	AuditId    int64         `json:"auditId"`
+	Ts         int64         `json:"ts"`
+	EntityType string        `json:"entityType"` // "file" or "gallery"
+	EntityId   int64         `json:"entityId"`   // remote_file_id or album_id
+	RipperHost string        `json:"ripperHost"`
+	EntityKey  string        `json:"entityKey"` // file id or gid, as used in page URLs
+	Field      string        `json:"field"`     // "local_rating", "ignored", "tag", "title", "notes", or "cover"
+	OldValue   SqlJsonString `json:"oldValue"`
+	NewValue   SqlJsonString `json:"newValue"`
+	ClientAddr string        `json:"clientAddr"`
+	UndoOf     SqlJsonInt64  `json:"undoOf,omitzero"`   // entry that this change undid
+	UndoneTs   SqlJsonInt64  `json:"undoneTs,omitzero"` // when this change was undone
+	HrefEntity string        `json:"hrefEntity,omitempty,omitzero"`
+}
+
 type User struct {
 	UserName   string `json:"userName"`
 	RipperHost string `json:"ripperHost"`
@@ -127,6 +287,14 @@ func (v SqlJsonInt64) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal(v.Int64)
 }
+func (v *SqlJsonInt64) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = SqlJsonInt64{}
+		return nil
+	}
+	v.Valid = true
+	return json.Unmarshal(data, &v.Int64)
+}
 
 type Perf struct {
 	SQLCount int           `json:"sqlCount"`
@@ -6,6 +6,14 @@ type BasePage struct {
 	GalleryRatingFilter RatingFilter   `json:"galleryRatingFilter,omitzero"`
 	FileRatingFilter    RatingFilter   `json:"fileRatingFilter,omitzero"`
 	FileTypeFilter      FileTypeFilter `json:"fileTypeFilter,omitzero"`
+	Profile             string         `json:"profile,omitempty,omitzero"` // name of the active filter profile
+	ProfileNames        []string       `json:"-"`
+	SelectMode          bool           `json:"-"` // show checkboxes on file tiles for bulk actions
+	SelectToggleHref    string         `json:"-"` // current page with selection mode toggled
+	Notice              string         `json:"-"` // one-off message, such as the result of a bulk action
+	CSRFToken           string         `json:"-"` // embedded by forms, see checkCSRF
+	CSPNonce            string         `json:"-"` // embedded by scripts, see withSecurityHeaders
+	Here                string         `json:"-"` // path and query of the page, which forms send as next to come back to
 }
 
 type BasePager interface {
@@ -17,13 +25,15 @@ func (b *BasePage) GetBasePage() *BasePage {
 }
 
 type BrowsePage struct {
-	Albums   []Album `json:"albums"`
-	Page     int     `json:"page"`
-	PageSize int     `json:"pageSize"`
-	Total    int     `json:"total"`
-	HasPrev  bool    `json:"hasPrev"`
-	HasNext  bool    `json:"hasNext"`
-	Sort     string  `json:"sort,omitempty,omitzero"`
+	Albums     []Album `json:"albums"`
+	Page       int     `json:"page"`
+	PageSize   int     `json:"pageSize"`
+	Total      int     `json:"total"`
+	HasPrev    bool    `json:"hasPrev"`
+	HasNext    bool    `json:"hasNext"`
+	NextCursor string  `json:"nextCursor,omitempty"` // keyset cursor of the next page, for the cursor query parameter
+	PrevCursor string  `json:"prevCursor,omitempty"`
+	Sort       string  `json:"sort,omitempty,omitzero"`
 	//Perf     Perf    `json:"perf"`
 	*BasePage
 }
@@ -37,11 +47,16 @@ type GalleryPage struct {
 	TotalUnfiltered int    `json:"totalUnfiltered"`
 	HasPrev         bool   `json:"hasPrev"`
 	HasNext         bool   `json:"hasNext"`
+	NextCursor      string `json:"nextCursor,omitempty"` // keyset cursor of the next page, for the cursor query parameter
+	PrevCursor      string `json:"prevCursor,omitempty"`
 	AlbumTags       []Tag  `json:"albumTags"`
 	AsyncFileTags   bool   `json:"-"`
 	FileTags        []Tag  `json:"fileTags"`
 	AlbumBytes      int64  `json:"albumBytes"`
+	IgnoredCount    int    `json:"ignoredCount"` // ignored files, which are excluded from TotalUnfiltered and AlbumBytes like unfetched files
+	IgnoredBytes    int64  `json:"ignoredBytes"`
 	Sort            string `json:"sort,omitempty,omitzero"`
+	CoverRule       string `json:"coverRule"` // picks the thumbnail when no cover is chosen
 	//Perf      Perf   `json:"perf"`
 	*BasePage
 }
@@ -59,6 +74,8 @@ type SearchPage struct {
 	TagsTotal      int     `json:"tagsTotal"`
 	HasNext        bool    `json:"hasNext"`
 	HasPrev        bool    `json:"hasPrev"`
+	NextCursor     string  `json:"nextCursor,omitempty"` // keyset cursor of the next page, for the cursor query parameter
+	PrevCursor     string  `json:"prevCursor,omitempty"`
 	Page           int     `json:"page"`
 	PageSize       int     `json:"pageSize"`
 	Sort           string  `json:"sort,omitempty,omitzero"`
@@ -74,16 +91,18 @@ type SearchErrorPage struct {
 }
 
 type FilePage struct {
-	File         File    `json:"file"`
-	Prev         []File  `json:"prev"`
-	Next         []File  `json:"next"`
-	FileTags     []Tag   `json:"fileTags"`
-	AsyncAlbums  bool    `json:"-"`
-	Albums       []Album `json:"albums"`
-	CurrentAlbum Album   `json:"currentAlbum"` // album when viewing within an album; nil for standalone
-	ShowPrevNext bool    `json:"showPrevNext"` // whether to show prev/next rail
-	Autoplay     bool    `json:"-"`
-	ForceFit     bool    `json:"-"`
+	File              File         `json:"file"`
+	Prev              []File       `json:"prev"`
+	Next              []File       `json:"next"`
+	FileTags          []Tag        `json:"fileTags"`
+	AsyncAlbums       bool         `json:"-"`
+	Albums            []Album      `json:"albums"`
+	CurrentAlbum      Album        `json:"currentAlbum"`                // album when viewing within an album; nil for standalone
+	CurrentCollection *Collection  `json:"currentCollection,omitempty"` // collection when viewing within a collection
+	Collections       []Collection `json:"collections,omitempty"`       // collections the file can be added to or removed from
+	ShowPrevNext      bool         `json:"showPrevNext"`                // whether to show prev/next rail
+	Autoplay          bool         `json:"-"`
+	ForceFit          bool         `json:"-"`
 	//Perf         Perf    `json:"perf"`
 	*BasePage
 }
@@ -97,6 +116,8 @@ type UserPage struct {
 	FilesTotal  int     `json:"filesTotal,omitempty,omitzero"`
 	HasNext     bool    `json:"hasNext"`
 	HasPrev     bool    `json:"hasPrev"`
+	NextCursor  string  `json:"nextCursor,omitempty"` // keyset cursor of the next page, for the cursor query parameter
+	PrevCursor  string  `json:"prevCursor,omitempty"`
 	Page        int     `json:"page"`
 	PageSize    int     `json:"pageSize"`
 	Sort        string  `json:"sort,omitempty,omitzero"`
@@ -112,19 +133,60 @@ type TagsPage struct {
 }
 
 type TagDetailPage struct {
-	Tag      Tag     `json:"tag"`
-	Albums   []Album `json:"albums"`
-	Files    []File  `json:"files"`
-	Page     int     `json:"page"`
-	PageSize int     `json:"pageSize"`
-	Total    int     `json:"total"`
-	HasPrev  bool    `json:"hasPrev"`
-	HasNext  bool    `json:"hasNext"`
+	Tag        Tag      `json:"tag"`
+	Aliases    []string `json:"aliases,omitempty"`  // tags that count as this tag
+	Parents    []string `json:"parents,omitempty"`  // tags that this tag implies
+	Children   []string `json:"children,omitempty"` // tags that imply this tag
+	Albums     []Album  `json:"albums"`
+	Files      []File   `json:"files"`
+	Sort       string   `json:"sort,omitempty,omitzero"` // of the files, and of their playlist
+	Page       int      `json:"page"`
+	PageSize   int      `json:"pageSize"`
+	Total      int      `json:"total"`
+	HasPrev    bool     `json:"hasPrev"`
+	HasNext    bool     `json:"hasNext"`
+	NextCursor string   `json:"nextCursor,omitempty"` // keyset cursor of the next page of albums, for the cursor query parameter
+	PrevCursor string   `json:"prevCursor,omitempty"`
 	//Perf     Perf    `json:"perf"`
 	*BasePage
 }
 
+type TagRelationsPage struct {
+	Aliases      []TagAlias           `json:"aliases"`
+	Implications []TagImplication     `json:"implications"`
+	Suggestions  []TagMergeSuggestion `json:"suggestions"`
+	Available    bool                 `json:"available"`
+	*BasePage
+}
+
+type BlocklistPage struct {
+	Tags      []string          `json:"tags"`
+	Uploaders []BlockedUploader `json:"uploaders"`
+	Hosts     []string          `json:"hosts"`
+	Galleries []BlockedGallery  `json:"galleries"`
+	Available bool              `json:"available"`
+	*BasePage
+}
+
+type CollectionsPage struct {
+	Collections []Collection `json:"collections"`
+	Available   bool         `json:"available"`
+	*BasePage
+}
+
+type CollectionPage struct {
+	Collection Collection `json:"collection"`
+	Files      []File     `json:"files"`
+	Page       int        `json:"page"`
+	PageSize   int        `json:"pageSize"`
+	Total      int        `json:"total"`
+	HasPrev    bool       `json:"hasPrev"`
+	HasNext    bool       `json:"hasNext"`
+	*BasePage
+}
+
 type StatsPage struct {
+	Catalogue     string `json:"catalogue"`
 	DbBytes       int64  `json:"dbBytes"`
 	SchemaVersion string `json:"schemaVersion"`
 	GalleryCount  int    `json:"galleryCount"`
@@ -134,9 +196,91 @@ type StatsPage struct {
 	*BasePage
 }
 
+type IgnoredPage struct {
+	Files    []File `json:"files"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+	Total    int    `json:"total"`
+	HasPrev  bool   `json:"hasPrev"`
+	HasNext  bool   `json:"hasNext"`
+	ReadOnly bool   `json:"readOnly"`
+	*BasePage
+}
+
+type HistoryPage struct {
+	Entries   []HistoryEntry `json:"entries"`
+	Page      int            `json:"page"`
+	PageSize  int            `json:"pageSize"`
+	Total     int            `json:"total"`
+	HasPrev   bool           `json:"hasPrev"`
+	HasNext   bool           `json:"hasNext"`
+	Available bool           `json:"available"`
+	ReadOnly  bool           `json:"readOnly"`
+	*BasePage
+}
+
+// UndoResultPage reports the result of undoing audit log entries
+type UndoResultPage struct {
+	Undone  int            `json:"undone"`
+	Skipped int            `json:"skipped"` // entries already undone, or whose value changed again since
+	Changes []HistoryEntry `json:"changes"`
+	*BasePage
+}
+
+// BulkResultPage reports the rows changed by a bulk action on files
+// ComparePage shows two files to choose the preferred one of
+type ComparePage struct {
+	Left        File      `json:"left"`
+	Right       File      `json:"right"`
+	LeftScore   FileScore `json:"leftScore"`
+	RightScore  FileScore `json:"rightScore"`
+	Comparisons int       `json:"comparisons"` // comparisons made so far
+	Scored      int       `json:"scored"`      // files with a score
+	Empty       bool      `json:"empty"`       // fewer than two files match the filters
+	Available   bool      `json:"available"`
+	ReadOnly    bool      `json:"readOnly"`
+	*BasePage
+}
+
+// CompareResultPage reports the scores after a comparison
+type CompareResultPage struct {
+	Winner FileScore `json:"winner"`
+	Loser  FileScore `json:"loser"`
+	*BasePage
+}
+
+type BulkResultPage struct {
+	Selected    int   `json:"selected"`
+	NotFound    int   `json:"notFound"`
+	Rated       int64 `json:"rated"`
+	Ignored     int64 `json:"ignored"` // files whose ignored flag changed
+	TagsAdded   int64 `json:"tagsAdded"`
+	TagsRemoved int64 `json:"tagsRemoved"`
+	Changed     int64 `json:"changed"` // sum of the above
+	*BasePage
+}
+
+type PreferencesPage struct {
+	Profiles           []FilterProfile `json:"profiles"`
+	Current            FilterProfile   `json:"current"` // currently effective defaults, from the active profile and cookies
+	Edit               FilterProfile   `json:"-"`       // prefilled values for the profile form
+	Available          bool            `json:"available"`
+	GallerySorts       []string        `json:"-"`
+	FileSorts          []string        `json:"-"`
+	GallerySearchSorts []string        `json:"-"`
+	FileSearchSorts    []string        `json:"-"`
+	*BasePage
+}
+
 type ErrorPage struct {
 	StatusText string `json:"statusText"`
 	Message    string `json:"message"`
 	//Perf       Perf   `json:"perf"`
 	*BasePage
 }
+
+type LoginPage struct {
+	Next    string // page to go to after logging in
+	Message string
+	*BasePage
+}
@@ -31,15 +31,22 @@ func (key Env) Key() string {
 }
 
 const (
-	EnvBind        Env = "BIND"
-	EnvSqliteDsn   Env = "SQLITE_DSN"
-	EnvSlowSqlMs   Env = "SLOW_SQL_MS"
-	EnvMediaRoot   Env = "MEDIA_ROOT"
-	EnvDflog       Env = "DFLOG"
-	EnvDflogRoot   Env = "DFLOG_ROOT"
-	EnvGui         Env = "GUI"
-	EnvRo          Env = "RO"
-	EnvCorsOrigins Env = "CORS_ORIGINS"
+	EnvBind           Env = "BIND"
+	EnvBaseUrl        Env = "BASE_URL"
+	EnvSqliteDsn      Env = "SQLITE_DSN"
+	EnvSlowSqlMs      Env = "SLOW_SQL_MS"
+	EnvMediaRoot      Env = "MEDIA_ROOT"
+	EnvDflog          Env = "DFLOG"
+	EnvDflogRoot      Env = "DFLOG_ROOT"
+	EnvFollowSymlinks Env = "FOLLOW_SYMLINKS"
+	EnvGui            Env = "GUI"
+	EnvRo             Env = "RO"
+	EnvCorsOrigins    Env = "CORS_ORIGINS"
+	EnvLocalDsn       Env = "LOCALGAL_DSN"
+	EnvCoverRule      Env = "COVER_RULE"
+	EnvAuthSecret     Env = "AUTH_SECRET"
+	EnvAuthLoopback   Env = "AUTH_LOOPBACK"
+	EnvCatalogue      Env = "CATALOGUE"
 )
 
 // Global variables
@@ -53,3 +60,8 @@ var RoFlag struct {
 	IsSet bool
 	Value bool
 }
+
+var AuthSecretFlag struct {
+	IsSet bool
+	Value string
+}
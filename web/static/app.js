@@ -104,7 +104,7 @@
                     // TODO show popup?
                     return;
                 }
-                document.location = '/random/page';
+                document.location = '/random/page?from=' + encodeURIComponent(location.pathname + location.search);
                 break;
 
             case 'f':
@@ -141,6 +141,12 @@
                 }
             // fallthrough
             case 'h':
+                // On the compare page, choose the left file
+                const compareLeftEl = document.querySelector('form.form-compare-left button');
+                if (compareLeftEl) {
+                    compareLeftEl.click();
+                    break;
+                }
                 let prevFileEl = document.querySelector('.pv-rail .pv-prev a:last-child');
                 let prevPageEl = document.querySelector('a.pager-prev');
                 if (prevFileEl) {
@@ -157,6 +163,12 @@
                 }
             // fallthrough
             case 'l':
+                // On the compare page, choose the right file
+                const compareRightEl = document.querySelector('form.form-compare-right button');
+                if (compareRightEl) {
+                    compareRightEl.click();
+                    break;
+                }
                 let nextFileEl = document.querySelector('.pv-rail .pv-next a:first-child');
                 let nextPageEl = document.querySelector('a.pager-next');
                 if (nextFileEl) {
@@ -183,6 +195,22 @@
                 }
                 break;
 
+            case 'x':
+                // Only on file pages; the gallery form ignores every file in the gallery
+                const ignoreBtnEl = document.querySelector('form.form-ignore-file button[name="ignored"][value="1"]');
+                if (ignoreBtnEl) {
+                    ignoreBtnEl.click();
+                }
+                break;
+
+            case 's':
+                // Toggle the built-in favorites collection on file pages
+                const favoriteBtnEl = document.querySelector('form.form-favorite button');
+                if (favoriteBtnEl) {
+                    favoriteBtnEl.click();
+                }
+                break;
+
             // Keyboard navigation QoL: scroll up/down by half a screen instead of a full screen
             case 'PageDown':
                 window.scrollBy({ top: window.innerHeight / 2, behavior: 'smooth' });
@@ -485,15 +513,68 @@
         }
     }
 
+    // Live updates: count the galleries added while the galleries page is open, from /api/events
+    let liveUpdatesSource = null;
+
+    function setupLiveUpdates() {
+        const checkbox = document.getElementById('live-updates-checkbox');
+        const bannerEl = document.getElementById('live-updates-banner');
+        const savedState = localStorage.getItem('liveUpdatesChecked');
+        if (savedState) {
+            checkbox.checked = JSON.parse(savedState);
+        }
+        checkbox.addEventListener('change', function () {
+            localStorage.setItem('liveUpdatesChecked', JSON.stringify(this.checked));
+            toggleLiveUpdates(this.checked, bannerEl);
+        });
+        toggleLiveUpdates(checkbox.checked, bannerEl);
+    }
+
+    function toggleLiveUpdates(on, bannerEl) {
+        if (!bannerEl) {
+            return;
+        }
+        if (!on) {
+            if (liveUpdatesSource) {
+                liveUpdatesSource.close();
+                liveUpdatesSource = null;
+            }
+            bannerEl.hidden = true;
+            return;
+        }
+        if (liveUpdatesSource) {
+            return;
+        }
+        let newCount = 0;
+        liveUpdatesSource = new EventSource('/api/events');
+        liveUpdatesSource.addEventListener('galleries', event => {
+            newCount += JSON.parse(event.data).count;
+            // The newest galleries are on the first page
+            const url = new URL(window.location.href);
+            url.searchParams.delete('cursor');
+            url.searchParams.delete('page');
+            const linkEl = document.createElement('a');
+            linkEl.href = url.toString();
+            linkEl.textContent = `${newCount} new ${newCount === 1 ? 'gallery' : 'galleries'} \u2014 refresh`;
+            bannerEl.replaceChildren(linkEl);
+            bannerEl.hidden = false;
+        });
+    }
+
     function setupAsyncLocalRating() {
         document.querySelectorAll('form.form-local-rating').forEach(formEl => {
             formEl.addEventListener('submit', async event => {
                 event.preventDefault();
                 const rating = event.submitter.value;
+                const body = new URLSearchParams({rating: rating});
+                const csrfEl = formEl.querySelector('input[name="csrf"]');
+                if (csrfEl) {
+                    body.set('csrf', csrfEl.value);
+                }
                 fetch(formEl.action, {
                     method: 'POST',
                     headers: {'Content-Type': 'application/x-www-form-urlencoded'},
-                    body: new URLSearchParams({rating: rating}),
+                    body: body,
                     redirect: 'manual',
                 })
                     .then(res => {
@@ -520,6 +601,41 @@
         });
     }
 
+    function setupBulkSelect() {
+        const formEl = document.querySelector('form#bulk-form');
+        if (!formEl) {
+            return;
+        }
+        const boxes = Array.from(document.querySelectorAll('input[type=checkbox][name=file_id][form=bulk-form]'));
+        const countEl = formEl.querySelector('.bulk-count');
+        const updateCount = () => {
+            countEl.textContent = boxes.filter(box => box.checked).length;
+        };
+        // Shift+click sets every checkbox between the last clicked one and this one
+        let lastIndex = -1;
+        boxes.forEach((box, index) => {
+            box.addEventListener('click', event => {
+                if (event.shiftKey && lastIndex >= 0) {
+                    const [start, end] = index < lastIndex ? [index, lastIndex] : [lastIndex, index];
+                    for (let i = start; i <= end; i++) {
+                        boxes[i].checked = box.checked;
+                    }
+                }
+                lastIndex = index;
+                updateCount();
+            });
+        });
+        formEl.querySelector('.bulk-select-all').addEventListener('click', () => {
+            boxes.forEach(box => box.checked = true);
+            updateCount();
+        });
+        formEl.querySelector('.bulk-select-none').addEventListener('click', () => {
+            boxes.forEach(box => box.checked = false);
+            updateCount();
+        });
+        updateCount();
+    }
+
     document.addEventListener('DOMContentLoaded', function () {
         const jumpEl = document.querySelector('a#jump-to-content-link');
         jumpEl.addEventListener('click', handleJump);
@@ -542,6 +658,8 @@
 
         setupCellNavBtnTrackPointer();
 
+        setupBulkSelect();
+
         autoJump();
         setupAutoJumpChangeListener();
 
@@ -549,5 +667,7 @@
         setupAutoPlayChangeListener();
 
         setupAsyncLocalRating();
+
+        setupLiveUpdates();
     });
 })();